@@ -0,0 +1,112 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import "strings"
+
+// A command of the CLI, as listed in the usage and the shell completions.
+type command struct {
+	name    string
+	summary string
+	// Takes the instance name as its first argument, instead of
+	// -instancename.
+	instance bool
+}
+
+// The commands, in the order of the usage line.
+var commands = []command{
+	{"start", "Create the instance if needed and open the tunnel to docker", true},
+	{"config", "Set, get or list the per-user flag defaults", false},
+	{"adopt", "Take over an instance created outside docker-cloud", true},
+	{"stop", "Delete the instance", true},
+	{"suspend", "Power the instance off, keeping its disk", true},
+	{"resume", "Power a suspended instance on and open the tunnel", true},
+	{"tunnel", "Open and supervise the tunnel to a running instance", true},
+	{"restart", "Reset the instance and wait for docker", true},
+	{"recover", "Start again in the zone where the root disk survived", true},
+	{"console-url", "Print the Cloud Console URL of the serial console", true},
+	{"check-egress", "Print the internet egress of the instance", true},
+	{"prune", "Remove the unused docker resources", true},
+	{"get-service-account", "Print the service account of the instance", true},
+	{"grant-gcs-access", "Grant or revoke a role on a GCS bucket to the instance", true},
+	{"status", "Print the state of the instance, the tunnel and docker", true},
+	{"inspect", "Print the full description of the instance as JSON", true},
+	{"provision", "Run the startup script again on the instance", true},
+	{"upgrade", "Install another docker version on the instance", true},
+	{"ip", "Print the public IP of the instance", true},
+	{"env", "Print the commands pointing a shell to the tunnel", true},
+	{"ports", "List the forwarded ports and the ports of the containers", true},
+	{"events", "Stream the docker events or the cloud operations", true},
+	{"image", "List or remove the images on the instance", false},
+	{"exec", "Run the local docker CLI, or a command in a container", false},
+	{"cp", "Copy files between the local machine and the instance", false},
+	{"ssh", "Open a shell or run a command on the instance", false},
+	{"logs", "Print the docker daemon log", true},
+	{"top", "List the processes of a container", false},
+	{"diff", "List the filesystem changes of a container", false},
+	{"create-health-check", "Create a TCP health check", false},
+	{"delete-health-check", "Delete a health check", false},
+	{"list-health-checks", "List the health checks", false},
+	{"commit", "Save a running container as an image", true},
+	{"enable-serial-console", "Enable interactive access to the serial console", true},
+	{"disable-serial-console", "Disable interactive access to the serial console", true},
+	{"save-image", "Save an image to GCS", true},
+	{"load-image", "Load an image from GCS", true},
+	{"copy-between-instances", "Copy files between two instances", false},
+	{"set-cpu-platform", "Set the minimum CPU platform of the instance", false},
+	{"resize", "Change the machine type of the instance", false},
+	{"snapshot", "Snapshot the root disk", true},
+	{"stats", "Print the resource usage of the instance and the containers", true},
+	{"clone", "Create a new instance from a snapshot of the root disk", true},
+	{"system-df", "Print the docker disk usage", true},
+	{"gc", "Delete the leftover disks, snapshots and saved instances", false},
+	{"list", "List the instances", false},
+	{"list-by-suffix", "List the instances with a suffix", false},
+	{"doctor", "Check the setup and tell how to fix it", false},
+	{"version", "Print the versions of docker-cloud and docker", false},
+	{"completion", "Print the bash, zsh or fish completion script", false},
+}
+
+// Tell whether the named command takes the instance name as its first
+// argument.
+func takesInstance(name string) bool {
+	for _, c := range commands {
+		if c.name == name {
+			return c.instance
+		}
+	}
+	return false
+}
+
+// Return the names of the commands taking the instance name as their first
+// argument.
+func instanceCommands() []string {
+	names := []string{}
+	for _, c := range commands {
+		if c.instance {
+			names = append(names, c.name)
+		}
+	}
+	return names
+}
+
+// Return the usage line listing the commands.
+func usageLine() string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return "usage: docker-cloud [flags] " + strings.Join(names, "|") + " [instance]"
+}
@@ -0,0 +1,162 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// Run completion bash|zsh|fish, or completion instances, listing the known
+// instance names for the scripts.
+func completionCommand(w io.Writer, flags *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: docker-cloud completion bash|zsh|fish")
+	}
+	switch args[0] {
+	case "bash":
+		bashCompletion(w, flags)
+	case "zsh":
+		zshCompletion(w, flags)
+	case "fish":
+		fishCompletion(w, flags)
+	case "instances":
+		for _, name := range knownInstances() {
+			fmt.Fprintln(w, name)
+		}
+	default:
+		return fmt.Errorf("unsupported shell %q, want bash, zsh or fish", args[0])
+	}
+	return nil
+}
+
+// Return the names of the instances with a directory in machinesDir.
+func knownInstances() []string {
+	entries, _ := os.ReadDir(machinesDir)
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A global flag, as completed by the scripts.
+type completionFlag struct {
+	name  string
+	usage string
+	// Takes no value, such as -json.
+	boolean bool
+}
+
+func completionFlags(flags *flag.FlagSet) []completionFlag {
+	result := []completionFlag{}
+	flags.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		result = append(result, completionFlag{f.Name, f.Usage, ok && b.IsBoolFlag()})
+	})
+	return result
+}
+
+func bashCompletion(w io.Writer, flags *flag.FlagSet) {
+	names := []string{}
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	flagNames := []string{}
+	for _, f := range completionFlags(flags) {
+		flagNames = append(flagNames, "-"+f.name)
+	}
+	fmt.Fprintf(w, `_docker_cloud() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	case "$prev" in
+	-instancename|%s)
+		COMPREPLY=($(compgen -W "$(docker-cloud completion instances 2>/dev/null)" -- "$cur"))
+		return;;
+	-provider)
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return;;
+	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+	fi
+}
+complete -F _docker_cloud docker-cloud
+`, strings.Join(instanceCommands(), "|"), strings.Join(dockercloud.Providers(), " "), strings.Join(flagNames, " "), strings.Join(names, " "))
+}
+
+// Escape the description of a zsh _arguments or _describe spec.
+func zshEscape(s string) string {
+	return strings.NewReplacer("'", `'\''`, ":", `\:`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+func zshCompletion(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "#compdef docker-cloud\n\n_docker_cloud() {\n\tlocal -a commands\n\tcommands=(")
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", c.name, zshEscape(c.summary))
+	}
+	fmt.Fprintln(w, "\t)\n\t_arguments -C \\")
+	for _, f := range completionFlags(flags) {
+		spec := fmt.Sprintf("-%s[%s]", f.name, zshEscape(f.usage))
+		switch {
+		case f.name == "instancename":
+			spec += ":instance:($(docker-cloud completion instances 2>/dev/null))"
+		case f.name == "provider":
+			spec += fmt.Sprintf(":provider:(%s)", strings.Join(dockercloud.Providers(), " "))
+		case !f.boolean:
+			spec += ":value:"
+		}
+		fmt.Fprintf(w, "\t\t'%s' \\\n", spec)
+	}
+	fmt.Fprintln(w, "\t\t'1:command:->command' \\\n\t\t'*::arg:->args'\n\tcase $state in\n\tcommand)\n\t\t_describe command commands\n\t\t;;\n\targs)")
+	// The instance name follows its commands.
+	fmt.Fprintf(w, "\t\tcase $words[1] in\n\t\t%s)\n\t\t\t(( CURRENT == 2 )) && _values instance $(docker-cloud completion instances 2>/dev/null)\n\t\t\t;;\n\t\tesac\n", strings.Join(instanceCommands(), "|"))
+	fmt.Fprintln(w, "\t\t;;\n\tesac\n}\n\n_docker_cloud \"$@\"")
+}
+
+// Quote a fish argument.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func fishCompletion(w io.Writer, flags *flag.FlagSet) {
+	fmt.Fprintln(w, "complete -c docker-cloud -f")
+	for _, c := range commands {
+		fmt.Fprintf(w, "complete -c docker-cloud -n __fish_use_subcommand -a %s -d %s\n", c.name, fishQuote(c.summary))
+	}
+	fmt.Fprintf(w, "complete -c docker-cloud -n '__fish_seen_subcommand_from %s' -a '(docker-cloud completion instances 2>/dev/null)'\n", strings.Join(instanceCommands(), " "))
+	for _, f := range completionFlags(flags) {
+		line := fmt.Sprintf("complete -c docker-cloud -o %s -d %s", f.name, fishQuote(f.usage))
+		switch {
+		case f.name == "instancename":
+			line += " -x -a '(docker-cloud completion instances 2>/dev/null)'"
+		case f.name == "provider":
+			line += " -x -a " + fishQuote(strings.Join(dockercloud.Providers(), " "))
+		case !f.boolean:
+			line += " -r"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
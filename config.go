@@ -0,0 +1,411 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The per-user settings, saved by the config command. Each one is the
+// default of the global flag of the same name, which the command line still
+// overrides.
+var configPath = path.Join(os.Getenv("HOME"), ".docker-cloud/config.yaml")
+
+// Where the config command saved the settings before they moved to YAML.
+var legacyConfigPath = path.Join(os.Getenv("HOME"), ".docker-cloud/config.json")
+
+// The settings shared by a team, checked into their repository. The closest
+// one from the working directory up overrides the per-user settings.
+const projectConfigName = ".docker-cloud.yaml"
+
+// Returned by applyConfig when no config file has the -profile.
+var errUnknownProfile = errors.New("unknown profile")
+
+var profile = flag.String("profile", "", "The profile of the config files to use on top of their settings")
+
+// The settings of a config file.
+type configFile struct {
+	Settings map[string]string
+	// The settings of each named profile, applied over Settings when
+	// selected with -profile.
+	Profiles map[string]map[string]string
+}
+
+// Return the settings of the profile, the top-level ones when empty.
+func (c *configFile) section(name string) map[string]string {
+	if name == "" {
+		return c.Settings
+	}
+	if c.Profiles[name] == nil {
+		c.Profiles[name] = map[string]string{}
+	}
+	return c.Profiles[name]
+}
+
+// Read a YAML config file, nil when it doesn't exist. The settings of a
+// section are prefixed with its name, so that
+//
+//	aws:
+//	  region: eu-west-1
+//
+// sets -aws-region, except for the profiles section holding a section of
+// settings per profile.
+func readConfigFile(file string) (*configFile, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %v", file, err)
+	}
+	c := &configFile{Settings: map[string]string{}, Profiles: map[string]map[string]string{}}
+	if profiles, ok := doc["profiles"]; ok {
+		sections, ok := profiles.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid config %q: profiles: want a section per profile", file)
+		}
+		for name, section := range sections {
+			settings, ok := section.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("invalid config %q: profiles-%s: want a section", file, name)
+			}
+			c.Profiles[name] = map[string]string{}
+			if err := flattenConfig("", settings, c.Profiles[name]); err != nil {
+				return nil, fmt.Errorf("invalid config %q: profile %s: %v", file, name, err)
+			}
+		}
+		delete(doc, "profiles")
+	}
+	if err := flattenConfig("", doc, c.Settings); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %v", file, err)
+	}
+	return c, nil
+}
+
+func flattenConfig(prefix string, doc map[string]interface{}, settings map[string]string) error {
+	for key, value := range doc {
+		name := prefix + key
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if err := flattenConfig(name+"-", value, settings); err != nil {
+				return err
+			}
+		case []interface{}, nil:
+			return fmt.Errorf("%s: want a single value", name)
+		default:
+			settings[name] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
+
+// Return the project config from the working directory up, empty when
+// there is none.
+func findProjectConfig() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		file := filepath.Join(dir, projectConfigName)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Read the per-user settings, none when the file doesn't exist. The JSON
+// settings of older versions are moved to the YAML file on the way.
+func loadConfig() (*configFile, error) {
+	c, err := readConfigFile(configPath)
+	if c != nil || err != nil {
+		return c, err
+	}
+	c = &configFile{Settings: map[string]string{}, Profiles: map[string]map[string]string{}}
+	data, err := os.ReadFile(legacyConfigPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.Settings); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %v", legacyConfigPath, err)
+	}
+	if err := saveConfig(c); err != nil {
+		return nil, err
+	}
+	log.Printf("moved the settings of %q to %q", legacyConfigPath, configPath)
+	return c, os.Remove(legacyConfigPath)
+}
+
+// Write the settings, only readable by the user as they may point to
+// credentials.
+func saveConfig(c *configFile) error {
+	doc := map[string]interface{}{}
+	for name, value := range c.Settings {
+		doc[name] = value
+	}
+	if len(c.Profiles) > 0 {
+		doc["profiles"] = c.Profiles
+	}
+	var data bytes.Buffer
+	enc := yaml.NewEncoder(&data)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(configPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(configPath, data.Bytes(), 0600)
+}
+
+// Make the per-user then the project settings the defaults of the flags,
+// followed by the settings of the profile, picked with -profile in args,
+// DOCKER_CLOUD_PROFILE or a profile setting, and last the DOCKER_CLOUD_
+// environment variables. They don't count as set on the command line, so
+// settings of another provider than -provider are ignored rather than
+// rejected.
+func applyConfig(flags *flag.FlagSet, args []string) error {
+	user, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	files := []string{configPath}
+	configs := []*configFile{user}
+	if file := findProjectConfig(); file != "" {
+		project, err := readConfigFile(file)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+		configs = append(configs, project)
+	}
+	for i, c := range configs {
+		if err := applySettings(flags, strconv.Quote(files[i]), c.Settings); err != nil {
+			return err
+		}
+	}
+	env, err := envSettings(flags)
+	if err != nil {
+		return err
+	}
+	if name, ok := env["profile"]; ok {
+		*profile = name
+	}
+	// flags isn't parsed yet.
+	if name, ok := commandLineValue(flags, args, "profile"); ok {
+		*profile = name
+	}
+	var profileErr error
+	if *profile != "" {
+		found := false
+		for i, c := range configs {
+			if settings, ok := c.Profiles[*profile]; ok {
+				found = true
+				if err := applySettings(flags, strconv.Quote(files[i]), settings); err != nil {
+					return err
+				}
+			}
+		}
+		if !found {
+			profileErr = fmt.Errorf("%w %q, not in %s", errUnknownProfile, *profile, strings.Join(files, " nor "))
+		}
+	}
+	if err := applySettings(flags, "the environment", env); err != nil {
+		return err
+	}
+	return profileErr
+}
+
+// The prefix of the environment variables setting the flags.
+const envPrefix = "DOCKER_CLOUD_"
+
+// Environment variables named otherwise than their flag.
+var envAliases = map[string]string{
+	"MACHINE_TYPE": "instancetype",
+}
+
+// Return the settings of the DOCKER_CLOUD_ environment variables. Each one
+// sets the flag of the same name, ignoring case, dashes and underscores, so
+// that DOCKER_CLOUD_DISK_SIZE sets -disksize and DOCKER_CLOUD_AWS_REGION
+// -aws-region.
+func envSettings(flags *flag.FlagSet) (map[string]string, error) {
+	names := map[string]string{}
+	flags.VisitAll(func(f *flag.Flag) {
+		names[strings.ReplaceAll(f.Name, "-", "")] = f.Name
+	})
+	settings := map[string]string{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(key, envPrefix) {
+			continue
+		}
+		key = strings.TrimPrefix(key, envPrefix)
+		name, ok := envAliases[key]
+		if !ok {
+			name, ok = names[strings.ToLower(strings.ReplaceAll(key, "_", ""))]
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s%s doesn't match any flag", envPrefix, key)
+		}
+		settings[name] = value
+	}
+	return settings, nil
+}
+
+// Return the value of a flag in the command line args, before they are
+// parsed. Stops at the command.
+func commandLineValue(flags *flag.FlagSet, args []string, name string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" || !strings.HasPrefix(args[i], "-") {
+			break
+		}
+		key, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if key == name {
+			if hasValue {
+				return value, true
+			}
+			if i+1 < len(args) {
+				return args[i+1], true
+			}
+			return "", false
+		}
+		// Skip the value of the other flags, the booleans have none.
+		if f := flags.Lookup(key); f != nil && !hasValue {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+			}
+		}
+	}
+	return "", false
+}
+
+// Apply the settings read from source, a quoted file name or the
+// environment.
+func applySettings(flags *flag.FlagSet, source string, settings map[string]string) error {
+	for name, value := range settings {
+		f := flags.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown setting %q in %s", name, source)
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid setting %s=%q in %s: %v", name, value, source, err)
+		}
+		f.DefValue = value
+	}
+	return nil
+}
+
+// Run config set|get|unset|list|profiles, on the settings of the -profile
+// when set.
+func configCommand(w io.Writer, flags *flag.FlagSet, args []string) error {
+	usage := errors.New("usage: docker-cloud [-profile <name>] config set <flag> <value> | get <flag> | unset <flag> | list | profiles")
+	if len(args) == 0 {
+		return usage
+	}
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	// The settings of the -profile, created by set.
+	settings := c.section(*profile)
+	lookup := func(name string) (*flag.Flag, error) {
+		f := flags.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown flag -%s", name)
+		}
+		return f, nil
+	}
+	switch {
+	case args[0] == "set" && len(args) == 3:
+		f, err := lookup(args[1])
+		if err != nil {
+			return err
+		}
+		if err := f.Value.Set(args[2]); err != nil {
+			return fmt.Errorf("invalid value %q for -%s: %v", args[2], f.Name, err)
+		}
+		settings[f.Name] = args[2]
+		return saveConfig(c)
+	case args[0] == "get" && len(args) == 2:
+		// The setting, or the flag default when it isn't set.
+		f, err := lookup(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, f.DefValue)
+	case args[0] == "unset" && len(args) == 2:
+		if _, err := lookup(args[1]); err != nil {
+			return err
+		}
+		delete(settings, args[1])
+		return saveConfig(c)
+	case args[0] == "list" && len(args) == 1:
+		names := []string{}
+		for name := range settings {
+			names = append(names, name)
+		}
+		if *jsonOutput {
+			printJSON(settings)
+			break
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s=%s\n", name, settings[name])
+		}
+	case args[0] == "profiles" && len(args) == 1:
+		names := []string{}
+		for name := range c.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if *jsonOutput {
+			printJSON(names)
+			break
+		}
+		for _, name := range names {
+			fmt.Fprintln(w, name)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
@@ -15,62 +15,1586 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/proppy/docker-cloud/dockercloud"
+	"golang.org/x/term"
 )
 
 var (
-	dockerPort   = flag.Int("dockerport", 8000, "The remote port to run docker on")
-	tunnelPort   = flag.Int("tunnelport", 8001, "The local port open the tunnel to docker")
-	instanceName = flag.String("instancename", "docker-instance", "The name of the instance")
-	zone         = flag.String("zone", "us-central1-a", "The zone to run in")
+	provider       = flag.String("provider", "gce", "The cloud provider to run on")
+	dockerPort     = flag.Int("dockerport", 8000, "The remote port to run docker on")
+	tunnelPort     = flag.Int("tunnelport", 8001, "The local port open the tunnel to docker")
+	dockerSocket   = flag.String("local-docker-socket", "", "Forward the docker socket of the instance to this local unix socket instead of -tunnelport")
+	instanceName   = flag.String("instancename", "docker-instance", "The name of the instance")
+	instanceSuffix = flag.String("instance-suffix", "", "Appended to -instancename to namespace instances, e.g. per branch")
+	suffixFromEnv  = flag.String("instance-suffix-from-env", "", "Read -instance-suffix from this environment variable, e.g. GITHUB_REF_NAME")
+	zone           = flag.String("zone", "", "The zone to run in (default the project default zone on GCE, else the provider default)")
+	cloudNatIP     = flag.String("cloud-nat-ip", "", "Comma-separated reserved external IPs to pin on the Cloud NAT gateway")
+	cloudNatRouter = flag.String("cloud-nat-router", "docker-cloud-router", "The Cloud Router hosting the Cloud NAT gateway")
+	cloudNatName   = flag.String("cloud-nat-name", "", "The Cloud NAT gateway of -cloud-nat-router to pin -cloud-nat-ip on (default the first one)")
+	egressAlertGb  = flag.Float64("egress-alert-gb", 10, "Warn when the instance has sent more than this many GB while the tunnel is up (0 to disable)")
+	forwardedPorts = flag.String("forwarded-ports", "", "Extra localPort:remotePort pairs to forward through the tunnel, comma separated")
+	buildTrigger   = flag.String("cloud-build-trigger", "", "A Cloud Build trigger to run against the instance once it is started")
+	buildTimeout   = flag.Duration("cloud-build-timeout", 30*time.Minute, "The maximum duration of the Cloud Build")
+	buildSubs      = map[string]string{}
+	restartDocker  = flag.Bool("tunnel-restart-docker-on-failure", false, "Restart the remote Docker daemon when it stops answering through the tunnel")
+	restartTimeout = flag.Duration("docker-restart-timeout", 2*time.Minute, "How long to wait for Docker to come back after a restart")
+	jsonOutput     = flag.Bool("json", false, "Print the results of the commands as JSON on stdout, the logs stay on stderr")
+	zoneFallback   = flag.Bool("zone-fallback", false, "On quota or capacity errors, create the instance in the other zones of the region instead (GCE only)")
+	osName         = flag.String("os", "", "The OS to boot, such as debian-12 or ubuntu-22.04, resolved to the current image of the provider instead of its image flag")
+	dryRun         = flag.Bool("dry-run", false, "Print the resources start and stop would create or delete, with the startup script, without changing them (GCE only)")
 )
 
+// The GCE and instance flags, turned into the dockercloud configuration.
+var (
+	projectId             = flag.String("project", "", "Google Cloud Project Name")
+	gcloudCredentialsPath = flag.String("gcloudcredentials", path.Join(os.Getenv("HOME"), ".config/gcloud/credentials"), "gcloud SDK credentials path")
+	instanceType          = flag.String("instancetype", "n1-standard-1",
+		"The machine type to create, such as n1-standard-2, in -zone")
+	image = flag.String("image",
+		"https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/backports-debian-7-wheezy-v20131127",
+		"The GCE image to boot from.")
+	diskName            = flag.String("diskname", "docker-root", "Name of the instance root disk")
+	fromSnapshot        = flag.String("from-snapshot", "", "Create the root disk from this GCE snapshot instead of -image, the disk must not exist")
+	diskSizeGb          = flag.Int64("disksize", 100, "Size of the root disk in GB")
+	dockerVersion       = flag.String("docker-version", "", "The Docker version to install (default latest)")
+	startupScriptBase64 = flag.Bool("startup-script-base64", false,
+		"Pass the startup script base64 encoded across several metadata values to bypass the metadata value size limit")
+	snapshotter = flag.String("docker-containerd-snapshotter", "",
+		"Use the containerd image store with the given snapshotter (overlayfs|native|zfs), requires Docker >= 24.0")
+)
+
+// Return the spec of the instance to create from the flags.
+func instanceSpec() dockercloud.InstanceSpec {
+	return dockercloud.InstanceSpec{
+		MachineType:         *instanceType,
+		Image:               *image,
+		Snapshot:            *fromSnapshot,
+		DiskName:            *diskName,
+		DiskSizeGb:          *diskSizeGb,
+		DockerVersion:       *dockerVersion,
+		Snapshotter:         *snapshotter,
+		StartupScriptBase64: *startupScriptBase64,
+	}
+}
+
 type DockerCloud struct {
 	dockercloud.Cloud
 }
 
-func (cloud *DockerCloud) GetOrCreateInstance() (string, error) {
-	ip, err := cloud.GetPublicIPAddress(*instanceName, *zone)
-	instanceRunning := len(ip) > 0
-	if instanceRunning {
+func (cloud *DockerCloud) GetOrCreateInstance(ctx context.Context) (string, error) {
+	ip, err := cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+	if err == nil && ip == "" && cloud.Capabilities().ListInstances && cloud.Capabilities().StopStart {
+		// A suspended instance is still there, without an address.
+		instance, err := cloud.DescribeInstance(ctx, *instanceName, *zone)
+		if err != nil {
+			return "", err
+		}
+		if instance.Status == dockercloud.StatusStopped {
+			if *dryRun {
+				fmt.Printf("would resume instance %q\n", *instanceName)
+				return "", nil
+			}
+			log.Printf("instance %q is suspended, resuming it", *instanceName)
+			return cloud.StartInstance(ctx, *instanceName, *zone)
+		}
+	}
+	if !errors.Is(err, dockercloud.ErrInstanceNotFound) {
 		return ip, err
 	}
 
 	// Otherwise create a new VM.
-	return cloud.CreateInstance(*instanceName, *zone)
+	if *zoneFallback {
+		return cloud.createInRegion(ctx)
+	}
+	return cloud.CreateInstance(ctx, *instanceName, *zone, instanceSpec())
+}
+
+// Create the instance in -zone, or on quota and capacity errors in the
+// other zones of its region, updating -zone to where it landed. An existing
+// root disk pins the instance to its zone.
+func (cloud *DockerCloud) createInRegion(ctx context.Context) (string, error) {
+	gce := cloud.gce()
+	if diskZone, err := gce.LookupZoneForDisk(ctx, *diskName); err == nil {
+		if diskZone != *zone {
+			log.Printf("root disk %q is in zone %q, creating the instance there", *diskName, diskZone)
+			*zone = diskZone
+		}
+		return cloud.CreateInstance(ctx, *instanceName, *zone, instanceSpec())
+	}
+	region := dockercloud.RegionForZone(*zone)
+	zones, err := gce.ZonesInRegion(ctx, region)
+	if err != nil {
+		return "", err
+	}
+	// The preferred zone first.
+	candidates := []string{*zone}
+	for _, z := range zones {
+		if z != *zone {
+			candidates = append(candidates, z)
+		}
+	}
+	for _, z := range candidates {
+		*zone = z
+		var ip string
+		ip, err = cloud.CreateInstance(ctx, *instanceName, z, instanceSpec())
+		if !errors.Is(err, dockercloud.ErrQuotaExceeded) && !errors.Is(err, dockercloud.ErrZoneExhausted) {
+			return ip, err
+		}
+		log.Printf("no room for the instance in zone %q: %v", z, err)
+		// The root disk was created before the instance failed.
+		if err := gce.DeleteDisk(ctx, *diskName, z); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no zone of %s could take the instance: %w", region, err)
+}
+
+// Return the GCE implementation backing this cloud, for commands that only
+// make sense on Google Compute Engine.
+func (cloud *DockerCloud) gce() *dockercloud.GCECloud {
+	gce, ok := cloud.Cloud.(*dockercloud.GCECloud)
+	if !ok {
+		log.Fatalf("command not supported by %T", cloud.Cloud)
+	}
+	return gce
+}
+
+// Exit when the provider lacks the capability a command needs, before
+// doing anything.
+func (cloud *DockerCloud) require(command string, capable bool) {
+	if !capable {
+		log.Fatalf("%s is not supported by the %s provider", command, *provider)
+	}
+}
+
+func init() {
+	registerProviders()
+	// The providers are only all registered by now.
+	flag.Lookup("provider").Usage = "The cloud provider to run on (" + strings.Join(dockercloud.Providers(), "|") + "), or the name of a provider plugin"
+	flag.Func("cloud-build-sub", "A key=value substitution for the Cloud Build trigger (repeatable)", func(sub string) error {
+		kv := strings.SplitN(sub, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid substitution %q, want key=value", sub)
+		}
+		buildSubs[kv[0]] = kv[1]
+		return nil
+	})
+}
+
+// The docker socket on the instance, forwarded by -local-docker-socket. The
+// ssh user is added to the docker group by openTunnel to connect to it.
+const remoteDockerSocket = "/var/run/docker.sock"
+
+// Add the ssh user to the docker group, unless root or already in it. The
+// instances only know the user once logged in, so it can't be done by the
+// startup script.
+const joinDockerGroup = `test "$(id -u)" = 0 || id -nG | grep -qw docker || sudo usermod -aG docker "$(id -un)"`
+
+// Return all the ports forwarded through the tunnel, the Docker port first.
+func portMappings() ([]dockercloud.PortMapping, error) {
+	extra, err := dockercloud.ParsePortMappings(*forwardedPorts)
+	if err != nil {
+		return nil, err
+	}
+	docker := dockercloud.PortMapping{LocalPort: *tunnelPort, RemotePort: *dockerPort}
+	if *dockerSocket != "" {
+		docker = dockercloud.PortMapping{LocalSocket: *dockerSocket, RemoteSocket: remoteDockerSocket}
+	}
+	mappings := append([]dockercloud.PortMapping{docker}, extra...)
+	return mappings, dockercloud.ValidatePortMappings(mappings)
+}
+
+// Open the tunnel to the instance, forwarding the Docker port and any
+// -forwarded-ports.
+func (cloud *DockerCloud) openTunnel(ctx context.Context) (*os.Process, error) {
+	mappings, err := portMappings()
+	if err != nil {
+		return nil, err
+	}
+	if len(mappings) == 1 && *dockerSocket == "" {
+		return cloud.OpenSecureTunnel(ctx, *instanceName, *zone, *tunnelPort, *dockerPort)
+	}
+	multi, ok := cloud.Cloud.(multiTunnelCloud)
+	if !ok {
+		return nil, fmt.Errorf("%T can't forward -forwarded-ports or -local-docker-socket", cloud.Cloud)
+	}
+	if *dockerSocket != "" {
+		// The group applies to the next sessions, such as the tunnel.
+		if _, err := cloud.RunCommand(ctx, *instanceName, *zone, joinDockerGroup); err != nil {
+			return nil, fmt.Errorf("failed to add the ssh user to the docker group: %v", err)
+		}
+	}
+	return multi.OpenMultiTunnel(ctx, *instanceName, *zone, mappings)
+}
+
+// Return the instances created by docker-cloud in all the zones with the
+// given labels.
+func (cloud *DockerCloud) managedInstances(ctx context.Context, labels map[string]string) ([]dockercloud.Instance, error) {
+	instances, err := cloud.ListInstances(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	matching := []dockercloud.Instance{}
+	for _, instance := range instances {
+		if hasLabels(instance, labels) {
+			matching = append(matching, instance)
+		}
+	}
+	return matching, nil
+}
+
+// Delete instances concurrently. Returns an error when any deletion failed.
+func (cloud *DockerCloud) DeleteInstances(ctx context.Context, instances []dockercloud.Instance) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance dockercloud.Instance) {
+			defer wg.Done()
+			// GCE keeps the disks, saved so that gc doesn't collect them.
+			gce, keep := cloud.Cloud.(*dockercloud.GCECloud)
+			rootDisk, disks := "", []string{}
+			if keep {
+				if details, err := gce.DescribeInstanceDetails(ctx, instance.Name, instance.Zone); err == nil {
+					for _, disk := range details.Disks {
+						if disk.Boot {
+							rootDisk = disk.Name
+						}
+						disks = append(disks, disk.Name)
+					}
+				}
+			}
+			log.Printf("deleting %q in %q", instance.Name, instance.Zone)
+			if err := cloud.DeleteInstance(ctx, instance.Name, instance.Zone); err != nil {
+				log.Printf("failed to delete %q: %v", instance.Name, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			if keep {
+				// Saving a new instance takes a tunnel port.
+				mu.Lock()
+				keepDisks(instance.Name, instance.Zone, rootDisk, disks)
+				mu.Unlock()
+				return
+			}
+			forgetInstance(instance.Name)
+		}(instance)
+	}
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d instances", failed)
+	}
+	return nil
+}
+
+// Tell whether an instance has all the labels.
+func hasLabels(instance dockercloud.Instance, labels map[string]string) bool {
+	for key, value := range labels {
+		if instance.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// List what a command is about to delete and ask the user to confirm,
+// unless force or -dry-run. Exits when the user doesn't confirm or can't be
+// asked.
+func confirmDeletion(force bool, doomed []string) {
+	if force || *dryRun {
+		return
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		log.Fatalf("not deleting without -force, stdin is not a terminal")
+	}
+	fmt.Fprintln(os.Stderr, "This will delete:")
+	for _, d := range doomed {
+		fmt.Fprintf(os.Stderr, "  %s\n", d)
+	}
+	fmt.Fprint(os.Stderr, "Continue? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer := strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		log.Fatal("aborted")
+	}
+}
+
+// Open the tunnel unless one already listens, such as the one of a running
+// start. Returns the process of the new tunnel, nil when there was one.
+func (cloud *DockerCloud) ensureTunnel(ctx context.Context) (*os.Process, error) {
+	network, addr := dockerAddr()
+	if conn, err := net.Dial(network, addr); err == nil {
+		conn.Close()
+		return nil, nil
+	}
+	return cloud.openTunnel(ctx)
+}
+
+// A cloud able to run commands attached to the local terminal.
+type interactiveCloud interface {
+	RunInteractiveCommand(ctx context.Context, name, zone, command string, tty bool) error
+}
+
+// Return the cloud as an interactiveCloud, exiting when it is not one.
+func (cloud *DockerCloud) interactive() interactiveCloud {
+	interactive, ok := cloud.Cloud.(interactiveCloud)
+	if !ok {
+		log.Fatalf("%T can't run interactive commands", cloud.Cloud)
+	}
+	return interactive
+}
+
+// A cloud able to copy files to and from the instances.
+type copyCloud interface {
+	CopyToInstance(ctx context.Context, name, zone, localPath, remotePath string) error
+	CopyFromInstance(ctx context.Context, name, zone, remotePath, localPath string) error
+}
+
+// Return the cloud as a copyCloud, exiting when it is not one.
+func (cloud *DockerCloud) copier() copyCloud {
+	copier, ok := cloud.Cloud.(copyCloud)
+	if !ok {
+		log.Fatalf("%T can't copy files", cloud.Cloud)
+	}
+	return copier
+}
+
+// Split a cp argument such as ":/tmp/ctx" or "builder-1:/tmp/ctx" into the
+// instance name, empty for the current one, and the path on the instance.
+// remote is false for the local paths, such as "./a:b".
+func splitRemotePath(arg string) (name, remotePath string, remote bool) {
+	i := strings.Index(arg, ":")
+	if i < 0 || strings.Contains(arg[:i], "/") {
+		return "", arg, false
+	}
+	return arg[:i], arg[i+1:], true
+}
+
+// A cloud able to forward several ports through a single tunnel.
+type multiTunnelCloud interface {
+	OpenMultiTunnel(ctx context.Context, name, zone string, mappings []dockercloud.PortMapping) (*os.Process, error)
+}
+
+// Create the GCE cloud from the flags, in the project default zone when zone
+// is empty.
+func newGCECloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	resolveProject()
+	if *projectId == "" {
+		return nil, "", errors.New("no GCE project, pass -project or run gcloud config set project <id>")
+	}
+	cloud, err := dockercloud.NewGCECloud(dockercloud.GCEConfig{
+		Options:         providerOptions(),
+		ProjectId:       *projectId,
+		CredentialsPath: *gcloudCredentialsPath,
+		DryRun:          *dryRun,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	projectZone := ""
+	if zone == "" {
+		projectZone, err = cloud.(*dockercloud.GCECloud).GetProjectDefaultZone(ctx)
+		if err != nil {
+			log.Printf("failed to get project default zone: %v", err)
+		}
+	}
+	return cloud, dockercloud.ResolveZone(zone, projectZone, dockercloud.DefaultGCEZone), nil
+}
+
+// Take -project from the gcloud SDK configuration when it is not set.
+func resolveProject() {
+	if *projectId != "" {
+		return
+	}
+	if project := dockercloud.GcloudProject(); project != "" {
+		log.Printf("using the gcloud project %q", project)
+		*projectId = project
+	}
+}
+
+// Create the -provider cloud and resolve -zone for it.
+func newCloud(ctx context.Context) DockerCloud {
+	if *osName != "" {
+		if err := applyOS(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := dockercloud.CheckProviderFlags(*provider, flag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+	if *dryRun && *provider != "gce" {
+		log.Fatalf("-dry-run is only supported on GCE")
+	}
+	cloud, resolved, err := dockercloud.NewCloud(ctx, *provider, *zone, pluginConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+	*zone = resolved
+	return DockerCloud{cloud}
+}
+
+// Set the image flag of the provider to the image of -os, unless the image
+// is also set on the command line.
+func applyOS() error {
+	flagName, image, err := dockercloud.ResolveOS(*provider, *osName)
+	if err != nil {
+		return err
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) { set = set || f.Name == flagName })
+	if set {
+		return fmt.Errorf("-os and -%s both pick the image, only set one", flagName)
+	}
+	return flag.Set(flagName, image)
+}
+
+// Print v as indented JSON on stdout, for -json.
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatalf("failed to encode JSON: %v", err)
+	}
+}
+
+// Parse the -since of events, a timestamp or a duration back from now. Empty
+// is now.
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Now(), nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -since %q, want a duration or an RFC 3339 timestamp", since)
+	}
+	return t, nil
+}
+
+// Return the network and address of the local end of the docker tunnel.
+func dockerAddr() (string, string) {
+	if *dockerSocket != "" {
+		return "unix", *dockerSocket
+	}
+	return "tcp", fmt.Sprintf("localhost:%d", *tunnelPort)
+}
+
+// Return the DOCKER_HOST to reach docker through the tunnel.
+func dockerHost() string {
+	network, addr := dockerAddr()
+	return network + "://" + addr
+}
+
+// Print the commands pointing the docker client of a shell (bash, fish or
+// powershell) to the tunnel, or undoing it. The TLS variables are unset, as
+// docker is reached in the clear through the tunnel.
+func printEnv(w io.Writer, shell string, unset bool) error {
+	vars := [][2]string{{"DOCKER_HOST", dockerHost()}, {"DOCKER_TLS_VERIFY", ""}, {"DOCKER_CERT_PATH", ""}}
+	if unset {
+		vars[0][1] = ""
+	}
+	for _, v := range vars {
+		name, value := v[0], v[1]
+		var line string
+		switch shell {
+		case "bash", "sh", "zsh":
+			line = fmt.Sprintf("export %s=%q", name, value)
+			if value == "" {
+				line = "unset " + name
+			}
+		case "fish":
+			line = fmt.Sprintf("set -gx %s %q;", name, value)
+			if value == "" {
+				line = fmt.Sprintf("set -e %s;", name)
+			}
+		case "powershell":
+			line = fmt.Sprintf("$Env:%s = %q", name, value)
+			if value == "" {
+				line = fmt.Sprintf(`Remove-Item Env:\%s -ErrorAction SilentlyContinue`, name)
+			}
+		default:
+			return fmt.Errorf("unsupported shell %q, want bash, fish or powershell", shell)
+		}
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// Open a URL in the default browser.
+func openBrowser(url string) error {
+	opener := "xdg-open"
+	if runtime.GOOS == "darwin" {
+		opener = "open"
+	}
+	return exec.Command(opener, url).Run()
 }
 
 func main() {
+	configErr := applyConfig(flag.CommandLine, os.Args[1:])
 	flag.Parse()
+	// config set creates the profiles.
+	if configErr != nil && !(errors.Is(configErr, errUnknownProfile) && flag.Arg(0) == "config") {
+		log.Fatal(configErr)
+	}
 	args := flag.Args()
+	if len(args) > 1 && takesInstance(args[0]) && !strings.HasPrefix(args[1], "-") {
+		if err := useMachine(args[1]); err != nil {
+			log.Fatal(err)
+		}
+		args = append(args[:1:1], args[2:]...)
+	}
+	if args := flag.Args(); len(args) == 3 && args[0] == "cp" {
+		// Either path may name the instance, as in builder-1:/tmp.
+		for _, arg := range args[1:] {
+			if name, _, remote := splitRemotePath(arg); remote && name != "" {
+				if err := useMachine(name); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+	suffix := *instanceSuffix
+	if suffix == "" && *suffixFromEnv != "" {
+		suffix = os.Getenv(*suffixFromEnv)
+	}
+	if suffix != "" {
+		*instanceName = dockercloud.SanitizeInstanceName(*instanceName + "-" + suffix)
+		log.Printf("using instance %q", *instanceName)
+	}
+	if *dockerSocket != "" && !dockercloud.SupportsUnixSocketForwarding() {
+		log.Printf("ssh can't forward unix sockets, falling back to localhost:%d", *tunnelPort)
+		*dockerSocket = ""
+	}
 	if len(args) == 0 {
-		fmt.Fprintln(os.Stderr, "usage: docker-cloud start|stop")
+		fmt.Fprintln(os.Stderr, usageLine())
 		flag.Usage()
 		flag.PrintDefaults()
 		os.Exit(-1)
 	}
-	cloud := DockerCloud{dockercloud.NewGCECloud()}
+	if args[0] == "completion" {
+		if err := completionCommand(os.Stdout, flag.CommandLine, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if args[0] == "config" {
+		if err := configCommand(os.Stdout, flag.CommandLine, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if args[0] == "version" {
+		// Only asks the docker daemon through an open tunnel, no need for the cloud.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		v, err := (&DockerCloud{}).DockerVersion(ctx)
+		if *jsonOutput {
+			report := struct {
+				Version, GoVersion, OS, Arch, Provider string
+				Docker                                 *types.Version
+			}{dockercloud.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH, *provider, nil}
+			if err == nil {
+				report.Docker = &v
+			}
+			printJSON(report)
+			return
+		}
+		fmt.Printf("docker-cloud %s (%s %s/%s)\nprovider: %s\n", dockercloud.Version, runtime.Version(), runtime.GOOS, runtime.GOARCH, *provider)
+		if err != nil {
+			fmt.Printf("docker: unreachable through %s\n", dockerHost())
+			return
+		}
+		fmt.Printf("docker: %s (API %s, %s/%s)\n", v.Version, v.APIVersion, v.Os, v.Arch)
+		return
+	}
+	if args[0] == "env" {
+		// Only the local end of the tunnel matters, no need for the cloud.
+		flags := flag.NewFlagSet("env", flag.ExitOnError)
+		defaultShell := "bash"
+		if os.Getenv("SHELL") != "" {
+			defaultShell = path.Base(os.Getenv("SHELL"))
+		}
+		shell := flags.String("shell", defaultShell, "The shell to print the commands for (bash|fish|powershell)")
+		unset := flags.Bool("unset", false, "Print the commands undoing the configuration instead")
+		flags.Parse(args[1:])
+		if err := printEnv(os.Stdout, *shell, *unset); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// Interrupting aborts the pending cloud operations.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if args[0] == "doctor" {
+		// The GCE cloud can't even be created without credentials.
+		results := localChecks()
+		if !checksFailed(results) {
+			cloud := newCloud(ctx)
+			results = append(results, cloud.cloudChecks(ctx)...)
+		}
+		if *jsonOutput {
+			printJSON(results)
+		} else {
+			printChecks(os.Stdout, results)
+		}
+		if checksFailed(results) {
+			os.Exit(1)
+		}
+		return
+	}
+	cloud := newCloud(ctx)
 	switch args[0] {
+	case "recover":
+		// Find where the root disk survived and start again from there.
+		diskZone, err := cloud.gce().LookupZoneForDisk(ctx, *diskName)
+		if err != nil {
+			log.Fatalf("failed to find root disk: %v", err)
+		}
+		log.Printf("found root disk in zone %q", diskZone)
+		*zone = diskZone
+		fallthrough
 	case "start":
-		_, err := cloud.GetOrCreateInstance()
+		if !*dryRun {
+			// Reserves the tunnel port of a new named instance.
+			saveMachine()
+		}
+		ip, err := cloud.GetOrCreateInstance(ctx)
+		if errors.Is(err, dockercloud.ErrQuotaExceeded) || errors.Is(err, dockercloud.ErrZoneExhausted) {
+			log.Fatalf("failed to create VM instance, try another -zone, -zone-fallback or another -instancetype: %v", err)
+		}
 		if err != nil {
-			log.Fatalf("failed to create VM instance")
+			log.Fatalf("failed to create VM instance: %v", err)
+		}
+		if *dryRun {
+			if ip != "" {
+				fmt.Printf("instance %q already running at %s\n", *instanceName, ip)
+			}
+			break
+		}
+		if *cloudNatIP != "" {
+			ips := strings.Split(*cloudNatIP, ",")
+			err = cloud.gce().SetNATExternalIPs(ctx, *cloudNatRouter, *cloudNatName, dockercloud.RegionForZone(*zone), ips)
+			if err != nil {
+				log.Fatalf("failed to set Cloud NAT external IPs: %v", err)
+			}
 		}
-		_, err = cloud.OpenSecureTunnel(*instanceName, *zone, *tunnelPort, *dockerPort)
+		cloud.recordInstance(ctx, ip)
+		tunnel, err := cloud.openTunnel(ctx)
 		if err != nil {
-			log.Fatalf("failed to create SSH tunnel")
+			log.Fatalf("failed to create SSH tunnel: %v", err)
 		}
-		var c chan bool
-		<-c
+		rememberTunnel(tunnel)
+		if *buildTrigger != "" {
+			err = cloud.gce().RunBuildTrigger(ctx, *buildTrigger, *instanceName, *zone, buildSubs, *buildTimeout)
+			if err != nil {
+				log.Fatalf("cloud build failed: %v", err)
+			}
+		}
+		cloud.TunnelMonitor(ctx, time.Now())
+	case "restart":
+		if _, err := cloud.gce().ResetInstance(ctx, *instanceName, *zone); err != nil {
+			log.Fatalf("failed to reset VM instance: %v", err)
+		}
+		tunnel, err := cloud.ensureTunnel(ctx)
+		if err != nil {
+			log.Fatalf("failed to create SSH tunnel: %v", err)
+		}
+		if tunnel == nil {
+			// The tunnel of a running start recovers by itself.
+			if err := cloud.waitForDocker(ctx, *restartTimeout); err != nil {
+				log.Fatalf("docker unreachable through the tunnel: %v", err)
+			}
+			break
+		}
+		rememberTunnel(tunnel)
+		cloud.TunnelMonitor(ctx, time.Now())
+	case "tunnel":
+		flags := flag.NewFlagSet("tunnel", flag.ExitOnError)
+		flags.IntVar(tunnelPort, "local-port", *tunnelPort, "The local port of the tunnel to docker")
+		flags.IntVar(dockerPort, "remote-port", *dockerPort, "The remote port docker listens on")
+		flags.Func("forward", "An extra localPort:remotePort pair to forward (repeatable)", func(pair string) error {
+			if *forwardedPorts != "" {
+				pair = *forwardedPorts + "," + pair
+			}
+			*forwardedPorts = pair
+			return nil
+		})
+		flags.Parse(args[1:])
+		if _, err := portMappings(); err != nil {
+			log.Fatalf("invalid ports: %v", err)
+		}
+		// Never creates the instance, unlike start.
+		ip, err := cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+		if errors.Is(err, dockercloud.ErrInstanceNotFound) {
+			log.Fatalf("instance %q is not running, start it first", *instanceName)
+		}
+		if err != nil {
+			log.Fatalf("failed to get instance IP: %v", err)
+		}
+		tunnel, err := cloud.ensureTunnel(ctx)
+		if err != nil {
+			log.Fatalf("failed to create SSH tunnel: %v", err)
+		}
+		if tunnel == nil {
+			log.Printf("a tunnel to docker already listens, supervising it")
+		} else {
+			log.Printf("tunnel open to %q at %s", *instanceName, ip)
+			rememberTunnel(tunnel)
+		}
+		cloud.TunnelMonitor(ctx, time.Now())
+	case "adopt":
+		if currentMachine == nil {
+			log.Fatalf("usage: docker-cloud adopt <instance>")
+		}
+		zoneSet := false
+		flag.Visit(func(f *flag.Flag) { zoneSet = zoneSet || f.Name == "zone" })
+		if err := cloud.adopt(ctx, zoneSet); err != nil {
+			log.Fatalf("failed to adopt %q: %v", *instanceName, err)
+		}
+		log.Printf("adopted %q in zone %q, on local port %d", *instanceName, *zone, *tunnelPort)
+	case "suspend":
+		cloud.require("suspend", cloud.Capabilities().StopStart)
+		if err := cloud.StopInstance(ctx, *instanceName, *zone); err != nil {
+			log.Fatalf("failed to suspend instance: %v", err)
+		}
+		log.Printf("%q suspended, its disks are kept until stop", *instanceName)
+	case "resume":
+		cloud.require("resume", cloud.Capabilities().StopStart)
+		ip, err := cloud.StartInstance(ctx, *instanceName, *zone)
+		if err != nil {
+			log.Fatalf("failed to resume instance: %v", err)
+		}
+		// The IP may have changed.
+		cloud.recordInstance(ctx, ip)
+		tunnel, err := cloud.ensureTunnel(ctx)
+		if err != nil {
+			log.Fatalf("failed to create SSH tunnel: %v", err)
+		}
+		if tunnel == nil {
+			// The tunnel of a running start recovers by itself.
+			if err := cloud.waitForDocker(ctx, *restartTimeout); err != nil {
+				log.Fatalf("docker unreachable through the tunnel: %v", err)
+			}
+			break
+		}
+		rememberTunnel(tunnel)
+		cloud.TunnelMonitor(ctx, time.Now())
+	case "upgrade":
+		flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+		version := flags.String("version", *dockerVersion, "The Docker version to upgrade to (default latest)")
+		flags.Parse(args[1:])
+		tunnel, err := cloud.ensureTunnel(ctx)
+		if err != nil {
+			log.Fatalf("failed to create SSH tunnel: %v", err)
+		}
+		if tunnel != nil {
+			defer tunnel.Kill()
+		}
+		v, err := cloud.UpgradeDocker(ctx, *version)
+		if err != nil {
+			log.Fatalf("failed to upgrade docker: %v", err)
+		}
+		log.Printf("docker %s (API %s) running on %q", v.Version, v.APIVersion, *instanceName)
 	case "stop":
-		err := cloud.DeleteInstance(*instanceName, *zone)
+		flags := flag.NewFlagSet("stop", flag.ExitOnError)
+		noWait := flags.Bool("no-wait", false, "Return without waiting for the deletion to complete")
+		all := flags.Bool("all", false, "Delete all the instances created by docker-cloud, in all the zones, concurrently")
+		labels := map[string]string{}
+		flags.Func("label", "With -all, only delete the instances with this key=value label (repeatable)", func(l string) error {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid label %q, want key=value", l)
+			}
+			labels[kv[0]] = kv[1]
+			return nil
+		})
+		force := flags.Bool("force", false, "Don't ask for confirmation")
+		flags.BoolVar(force, "y", false, "Shorthand for -force")
+		keepDisk := flags.Bool("keep-disk", false, "Keep the root disk of the instance, to start again from it (GCE only, the other providers delete it)")
+		flags.Parse(args[1:])
+		_, gce := cloud.Cloud.(*dockercloud.GCECloud)
+		if *keepDisk && !gce {
+			log.Fatalf("-keep-disk is only supported on GCE")
+		}
+		if *all {
+			cloud.require("stop -all", cloud.Capabilities().ListInstances)
+			instances, err := cloud.managedInstances(ctx, labels)
+			if err != nil {
+				log.Fatalf("failed to list instances: %v", err)
+			}
+			if len(instances) == 0 {
+				log.Print("no instance to delete")
+				break
+			}
+			doomed := []string{}
+			for _, instance := range instances {
+				doomed = append(doomed, fmt.Sprintf("instance %q in %q", instance.Name, instance.Zone))
+			}
+			if gce {
+				doomed = append(doomed, "but not their root disks")
+			}
+			confirmDeletion(*force, doomed)
+			if err := cloud.DeleteInstances(ctx, instances); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+		// The root disk can only go once the instance is gone.
+		deleteDisk := gce && !*keepDisk && !*noWait
+		doomed := []string{fmt.Sprintf("instance %q in %q", *instanceName, *zone)}
+		switch {
+		case deleteDisk:
+			doomed = append(doomed, fmt.Sprintf("root disk %q in %q", *diskName, *zone))
+		case gce:
+			doomed = append(doomed, fmt.Sprintf("but not root disk %q", *diskName))
+		default:
+			doomed[0] += " with its disks"
+		}
+		confirmDeletion(*force, doomed)
+		if *noWait {
+			op, err := cloud.gce().DeleteInstanceAsync(ctx, *instanceName, *zone)
+			if err != nil {
+				log.Fatalf("failed to delete VM instance: %v", err)
+			}
+			stoppedMachine(gce && !deleteDisk)
+			if *jsonOutput {
+				printJSON(struct{ Operation string }{op})
+				break
+			}
+			fmt.Println(op)
+			break
+		}
+		err := cloud.DeleteInstance(ctx, *instanceName, *zone)
+		if err != nil {
+			log.Fatalf("failed to delete VM instance: %v", err)
+		}
+		if deleteDisk {
+			if err := cloud.gce().DeleteDisk(ctx, *diskName, *zone); err != nil {
+				log.Fatalf("failed to delete root disk: %v", err)
+			}
+		}
+		stoppedMachine(gce && !deleteDisk)
+	case "check-egress":
+		flags := flag.NewFlagSet("check-egress", flag.ExitOnError)
+		since := flags.Duration("since", 24*time.Hour, "How far back to sum the instance egress")
+		flags.Parse(args[1:])
+		sent, err := cloud.gce().GetInternetEgress(ctx, *instanceName, *zone, time.Now().Add(-*since))
+		if err != nil {
+			log.Fatalf("failed to get instance egress: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(struct{ EgressBytes float64 }{sent})
+		} else {
+			fmt.Printf("%.2f GB\n", sent/1e9)
+		}
+		if *egressAlertGb > 0 && sent/1e9 > *egressAlertGb {
+			log.Printf("warning: above the %.2f GB alert threshold", *egressAlertGb)
+		}
+	case "prune":
+		flags := flag.NewFlagSet("prune", flag.ExitOnError)
+		containers := flags.Bool("containers", false, "Remove stopped containers")
+		images := flags.Bool("images", false, "Remove dangling images")
+		volumes := flags.Bool("volumes", false, "Remove unused volumes")
+		networks := flags.Bool("networks", false, "Remove unused networks")
+		all := flags.Bool("all", false, "Remove all of the above")
+		flags.Parse(args[1:])
+		if *all {
+			*containers, *images, *volumes, *networks = true, true, true, true
+		}
+		report, err := cloud.Prune(ctx, *containers, *images, *volumes, *networks)
+		if err != nil {
+			log.Fatalf("failed to prune docker resources: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(report)
+			break
+		}
+		fmt.Printf("containers: %d, images: %d, volumes: %d, networks: %d, reclaimed: %.2f MB\n",
+			report.ContainersDeleted, report.ImagesDeleted, report.VolumesDeleted, report.NetworksDeleted,
+			float64(report.SpaceReclaimedBytes)/1e6)
+	case "get-service-account":
+		email, err := cloud.gce().GetServiceAccountEmail(ctx, *instanceName, *zone)
+		if err != nil {
+			log.Fatalf("failed to get service account: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(struct{ Email string }{email})
+			break
+		}
+		fmt.Println(email)
+	case "grant-gcs-access":
+		flags := flag.NewFlagSet("grant-gcs-access", flag.ExitOnError)
+		bucket := flags.String("bucket", "", "The GCS bucket to grant access to")
+		role := flags.String("role", "roles/storage.objectViewer", "The IAM role to grant on the bucket")
+		revoke := flags.Bool("revoke", false, "Revoke the role instead of granting it")
+		flags.Parse(args[1:])
+		if *bucket == "" {
+			log.Fatalf("-bucket is required")
+		}
+		var err error
+		if *revoke {
+			err = cloud.gce().RevokeGCSAccess(ctx, *bucket, *instanceName, *zone, *role)
+		} else {
+			err = cloud.gce().GrantGCSAccess(ctx, *bucket, *instanceName, *zone, *role)
+		}
+		if err != nil {
+			log.Fatalf("failed to update bucket access: %v", err)
+		}
+	case "provision":
+		// Keep the next boots of GCE instances in line with the new spec.
+		if gce, ok := cloud.Cloud.(*dockercloud.GCECloud); ok {
+			if err := gce.UpdateStartupScript(ctx, *instanceName, *zone, instanceSpec()); err != nil {
+				log.Fatalf("failed to update the startup script of %q: %v", *instanceName, err)
+			}
+		}
+		log.Printf("provisioning %q", *instanceName)
+		if err := dockercloud.ProvisionInstance(ctx, cloud, *instanceName, *zone, instanceSpec()); err != nil {
+			log.Fatalf("failed to provision %q: %v", *instanceName, err)
+		}
+		log.Printf("%q provisioned", *instanceName)
+	case "ip":
+		ip, err := cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+		if err != nil {
+			log.Fatalf("failed to get instance %q: %v", *instanceName, err)
+		}
+		if ip == "" {
+			log.Fatalf("instance %q has no public IP, is it stopped?", *instanceName)
+		}
+		if *jsonOutput {
+			printJSON(struct{ Instance, IP string }{*instanceName, ip})
+			break
+		}
+		fmt.Println(ip)
+	case "gc":
+		flags := flag.NewFlagSet("gc", flag.ExitOnError)
+		olderThan := flags.Duration("older-than", 24*time.Hour, "Only collect the resources created longer ago than this")
+		force := flags.Bool("force", false, "Don't ask for confirmation")
+		flags.BoolVar(force, "y", false, "Shorthand for -force")
+		flags.Parse(args[1:])
+		garbage, err := cloud.findGarbage(ctx, *olderThan)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *jsonOutput {
+			// Only a report, scripts delete with gc -force.
+			printJSON(garbage)
+			break
+		}
+		doomed := garbage.describe()
+		if len(doomed) == 0 {
+			log.Print("nothing to collect")
+			break
+		}
+		confirmDeletion(*force, doomed)
+		if err := cloud.collectGarbage(ctx, garbage); err != nil {
+			log.Fatal(err)
+		}
+	case "inspect":
+		inspection, err := cloud.Inspect(ctx)
+		if err != nil {
+			log.Fatalf("failed to inspect %q: %v", *instanceName, err)
+		}
+		printJSON(inspection)
+	case "status":
+		status, err := cloud.Status(ctx)
+		if err != nil {
+			log.Fatalf("failed to get the status of %q: %v", *instanceName, err)
+		}
+		if *jsonOutput {
+			printJSON(status)
+			break
+		}
+		status.Print(os.Stdout)
+	case "ports":
+		tunnel, err := cloud.ensureTunnel(ctx)
 		if err != nil {
-			log.Fatalf("failed to delete VM instance")
+			log.Fatalf("failed to create SSH tunnel: %v", err)
+		}
+		if tunnel != nil {
+			defer tunnel.Kill()
+		}
+		report, err := cloud.Ports(ctx)
+		if err != nil {
+			log.Fatalf("failed to list ports: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(report)
+			break
+		}
+		report.print(os.Stdout)
+	case "events":
+		flags := flag.NewFlagSet("events", flag.ExitOnError)
+		filterMap := map[string][]string{}
+		flags.Func("filter", "Filter events, e.g. type=container (repeatable)", func(f string) error {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid filter %q, want key=value", f)
+			}
+			filterMap[kv[0]] = append(filterMap[kv[0]], kv[1])
+			return nil
+		})
+		since := flags.String("since", "", "Show events since a timestamp or duration, e.g. 5m")
+		cloudOps := flags.Bool("cloud", false, "Show the GCE operations on the instance, such as preemptions, instead of the docker events")
+		asJSON := flags.Bool("json", *jsonOutput, "Print the events as JSON, one per line")
+		flags.Parse(args[1:])
+		out := json.NewEncoder(os.Stdout)
+		if *cloudOps {
+			start, err := parseSince(*since)
+			if err != nil {
+				log.Fatal(err)
+			}
+			ops, errs := cloud.gce().WatchInstanceOperations(ctx, *instanceName, *zone, start, 10*time.Second)
+			for op := range ops {
+				if *asJSON {
+					out.Encode(op)
+					continue
+				}
+				fmt.Printf("%s %s %s %s %s\n", op.InsertTime.Format(time.RFC3339), op.Type, op.Status, op.Instance, op.User)
+				if op.Error != "" {
+					fmt.Printf("  error: %s\n", op.Error)
+				}
+			}
+			if err := <-errs; err != nil && ctx.Err() == nil {
+				log.Fatalf("operation stream failed: %v", err)
+			}
+			break
+		}
+		messages, errs := cloud.Events(ctx, filterMap, *since)
+		var err error
+		for err == nil {
+			select {
+			case m := <-messages:
+				if *asJSON {
+					out.Encode(m)
+					continue
+				}
+				fmt.Printf("%s %s %s %s\n", time.Unix(0, m.TimeNano).Format(time.RFC3339), m.Type, m.Action, m.Actor.ID)
+			case err = <-errs:
+			}
+		}
+		// Interrupted with Ctrl-C.
+		if !errors.Is(err, context.Canceled) {
+			log.Fatalf("event stream failed: %v", err)
+		}
+	case "image":
+		if len(args) < 2 {
+			log.Fatalf("usage: docker-cloud image ls|rm [-f] <image>...")
+		}
+		switch args[1] {
+		case "ls":
+			images, err := cloud.ListImages(ctx)
+			if err != nil {
+				log.Fatalf("failed to list images: %v", err)
+			}
+			if *jsonOutput {
+				printJSON(images)
+				break
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+			for _, image := range images {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f MB\n", image.Repository, image.Tag, image.ID, image.Created, float64(image.Size)/1e6)
+			}
+			w.Flush()
+		case "rm":
+			flags := flag.NewFlagSet("image rm", flag.ExitOnError)
+			force := flags.Bool("f", false, "Force the removal of the image")
+			flags.Parse(args[2:])
+			for _, image := range flags.Args() {
+				if err := cloud.RemoveImage(ctx, image, *force); err != nil {
+					log.Fatalf("failed to remove image %q: %v", image, err)
+				}
+			}
+		default:
+			log.Fatalf("unknown image command %q", args[1])
+		}
+	case "exec":
+		flags := flag.NewFlagSet("exec", flag.ExitOnError)
+		container := flags.String("container", "", "Exec into this running container instead of running the local docker CLI")
+		flags.Parse(args[1:])
+		var err error
+		if *container != "" {
+			err = cloud.Exec(ctx, *container, flags.Args())
+		} else {
+			// Make sure there is a docker to run against, through a tunnel
+			// only kept for the command when start isn't running.
+			if _, err := cloud.GetOrCreateInstance(ctx); err != nil {
+				log.Fatalf("failed to create VM instance: %v", err)
+			}
+			var tunnel *os.Process
+			if tunnel, err = cloud.ensureTunnel(ctx); err != nil {
+				log.Fatalf("failed to create SSH tunnel: %v", err)
+			}
+			if err := cloud.waitForDocker(ctx, *restartTimeout); err != nil {
+				log.Fatalf("docker unreachable through the tunnel: %v", err)
+			}
+			cmd := exec.Command("docker", flags.Args()...)
+			cmd.Env = append(os.Environ(), "DOCKER_HOST="+dockerHost())
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			err = cmd.Run()
+			if tunnel != nil {
+				tunnel.Kill()
+			}
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		} else if err != nil {
+			log.Fatalf("exec failed: %v", err)
+		}
+	case "cp":
+		if len(args) != 3 {
+			log.Fatalf("usage: docker-cloud cp <local-path> [instance]:<path> | [instance]:<path> <local-path>")
+		}
+		_, srcPath, srcRemote := splitRemotePath(args[1])
+		_, dstPath, dstRemote := splitRemotePath(args[2])
+		var err error
+		switch {
+		case srcRemote == dstRemote:
+			log.Fatalf("exactly one of the paths must be on the instance, as in :%s", args[2])
+		case dstRemote:
+			err = cloud.copier().CopyToInstance(ctx, *instanceName, *zone, srcPath, dstPath)
+		default:
+			err = cloud.copier().CopyFromInstance(ctx, *instanceName, *zone, srcPath, dstPath)
+		}
+		if err != nil {
+			log.Fatalf("copy failed: %v", err)
+		}
+	case "ssh":
+		// Without arguments, open a shell.
+		command := strings.Join(args[1:], " ")
+		tty := command == "" || term.IsTerminal(int(os.Stdin.Fd()))
+		err := cloud.interactive().RunInteractiveCommand(ctx, *instanceName, *zone, command, tty)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		} else if err != nil {
+			log.Fatalf("ssh failed: %v", err)
+		}
+	case "logs":
+		flags := flag.NewFlagSet("logs", flag.ExitOnError)
+		follow := flags.Bool("follow", false, "Keep printing the new log lines")
+		lines := flags.Int("lines", 100, "The number of past lines to print")
+		flags.Parse(args[1:])
+		if err := cloud.DaemonLogs(ctx, *follow, *lines); err != nil && ctx.Err() == nil {
+			log.Fatalf("failed to get the docker daemon logs: %v", err)
+		}
+	case "top":
+		flags := flag.NewFlagSet("top", flag.ExitOnError)
+		psArgs := flags.String("ps-args", "aux", "The ps options")
+		interval := flags.Duration("interval", 0, "Refresh the output at this interval")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			log.Fatalf("usage: docker-cloud top [-ps-args aux] [-interval 2s] <container>")
+		}
+		for {
+			entries, err := cloud.Top(ctx, flags.Arg(0), *psArgs)
+			if err != nil && ctx.Err() != nil {
+				// Interrupted while refreshing.
+				return
+			}
+			if err != nil {
+				log.Fatalf("failed to list container processes: %v", err)
+			}
+			if *interval > 0 && !*jsonOutput {
+				// Move to the top left corner and clear the screen.
+				fmt.Print("\033[H\033[2J")
+			}
+			if *jsonOutput {
+				printJSON(entries)
+			} else {
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "PID\tUSER\t%CPU\t%MEM\tVSZ\tRSS\tSTAT\tSTART\tTIME\tCOMMAND")
+				for _, e := range entries {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+						e.PID, e.User, e.CPU, e.Mem, e.VSZ, e.RSS, e.Stat, e.Start, e.Time, e.Command)
+				}
+				w.Flush()
+			}
+			if *interval <= 0 {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(*interval):
+			}
+		}
+	case "diff":
+		if len(args) != 2 {
+			log.Fatalf("usage: docker-cloud diff <container>")
+		}
+		entries, err := cloud.Diff(ctx, args[1])
+		if err != nil {
+			log.Fatalf("failed to diff container: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(entries)
+			break
+		}
+		for _, e := range entries {
+			fmt.Printf("%s %s\n", e.Kind, e.Path)
+		}
+	case "create-health-check":
+		flags := flag.NewFlagSet("create-health-check", flag.ExitOnError)
+		name := flags.String("name", "docker-health-check", "The name of the health check")
+		port := flags.Int("port", *dockerPort, "The TCP port to probe")
+		interval := flags.Int64("interval", 5, "Seconds between probes")
+		timeout := flags.Int64("timeout", 5, "Seconds to wait for a probe")
+		healthy := flags.Int64("healthy-threshold", 2, "Consecutive successes to become healthy")
+		unhealthy := flags.Int64("unhealthy-threshold", 2, "Consecutive failures to become unhealthy")
+		flags.Parse(args[1:])
+		link, err := cloud.gce().CreateTCPHealthCheck(ctx, *name, *port, *interval, *timeout, *healthy, *unhealthy)
+		if err != nil {
+			log.Fatalf("failed to create health check: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(struct{ Link string }{link})
+			break
+		}
+		fmt.Println(link)
+	case "delete-health-check":
+		if len(args) != 2 {
+			log.Fatalf("usage: docker-cloud delete-health-check <name>")
+		}
+		if err := cloud.gce().DeleteHealthCheck(ctx, args[1]); err != nil {
+			log.Fatalf("failed to delete health check: %v", err)
+		}
+	case "list-health-checks":
+		checks, err := cloud.gce().ListHealthChecks(ctx)
+		if err != nil {
+			log.Fatalf("failed to list health checks: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(checks)
+			break
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTYPE\tINTERVAL\tTIMEOUT")
+		for _, check := range checks {
+			fmt.Fprintf(w, "%s\t%s\t%ds\t%ds\n", check.Name, check.Type, check.CheckIntervalSec, check.TimeoutSec)
+		}
+		w.Flush()
+	case "commit":
+		flags := flag.NewFlagSet("commit", flag.ExitOnError)
+		container := flags.String("container", "", "The container to snapshot")
+		repository := flags.String("repository", "", "The repository of the new image")
+		tag := flags.String("tag", "latest", "The tag of the new image")
+		noPause := flags.Bool("no-pause", false, "Don't pause the container while committing")
+		flags.Parse(args[1:])
+		if *container == "" || *repository == "" {
+			log.Fatalf("-container and -repository are required")
+		}
+		id, err := cloud.Commit(ctx, *container, *repository, *tag, !*noPause)
+		if err != nil {
+			log.Fatalf("failed to commit container: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(struct{ ID string }{id})
+			break
+		}
+		fmt.Println(id)
+	case "enable-serial-console":
+		if err := cloud.gce().EnableSerialConsolePort(ctx, *instanceName, *zone); err != nil {
+			log.Fatalf("failed to enable serial console: %v", err)
+		}
+	case "disable-serial-console":
+		if err := cloud.gce().DisableSerialConsolePort(ctx, *instanceName, *zone); err != nil {
+			log.Fatalf("failed to disable serial console: %v", err)
+		}
+	case "save-image", "load-image":
+		flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+		image := flags.String("image", "", "The image to save")
+		bucket := flags.String("bucket", "", "The GCS bucket holding the image tarball")
+		object := flags.String("object", "", "The GCS object name of the image tarball")
+		flags.Parse(args[1:])
+		if *bucket == "" || *object == "" {
+			log.Fatalf("-bucket and -object are required")
+		}
+		var err error
+		if args[0] == "save-image" {
+			if *image == "" {
+				log.Fatalf("-image is required")
+			}
+			err = cloud.Save(ctx, *image, *bucket, *object)
+		} else {
+			err = cloud.Load(ctx, *bucket, *object)
+		}
+		if err != nil {
+			log.Fatalf("%s failed: %v", args[0], err)
+		}
+	case "copy-between-instances":
+		flags := flag.NewFlagSet("copy-between-instances", flag.ExitOnError)
+		srcZone := flags.String("src-zone", *zone, "The zone of the source instance")
+		dstZone := flags.String("dst-zone", *zone, "The zone of the destination instance")
+		flags.Parse(args[1:])
+		if flags.NArg() != 4 {
+			log.Fatalf("usage: docker-cloud copy-between-instances [-src-zone zone] [-dst-zone zone] <src-instance> <src-path> <dst-instance> <dst-path>")
+		}
+		err := cloud.CopyBetweenInstances(ctx, flags.Arg(0), *srcZone, flags.Arg(1), flags.Arg(2), *dstZone, flags.Arg(3))
+		if err != nil {
+			log.Fatalf("copy failed: %v", err)
+		}
+	case "set-cpu-platform":
+		if len(args) != 2 {
+			log.Fatalf("usage: docker-cloud set-cpu-platform <platform>")
+		}
+		if err := cloud.gce().SetMinCPUPlatform(ctx, *instanceName, *zone, args[1]); err != nil {
+			log.Fatalf("failed to set CPU platform: %v", err)
+		}
+	case "resize":
+		if len(args) != 2 {
+			log.Fatalf("usage: docker-cloud resize <machine-type>")
+		}
+		cloud.require("resize", cloud.Capabilities().Resize)
+		if err := cloud.ResizeInstance(ctx, *instanceName, *zone, args[1]); err != nil {
+			log.Fatalf("failed to resize instance: %v", err)
+		}
+	case "stats":
+		flags := flag.NewFlagSet("stats", flag.ExitOnError)
+		interval := flags.Duration("interval", 2*time.Second, "Refresh the output at this interval (0 to print once)")
+		flags.Parse(args[1:])
+		tunnel, err := cloud.ensureTunnel(ctx)
+		if err != nil {
+			log.Fatalf("failed to create SSH tunnel: %v", err)
+		}
+		if tunnel != nil {
+			defer tunnel.Kill()
+		}
+		for {
+			report := &StatsReport{}
+			report.Instance, err = cloud.InstanceStats(ctx)
+			if err == nil {
+				report.Containers, err = cloud.ContainerStats(ctx)
+			}
+			if err != nil && ctx.Err() != nil {
+				// Interrupted, returning closes the tunnel.
+				return
+			}
+			if err != nil {
+				log.Fatalf("failed to get stats: %v", err)
+			}
+			if *interval > 0 && !*jsonOutput {
+				// Move to the top left corner and clear the screen.
+				fmt.Print("\033[H\033[2J")
+			}
+			if *jsonOutput {
+				printJSON(report)
+			} else {
+				report.print(os.Stdout)
+			}
+			if *interval <= 0 {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(*interval):
+			}
+		}
+	case "system-df":
+		flags := flag.NewFlagSet("system-df", flag.ExitOnError)
+		threshold := flags.Float64("reclaimable-threshold-gb", 0, "Exit with status 2 when more than this many GB are reclaimable (0 to disable)")
+		flags.Parse(args[1:])
+		report, err := cloud.SystemDF(ctx)
+		if err != nil {
+			log.Fatalf("failed to get docker disk usage: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(report)
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "TYPE\tTOTAL\tACTIVE\tSIZE\tRECLAIMABLE")
+			for _, row := range []struct {
+				name     string
+				category DFCategory
+			}{
+				{"Images", report.Images},
+				{"Containers", report.Containers},
+				{"Local Volumes", report.LocalVolumes},
+				{"Build Cache", report.BuildCache},
+			} {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%.2f GB\t%.2f GB\n", row.name, row.category.TotalCount, row.category.Active,
+					float64(row.category.SizeBytes)/1e9, float64(row.category.ReclaimableBytes)/1e9)
+			}
+			w.Flush()
+		}
+		if reclaimable := float64(report.ReclaimableBytes()) / 1e9; *threshold > 0 && reclaimable > *threshold {
+			log.Printf("%.2f GB reclaimable, above the %.2f GB threshold", reclaimable, *threshold)
+			os.Exit(2)
+		}
+	case "snapshot":
+		flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+		name := flags.String("name", *diskName+"-"+time.Now().UTC().Format("20060102-150405"), "The name of the snapshot")
+		labels := map[string]string{}
+		flags.Func("label", "A key=value label of the snapshot (repeatable)", func(l string) error {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid label %q, want key=value", l)
+			}
+			labels[kv[0]] = kv[1]
+			return nil
+		})
+		flags.Parse(args[1:])
+		cloud.require("snapshot", cloud.Capabilities().Snapshots)
+		link, err := cloud.gce().CreateSnapshot(ctx, *diskName, *zone, *name, labels)
+		if err != nil {
+			log.Fatalf("failed to snapshot the root disk: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(struct{ Link string }{link})
+			break
+		}
+		fmt.Println(link)
+	case "clone":
+		flags := flag.NewFlagSet("clone", flag.ExitOnError)
+		snapshot := flags.String("snapshot", "", "The name of the intermediate snapshot (default <diskname>-clone-<timestamp>)")
+		keepSnapshot := flags.Bool("keep-snapshot", false, "Keep the intermediate snapshot once the clone is created")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			log.Fatalf("usage: docker-cloud clone [instance] [-snapshot name] [-keep-snapshot] <new-instance>")
+		}
+		cloud.require("clone", cloud.Capabilities().Snapshots)
+		source, sourceDisk := *instanceName, *diskName
+		if *snapshot == "" {
+			*snapshot = sourceDisk + "-clone-" + time.Now().UTC().Format("20060102-150405")
+		}
+		if err := useMachine(flags.Arg(0)); err != nil {
+			log.Fatal(err)
+		}
+		if _, err := cloud.GetPublicIPAddress(ctx, *instanceName, *zone); !errors.Is(err, dockercloud.ErrInstanceNotFound) {
+			log.Fatalf("instance %q already exists", *instanceName)
+		}
+		if *dryRun {
+			fmt.Printf("would snapshot disk %q to %q\n", sourceDisk, *snapshot)
+		} else {
+			// Flush the page cache, the snapshot of a running disk is only
+			// crash consistent.
+			if _, err := cloud.RunCommand(ctx, source, *zone, "sync"); err != nil {
+				log.Printf("failed to sync the disk of %q: %v", source, err)
+			}
+			if _, err := cloud.gce().CreateSnapshot(ctx, sourceDisk, *zone, *snapshot, map[string]string{"docker-cloud-clone-of": source}); err != nil {
+				log.Fatalf("failed to snapshot the root disk of %q: %v", source, err)
+			}
+		}
+		*fromSnapshot = *snapshot
+		if !*dryRun {
+			saveMachine()
+		}
+		ip, err := cloud.GetOrCreateInstance(ctx)
+		if err != nil {
+			log.Fatalf("failed to create VM instance: %v", err)
+		}
+		if !*dryRun && ip == "" {
+			// Not every provider knows the address when the insert returns.
+			if ip, err = cloud.GetPublicIPAddress(ctx, *instanceName, *zone); err != nil {
+				log.Fatalf("failed to get the IP of %q: %v", *instanceName, err)
+			}
+		}
+		if !*dryRun {
+			cloud.recordInstance(ctx, ip)
+		}
+		if !*keepSnapshot {
+			// The disk no longer needs its snapshot once created.
+			if err := cloud.gce().DeleteSnapshot(ctx, *snapshot); err != nil {
+				log.Printf("failed to delete snapshot %q: %v", *snapshot, err)
+			}
+		}
+		if *dryRun {
+			break
+		}
+		if *jsonOutput {
+			printJSON(struct{ Name, IP string }{*instanceName, ip})
+			break
+		}
+		log.Printf("cloned %q to %q at %s, run docker-cloud start %s to open the tunnel", source, *instanceName, ip, *instanceName)
+	case "list":
+		flags := flag.NewFlagSet("list", flag.ExitOnError)
+		thisZone := flags.Bool("this-zone", false, "Only list the instances of -zone instead of all the zones")
+		flags.Parse(args[1:])
+		cloud.require("list", cloud.Capabilities().ListInstances)
+		listZone := ""
+		if *thisZone {
+			listZone = *zone
+		}
+		instances, err := cloud.ListInstances(ctx, listZone)
+		if err != nil {
+			log.Fatalf("failed to list instances: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(instances)
+			break
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tZONE\tSTATUS\tIP\tUPTIME")
+		for _, instance := range instances {
+			// Counted from the creation on the providers that don't report the
+			// last start.
+			started := instance.LastStartTime
+			if started.IsZero() {
+				started = instance.CreationTime
+			}
+			uptime := "-"
+			if instance.Status == dockercloud.StatusRunning && !started.IsZero() {
+				uptime = time.Since(started).Round(time.Minute).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", instance.Name, instance.Zone, instance.Status, instance.PublicIP, uptime)
+		}
+		w.Flush()
+	case "list-by-suffix":
+		if len(args) != 2 {
+			log.Fatalf("usage: docker-cloud list-by-suffix <suffix>")
+		}
+		names, err := cloud.gce().ListInstancesBySuffix(ctx, *zone, dockercloud.SanitizeNameSegment(args[1]))
+		if err != nil {
+			log.Fatalf("failed to list instances: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(names)
+			break
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+	case "console-url":
+		flags := flag.NewFlagSet("console-url", flag.ExitOnError)
+		open := flags.Bool("open", false, "Open the serial console in the default browser")
+		flags.Parse(args[1:])
+		url, err := cloud.gce().GetInstanceConsoleURL(ctx, *instanceName, *zone)
+		if err != nil {
+			log.Fatalf("failed to get console URL: %v", err)
+		}
+		if *jsonOutput {
+			printJSON(struct{ URL string }{url})
+		} else {
+			fmt.Println(url)
+		}
+		if *open {
+			if err := openBrowser(url); err != nil {
+				log.Fatalf("failed to open browser: %v", err)
+			}
 		}
 	}
 }
@@ -0,0 +1,61 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+	"github.com/proppy/docker-cloud/dockercloud/fakecloud"
+)
+
+func TestGetOrCreateInstance(t *testing.T) {
+	savedName, savedZone := *instanceName, *zone
+	*instanceName, *zone = "docker-test", "zone-a"
+	defer func() { *instanceName, *zone = savedName, savedZone }()
+	ctx := context.Background()
+	fake := fakecloud.New()
+	cloud := &DockerCloud{fake}
+
+	ip, err := cloud.GetOrCreateInstance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip == "" {
+		t.Fatal("GetOrCreateInstance() created no address")
+	}
+	if again, err := cloud.GetOrCreateInstance(ctx); err != nil || again != ip {
+		t.Errorf("GetOrCreateInstance() of a running instance = %q, %v, want %q", again, err, ip)
+	}
+	if instances, _ := fake.ListInstances(ctx, ""); len(instances) != 1 {
+		t.Errorf("%d instances, want 1", len(instances))
+	}
+
+	if err := fake.StopInstance(ctx, *instanceName, *zone); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := cloud.GetOrCreateInstance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance, err := fake.DescribeInstance(ctx, *instanceName, *zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status != dockercloud.StatusRunning || resumed != instance.PublicIP || resumed == "" {
+		t.Errorf("GetOrCreateInstance() of a stopped instance = %q, instance %s at %q, want it resumed", resumed, instance.Status, instance.PublicIP)
+	}
+}
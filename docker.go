@@ -0,0 +1,427 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"golang.org/x/term"
+)
+
+// Summary of the resources removed by DockerCloud.Prune.
+type PruneReport struct {
+	SpaceReclaimedBytes int64
+	ContainersDeleted   int
+	ImagesDeleted       int
+	VolumesDeleted      int
+	NetworksDeleted     int
+}
+
+// Run a docker command on the remote instance and return its output.
+func (cloud *DockerCloud) docker(ctx context.Context, args string) (string, error) {
+	return cloud.RunCommand(ctx, *instanceName, *zone, "sudo docker "+args)
+}
+
+// Remove unused Docker resources on the remote instance.
+func (cloud *DockerCloud) Prune(ctx context.Context, containers, images, volumes, networks bool) (PruneReport, error) {
+	var report PruneReport
+	prunes := []struct {
+		enabled bool
+		command string
+		deleted *int
+	}{
+		{containers, "container prune -f", &report.ContainersDeleted},
+		{images, "image prune -f", &report.ImagesDeleted},
+		{volumes, "volume prune -f", &report.VolumesDeleted},
+		{networks, "network prune -f", &report.NetworksDeleted},
+	}
+	for _, prune := range prunes {
+		if !prune.enabled {
+			continue
+		}
+		out, err := cloud.docker(ctx, prune.command)
+		if err != nil {
+			return report, fmt.Errorf("docker %s: %v", prune.command, err)
+		}
+		deleted, reclaimed := parsePruneOutput(out)
+		*prune.deleted += deleted
+		report.SpaceReclaimedBytes += reclaimed
+	}
+	return report, nil
+}
+
+// A Docker image on the remote instance.
+type DockerImage struct {
+	ID         string
+	Repository string
+	Tag        string
+	Size       int64
+	Created    string
+}
+
+// List the Docker images on the remote instance.
+func (cloud *DockerCloud) ListImages(ctx context.Context) ([]DockerImage, error) {
+	out, err := cloud.docker(ctx, "image ls --format json")
+	if err != nil {
+		return nil, err
+	}
+	images := []DockerImage{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var image struct {
+			ID, Repository, Tag, Size, CreatedAt string
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &image); err != nil {
+			return nil, fmt.Errorf("failed to parse image %q: %v", scanner.Text(), err)
+		}
+		images = append(images, DockerImage{
+			ID:         image.ID,
+			Repository: image.Repository,
+			Tag:        image.Tag,
+			Size:       parseSize(image.Size),
+			Created:    image.CreatedAt,
+		})
+	}
+	return images, nil
+}
+
+// Remove a Docker image from the remote instance.
+func (cloud *DockerCloud) RemoveImage(ctx context.Context, imageID string, force bool) error {
+	command := "image rm "
+	if force {
+		command += "-f "
+	}
+	_, err := cloud.docker(ctx, command+shellQuote(imageID))
+	return err
+}
+
+// Parse the output of a docker prune command into the number of deleted
+// resources and the reclaimed space in bytes.
+func parsePruneOutput(out string) (int, int64) {
+	deleted := 0
+	var reclaimed int64
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, "Deleted "), strings.HasPrefix(line, "untagged:"):
+		case strings.HasPrefix(line, "Total reclaimed space:"):
+			reclaimed = parseSize(strings.TrimSpace(strings.TrimPrefix(line, "Total reclaimed space:")))
+		default:
+			deleted++
+		}
+	}
+	return deleted, reclaimed
+}
+
+// Parse a human readable docker size such as "1.5GB" into bytes.
+func parseSize(size string) int64 {
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"kB", 1e3}, {"KB", 1e3}, {"B", 1},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(size, unit.suffix), 64)
+			if err != nil {
+				return 0
+			}
+			return int64(value * unit.multiplier)
+		}
+	}
+	return 0
+}
+
+// Print the last lines of the remote docker daemon log, from journald on
+// systemd hosts and from the upstart or sysvinit log file otherwise. With
+// follow, keep printing the new lines until ctx is done.
+func (cloud *DockerCloud) DaemonLogs(ctx context.Context, follow bool, lines int) error {
+	f := ""
+	if follow {
+		f = " -f"
+	}
+	remote := fmt.Sprintf(`if journalctl -u docker -n 1 -q >/dev/null 2>&1; then sudo journalctl -u docker --no-pager -n %[1]d%[2]s; `+
+		`elif test -f /var/log/upstart/docker.log; then sudo tail -n %[1]d%[2]s /var/log/upstart/docker.log; `+
+		`else sudo tail -n %[1]d%[2]s /var/log/docker.log; fi`, lines, f)
+	// A terminal makes the remote command exit with the local one.
+	tty := follow && term.IsTerminal(int(os.Stdin.Fd()))
+	return cloud.interactive().RunInteractiveCommand(ctx, *instanceName, *zone, remote, tty)
+}
+
+// Install the given docker version on the remote instance, the latest when
+// empty, restart the daemon and return the version docker answers with
+// through the tunnel.
+func (cloud *DockerCloud) UpgradeDocker(ctx context.Context, version string) (types.Version, error) {
+	install := "wget -qO- https://get.docker.io/ | sudo sh"
+	if version != "" {
+		install = fmt.Sprintf("wget -qO- https://get.docker.io/ | sudo VERSION=%s sh", shellQuote(version))
+	}
+	log.Printf("upgrading docker on %q", *instanceName)
+	if _, err := cloud.RunCommand(ctx, *instanceName, *zone, install+" && sudo service docker restart"); err != nil {
+		return types.Version{}, err
+	}
+	if err := cloud.waitForDocker(ctx, *restartTimeout); err != nil {
+		return types.Version{}, fmt.Errorf("docker did not come back after the upgrade: %v", err)
+	}
+	v, err := cloud.DockerVersion(ctx)
+	if err != nil {
+		return types.Version{}, err
+	}
+	if version != "" && !strings.HasPrefix(strings.TrimPrefix(v.Version, "v"), strings.TrimPrefix(version, "v")) {
+		return v, fmt.Errorf("docker %s is running instead of %s", v.Version, version)
+	}
+	return v, nil
+}
+
+// Run a command inside a running container on the remote instance, attached
+// to the local terminal.
+func (cloud *DockerCloud) Exec(ctx context.Context, container string, command []string) error {
+	tty := term.IsTerminal(int(os.Stdin.Fd()))
+	flags := "-i"
+	if tty {
+		flags = "-it"
+	}
+	remote := fmt.Sprintf("sudo docker exec %s %s %s", flags, shellQuote(container), shellJoin(command))
+	return cloud.interactive().RunInteractiveCommand(ctx, *instanceName, *zone, remote, tty)
+}
+
+// Quote a string for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Quote and join arguments for the remote shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// A process running in a container, as reported by docker top.
+type TopEntry struct {
+	PID     string
+	User    string
+	CPU     string
+	Mem     string
+	VSZ     string
+	RSS     string
+	Stat    string
+	Start   string
+	Time    string
+	Command string
+}
+
+// List the processes running in a container on the remote instance. psArgs
+// are passed to ps, e.g. "aux".
+func (cloud *DockerCloud) Top(ctx context.Context, container string, psArgs string) ([]TopEntry, error) {
+	out, err := cloud.docker(ctx, strings.TrimSpace("top "+shellQuote(container)+" "+shellJoin(strings.Fields(psArgs))))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("empty docker top output")
+	}
+	header := strings.Fields(lines[0])
+	entries := []TopEntry{}
+	for _, line := range lines[1:] {
+		// The last column, the command, may contain spaces.
+		fields := strings.Fields(line)
+		if len(fields) > len(header) {
+			fields = append(fields[:len(header)-1], strings.Join(fields[len(header)-1:], " "))
+		}
+		var entry TopEntry
+		for i, field := range fields {
+			switch header[i] {
+			case "PID":
+				entry.PID = field
+			case "USER", "UID":
+				entry.User = field
+			case "%CPU", "C":
+				entry.CPU = field
+			case "%MEM":
+				entry.Mem = field
+			case "VSZ":
+				entry.VSZ = field
+			case "RSS":
+				entry.RSS = field
+			case "STAT":
+				entry.Stat = field
+			case "START", "STIME":
+				entry.Start = field
+			case "TIME":
+				entry.Time = field
+			case "COMMAND", "CMD":
+				entry.Command = field
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// A filesystem change in a container: Kind is A (added), C (changed) or D (deleted).
+type DiffEntry struct {
+	Kind string
+	Path string
+}
+
+// List the filesystem changes in a container on the remote instance.
+func (cloud *DockerCloud) Diff(ctx context.Context, container string) ([]DiffEntry, error) {
+	out, err := cloud.docker(ctx, "diff "+shellQuote(container))
+	if err != nil {
+		return nil, err
+	}
+	entries := []DiffEntry{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		entries = append(entries, DiffEntry{Kind: fields[0], Path: fields[1]})
+	}
+	return entries, nil
+}
+
+// Snapshot a container on the remote instance as a new image and return the
+// image ID. The container is paused while committing when pause is set.
+//
+// Volumes are not part of the image, and each commit adds a layer holding
+// every change since the base image, so images built this way grow and can't
+// be reproduced: prefer building from a Dockerfile.
+func (cloud *DockerCloud) Commit(ctx context.Context, container, repository, tag string, pause bool) (string, error) {
+	out, err := cloud.docker(ctx, fmt.Sprintf("commit --pause=%t %s %s",
+		pause, shellQuote(container), shellQuote(repository+":"+tag)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Export an image from the remote instance to gs://gcsBucket/objectName as a
+// gzipped tarball. The instance needs write access to the bucket.
+func (cloud *DockerCloud) Save(ctx context.Context, image, gcsBucket, objectName string) error {
+	_, err := cloud.RunCommand(ctx, *instanceName, *zone, fmt.Sprintf("set -o pipefail; sudo docker save %s | gzip | gsutil cp - %s",
+		shellQuote(image), shellQuote("gs://"+gcsBucket+"/"+objectName)))
+	return err
+}
+
+// Import the images of the gzipped tarball gs://gcsBucket/objectName on the
+// remote instance. The instance needs read access to the bucket.
+func (cloud *DockerCloud) Load(ctx context.Context, gcsBucket, objectName string) error {
+	_, err := cloud.RunCommand(ctx, *instanceName, *zone, fmt.Sprintf("set -o pipefail; gsutil cp %s - | gunzip | sudo docker load",
+		shellQuote("gs://"+gcsBucket+"/"+objectName)))
+	return err
+}
+
+// Copy a file or directory from an instance to another one, directly if
+// possible or else through the local machine.
+func (cloud *DockerCloud) CopyBetweenInstances(ctx context.Context, srcName, srcZone, remoteSrcPath, dstName, dstZone, remoteDstPath string) error {
+	gce := cloud.gce()
+	err := gce.CopyBetweenInstances(ctx, srcName, srcZone, remoteSrcPath, dstName, dstZone, remoteDstPath)
+	if err == nil {
+		return nil
+	}
+	log.Printf("direct copy failed (%v), copying through localhost", err)
+	dir, err := ioutil.TempDir("", "docker-cloud")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, filepath.Base(remoteSrcPath))
+	if err := gce.CopyFromInstance(ctx, srcName, srcZone, remoteSrcPath, local); err != nil {
+		return err
+	}
+	return gce.CopyToInstance(ctx, dstName, dstZone, local, remoteDstPath)
+}
+
+// Disk usage of one kind of Docker resource.
+type DFCategory struct {
+	TotalCount       int
+	Active           int
+	SizeBytes        int64
+	ReclaimableBytes int64
+}
+
+// Disk usage of the remote Docker daemon, as reported by docker system df.
+type DFReport struct {
+	Images       DFCategory
+	Containers   DFCategory
+	LocalVolumes DFCategory
+	BuildCache   DFCategory
+}
+
+// Return the total reclaimable space of the report in bytes.
+func (r *DFReport) ReclaimableBytes() int64 {
+	return r.Images.ReclaimableBytes + r.Containers.ReclaimableBytes + r.LocalVolumes.ReclaimableBytes + r.BuildCache.ReclaimableBytes
+}
+
+// Report the disk usage of the remote Docker daemon.
+func (cloud *DockerCloud) SystemDF(ctx context.Context) (*DFReport, error) {
+	out, err := cloud.docker(ctx, "system df --format json")
+	if err != nil {
+		return nil, err
+	}
+	report := &DFReport{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var row struct {
+			Type, TotalCount, Active, Size, Reclaimable string
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, fmt.Errorf("failed to parse %q: %v", scanner.Text(), err)
+		}
+		var category *DFCategory
+		switch row.Type {
+		case "Images":
+			category = &report.Images
+		case "Containers":
+			category = &report.Containers
+		case "Local Volumes":
+			category = &report.LocalVolumes
+		case "Build Cache":
+			category = &report.BuildCache
+		default:
+			continue
+		}
+		category.TotalCount, _ = strconv.Atoi(row.TotalCount)
+		category.Active, _ = strconv.Atoi(row.Active)
+		category.SizeBytes = parseSize(row.Size)
+		// Reclaimable looks like "1.2GB (50%)".
+		category.ReclaimableBytes = parseSize(strings.Fields(row.Reclaimable + " ")[0])
+	}
+	return report, nil
+}
@@ -0,0 +1,460 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The settings of an AWS Cloud.
+type AWSConfig struct {
+	Options
+	// The AWS region, the -zone availability zone region when empty.
+	Region string
+	// The EC2 instance type.
+	InstanceType string
+	// The AMI to boot, the latest Ubuntu LTS from Canonical when empty.
+	AMI string
+	// The EC2 key pair to log into the instances.
+	KeyName string
+	// The private key of -aws-key-name, generated if missing.
+	KeyPath string
+	// The user to log into the instances.
+	SSHUser string
+	// The security group of the instances, created if missing.
+	SecurityGroup string
+}
+
+const (
+	ec2APIVersion = "2016-11-15"
+
+	// The owner and name of the default Ubuntu AMIs.
+	canonicalOwnerId = "099720109477"
+	ubuntuAMIPattern = "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server-*"
+
+	awsInstanceTimeout = 5 * time.Minute
+	awsDockerTimeout   = 10 * time.Minute
+)
+
+// An Amazon EC2 implementation of the Cloud interface
+type AWSCloud struct {
+	unsupported
+	sshInstances
+
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+	client          *http.Client
+	config          AWSConfig
+}
+
+// Create an AWS Cloud instance, with the credentials of the standard
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables.
+func NewAWSCloud(config AWSConfig) (Cloud, error) {
+	cloud := &AWSCloud{
+		config:          config,
+		accessKeyId:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		client:          &http.Client{Timeout: 30 * time.Second},
+	}
+	if cloud.accessKeyId == "" || cloud.secretAccessKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// An error returned by the EC2 API.
+type ec2Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *ec2Error) Error() string {
+	return fmt.Sprintf("ec2: %s: %s", e.Code, e.Message)
+}
+
+// Report whether err is an EC2 error with the given code.
+func isEC2Error(err error, code string) bool {
+	var e *ec2Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+type ec2Instance struct {
+	InstanceId string `xml:"instanceId"`
+	State      string `xml:"instanceState>name"`
+	IPAddress  string `xml:"ipAddress"`
+}
+
+// Return the region of an availability zone such as "us-east-1a", unless
+// -aws-region is set.
+func (cloud AWSCloud) regionForZone(zone string) string {
+	if cloud.config.Region != "" {
+		return cloud.config.Region
+	}
+	return strings.TrimRight(zone, "abcdefghijklmnopqrstuvwxyz")
+}
+
+// Call an EC2 API action in a region and decode its XML response into result.
+func (cloud AWSCloud) call(ctx context.Context, region, action string, params url.Values, result interface{}) error {
+	params.Set("Action", action)
+	params.Set("Version", ec2APIVersion)
+	body := params.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://ec2."+region+".amazonaws.com/", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	cloud.sign(req, body, "ec2", region, time.Now())
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Errors []ec2Error `xml:"Errors>Error"`
+		}
+		if xml.Unmarshal(data, &errResp) == nil && len(errResp.Errors) > 0 {
+			return &errResp.Errors[0]
+		}
+		return fmt.Errorf("ec2 %s failed: %s", action, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// Sign a request with AWS Signature Version 4.
+func (cloud AWSCloud) sign(req *http.Request, body, service, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if cloud.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cloud.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+cloud.secretAccessKey), date)
+	for _, s := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cloud.accessKeyId, scope, signedHeaders, signature))
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// Find the live instance with the given Name tag.
+func (cloud AWSCloud) findInstance(ctx context.Context, name, zone string) (*ec2Instance, error) {
+	params := url.Values{
+		"Filter.1.Name":    {"tag:Name"},
+		"Filter.1.Value.1": {name},
+		"Filter.2.Name":    {"availability-zone"},
+		"Filter.2.Value.1": {zone},
+		"Filter.3.Name":    {"instance-state-name"},
+		"Filter.3.Value.1": {"pending"},
+		"Filter.3.Value.2": {"running"},
+		"Filter.3.Value.3": {"stopping"},
+		"Filter.3.Value.4": {"stopped"},
+	}
+	var resp struct {
+		Instances []ec2Instance `xml:"reservationSet>item>instancesSet>item"`
+	}
+	if err := cloud.call(ctx, cloud.regionForZone(zone), "DescribeInstances", params, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Instances) == 0 {
+		return nil, fmt.Errorf("%w: instance %q in %q", ErrInstanceNotFound, name, zone)
+	}
+	return &resp.Instances[0], nil
+}
+
+// Wait until an instance reaches the given state.
+func (cloud AWSCloud) waitForInstance(ctx context.Context, instanceId, region, state string) (*ec2Instance, error) {
+	deadline := time.Now().Add(awsInstanceTimeout)
+	params := url.Values{"InstanceId.1": {instanceId}}
+	for {
+		var resp struct {
+			Instances []ec2Instance `xml:"reservationSet>item>instancesSet>item"`
+		}
+		err := cloud.call(ctx, region, "DescribeInstances", params, &resp)
+		// A new instance may not be visible to DescribeInstances yet.
+		if err != nil && !isEC2Error(err, "InvalidInstanceID.NotFound") {
+			return nil, err
+		}
+		if len(resp.Instances) > 0 && resp.Instances[0].State == state {
+			return &resp.Instances[0], nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for instance %q to be %s", ErrOperationTimeout, instanceId, state)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud AWSCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	instance, err := cloud.findInstance(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return instance.IPAddress, nil
+}
+
+// Import the -aws-key-path public key as -aws-key-name, generating the key
+// pair first if needed.
+func (cloud AWSCloud) ensureKeyPair(ctx context.Context, region string) error {
+	publicKey, err := EnsureSSHKey(cloud.config.KeyPath)
+	if err != nil {
+		return err
+	}
+	err = cloud.call(ctx, region, "ImportKeyPair", url.Values{
+		"KeyName":           {cloud.config.KeyName},
+		"PublicKeyMaterial": {base64.StdEncoding.EncodeToString(publicKey)},
+	}, nil)
+	if isEC2Error(err, "InvalidKeyPair.Duplicate") {
+		return nil
+	}
+	return err
+}
+
+// Get or create the -aws-security-group security group, allowing ssh from
+// anywhere and the docker port only between its members. Returns the group id.
+func (cloud AWSCloud) getOrCreateSecurityGroup(ctx context.Context, region string) (string, error) {
+	var groups struct {
+		GroupIds []string `xml:"securityGroupInfo>item>groupId"`
+	}
+	err := cloud.call(ctx, region, "DescribeSecurityGroups", url.Values{
+		"Filter.1.Name":    {"group-name"},
+		"Filter.1.Value.1": {cloud.config.SecurityGroup},
+	}, &groups)
+	if err != nil {
+		return "", err
+	}
+	if len(groups.GroupIds) > 0 {
+		return groups.GroupIds[0], nil
+	}
+	log.Printf("creating security group: %q", cloud.config.SecurityGroup)
+	var created struct {
+		GroupId string `xml:"groupId"`
+	}
+	err = cloud.call(ctx, region, "CreateSecurityGroup", url.Values{
+		"GroupName":        {cloud.config.SecurityGroup},
+		"GroupDescription": {"Docker on EC2"},
+	}, &created)
+	if err != nil {
+		return "", err
+	}
+	port := strconv.Itoa(startupDockerPort)
+	err = cloud.call(ctx, region, "AuthorizeSecurityGroupIngress", url.Values{
+		"GroupId":                           {created.GroupId},
+		"IpPermissions.1.IpProtocol":        {"tcp"},
+		"IpPermissions.1.FromPort":          {"22"},
+		"IpPermissions.1.ToPort":            {"22"},
+		"IpPermissions.1.IpRanges.1.CidrIp": {"0.0.0.0/0"},
+		"IpPermissions.2.IpProtocol":        {"tcp"},
+		"IpPermissions.2.FromPort":          {port},
+		"IpPermissions.2.ToPort":            {port},
+		"IpPermissions.2.Groups.1.GroupId":  {created.GroupId},
+	}, nil)
+	if err != nil && !isEC2Error(err, "InvalidPermission.Duplicate") {
+		return "", err
+	}
+	return created.GroupId, nil
+}
+
+// Return -aws-ami, or else the latest Ubuntu LTS AMI of the region.
+func (cloud AWSCloud) resolveAMI(ctx context.Context, region string) (string, error) {
+	if cloud.config.AMI != "" {
+		return cloud.config.AMI, nil
+	}
+	var resp struct {
+		Images []struct {
+			ImageId      string `xml:"imageId"`
+			CreationDate string `xml:"creationDate"`
+		} `xml:"imagesSet>item"`
+	}
+	err := cloud.call(ctx, region, "DescribeImages", url.Values{
+		"Owner.1":          {canonicalOwnerId},
+		"Filter.1.Name":    {"name"},
+		"Filter.1.Value.1": {ubuntuAMIPattern},
+		"Filter.2.Name":    {"state"},
+		"Filter.2.Value.1": {"available"},
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Images) == 0 {
+		return "", fmt.Errorf("no Ubuntu AMI found in %q, use -aws-ami", region)
+	}
+	latest := resp.Images[0]
+	for _, image := range resp.Images[1:] {
+		// The creation dates are RFC 3339 and sort as strings.
+		if image.CreationDate > latest.CreationDate {
+			latest = image
+		}
+	}
+	log.Printf("using AMI %q", latest.ImageId)
+	return latest.ImageId, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud AWSCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	region := cloud.regionForZone(zone)
+	if err := cloud.ensureKeyPair(ctx, region); err != nil {
+		log.Printf("failed to import key pair: %v", err)
+		return "", err
+	}
+	groupId, err := cloud.getOrCreateSecurityGroup(ctx, region)
+	if err != nil {
+		log.Printf("failed to create security group: %v", err)
+		return "", err
+	}
+	ami, err := cloud.resolveAMI(ctx, region)
+	if err != nil {
+		log.Printf("failed to find AMI: %v", err)
+		return "", err
+	}
+	params := url.Values{
+		"ImageId":                         {ami},
+		"InstanceType":                    {cloud.config.InstanceType},
+		"MinCount":                        {"1"},
+		"MaxCount":                        {"1"},
+		"KeyName":                         {cloud.config.KeyName},
+		"SecurityGroupId.1":               {groupId},
+		"Placement.AvailabilityZone":      {zone},
+		"UserData":                        {base64.StdEncoding.EncodeToString([]byte(script))},
+		"TagSpecification.1.ResourceType": {"instance"},
+		"TagSpecification.1.Tag.1.Key":    {"Name"},
+		"TagSpecification.1.Tag.1.Value":  {name},
+	}
+	if !cloud.config.NoManagedTags {
+		params.Set("TagSpecification.1.Tag.2.Key", managedByLabel)
+		params.Set("TagSpecification.1.Tag.2.Value", "docker-cloud")
+	}
+	log.Printf("starting instance: %q", name)
+	var resp struct {
+		Instances []ec2Instance `xml:"instancesSet>item"`
+	}
+	if err := cloud.call(ctx, region, "RunInstances", params, &resp); err != nil {
+		log.Printf("run instances api call failed: %v", err)
+		if isEC2Error(err, "InstanceLimitExceeded") || isEC2Error(err, "VcpuLimitExceeded") {
+			return "", fmt.Errorf("%w: %v", ErrQuotaExceeded, err)
+		}
+		return "", err
+	}
+	if len(resp.Instances) == 0 {
+		return "", fmt.Errorf("no instance started")
+	}
+	instance, err := cloud.waitForInstance(ctx, resp.Instances[0].InstanceId, region, "running")
+	if err != nil {
+		log.Printf("instance failed to start: %v", err)
+		return "", err
+	}
+	if err := cloud.target(instance.IPAddress).WaitForPort(ctx, startupDockerPort, awsDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("instance started: %q", instance.IPAddress)
+	return instance.IPAddress, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud AWSCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	instance, err := cloud.findInstance(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting instance")
+	region := cloud.regionForZone(zone)
+	err = cloud.call(ctx, region, "TerminateInstances", url.Values{"InstanceId.1": {instance.InstanceId}}, nil)
+	if err != nil {
+		return err
+	}
+	_, err = cloud.waitForInstance(ctx, instance.InstanceId, region, "terminated")
+	log.Print("instance deleted")
+	return err
+}
+
+// Return the ssh login on an instance. EC2 only exposes the host keys in the
+// console output, so they are trusted on first use.
+func (cloud AWSCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: ip, KeyPath: cloud.config.KeyPath, TrustOnFirstUse: true}
+}
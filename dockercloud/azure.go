@@ -0,0 +1,499 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The settings of an Azure Cloud.
+type AzureConfig struct {
+	Options
+	// The Azure subscription id, $AZURE_SUBSCRIPTION_ID when empty.
+	Subscription string
+	// The resource group holding the instances, created if missing.
+	ResourceGroup string
+	// The Azure VM size.
+	VMSize string
+	// The publisher:offer:sku:version image.
+	Image string
+	// The admin user of the instances.
+	SSHUser string
+	// The private key to log into the instances, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	azureManagement = "https://management.azure.com"
+
+	azureResourcesAPIVersion = "2021-04-01"
+	azureNetworkAPIVersion   = "2023-09-01"
+	azureComputeAPIVersion   = "2023-09-01"
+
+	// The network shared by the instances of the resource group.
+	azureNetwork = "docker-cloud"
+
+	azureTimeout       = 10 * time.Minute
+	azureDockerTimeout = 10 * time.Minute
+)
+
+// A Microsoft Azure implementation of the Cloud interface. Zones are Azure
+// locations such as "eastus", and all the resources live in
+// -azure-resource-group.
+type AzureCloud struct {
+	unsupported
+	sshInstances
+
+	subscription string
+	tenantId     string
+	clientId     string
+	clientSecret string
+	client       *http.Client
+	token        *azureToken
+	config       AzureConfig
+}
+
+// The cached OAuth token of the service principal.
+type azureToken struct {
+	sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+// Create an Azure Cloud instance authenticated as the service principal of
+// the standard AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET
+// variables.
+func NewAzureCloud(config AzureConfig) (Cloud, error) {
+	cloud := &AzureCloud{
+		config:       config,
+		subscription: config.Subscription,
+		tenantId:     os.Getenv("AZURE_TENANT_ID"),
+		clientId:     os.Getenv("AZURE_CLIENT_ID"),
+		clientSecret: os.Getenv("AZURE_CLIENT_SECRET"),
+		client:       &http.Client{Timeout: 60 * time.Second},
+		token:        &azureToken{},
+	}
+	if cloud.subscription == "" {
+		cloud.subscription = os.Getenv("AZURE_SUBSCRIPTION_ID")
+	}
+	if cloud.subscription == "" || cloud.tenantId == "" || cloud.clientId == "" || cloud.clientSecret == "" {
+		return nil, errors.New("-azure-subscription, AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET must be set")
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// An error returned by the Azure Resource Manager API.
+type azureError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *azureError) Error() string {
+	return fmt.Sprintf("azure: %s: %s", e.Code, e.Message)
+}
+
+// Report whether err is a missing resource error.
+func isAzureNotFound(err error) bool {
+	var e *azureError
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// Return a valid access token for the management API.
+func (cloud AzureCloud) accessToken(ctx context.Context) (string, error) {
+	cloud.token.Lock()
+	defer cloud.token.Unlock()
+	if time.Now().Before(cloud.token.expiry) {
+		return cloud.token.accessToken, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {cloud.clientId},
+		"client_secret": {cloud.clientSecret},
+		"scope":         {azureManagement + "/.default"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://login.microsoftonline.com/"+cloud.tenantId+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("azure authentication failed: %s", token.ErrorDescription)
+	}
+	cloud.token.accessToken = token.AccessToken
+	// Renew a minute early to not race the expiry.
+	cloud.token.expiry = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	return token.AccessToken, nil
+}
+
+// Return the id of a resource of the resource group, such as
+// "Microsoft.Compute/virtualMachines/name".
+func (cloud AzureCloud) resourceId(resource string) string {
+	id := "/subscriptions/" + cloud.subscription + "/resourceGroups/" + cloud.config.ResourceGroup
+	if resource != "" {
+		id += "/providers/" + resource
+	}
+	return id
+}
+
+// Call the Azure Resource Manager API on a resource id, encoding body and
+// decoding the response into result when not nil.
+func (cloud AzureCloud) call(ctx context.Context, method, id, apiVersion string, body, result interface{}) error {
+	token, err := cloud.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, azureManagement+id+"?api-version="+apiVersion, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var errResp struct {
+			Error azureError `json:"error"`
+		}
+		json.Unmarshal(data, &errResp)
+		errResp.Error.StatusCode = resp.StatusCode
+		if errResp.Error.Code == "" {
+			errResp.Error.Code = resp.Status
+		}
+		return &errResp.Error
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// The fields of a resource docker-cloud relies on.
+type azureResource struct {
+	Id         string `json:"id"`
+	Location   string `json:"location"`
+	Properties struct {
+		ProvisioningState string `json:"provisioningState"`
+		IPAddress         string `json:"ipAddress"`
+	} `json:"properties"`
+}
+
+// Create or update a resource and wait for its provisioning. Returns the
+// provisioned resource.
+func (cloud AzureCloud) put(ctx context.Context, id, apiVersion string, body interface{}) (*azureResource, error) {
+	if err := cloud.call(ctx, "PUT", id, apiVersion, body, nil); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(azureTimeout)
+	for {
+		resource := &azureResource{}
+		if err := cloud.call(ctx, "GET", id, apiVersion, nil, resource); err != nil {
+			return nil, err
+		}
+		switch resource.Properties.ProvisioningState {
+		case "Succeeded":
+			return resource, nil
+		case "Failed", "Canceled":
+			return nil, fmt.Errorf("provisioning %s: %s", id, resource.Properties.ProvisioningState)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w provisioning %s", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Delete a resource and wait until it is gone.
+func (cloud AzureCloud) delete(ctx context.Context, id, apiVersion string) error {
+	err := cloud.call(ctx, "DELETE", id, apiVersion, nil, nil)
+	if isAzureNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(azureTimeout)
+	for {
+		err := cloud.call(ctx, "GET", id, apiVersion, nil, nil)
+		if isAzureNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w deleting %s", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func azureVMId(name string) string {
+	return "Microsoft.Compute/virtualMachines/" + name
+}
+
+func azurePublicIPId(name string) string {
+	return "Microsoft.Network/publicIPAddresses/" + name + "-ip"
+}
+
+func azureNICId(name string) string {
+	return "Microsoft.Network/networkInterfaces/" + name + "-nic"
+}
+
+// Implementation of the Cloud interface
+func (cloud AzureCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	vm := &azureResource{}
+	err := cloud.call(ctx, "GET", cloud.resourceId(azureVMId(name)), azureComputeAPIVersion, nil, vm)
+	if isAzureNotFound(err) {
+		return "", fmt.Errorf("%w: instance %q", ErrInstanceNotFound, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if vm.Location != zone {
+		return "", fmt.Errorf("%w: instance %q in %q", ErrInstanceNotFound, name, zone)
+	}
+	ip := &azureResource{}
+	if err := cloud.call(ctx, "GET", cloud.resourceId(azurePublicIPId(name)), azureNetworkAPIVersion, nil, ip); err != nil {
+		return "", err
+	}
+	return ip.Properties.IPAddress, nil
+}
+
+// Create the resource group, network and network security group shared by
+// the instances of a location. The security group lets ssh in from anywhere
+// and the docker port only from the network. Returns the subnet and network
+// security group ids.
+func (cloud AzureCloud) ensureNetwork(ctx context.Context, zone string) (string, string, error) {
+	_, err := cloud.put(ctx, cloud.resourceId(""), azureResourcesAPIVersion, map[string]interface{}{
+		"location": zone,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	// Network resources are regional, keep one set per location.
+	network := azureNetwork + "-" + zone
+	vnet, err := cloud.put(ctx, cloud.resourceId("Microsoft.Network/virtualNetworks/"+network), azureNetworkAPIVersion, map[string]interface{}{
+		"location": zone,
+		"properties": map[string]interface{}{
+			"addressSpace": map[string]interface{}{"addressPrefixes": []string{"10.0.0.0/16"}},
+			"subnets": []map[string]interface{}{
+				{"name": "default", "properties": map[string]string{"addressPrefix": "10.0.0.0/24"}},
+			},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	rule := func(name, port, source string, priority int) map[string]interface{} {
+		return map[string]interface{}{
+			"name": name,
+			"properties": map[string]interface{}{
+				"protocol":                 "Tcp",
+				"sourcePortRange":          "*",
+				"destinationPortRange":     port,
+				"sourceAddressPrefix":      source,
+				"destinationAddressPrefix": "*",
+				"access":                   "Allow",
+				"priority":                 priority,
+				"direction":                "Inbound",
+			},
+		}
+	}
+	nsg, err := cloud.put(ctx, cloud.resourceId("Microsoft.Network/networkSecurityGroups/"+network), azureNetworkAPIVersion, map[string]interface{}{
+		"location": zone,
+		"properties": map[string]interface{}{
+			"securityRules": []map[string]interface{}{
+				rule("ssh", "22", "*", 1000),
+				rule("docker", fmt.Sprint(startupDockerPort), "VirtualNetwork", 1010),
+			},
+		},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return vnet.Id + "/subnets/default", nsg.Id, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud AzureCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	image := strings.Split(cloud.config.Image, ":")
+	if len(image) != 4 {
+		return "", fmt.Errorf("invalid -azure-image %q, want publisher:offer:sku:version", cloud.config.Image)
+	}
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		log.Printf("failed to get ssh key: %v", err)
+		return "", err
+	}
+	subnet, nsg, err := cloud.ensureNetwork(ctx, zone)
+	if err != nil {
+		log.Printf("failed to create network: %v", err)
+		return "", err
+	}
+	ip, err := cloud.put(ctx, cloud.resourceId(azurePublicIPId(name)), azureNetworkAPIVersion, map[string]interface{}{
+		"location":   zone,
+		"sku":        map[string]string{"name": "Standard"},
+		"properties": map[string]string{"publicIPAllocationMethod": "Static"},
+	})
+	if err != nil {
+		log.Printf("failed to create public IP: %v", err)
+		return "", err
+	}
+	nic, err := cloud.put(ctx, cloud.resourceId(azureNICId(name)), azureNetworkAPIVersion, map[string]interface{}{
+		"location": zone,
+		"properties": map[string]interface{}{
+			"networkSecurityGroup": map[string]string{"id": nsg},
+			"ipConfigurations": []map[string]interface{}{{
+				"name": "ipconfig",
+				"properties": map[string]interface{}{
+					"subnet":          map[string]string{"id": subnet},
+					"publicIPAddress": map[string]string{"id": ip.Id},
+				},
+			}},
+		},
+	})
+	if err != nil {
+		log.Printf("failed to create network interface: %v", err)
+		return "", err
+	}
+	tags := map[string]string{}
+	if !cloud.config.NoManagedTags {
+		tags[managedByLabel] = "docker-cloud"
+	}
+	log.Printf("starting instance: %q", name)
+	_, err = cloud.put(ctx, cloud.resourceId(azureVMId(name)), azureComputeAPIVersion, map[string]interface{}{
+		"location": zone,
+		"tags":     tags,
+		"properties": map[string]interface{}{
+			"hardwareProfile": map[string]string{"vmSize": cloud.config.VMSize},
+			"storageProfile": map[string]interface{}{
+				"imageReference": map[string]string{
+					"publisher": image[0],
+					"offer":     image[1],
+					"sku":       image[2],
+					"version":   image[3],
+				},
+				"osDisk": map[string]interface{}{
+					"createOption": "FromImage",
+					"deleteOption": "Delete",
+					"managedDisk":  map[string]string{"storageAccountType": "StandardSSD_LRS"},
+				},
+			},
+			"osProfile": map[string]interface{}{
+				"computerName":  name,
+				"adminUsername": cloud.config.SSHUser,
+				// cloud-init runs the startup script from the custom data.
+				"customData": base64.StdEncoding.EncodeToString([]byte(script)),
+				"linuxConfiguration": map[string]interface{}{
+					"disablePasswordAuthentication": true,
+					"ssh": map[string]interface{}{
+						"publicKeys": []map[string]string{{
+							"path":    "/home/" + cloud.config.SSHUser + "/.ssh/authorized_keys",
+							"keyData": strings.TrimSpace(string(publicKey)),
+						}},
+					},
+				},
+			},
+			"networkProfile": map[string]interface{}{
+				"networkInterfaces": []map[string]string{{"id": nic.Id}},
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("instance create api call failed: %v", err)
+		return "", err
+	}
+	if err := cloud.target(ip.Properties.IPAddress).WaitForPort(ctx, startupDockerPort, azureDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("instance started: %q", ip.Properties.IPAddress)
+	return ip.Properties.IPAddress, nil
+}
+
+// Implementation of the Cloud interface. The network interface and public IP
+// of the instance are deleted along.
+func (cloud AzureCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	if _, err := cloud.GetPublicIPAddress(ctx, name, zone); err != nil {
+		return err
+	}
+	log.Print("deleting instance")
+	if err := cloud.delete(ctx, cloud.resourceId(azureVMId(name)), azureComputeAPIVersion); err != nil {
+		return err
+	}
+	if err := cloud.delete(ctx, cloud.resourceId(azureNICId(name)), azureNetworkAPIVersion); err != nil {
+		return err
+	}
+	if err := cloud.delete(ctx, cloud.resourceId(azurePublicIPId(name)), azureNetworkAPIVersion); err != nil {
+		return err
+	}
+	log.Print("instance deleted")
+	return nil
+}
+
+// Return the ssh login on an instance, whose host keys are trusted on first use.
+func (cloud AzureCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -15,24 +15,196 @@
 package dockercloud
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"os"
+	"time"
 )
 
+// The version of docker-cloud.
+const Version = "0.1.0"
+
+// Returned by operations that can only be applied to a stopped instance.
+var ErrInstanceMustBeStopped = errors.New("the instance must be stopped")
+
+// Returned by the Cloud methods a provider doesn't implement.
+var ErrNotSupported = errors.New("not supported by this provider")
+
+// Errors wrapped by the Cloud methods of all the providers, to be told apart
+// with errors.Is.
+var (
+	ErrInstanceNotFound = errors.New("instance not found")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+	// The zone has no capacity left for the machine type.
+	ErrZoneExhausted    = errors.New("zone out of capacity")
+	ErrOperationTimeout = errors.New("operation timed out")
+)
+
+// The power state of an instance, the same for all the providers.
+type InstanceStatus string
+
+const (
+	// Being created or started.
+	StatusProvisioning InstanceStatus = "PROVISIONING"
+	StatusRunning      InstanceStatus = "RUNNING"
+	// Powered off or being powered off, keeping its disks.
+	StatusStopped InstanceStatus = "STOPPED"
+	// Being deleted.
+	StatusTerminated InstanceStatus = "TERMINATED"
+)
+
+// An instance as described by DescribeInstance and ListInstances.
+type Instance struct {
+	Name         string
+	Zone         string
+	Status       InstanceStatus
+	PublicIP     string
+	PrivateIP    string
+	MachineType  string
+	CreationTime time.Time
+	// When the instance last booted, zero on the providers that don't tell.
+	LastStartTime time.Time
+	// Nil on the providers without labels.
+	Labels map[string]string
+}
+
+// The optional features of a provider, for the CLI to turn down the commands
+// a provider can't run up front.
+type Capabilities struct {
+	// ListInstances and DescribeInstance.
+	ListInstances bool
+	// StopInstance and StartInstance.
+	StopStart bool
+	// ResizeInstance.
+	Resize bool
+	// Snapshots of the instance disks.
+	Snapshots bool
+	// Reserved public IP addresses kept across instances.
+	StaticIPs bool
+	// Instances with GPUs attached.
+	GPUs bool
+	// Preemptible or spot instances.
+	Preemptible bool
+}
+
+// The settings of the instances created by CreateInstance. The machine type,
+// image and root disk are only read by GCE, the other providers take them from
+// their own configs, such as AWSConfig.
+type InstanceSpec struct {
+	// The machine type, as in /zones/us-central1-a/machineTypes/n1-standard-1.
+	MachineType string
+	// The image to boot from.
+	Image string
+	// The snapshot to create the root disk from instead of Image.
+	Snapshot string
+	// The name and size of the root disk, kept across instances.
+	DiskName   string
+	DiskSizeGb int64
+	// The Docker version to install, empty for the latest.
+	DockerVersion string
+	// The containerd snapshotter of the containerd image store, empty for
+	// the classic image store.
+	Snapshotter string
+	// Pass the startup script base64 encoded across several metadata values
+	// to bypass the metadata value size limit.
+	StartupScriptBase64 bool
+}
+
 // The Cloud interface provides the contract that cloud providers should implement to enable
-// running Docker containers in their cloud.
+// running Docker containers in their cloud.  The context of every method bounds the operation;
+// tunnels outlive it once they are open.
 // TODO(bburns): Restructure this into Cloud, Instance and Tunnel interfaces
 type Cloud interface {
 	// GetPublicIPAddress returns the stringified address (e.g "1.2.3.4") of the runtime
-	GetPublicIPAddress(name string, zone string) (string, error)
+	GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error)
 
-	// CreateInstance creates a virtual machine instance given a name and a zone.  Returns the
-	// IP address of the instance.  Waits until Docker is up and functioning on the machine
-	// before returning.
-	CreateInstance(name string, zone string) (string, error)
+	// CreateInstance creates a virtual machine instance given a name, a zone and the spec of
+	// the instance.  Returns the IP address of the instance.  Waits until Docker is up and
+	// functioning on the machine before returning.
+	CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error)
 
 	// DeleteInstance deletes a virtual machine instance, given the instance name and zone.
-	DeleteInstance(name string, zone string) error
+	DeleteInstance(ctx context.Context, name string, zone string) error
 
 	// Open a secure tunnel (generally SSH) between the local host and a remote host.
-	OpenSecureTunnel(name string, zone string, localPort int, remotePort int) (*os.Process, error)
+	OpenSecureTunnel(ctx context.Context, name string, zone string, localPort int, remotePort int) (*os.Process, error)
+
+	// RunCommand runs a shell command on the instance over the secure channel and returns
+	// its standard output.
+	RunCommand(ctx context.Context, name string, zone string, command string) (string, error)
+
+	// ListInstances returns the instances created by docker-cloud in a zone, or in all the
+	// zones when zone is empty.
+	ListInstances(ctx context.Context, zone string) ([]Instance, error)
+
+	// StopInstance powers off an instance, keeping its disks so that it can be started again.
+	StopInstance(ctx context.Context, name string, zone string) error
+
+	// StartInstance powers on a stopped instance.  Returns its IP address, which may have
+	// changed, once Docker is up.
+	StartInstance(ctx context.Context, name string, zone string) (string, error)
+
+	// DescribeInstance returns the state of an instance, or an error if it doesn't exist.
+	DescribeInstance(ctx context.Context, name string, zone string) (*Instance, error)
+
+	// ResizeInstance changes the machine type of an instance, keeping its disks.  A running
+	// instance is stopped and started again, possibly with another IP address.
+	ResizeInstance(ctx context.Context, name string, zone string, machineType string) error
+
+	// Capabilities returns the optional features the provider supports.
+	Capabilities() Capabilities
+}
+
+// Run the startup script of the spec again on an existing instance, over
+// the secure channel, to repair a failed first boot or a configuration gone
+// astray. Docker is reinstalled and restarted, the containers and images are
+// kept.
+func ProvisionInstance(ctx context.Context, cloud Cloud, name, zone string, spec InstanceSpec) error {
+	script, err := startupScript(spec)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(script))
+	_, err = cloud.RunCommand(ctx, name, zone, fmt.Sprintf("echo %s | base64 -d | sudo bash", encoded))
+	return err
+}
+
+// Sleep for d, or until ctx is done. Returns the error of ctx in that case.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Embedded by the providers to implement the Cloud methods they don't
+// support, which return ErrNotSupported.
+type unsupported struct{}
+
+func (unsupported) ListInstances(ctx context.Context, zone string) ([]Instance, error) {
+	return nil, fmt.Errorf("listing instances: %w", ErrNotSupported)
+}
+
+func (unsupported) StopInstance(ctx context.Context, name, zone string) error {
+	return fmt.Errorf("stopping instances: %w", ErrNotSupported)
+}
+
+func (unsupported) StartInstance(ctx context.Context, name, zone string) (string, error) {
+	return "", fmt.Errorf("starting instances: %w", ErrNotSupported)
+}
+
+func (unsupported) DescribeInstance(ctx context.Context, name, zone string) (*Instance, error) {
+	return nil, fmt.Errorf("describing instances: %w", ErrNotSupported)
+}
+
+func (unsupported) ResizeInstance(ctx context.Context, name, zone, machineType string) error {
+	return fmt.Errorf("resizing instances: %w", ErrNotSupported)
+}
+
+func (unsupported) Capabilities() Capabilities {
+	return Capabilities{}
 }
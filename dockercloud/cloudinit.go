@@ -0,0 +1,134 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The cloud-config authorizing the ssh key of the default user and running
+// the startup script on first boot.
+const cloudConfig = `#cloud-config
+hostname: %s
+ssh_authorized_keys:
+  - %s
+write_files:
+  - path: /var/lib/docker-cloud/startup.sh
+    permissions: '0755'
+    encoding: b64
+    content: %s
+runcmd:
+  - /var/lib/docker-cloud/startup.sh
+`
+
+// Write a cloud-init NoCloud seed ISO to dir/seed.iso, for local VMs that
+// have no metadata server. Returns the path of the ISO.
+func writeCloudInitSeed(dir, hostname, publicKey, script string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	userData := fmt.Sprintf(cloudConfig, hostname, strings.TrimSpace(publicKey), base64.StdEncoding.EncodeToString([]byte(script)))
+	metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", hostname, hostname)
+	for name, content := range map[string]string{"user-data": userData, "meta-data": metaData} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			return "", err
+		}
+	}
+	iso := filepath.Join(dir, "seed.iso")
+	os.Remove(iso)
+	files := []string{filepath.Join(dir, "user-data"), filepath.Join(dir, "meta-data")}
+	// The volume label must be "cidata" for cloud-init to find the seed.
+	var cmd *exec.Cmd
+	switch {
+	case lookPath("genisoimage"):
+		cmd = exec.Command("genisoimage", append([]string{"-quiet", "-output", iso, "-volid", "cidata", "-joliet", "-rock"}, files...)...)
+	case lookPath("mkisofs"):
+		cmd = exec.Command("mkisofs", append([]string{"-quiet", "-output", iso, "-volid", "cidata", "-joliet", "-rock"}, files...)...)
+	case lookPath("hdiutil"):
+		seed := filepath.Join(dir, "seed")
+		if err := os.MkdirAll(seed, 0700); err != nil {
+			return "", err
+		}
+		for _, f := range files {
+			if err := os.Rename(f, filepath.Join(seed, filepath.Base(f))); err != nil {
+				return "", err
+			}
+		}
+		cmd = exec.Command("hdiutil", "makehybrid", "-quiet", "-o", iso, "-iso", "-joliet", "-default-volume-name", "cidata", seed)
+	default:
+		return "", fmt.Errorf("genisoimage, mkisofs or hdiutil is required to build the cloud-init seed")
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to build the cloud-init seed: %v", err)
+	}
+	return iso, nil
+}
+
+// Download the image at url into dir if missing. Returns its path.
+func downloadImage(ctx context.Context, url, dir string) (string, error) {
+	image := filepath.Join(dir, path.Base(url))
+	if _, err := os.Stat(image); err == nil {
+		return image, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	log.Printf("downloading %q", url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %q: %s", url, resp.Status)
+	}
+	// Download next to the image to not leave a truncated one behind.
+	tmp := image + ".download"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return image, os.Rename(tmp, image)
+}
+
+// Report whether a command is in the PATH.
+func lookPath(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
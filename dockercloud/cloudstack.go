@@ -0,0 +1,449 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The settings of a CloudStack Cloud.
+type CloudStackConfig struct {
+	Options
+	// The CloudStack API URL, $CLOUDSTACK_API_URL when empty.
+	URL string
+	// The CloudStack API key, $CLOUDSTACK_API_KEY when empty.
+	APIKey string
+	// The CloudStack secret key, $CLOUDSTACK_SECRET_KEY when empty.
+	SecretKey string
+	// The service offering name.
+	ServiceOffering string
+	// The template name, with cloud-init.
+	Template string
+	// The isolated network of the VMs, reached through a public IP port forwarding, the zone network when empty.
+	Network string
+	// The SSH key pair to log into the VMs.
+	KeyPair string
+	// The user to log into the VMs.
+	SSHUser string
+	// The private key of -cloudstack-key-pair, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	csJobTimeout    = 10 * time.Minute
+	csDockerTimeout = 10 * time.Minute
+)
+
+// An Apache CloudStack implementation of the Cloud interface. Zones are
+// CloudStack zone names. With -cloudstack-network the VMs are reached
+// through a public IP forwarding the ssh port, else through their own
+// address as in basic zones.
+type CloudStackCloud struct {
+	unsupported
+	sshInstances
+
+	endpoint  string
+	apiKey    string
+	secretKey string
+	client    *http.Client
+	config    CloudStackConfig
+}
+
+// Create a CloudStack Cloud instance.
+func NewCloudStackCloud(config CloudStackConfig) (Cloud, error) {
+	cloud := &CloudStackCloud{
+		config:    config,
+		endpoint:  config.URL,
+		apiKey:    config.APIKey,
+		secretKey: config.SecretKey,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}
+	if cloud.endpoint == "" {
+		cloud.endpoint = os.Getenv("CLOUDSTACK_API_URL")
+	}
+	if cloud.apiKey == "" {
+		cloud.apiKey = os.Getenv("CLOUDSTACK_API_KEY")
+	}
+	if cloud.secretKey == "" {
+		cloud.secretKey = os.Getenv("CLOUDSTACK_SECRET_KEY")
+	}
+	if cloud.endpoint == "" || cloud.apiKey == "" || cloud.secretKey == "" {
+		return nil, errors.New("-cloudstack-url, -cloudstack-api-key and -cloudstack-secret-key must be set")
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call a CloudStack API command and decode its response object into result.
+func (cloud CloudStackCloud) call(ctx context.Context, command string, params url.Values, result interface{}) error {
+	params.Set("command", command)
+	params.Set("apikey", cloud.apiKey)
+	params.Set("response", "json")
+	params.Set("signature", cloud.sign(params))
+	// Posted as a form for the user data to not hit the URL length limits.
+	req, err := http.NewRequestWithContext(ctx, "POST", cloud.endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &apiError{Provider: "cloudstack", StatusCode: resp.StatusCode, Message: apiErrorMessage(data)}
+	}
+	// The response is wrapped in a "<command>response" object.
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal(data, &wrapper); err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(wrapper[strings.ToLower(command)+"response"], result)
+}
+
+// Sign the request parameters: the HMAC-SHA1 of the sorted, lower cased
+// query string.
+func (cloud CloudStackCloud) sign(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := strings.Replace(url.QueryEscape(params.Get(key)), "+", "%20", -1)
+		pairs[i] = key + "=" + value
+	}
+	mac := hmac.New(sha1.New, []byte(cloud.secretKey))
+	mac.Write([]byte(strings.ToLower(strings.Join(pairs, "&"))))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Call an asynchronous command and wait for its job, decoding the job
+// result into result.
+func (cloud CloudStackCloud) callAsync(ctx context.Context, command string, params url.Values, result interface{}) error {
+	var job struct {
+		JobId string `json:"jobid"`
+	}
+	if err := cloud.call(ctx, command, params, &job); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(csJobTimeout)
+	for {
+		var status struct {
+			JobStatus int             `json:"jobstatus"`
+			JobResult json.RawMessage `json:"jobresult"`
+		}
+		if err := cloud.call(ctx, "queryAsyncJobResult", url.Values{"jobid": {job.JobId}}, &status); err != nil {
+			return err
+		}
+		switch status.JobStatus {
+		case 1:
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(status.JobResult, result)
+		case 2:
+			return fmt.Errorf("cloudstack %s failed: %s", command, apiErrorMessage(status.JobResult))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w waiting for cloudstack %s", ErrOperationTimeout, command)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Return the id of the resource listed by command with the given name.
+func (cloud CloudStackCloud) lookup(ctx context.Context, command, key, name string, params url.Values) (string, error) {
+	params.Set("name", name)
+	var resp map[string]json.RawMessage
+	if err := cloud.call(ctx, command, params, &resp); err != nil {
+		return "", err
+	}
+	var items []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if raw, ok := resp[key]; ok {
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return "", err
+		}
+	}
+	// The name filter also matches substrings.
+	for _, item := range items {
+		if item.Name == name {
+			return item.Id, nil
+		}
+	}
+	return "", fmt.Errorf("%s %q not found", key, name)
+}
+
+type csVirtualMachine struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Nic   []struct {
+		IPAddress string `json:"ipaddress"`
+	} `json:"nic"`
+}
+
+// Find the VM with the given name in a zone.
+func (cloud CloudStackCloud) findVM(ctx context.Context, name, zone string) (*csVirtualMachine, error) {
+	zoneId, err := cloud.lookup(ctx, "listZones", "zone", zone, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		VirtualMachines []csVirtualMachine `json:"virtualmachine"`
+	}
+	if err := cloud.call(ctx, "listVirtualMachines", url.Values{"name": {name}, "zoneid": {zoneId}}, &resp); err != nil {
+		return nil, err
+	}
+	for _, vm := range resp.VirtualMachines {
+		if vm.Name == name {
+			return &vm, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: vm %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// The port forwarding rule of the ssh port of a VM.
+type csPortForwarding struct {
+	IPAddress   string `json:"ipaddress"`
+	IPAddressId string `json:"ipaddressid"`
+}
+
+// Return the ssh port forwarding rule of a VM, nil if it has none.
+func (cloud CloudStackCloud) findPortForwarding(ctx context.Context, vmId string) (*csPortForwarding, error) {
+	var resp struct {
+		Rules []struct {
+			csPortForwarding
+			VirtualMachineId string `json:"virtualmachineid"`
+			PrivatePort      string `json:"privateport"`
+		} `json:"portforwardingrule"`
+	}
+	if err := cloud.call(ctx, "listPortForwardingRules", url.Values{"listall": {"true"}}, &resp); err != nil {
+		return nil, err
+	}
+	for _, rule := range resp.Rules {
+		if rule.VirtualMachineId == vmId && rule.PrivatePort == "22" {
+			return &rule.csPortForwarding, nil
+		}
+	}
+	return nil, nil
+}
+
+// Implementation of the Cloud interface. On isolated networks, this is the
+// public IP forwarding the ssh port.
+func (cloud CloudStackCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	vm, err := cloud.findVM(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	if cloud.config.Network == "" {
+		if len(vm.Nic) == 0 {
+			return "", fmt.Errorf("vm %q has no network interface", name)
+		}
+		return vm.Nic[0].IPAddress, nil
+	}
+	rule, err := cloud.findPortForwarding(ctx, vm.Id)
+	if err != nil || rule == nil {
+		return "", err
+	}
+	return rule.IPAddress, nil
+}
+
+// Register the -cloudstack-ssh-key-path public key as -cloudstack-key-pair,
+// generating the key pair first if needed.
+func (cloud CloudStackCloud) ensureKeyPair(ctx context.Context) error {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		KeyPairs []struct {
+			Name string `json:"name"`
+		} `json:"sshkeypair"`
+	}
+	if err := cloud.call(ctx, "listSSHKeyPairs", url.Values{"name": {cloud.config.KeyPair}}, &resp); err != nil {
+		return err
+	}
+	if len(resp.KeyPairs) > 0 {
+		return nil
+	}
+	log.Printf("registering ssh key pair: %q", cloud.config.KeyPair)
+	return cloud.call(ctx, "registerSSHKeyPair", url.Values{
+		"name":      {cloud.config.KeyPair},
+		"publickey": {strings.TrimSpace(string(publicKey))},
+	}, nil)
+}
+
+// Acquire a public IP on the network and forward its ssh port to the VM.
+// Returns the public IP.
+func (cloud CloudStackCloud) forwardSSH(ctx context.Context, networkId, vmId string) (string, error) {
+	var ip struct {
+		IPAddress struct {
+			Id        string `json:"id"`
+			IPAddress string `json:"ipaddress"`
+		} `json:"ipaddress"`
+	}
+	if err := cloud.callAsync(ctx, "associateIpAddress", url.Values{"networkid": {networkId}}, &ip); err != nil {
+		return "", err
+	}
+	ipId := ip.IPAddress.Id
+	err := cloud.callAsync(ctx, "createFirewallRule", url.Values{
+		"ipaddressid": {ipId},
+		"protocol":    {"tcp"},
+		"startport":   {"22"},
+		"endport":     {"22"},
+		"cidrlist":    {"0.0.0.0/0"},
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	err = cloud.callAsync(ctx, "createPortForwardingRule", url.Values{
+		"ipaddressid":      {ipId},
+		"protocol":         {"tcp"},
+		"publicport":       {"22"},
+		"privateport":      {"22"},
+		"virtualmachineid": {vmId},
+		"openfirewall":     {"false"},
+	}, nil)
+	return ip.IPAddress.IPAddress, err
+}
+
+// Implementation of the Cloud interface
+func (cloud CloudStackCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// Basic zones may put the VMs directly on the internet.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	if err := cloud.ensureKeyPair(ctx); err != nil {
+		log.Printf("failed to register key pair: %v", err)
+		return "", err
+	}
+	zoneId, err := cloud.lookup(ctx, "listZones", "zone", zone, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	offeringId, err := cloud.lookup(ctx, "listServiceOfferings", "serviceoffering", cloud.config.ServiceOffering, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	templateId, err := cloud.lookup(ctx, "listTemplates", "template", cloud.config.Template, url.Values{
+		"templatefilter": {"executable"},
+		"zoneid":         {zoneId},
+	})
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"name":              {name},
+		"displayname":       {name},
+		"zoneid":            {zoneId},
+		"serviceofferingid": {offeringId},
+		"templateid":        {templateId},
+		"keypair":           {cloud.config.KeyPair},
+		"userdata":          {base64.StdEncoding.EncodeToString([]byte(script))},
+	}
+	networkId := ""
+	if cloud.config.Network != "" {
+		networkId, err = cloud.lookup(ctx, "listNetworks", "network", cloud.config.Network, url.Values{"zoneid": {zoneId}})
+		if err != nil {
+			return "", err
+		}
+		params.Set("networkids", networkId)
+	}
+	log.Printf("deploying vm: %q", name)
+	var deployed struct {
+		VirtualMachine csVirtualMachine `json:"virtualmachine"`
+	}
+	if err := cloud.callAsync(ctx, "deployVirtualMachine", params, &deployed); err != nil {
+		log.Printf("vm deploy failed: %v", err)
+		return "", err
+	}
+	vm := deployed.VirtualMachine
+	var ip string
+	if networkId != "" {
+		ip, err = cloud.forwardSSH(ctx, networkId, vm.Id)
+		if err != nil {
+			log.Printf("failed to forward ssh: %v", err)
+			return "", err
+		}
+	} else if len(vm.Nic) > 0 {
+		ip = vm.Nic[0].IPAddress
+	}
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, csDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("vm deployed: %q", ip)
+	return ip, nil
+}
+
+// Implementation of the Cloud interface. The public IP forwarding the ssh
+// port is released along.
+func (cloud CloudStackCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	vm, err := cloud.findVM(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	rule, err := cloud.findPortForwarding(ctx, vm.Id)
+	if err != nil {
+		return err
+	}
+	log.Print("destroying vm")
+	if err := cloud.callAsync(ctx, "destroyVirtualMachine", url.Values{"id": {vm.Id}, "expunge": {"true"}}, nil); err != nil {
+		return err
+	}
+	if rule != nil {
+		if err := cloud.callAsync(ctx, "disassociateIpAddress", url.Values{"id": {rule.IPAddressId}}, nil); err != nil {
+			return err
+		}
+	}
+	log.Print("vm destroyed")
+	return nil
+}
+
+// Return the ssh login on a VM, whose host keys are trusted on first use.
+func (cloud CloudStackCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
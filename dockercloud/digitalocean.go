@@ -0,0 +1,278 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The settings of a DigitalOcean Cloud.
+type DOConfig struct {
+	Options
+	// The DigitalOcean API token, $DIGITALOCEAN_TOKEN when empty.
+	Token string
+	// The droplet size.
+	Size string
+	// The droplet image.
+	Image string
+	// The private key to log into the droplets, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	doAPI = "https://api.digitalocean.com/v2"
+
+	// The tag of the droplets created by docker-cloud, the firewall applies to it.
+	doTag      = "docker-cloud"
+	doFirewall = "docker-cloud"
+
+	doDropletTimeout = 5 * time.Minute
+	doDockerTimeout  = 10 * time.Minute
+)
+
+// A DigitalOcean implementation of the Cloud interface. Zones are
+// DigitalOcean regions such as "nyc3".
+type DOCloud struct {
+	unsupported
+	sshInstances
+
+	token  string
+	client *http.Client
+	config DOConfig
+}
+
+// Create a DigitalOcean Cloud instance.
+func NewDOCloud(config DOConfig) (Cloud, error) {
+	token := config.Token
+	if token == "" {
+		token = os.Getenv("DIGITALOCEAN_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.New("-do-token or DIGITALOCEAN_TOKEN must be set")
+	}
+	cloud := &DOCloud{token: token, client: &http.Client{Timeout: 30 * time.Second}, config: config}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+type doDroplet struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Region struct {
+		Slug string `json:"slug"`
+	} `json:"region"`
+	Networks struct {
+		V4 []struct {
+			IPAddress string `json:"ip_address"`
+			Type      string `json:"type"`
+		} `json:"v4"`
+	} `json:"networks"`
+}
+
+// Return the public IPv4 address of the droplet, empty until it is assigned.
+func (d doDroplet) publicIP() string {
+	for _, n := range d.Networks.V4 {
+		if n.Type == "public" {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+// Call the DigitalOcean API, encoding body and decoding the response into
+// result when not nil.
+func (cloud DOCloud) call(ctx context.Context, method, path string, body, result interface{}) error {
+	header := http.Header{"Authorization": {"Bearer " + cloud.token}}
+	return callJSON(ctx, cloud.client, "digitalocean", method, doAPI+path, header, body, result)
+}
+
+// Find the droplet with the given name in a region.
+func (cloud DOCloud) findDroplet(ctx context.Context, name, zone string) (*doDroplet, error) {
+	var resp struct {
+		Droplets []doDroplet `json:"droplets"`
+	}
+	if err := cloud.call(ctx, "GET", "/droplets?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, d := range resp.Droplets {
+		if d.Region.Slug == zone {
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: droplet %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud DOCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	droplet, err := cloud.findDroplet(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return droplet.publicIP(), nil
+}
+
+// Register the -do-ssh-key-path public key, generating the key pair first if
+// needed. Returns the key fingerprint.
+func (cloud DOCloud) ensureSSHKey(ctx context.Context) (string, error) {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return "", err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	fingerprint := ssh.FingerprintLegacyMD5(key)
+	if cloud.call(ctx, "GET", "/account/keys/"+fingerprint, nil, nil) == nil {
+		return fingerprint, nil
+	}
+	log.Printf("registering ssh key: %q", fingerprint)
+	err = cloud.call(ctx, "POST", "/account/keys", map[string]string{
+		"name":       "docker-cloud",
+		"public_key": strings.TrimSpace(string(publicKey)),
+	}, nil)
+	return fingerprint, err
+}
+
+// Create the firewall of the docker-cloud droplets if missing, only allowing
+// ssh in so that docker is only reached through the tunnel.
+func (cloud DOCloud) ensureFirewall(ctx context.Context) error {
+	var resp struct {
+		Firewalls []struct {
+			Name string `json:"name"`
+		} `json:"firewalls"`
+	}
+	if err := cloud.call(ctx, "GET", "/firewalls?per_page=200", nil, &resp); err != nil {
+		return err
+	}
+	for _, f := range resp.Firewalls {
+		if f.Name == doFirewall {
+			return nil
+		}
+	}
+	anywhere := map[string][]string{"addresses": {"0.0.0.0/0", "::/0"}}
+	log.Printf("creating firewall: %q", doFirewall)
+	return cloud.call(ctx, "POST", "/firewalls", map[string]interface{}{
+		"name": doFirewall,
+		"tags": []string{doTag},
+		"inbound_rules": []map[string]interface{}{
+			{"protocol": "tcp", "ports": "22", "sources": anywhere},
+		},
+		"outbound_rules": []map[string]interface{}{
+			{"protocol": "tcp", "ports": "all", "destinations": anywhere},
+			{"protocol": "udp", "ports": "all", "destinations": anywhere},
+			{"protocol": "icmp", "destinations": anywhere},
+		},
+	}, nil)
+}
+
+// Implementation of the Cloud interface
+func (cloud DOCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	fingerprint, err := cloud.ensureSSHKey(ctx)
+	if err != nil {
+		log.Printf("failed to register ssh key: %v", err)
+		return "", err
+	}
+	if err := cloud.ensureFirewall(ctx); err != nil {
+		log.Printf("failed to create firewall: %v", err)
+		return "", err
+	}
+	log.Printf("starting droplet: %q", name)
+	var resp struct {
+		Droplet doDroplet `json:"droplet"`
+	}
+	err = cloud.call(ctx, "POST", "/droplets", map[string]interface{}{
+		"name":      name,
+		"region":    zone,
+		"size":      cloud.config.Size,
+		"image":     cloud.config.Image,
+		"ssh_keys":  []string{fingerprint},
+		"user_data": script,
+		"tags":      []string{doTag},
+	}, &resp)
+	if err != nil {
+		log.Printf("droplet create api call failed: %v", err)
+		return "", err
+	}
+	droplet, err := cloud.waitForDroplet(ctx, resp.Droplet.Id)
+	if err != nil {
+		log.Printf("droplet failed to start: %v", err)
+		return "", err
+	}
+	ip := droplet.publicIP()
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, doDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("droplet started: %q", ip)
+	return ip, nil
+}
+
+// Wait until a droplet is active with a public address.
+func (cloud DOCloud) waitForDroplet(ctx context.Context, id int) (*doDroplet, error) {
+	deadline := time.Now().Add(doDropletTimeout)
+	for {
+		var resp struct {
+			Droplet doDroplet `json:"droplet"`
+		}
+		if err := cloud.call(ctx, "GET", fmt.Sprintf("/droplets/%d", id), nil, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Droplet.Status == "active" && resp.Droplet.publicIP() != "" {
+			return &resp.Droplet, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for droplet %d to be active", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud DOCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	droplet, err := cloud.findDroplet(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting droplet")
+	err = cloud.call(ctx, "DELETE", fmt.Sprintf("/droplets/%d", droplet.Id), nil, nil)
+	if err == nil {
+		log.Print("droplet deleted")
+	}
+	return err
+}
+
+// Return the ssh login on a droplet, whose host keys are trusted on first use.
+func (cloud DOCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,367 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The settings of an Exoscale Cloud.
+type ExoscaleConfig struct {
+	Options
+	// The Exoscale API key, $EXOSCALE_API_KEY when empty.
+	APIKey string
+	// The Exoscale API secret, $EXOSCALE_API_SECRET when empty.
+	APISecret string
+	// The Exoscale instance type, as family.size.
+	InstanceType string
+	// The Exoscale template name.
+	Template string
+	// The disk size of the instances in GB.
+	DiskSize int
+	// The private key to log into the instances, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	// The names of the ssh key and security group created by docker-cloud.
+	exoSSHKeyName    = "docker-cloud"
+	exoSecurityGroup = "docker-cloud"
+
+	exoTimeout        = 5 * time.Minute
+	exoDockerTimeout  = 10 * time.Minute
+	exoSignatureValid = 10 * time.Minute
+)
+
+// An Exoscale implementation of the Cloud interface. Zones are Exoscale zones
+// such as "ch-gva-2", each with its own API endpoint.
+type ExoscaleCloud struct {
+	unsupported
+	sshInstances
+
+	key    string
+	secret string
+	client *http.Client
+	config ExoscaleConfig
+}
+
+// Create an Exoscale Cloud instance.
+func NewExoscaleCloud(config ExoscaleConfig) (Cloud, error) {
+	key, secret := config.APIKey, config.APISecret
+	if key == "" {
+		key = os.Getenv("EXOSCALE_API_KEY")
+	}
+	if secret == "" {
+		secret = os.Getenv("EXOSCALE_API_SECRET")
+	}
+	if key == "" || secret == "" {
+		return nil, errors.New("-exoscale-api-key and -exoscale-api-secret or EXOSCALE_API_KEY and EXOSCALE_API_SECRET must be set")
+	}
+	cloud := &ExoscaleCloud{key: key, secret: secret, client: &http.Client{Timeout: 30 * time.Second}, config: config}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call the Exoscale v2 API of a zone.
+func (cloud ExoscaleCloud) call(ctx context.Context, zone, method, path string, body, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("https://api-%s.exoscale.com/v2%s", zone, path), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", cloud.authorization(req, data))
+	return doJSON(cloud.client, "exoscale", req, result)
+}
+
+// Return the EXO2-HMAC-SHA256 authorization of a request without query
+// parameters: the signed message is the request line, the body, the empty
+// query arguments and headers, and the expiration.
+func (cloud ExoscaleCloud) authorization(req *http.Request, body []byte) string {
+	expires := fmt.Sprint(time.Now().Add(exoSignatureValid).Unix())
+	message := strings.Join([]string{
+		req.Method + " " + req.URL.EscapedPath(),
+		string(body),
+		"",
+		"",
+		expires,
+	}, "\n")
+	mac := hmac.New(sha256.New, []byte(cloud.secret))
+	mac.Write([]byte(message))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return fmt.Sprintf("EXO2-HMAC-SHA256 credential=%s,expires=%s,signature=%s", cloud.key, expires, signature)
+}
+
+// An asynchronous operation, referencing the resource it acts upon.
+type exoOperation struct {
+	Id        string `json:"id"`
+	State     string `json:"state"`
+	Reference struct {
+		Id string `json:"id"`
+	} `json:"reference"`
+}
+
+// Call an API returning an operation and wait for it to succeed. Returns the
+// id of the resource.
+func (cloud ExoscaleCloud) callOperation(ctx context.Context, zone, method, path string, body interface{}) (string, error) {
+	var op exoOperation
+	if err := cloud.call(ctx, zone, method, path, body, &op); err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(exoTimeout)
+	for op.State == "pending" {
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("%w waiting for operation %s", ErrOperationTimeout, op.Id)
+		}
+		if err := sleep(ctx, 2*time.Second); err != nil {
+			return "", err
+		}
+		if err := cloud.call(ctx, zone, "GET", "/operation/"+op.Id, nil, &op); err != nil {
+			return "", err
+		}
+	}
+	if op.State != "success" {
+		return "", fmt.Errorf("operation %s %s", op.Id, op.State)
+	}
+	return op.Reference.Id, nil
+}
+
+type exoInstance struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	PublicIP string `json:"public-ip"`
+}
+
+// Find the instance with the given name in a zone.
+func (cloud ExoscaleCloud) findInstance(ctx context.Context, name, zone string) (*exoInstance, error) {
+	var resp struct {
+		Instances []exoInstance `json:"instances"`
+	}
+	if err := cloud.call(ctx, zone, "GET", "/instance", nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, instance := range resp.Instances {
+		if instance.Name == name {
+			return &instance, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: instance %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud ExoscaleCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	instance, err := cloud.findInstance(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return instance.PublicIP, nil
+}
+
+// Register the -exoscale-ssh-key-path public key, generating the key pair
+// first if needed.
+func (cloud ExoscaleCloud) ensureSSHKey(ctx context.Context, zone string) error {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return err
+	}
+	err = cloud.call(ctx, zone, "GET", "/ssh-key/"+exoSSHKeyName, nil, nil)
+	if !isAPIStatus(err, http.StatusNotFound) {
+		return err
+	}
+	log.Printf("registering ssh key: %q", exoSSHKeyName)
+	_, err = cloud.callOperation(ctx, zone, "POST", "/ssh-key", map[string]string{
+		"name":       exoSSHKeyName,
+		"public-key": strings.TrimSpace(string(publicKey)),
+	})
+	return err
+}
+
+// Get or create the security group of the instances, letting ssh in and the
+// docker port only from the group itself, so that docker is reached through
+// the tunnel. Returns the security group id.
+func (cloud ExoscaleCloud) ensureSecurityGroup(ctx context.Context, zone string) (string, error) {
+	var resp struct {
+		SecurityGroups []struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"security-groups"`
+	}
+	if err := cloud.call(ctx, zone, "GET", "/security-group", nil, &resp); err != nil {
+		return "", err
+	}
+	for _, group := range resp.SecurityGroups {
+		if group.Name == exoSecurityGroup {
+			return group.Id, nil
+		}
+	}
+	log.Printf("creating security group: %q", exoSecurityGroup)
+	id, err := cloud.callOperation(ctx, zone, "POST", "/security-group", map[string]string{
+		"name":        exoSecurityGroup,
+		"description": "docker-cloud instances",
+	})
+	if err != nil {
+		return "", err
+	}
+	rules := []map[string]interface{}{{
+		"flow-direction": "ingress",
+		"protocol":       "tcp",
+		"start-port":     22,
+		"end-port":       22,
+		"network":        "0.0.0.0/0",
+	}, {
+		"flow-direction": "ingress",
+		"protocol":       "tcp",
+		"start-port":     startupDockerPort,
+		"end-port":       startupDockerPort,
+		"security-group": map[string]string{"id": id},
+	}}
+	for _, rule := range rules {
+		if _, err := cloud.callOperation(ctx, zone, "POST", "/security-group/"+id+"/rules", rule); err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// Return the id of the -exoscale-instance-type.
+func (cloud ExoscaleCloud) resolveInstanceType(ctx context.Context, zone string) (string, error) {
+	var resp struct {
+		InstanceTypes []struct {
+			Id     string `json:"id"`
+			Family string `json:"family"`
+			Size   string `json:"size"`
+		} `json:"instance-types"`
+	}
+	if err := cloud.call(ctx, zone, "GET", "/instance-type", nil, &resp); err != nil {
+		return "", err
+	}
+	for _, t := range resp.InstanceTypes {
+		if t.Family+"."+t.Size == cloud.config.InstanceType {
+			return t.Id, nil
+		}
+	}
+	return "", fmt.Errorf("instance type %q not found in %q", cloud.config.InstanceType, zone)
+}
+
+// Return the id of the -exoscale-template.
+func (cloud ExoscaleCloud) resolveTemplate(ctx context.Context, zone string) (string, error) {
+	var resp struct {
+		Templates []struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"templates"`
+	}
+	if err := cloud.call(ctx, zone, "GET", "/template", nil, &resp); err != nil {
+		return "", err
+	}
+	for _, t := range resp.Templates {
+		if t.Name == cloud.config.Template {
+			return t.Id, nil
+		}
+	}
+	return "", fmt.Errorf("template %q not found in %q", cloud.config.Template, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud ExoscaleCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	if err := cloud.ensureSSHKey(ctx, zone); err != nil {
+		log.Printf("failed to register ssh key: %v", err)
+		return "", err
+	}
+	groupId, err := cloud.ensureSecurityGroup(ctx, zone)
+	if err != nil {
+		log.Printf("failed to create security group: %v", err)
+		return "", err
+	}
+	typeId, err := cloud.resolveInstanceType(ctx, zone)
+	if err != nil {
+		return "", err
+	}
+	templateId, err := cloud.resolveTemplate(ctx, zone)
+	if err != nil {
+		return "", err
+	}
+	instance := map[string]interface{}{
+		"name":            name,
+		"instance-type":   map[string]string{"id": typeId},
+		"template":        map[string]string{"id": templateId},
+		"disk-size":       cloud.config.DiskSize,
+		"ssh-key":         map[string]string{"name": exoSSHKeyName},
+		"security-groups": []map[string]string{{"id": groupId}},
+		"user-data":       base64.StdEncoding.EncodeToString([]byte(script)),
+	}
+	if !cloud.config.NoManagedTags {
+		instance["labels"] = map[string]string{managedByLabel: "docker-cloud"}
+	}
+	log.Printf("starting instance: %q", name)
+	if _, err := cloud.callOperation(ctx, zone, "POST", "/instance", instance); err != nil {
+		log.Printf("instance create api call failed: %v", err)
+		return "", err
+	}
+	ip, err := cloud.GetPublicIPAddress(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, exoDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("instance started: %q", ip)
+	return ip, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud ExoscaleCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	instance, err := cloud.findInstance(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting instance")
+	if _, err := cloud.callOperation(ctx, zone, "DELETE", "/instance/"+instance.Id, nil); err != nil {
+		return err
+	}
+	log.Print("instance deleted")
+	return nil
+}
+
+// Return the ssh login on an instance, whose host keys are trusted on first
+// use.
+func (cloud ExoscaleCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "ubuntu", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,303 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fakecloud implements the dockercloud.Cloud interface in memory, to
+// test the programs using it without cloud credentials.
+package fakecloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// A Cloud keeping its instances in memory. The addresses are handed out in
+// order, so the state only depends on the calls made. Methods are named as
+// in the Cloud interface for SetLatency and Fail.
+type Cloud struct {
+	// Set the creation time of the instances, default time.Now.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	instances map[string]*dockercloud.Instance
+	commands  map[string][]string
+	latencies map[string]time.Duration
+	failures  map[string]error
+	handler   func(name, zone, command string) (string, error)
+	nextIP    int
+}
+
+// Create an empty fake cloud.
+func New() *Cloud {
+	return &Cloud{
+		Now:       time.Now,
+		instances: map[string]*dockercloud.Instance{},
+		commands:  map[string][]string{},
+		latencies: map[string]time.Duration{},
+		failures:  map[string]error{},
+	}
+}
+
+// Delay the calls of a method, to mimic a slow cloud. The delay is cut
+// short when the context of the call is done.
+func (cloud *Cloud) SetLatency(method string, d time.Duration) {
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	cloud.latencies[method] = d
+}
+
+// Make the calls of a method fail with err, without changing the state, until
+// Fail is called again with a nil err.
+func (cloud *Cloud) Fail(method string, err error) {
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	if err == nil {
+		delete(cloud.failures, method)
+		return
+	}
+	cloud.failures[method] = err
+}
+
+// Answer RunCommand with handler, which by default returns an empty output.
+func (cloud *Cloud) HandleCommands(handler func(name, zone, command string) (string, error)) {
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	cloud.handler = handler
+}
+
+// Return the commands run on an instance, oldest first.
+func (cloud *Cloud) Commands(name, zone string) []string {
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	return append([]string(nil), cloud.commands[key(name, zone)]...)
+}
+
+func key(name, zone string) string {
+	return zone + "/" + name
+}
+
+// Wait for the latency of method, then return its injected failure. The
+// lock is taken on success, to be released by the caller.
+func (cloud *Cloud) enter(ctx context.Context, method string) error {
+	cloud.mu.Lock()
+	latency := cloud.latencies[method]
+	cloud.mu.Unlock()
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+	cloud.mu.Lock()
+	if err := cloud.failures[method]; err != nil {
+		cloud.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Return the instance, or ErrInstanceNotFound. The lock must be held.
+func (cloud *Cloud) find(name, zone string) (*dockercloud.Instance, error) {
+	instance, ok := cloud.instances[key(name, zone)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q in %q", dockercloud.ErrInstanceNotFound, name, zone)
+	}
+	return instance, nil
+}
+
+// Implementation of the Cloud interface. Stopped instances have no address.
+func (cloud *Cloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	if err := cloud.enter(ctx, "GetPublicIPAddress"); err != nil {
+		return "", err
+	}
+	defer cloud.mu.Unlock()
+	instance, err := cloud.find(name, zone)
+	if err != nil {
+		return "", err
+	}
+	return instance.PublicIP, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud *Cloud) CreateInstance(ctx context.Context, name string, zone string, spec dockercloud.InstanceSpec) (string, error) {
+	if err := cloud.enter(ctx, "CreateInstance"); err != nil {
+		return "", err
+	}
+	defer cloud.mu.Unlock()
+	if _, ok := cloud.instances[key(name, zone)]; ok {
+		return "", fmt.Errorf("instance %q already exists in %q", name, zone)
+	}
+	cloud.nextIP++
+	instance := &dockercloud.Instance{
+		Name:          name,
+		Zone:          zone,
+		Status:        dockercloud.StatusRunning,
+		PublicIP:      fmt.Sprintf("203.0.113.%d", cloud.nextIP),
+		PrivateIP:     fmt.Sprintf("10.0.0.%d", cloud.nextIP),
+		MachineType:   spec.MachineType,
+		CreationTime:  cloud.Now(),
+		LastStartTime: cloud.Now(),
+	}
+	cloud.instances[key(name, zone)] = instance
+	return instance.PublicIP, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud *Cloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	if err := cloud.enter(ctx, "DeleteInstance"); err != nil {
+		return err
+	}
+	defer cloud.mu.Unlock()
+	if _, err := cloud.find(name, zone); err != nil {
+		return err
+	}
+	delete(cloud.instances, key(name, zone))
+	delete(cloud.commands, key(name, zone))
+	return nil
+}
+
+// Implementation of the Cloud interface. No tunnel is opened, and the
+// returned process is nil.
+func (cloud *Cloud) OpenSecureTunnel(ctx context.Context, name string, zone string, localPort int, remotePort int) (*os.Process, error) {
+	if err := cloud.enter(ctx, "OpenSecureTunnel"); err != nil {
+		return nil, err
+	}
+	defer cloud.mu.Unlock()
+	instance, err := cloud.find(name, zone)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Status != dockercloud.StatusRunning {
+		return nil, fmt.Errorf("instance %q is %s", name, instance.Status)
+	}
+	return nil, nil
+}
+
+// Implementation of the Cloud interface. The command is recorded, and
+// answered by the HandleCommands handler.
+func (cloud *Cloud) RunCommand(ctx context.Context, name string, zone string, command string) (string, error) {
+	if err := cloud.enter(ctx, "RunCommand"); err != nil {
+		return "", err
+	}
+	instance, err := cloud.find(name, zone)
+	if err == nil && instance.Status != dockercloud.StatusRunning {
+		err = fmt.Errorf("instance %q is %s", name, instance.Status)
+	}
+	if err != nil {
+		cloud.mu.Unlock()
+		return "", err
+	}
+	cloud.commands[key(name, zone)] = append(cloud.commands[key(name, zone)], command)
+	handler := cloud.handler
+	// The handler may call back into the cloud.
+	cloud.mu.Unlock()
+	if handler == nil {
+		return "", nil
+	}
+	return handler(name, zone, command)
+}
+
+// Implementation of the Cloud interface
+func (cloud *Cloud) ListInstances(ctx context.Context, zone string) ([]dockercloud.Instance, error) {
+	if err := cloud.enter(ctx, "ListInstances"); err != nil {
+		return nil, err
+	}
+	defer cloud.mu.Unlock()
+	instances := []dockercloud.Instance{}
+	for _, instance := range cloud.instances {
+		if zone == "" || instance.Zone == zone {
+			instances = append(instances, *instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return key(instances[i].Name, instances[i].Zone) < key(instances[j].Name, instances[j].Zone)
+	})
+	return instances, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud *Cloud) StopInstance(ctx context.Context, name string, zone string) error {
+	if err := cloud.enter(ctx, "StopInstance"); err != nil {
+		return err
+	}
+	defer cloud.mu.Unlock()
+	instance, err := cloud.find(name, zone)
+	if err != nil {
+		return err
+	}
+	instance.Status = dockercloud.StatusStopped
+	instance.PublicIP = ""
+	return nil
+}
+
+// Implementation of the Cloud interface. The instance gets a new public
+// address, as on most clouds.
+func (cloud *Cloud) StartInstance(ctx context.Context, name string, zone string) (string, error) {
+	if err := cloud.enter(ctx, "StartInstance"); err != nil {
+		return "", err
+	}
+	defer cloud.mu.Unlock()
+	instance, err := cloud.find(name, zone)
+	if err != nil {
+		return "", err
+	}
+	if instance.Status != dockercloud.StatusRunning {
+		cloud.nextIP++
+		instance.Status = dockercloud.StatusRunning
+		instance.PublicIP = fmt.Sprintf("203.0.113.%d", cloud.nextIP)
+		instance.LastStartTime = cloud.Now()
+	}
+	return instance.PublicIP, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud *Cloud) DescribeInstance(ctx context.Context, name string, zone string) (*dockercloud.Instance, error) {
+	if err := cloud.enter(ctx, "DescribeInstance"); err != nil {
+		return nil, err
+	}
+	defer cloud.mu.Unlock()
+	instance, err := cloud.find(name, zone)
+	if err != nil {
+		return nil, err
+	}
+	result := *instance
+	return &result, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud *Cloud) Capabilities() dockercloud.Capabilities {
+	return dockercloud.Capabilities{ListInstances: true, StopStart: true, Resize: true}
+}
+
+// Implementation of the Cloud interface. Running instances keep running,
+// with the same address.
+func (cloud *Cloud) ResizeInstance(ctx context.Context, name string, zone string, machineType string) error {
+	if err := cloud.enter(ctx, "ResizeInstance"); err != nil {
+		return err
+	}
+	defer cloud.mu.Unlock()
+	instance, err := cloud.find(name, zone)
+	if err != nil {
+		return err
+	}
+	instance.MachineType = machineType
+	return nil
+}
@@ -0,0 +1,131 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fakecloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// Return a fake cloud whose clock moves one minute per call.
+func newCloud() *Cloud {
+	cloud := New()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cloud.Now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	return cloud
+}
+
+func TestInstanceLifecycle(t *testing.T) {
+	ctx := context.Background()
+	cloud := newCloud()
+	ip, err := cloud.CreateInstance(ctx, "vm", "zone-a", dockercloud.InstanceSpec{MachineType: "small"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "203.0.113.1" {
+		t.Errorf("CreateInstance() = %q, want 203.0.113.1", ip)
+	}
+	if _, err := cloud.CreateInstance(ctx, "vm", "zone-a", dockercloud.InstanceSpec{}); err == nil {
+		t.Error("CreateInstance() of an existing instance succeeded")
+	}
+	created, err := cloud.DescribeInstance(ctx, "vm", "zone-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Status != dockercloud.StatusRunning || created.MachineType != "small" {
+		t.Errorf("created instance is %s %q, want RUNNING small", created.Status, created.MachineType)
+	}
+
+	if err := cloud.StopInstance(ctx, "vm", "zone-a"); err != nil {
+		t.Fatal(err)
+	}
+	if ip, err := cloud.GetPublicIPAddress(ctx, "vm", "zone-a"); err != nil || ip != "" {
+		t.Errorf("GetPublicIPAddress() of a stopped instance = %q, %v, want no address", ip, err)
+	}
+	if _, err := cloud.RunCommand(ctx, "vm", "zone-a", "true"); err == nil {
+		t.Error("RunCommand() on a stopped instance succeeded")
+	}
+
+	ip, err = cloud.StartInstance(ctx, "vm", "zone-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "203.0.113.2" {
+		t.Errorf("StartInstance() = %q, want a new address 203.0.113.2", ip)
+	}
+	started, err := cloud.DescribeInstance(ctx, "vm", "zone-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started.Status != dockercloud.StatusRunning || !started.LastStartTime.After(created.LastStartTime) {
+		t.Errorf("started instance is %s since %v, want RUNNING after %v", started.Status, started.LastStartTime, created.LastStartTime)
+	}
+	if !started.CreationTime.Equal(created.CreationTime) {
+		t.Errorf("CreationTime changed on start from %v to %v", created.CreationTime, started.CreationTime)
+	}
+
+	if err := cloud.DeleteInstance(ctx, "vm", "zone-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cloud.DescribeInstance(ctx, "vm", "zone-a"); !errors.Is(err, dockercloud.ErrInstanceNotFound) {
+		t.Errorf("DescribeInstance() after delete = %v, want ErrInstanceNotFound", err)
+	}
+	if err := cloud.DeleteInstance(ctx, "vm", "zone-a"); !errors.Is(err, dockercloud.ErrInstanceNotFound) {
+		t.Errorf("DeleteInstance() twice = %v, want ErrInstanceNotFound", err)
+	}
+}
+
+func TestFail(t *testing.T) {
+	ctx := context.Background()
+	cloud := newCloud()
+	errQuota := errors.New("quota exceeded")
+	cloud.Fail("CreateInstance", errQuota)
+	if _, err := cloud.CreateInstance(ctx, "vm", "zone-a", dockercloud.InstanceSpec{}); err != errQuota {
+		t.Errorf("CreateInstance() = %v, want the injected error", err)
+	}
+	if instances, err := cloud.ListInstances(ctx, ""); err != nil || len(instances) != 0 {
+		t.Errorf("a failed CreateInstance() left %d instances, %v", len(instances), err)
+	}
+	cloud.Fail("CreateInstance", nil)
+	if _, err := cloud.CreateInstance(ctx, "vm", "zone-a", dockercloud.InstanceSpec{}); err != nil {
+		t.Errorf("CreateInstance() after Fail(nil) = %v", err)
+	}
+}
+
+func TestSetLatency(t *testing.T) {
+	cloud := newCloud()
+	cloud.SetLatency("ListInstances", 50*time.Millisecond)
+	start := time.Now()
+	if _, err := cloud.ListInstances(context.Background(), ""); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("ListInstances() returned after %v, want at least 50ms", elapsed)
+	}
+
+	cloud.SetLatency("ListInstances", time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cloud.ListInstances(ctx, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ListInstances() = %v, want the context deadline", err)
+	}
+}
@@ -15,48 +15,201 @@
 package dockercloud
 
 import (
-	"code.google.com/p/goauth2/oauth"
-	compute "code.google.com/p/google-api-go-client/compute/v1"
+	"context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
 	"net/http"
 	"path"
 
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
-	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 )
 
-var (
-	projectId             = flag.String("project", "", "Google Cloud Project Name")
-	gcloudCredentialsPath = flag.String("gcloudcredentials", path.Join(os.Getenv("HOME"), ".config/gcloud/credentials"), "gcloud SDK credentials path")
-	instanceType          = flag.String("instancetype",
-		"/zones/us-central1-a/machineTypes/n1-standard-1",
-		"The reference to the instance type to create.")
-	image = flag.String("image",
-		"https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/backports-debian-7-wheezy-v20131127",
-		"The GCE image to boot from.")
-	diskName   = flag.String("diskname", "docker-root", "Name of the instance root disk")
-	diskSizeGb = flag.Int64("disksize", 100, "Size of the root disk in GB")
-)
+// Snapshotters supported with the containerd image store.
+var snapshotters = map[string]bool{"overlayfs": true, "native": true, "zfs": true}
+
+// The port docker listens on as set by the startup script.
+const startupDockerPort = 8000
 
-const startup = `#!/bin/bash
+// The startup script installing docker. systemd ignores /etc/default/docker,
+// so the docker port is set in daemon.json there, with a drop-in removing the
+// -H fd:// of the unit that would conflict with it. Only the legacy wheezy
+// image, running sysvinit, still reads DOCKER_OPTS.
+var startup = template.Must(template.New("startup").Parse(`#!/bin/bash
 sysctl -w net.ipv4.ip_forward=1
-wget -qO- https://get.docker.io/ | sh
+{{if .DaemonConfig}}mkdir -p /etc/docker
+cat > /etc/docker/daemon.json <<'EOF'
+{{.DaemonConfig}}
+EOF
+{{end}}wget -qO- https://get.docker.io/ | {{if .DockerVersion}}VERSION={{.DockerVersion}} {{end}}sh
 until test -f /var/run/docker.pid; do sleep 1 && echo waiting; done
+if test -d /run/systemd/system; then
+mkdir -p /etc/docker /etc/systemd/system/docker.service.d
+cat > /etc/systemd/system/docker.service.d/docker-cloud.conf <<'EOF'
+[Service]
+ExecStart=
+ExecStart=/usr/bin/dockerd --containerd=/run/containerd/containerd.sock
+EOF
+cat > /etc/docker/daemon.json <<'EOF'
+{{.SystemdDaemonConfig}}
+EOF
+systemctl daemon-reload
+systemctl restart docker
+else
 grep mtu /etc/default/docker || (echo 'DOCKER_OPTS="-H :8000 -mtu 1460"' >> /etc/default/docker)
 service docker restart
+fi
 until echo 'GET /' >/dev/tcp/localhost/8000; do sleep 1 && echo waiting; done
+`))
+
+const (
+	// GCE limits on the size of a single metadata value and of all the metadata.
+	maxMetadataValue = 256 * 1024
+	maxMetadataTotal = 512 * 1024
+
+	// Metadata keys holding the chunks of the encoded startup script.
+	startupScriptChunkKey = "startup-script-b64-"
+)
+
+// The startup script decoding and running the chunks of the encoded script.
+const startupScriptWrapper = `#!/bin/bash
+for i in $(seq 0 %d); do curl -sf -H 'Metadata-Flavor: Google' http://metadata.google.internal/computeMetadata/v1/instance/attributes/%s$i; done | base64 -d | bash
 `
 
+// Add a startup script to the metadata base64 encoded and split across
+// several values, with a small wrapper as the startup-script value.
+func injectLargeStartupScript(script string, metadata *compute.Metadata) error {
+	encoded := base64.StdEncoding.EncodeToString([]byte(script))
+	if len(encoded) > maxMetadataTotal-len(startupScriptWrapper)-1024 {
+		return fmt.Errorf("encoded startup script is %d bytes, over the %d bytes metadata limit", len(encoded), maxMetadataTotal)
+	}
+	chunks := 0
+	for ; len(encoded) > 0; chunks++ {
+		n := len(encoded)
+		if n > maxMetadataValue {
+			n = maxMetadataValue
+		}
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{
+			Key:   fmt.Sprintf("%s%d", startupScriptChunkKey, chunks),
+			Value: googleapi.String(encoded[:n]),
+		})
+		encoded = encoded[n:]
+	}
+	metadata.Items = append(metadata.Items, &compute.MetadataItems{
+		Key:   "startup-script",
+		Value: googleapi.String(fmt.Sprintf(startupScriptWrapper, chunks-1, startupScriptChunkKey)),
+	})
+	return nil
+}
+
+// Add the startup script to the metadata, encoded when the spec asks for it.
+func addStartupScript(script string, spec InstanceSpec, metadata *compute.Metadata) error {
+	if spec.StartupScriptBase64 {
+		return injectLargeStartupScript(script, metadata)
+	}
+	metadata.Items = append(metadata.Items, &compute.MetadataItems{
+		Key:   "startup-script",
+		Value: googleapi.String(script),
+	})
+	return nil
+}
+
+// Render the instance startup script from the Docker settings of the spec.
+func startupScript(spec InstanceSpec) (string, error) {
+	daemonConfig := map[string]interface{}{}
+	if spec.Snapshotter != "" {
+		if !snapshotters[spec.Snapshotter] {
+			return "", fmt.Errorf("unsupported containerd snapshotter %q", spec.Snapshotter)
+		}
+		if spec.DockerVersion != "" && dockerMajorVersion(spec.DockerVersion) < 24 {
+			return "", fmt.Errorf("containerd snapshotter requires Docker >= 24.0, got %q", spec.DockerVersion)
+		}
+		daemonConfig["features"] = map[string]bool{"containerd-snapshotter": true}
+		daemonConfig["storage-driver"] = spec.Snapshotter
+	}
+	data := struct {
+		DaemonConfig        string
+		SystemdDaemonConfig string
+		DockerVersion       string
+	}{DockerVersion: spec.DockerVersion}
+	if len(daemonConfig) > 0 {
+		b, err := json.MarshalIndent(daemonConfig, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		data.DaemonConfig = string(b)
+	}
+	daemonConfig["hosts"] = []string{fmt.Sprintf("tcp://127.0.0.1:%d", startupDockerPort), "unix:///var/run/docker.sock"}
+	daemonConfig["mtu"] = 1460
+	b, err := json.MarshalIndent(daemonConfig, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	data.SystemdDaemonConfig = string(b)
+	var script bytes.Buffer
+	if err := startup.Execute(&script, data); err != nil {
+		return "", err
+	}
+	return script.String(), nil
+}
+
+// Render the startup script with docker only reachable from the instance
+// itself, for providers without a firewall in front of the instances.
+func localDockerStartupScript(spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		return "", err
+	}
+	shebang := strings.Index(script, "\n") + 1
+	firewall := fmt.Sprintf("iptables -I INPUT -p tcp --dport %d ! -i lo -j DROP\n", startupDockerPort)
+	return script[:shebang] + firewall + script[shebang:], nil
+}
+
+// Return the major component of a Docker version string such as "24.0.7".
+func dockerMajorVersion(version string) int {
+	major, _ := strconv.Atoi(strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0])
+	return major
+}
+
 // A Google Compute Engine implementation of the Cloud interface
 type GCECloud struct {
-	service   *compute.Service
-	projectId string
+	service    *compute.Service
+	monitoring *monitoring.Service
+	storage    *storage.Service
+	cloudbuild *cloudbuild.Service
+	projectId  string
+	dryRun     bool
+	options    Options
+}
+
+// The settings of a GCE Cloud.
+type GCEConfig struct {
+	Options
+	// The Google Cloud project to create the resources in.
+	ProjectId string
+	// The gcloud SDK credentials to authenticate with.
+	CredentialsPath string
+	// Print the resources CreateInstance and DeleteInstance would create or
+	// delete on stdout instead of changing them.
+	DryRun bool
 }
 
 type gcloudCredentialsCache struct {
@@ -74,8 +227,9 @@ type gcloudCredentialsCache struct {
 	}
 }
 
-func gcloudTransport() (*oauth.Transport, error) {
-	f, err := os.Open(*gcloudCredentialsPath)
+// Return an HTTP client authenticated with the gcloud SDK credentials.
+func gcloudClient(ctx context.Context, credentialsPath string) (*http.Client, error) {
+	f, err := os.Open(credentialsPath)
 	if err != nil {
 		return nil, err
 	}
@@ -84,92 +238,198 @@ func gcloudTransport() (*oauth.Transport, error) {
 	if err := json.NewDecoder(f).Decode(cache); err != nil {
 		return nil, err
 	}
-	log.Print(cache)
+	if len(cache.Data) == 0 {
+		return nil, fmt.Errorf("no credentials in %s", credentialsPath)
+	}
 	gcloud := cache.Data[0]
-	t := &oauth.Transport{
-		Config: &oauth.Config{
-			ClientId:     gcloud.Credential.Client_Id,
-			ClientSecret: gcloud.Credential.Client_Secret,
-			RedirectURL:  "oob",
-			Scope:        gcloud.Key.Scope,
-			AuthURL:      "https://accounts.google.com/o/oauth2/auth",
-			TokenURL:     "https://accounts.google.com/o/oauth2/token",
-		},
-		Token: &oauth.Token{
-			AccessToken:  gcloud.Credential.Access_Token,
-			RefreshToken: gcloud.Credential.Refresh_Token,
-			Expiry:       gcloud.Credential.Token_Expiry,
-		},
-		Transport: http.DefaultTransport,
+	config := &oauth2.Config{
+		ClientID:     gcloud.Credential.Client_Id,
+		ClientSecret: gcloud.Credential.Client_Secret,
+		RedirectURL:  "oob",
+		Scopes:       strings.Fields(gcloud.Key.Scope),
+		Endpoint:     google.Endpoint,
 	}
-	return t, t.Refresh()
+	source := config.TokenSource(ctx, &oauth2.Token{
+		AccessToken:  gcloud.Credential.Access_Token,
+		RefreshToken: gcloud.Credential.Refresh_Token,
+		Expiry:       gcloud.Credential.Token_Expiry,
+	})
+	// Fail now rather than on the first API call when the token can't be refreshed.
+	if _, err := source.Token(); err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, source), nil
 }
 
+// The zone used when neither -zone nor the project default zone is set.
+const DefaultGCEZone = "us-central1-a"
+
 // Create a GCE Cloud instance.
-func NewGCECloud() Cloud {
-	// Set up a gcloud transport.
-	transport, err := gcloudTransport()
+func NewGCECloud(config GCEConfig) (Cloud, error) {
+	ctx := context.Background()
+	client, err := gcloudClient(ctx, config.CredentialsPath)
 	if err != nil {
-		log.Fatalf("unable to create gcloud transport: %v", err)
+		return nil, fmt.Errorf("unable to create gcloud client: %v", err)
 	}
+	opt := option.WithHTTPClient(client)
 
-	svc, err := compute.New(transport.Client())
+	svc, err := compute.NewService(ctx, opt)
+	if err != nil {
+		return nil, fmt.Errorf("error creating service: %v", err)
+	}
+	monitoringSvc, err := monitoring.NewService(ctx, opt)
 	if err != nil {
-		log.Fatalf("Error creating service: %v", err)
+		return nil, fmt.Errorf("error creating monitoring service: %v", err)
+	}
+	storageSvc, err := storage.NewService(ctx, opt)
+	if err != nil {
+		return nil, fmt.Errorf("error creating storage service: %v", err)
+	}
+	cloudbuildSvc, err := cloudbuild.NewService(ctx, opt)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cloud build service: %v", err)
 	}
 	return &GCECloud{
-		service:   svc,
-		projectId: *projectId,
+		service:    svc,
+		monitoring: monitoringSvc,
+		storage:    storageSvc,
+		cloudbuild: cloudbuildSvc,
+		projectId:  config.ProjectId,
+		dryRun:     config.DryRun,
+		options:    config.Options,
+	}, nil
+}
+
+// Wrap the errors of the GCE API calls on an instance in the Cloud errors.
+func gceError(err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	if apiErr.Code == http.StatusNotFound {
+		return fmt.Errorf("%w: %v", ErrInstanceNotFound, err)
+	}
+	for _, item := range apiErr.Errors {
+		if item.Reason == "quotaExceeded" {
+			return fmt.Errorf("%w: %v", ErrQuotaExceeded, err)
+		}
+	}
+	return err
+}
+
+// Return the error of a finished operation, or nil.
+func gceOpError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	opErr := op.Error.Errors[0]
+	switch opErr.Code {
+	case "QUOTA_EXCEEDED":
+		return fmt.Errorf("%w: operation %s failed: %s", ErrQuotaExceeded, op.Name, opErr.Message)
+	case "ZONE_RESOURCE_POOL_EXHAUSTED", "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS":
+		return fmt.Errorf("%w: operation %s failed: %s", ErrZoneExhausted, op.Name, opErr.Message)
 	}
+	return fmt.Errorf("operation %s failed: %s", op.Name, opErr.Message)
 }
 
 // Implementation of the Cloud interface
-func (cloud GCECloud) GetPublicIPAddress(name string, zone string) (string, error) {
-	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Do()
+func (cloud GCECloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
 	if err != nil {
-		return "", err
+		return "", gceError(err)
+	}
+	if len(instance.NetworkInterfaces) == 0 {
+		return "", fmt.Errorf("instance %q has no network interface", name)
+	}
+	if len(instance.NetworkInterfaces[0].AccessConfigs) == 0 {
+		return "", fmt.Errorf("instance %q has no external IP", name)
 	}
 	// Found the instance, we're good.
 	return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP, nil
 }
 
+// Find the zone containing the named disk.
+func (cloud GCECloud) LookupZoneForDisk(ctx context.Context, diskName string) (string, error) {
+	list, err := cloud.service.Disks.AggregatedList(cloud.projectId).Filter("name=" + diskName).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	for _, scoped := range list.Items {
+		for _, disk := range scoped.Disks {
+			// The self link looks like .../projects/<project>/zones/<zone>/disks/<name>.
+			parts := strings.Split(disk.SelfLink, "/")
+			for i := 0; i+1 < len(parts); i++ {
+				if parts[i] == "zones" {
+					return parts[i+1], nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("disk %q not found", diskName)
+}
+
 // Get or create a new root disk.
-func (cloud GCECloud) getOrCreateRootDisk(name, zone string) (string, error) {
+func (cloud GCECloud) getOrCreateRootDisk(ctx context.Context, spec InstanceSpec, zone string) (string, error) {
+	name := spec.DiskName
 	log.Printf("try getting root disk: %q", name)
-	disk, err := cloud.service.Disks.Get(cloud.projectId, zone, *diskName).Do()
+	disk, err := cloud.service.Disks.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err == nil && spec.Snapshot != "" {
+		return "", fmt.Errorf("root disk %q already exists, can't restore snapshot %q to it", name, spec.Snapshot)
+	}
 	if err == nil {
 		log.Printf("found %q", disk.SelfLink)
 		return disk.SelfLink, nil
 	}
 	log.Printf("not found, creating root disk: %q", name)
-	op, err := cloud.service.Disks.Insert(cloud.projectId, zone, &compute.Disk{
-		Name: *diskName,
-	}).SourceImage(*image).Do()
+	insert := cloud.service.Disks.Insert(cloud.projectId, zone, &compute.Disk{
+		Name:           name,
+		SizeGb:         spec.DiskSizeGb,
+		SourceSnapshot: snapshotLink(spec.Snapshot),
+	})
+	if spec.Snapshot == "" {
+		insert.SourceImage(spec.Image)
+	}
+	op, err := insert.Context(ctx).Do()
 	if err != nil {
 		log.Printf("disk insert api call failed: %v", err)
 		return "", err
 	}
-	err = cloud.waitForOp(op, zone)
+	err = cloud.waitForOp(ctx, op, zone)
 	if err != nil {
 		log.Printf("disk insert operation failed: %v", err)
 		return "", err
 	}
 	log.Printf("root disk created: %q", op.TargetLink)
+	if err := cloud.TagManagedResource(ctx, "disk", name, zone); err != nil {
+		log.Printf("failed to tag root disk: %v", err)
+	}
 	return op.TargetLink, nil
 }
 
 // Implementation of the Cloud interface
-func (cloud GCECloud) CreateInstance(name string, zone string) (string, error) {
-	rootDisk, err := cloud.getOrCreateRootDisk(*diskName, zone)
+func (cloud GCECloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	machineType, err := cloud.resolveMachineType(ctx, spec.MachineType, zone)
 	if err != nil {
-		log.Printf("failed to create root disk: %v", err)
 		return "", err
 	}
 	prefix := "https://www.googleapis.com/compute/v1/projects/" + cloud.projectId
+	rootDisk := prefix + "/zones/" + zone + "/disks/" + spec.DiskName
+	if !cloud.dryRun {
+		rootDisk, err = cloud.getOrCreateRootDisk(ctx, spec, zone)
+		if err != nil {
+			log.Printf("failed to create root disk: %v", err)
+			return "", err
+		}
+	}
 	instance := &compute.Instance{
 		Name:        name,
 		Description: "Docker on GCE",
-		MachineType: prefix + *instanceType,
+		MachineType: prefix + "/zones/" + zone + "/machineTypes/" + machineType,
 		Disks: []*compute.AttachedDisk{
 			{
 				Boot:   true,
@@ -186,88 +446,639 @@ func (cloud GCECloud) CreateInstance(name string, zone string) (string, error) {
 				Network: prefix + "/global/networks/default",
 			},
 		},
-		Metadata: &compute.Metadata{
-			Items: []*compute.MetadataItems{
-				{
-					Key:   "startup-script",
-					Value: startup,
-				},
-			},
-		},
+		Metadata: &compute.Metadata{},
+	}
+	if err := addStartupScript(script, spec, instance.Metadata); err != nil {
+		log.Printf("failed to inject startup script: %v", err)
+		return "", err
+	}
+	if cloud.options.SSH.StrictHostKeyChecking == "yes" {
+		// Have the guest environment publish the host keys for UpdateKnownHosts.
+		instance.Metadata.Items = append(instance.Metadata.Items, &compute.MetadataItems{
+			Key:   "enable-guest-attributes",
+			Value: googleapi.String("TRUE"),
+		})
+	}
+	if cloud.dryRun {
+		return "", cloud.printDryRun(spec, instance, script)
 	}
 	log.Printf("starting instance: %q", name)
-	op, err := cloud.service.Instances.Insert(cloud.projectId, zone, instance).Do()
+	op, err := cloud.service.Instances.Insert(cloud.projectId, zone, instance).Context(ctx).Do()
 	if err != nil {
 		log.Printf("instance insert api call failed: %v", err)
-		return "", err
+		return "", gceError(err)
 	}
-	err = cloud.waitForOp(op, zone)
+	err = cloud.waitForOp(ctx, op, zone)
 	if err != nil {
 		log.Printf("instance insert operation failed: %v", err)
 		return "", err
 	}
+	// The external IP is only assigned once the instance is created.
+	ip, err := cloud.GetPublicIPAddress(ctx, name, zone)
+	if err != nil {
+		log.Printf("failed to get the instance IP: %v", err)
+		return "", err
+	}
 
 	// Wait for docker to come up
 	// TODO(bburns) : Use metadata instead to signal that docker is up and read.
-	time.Sleep(60 * time.Second)
+	if err := sleep(ctx, 60*time.Second); err != nil {
+		return "", err
+	}
+
+	if err := cloud.TagManagedResource(ctx, "instance", name, zone); err != nil {
+		log.Printf("failed to tag instance: %v", err)
+	}
+	log.Printf("instance started: %q", ip)
+	return ip, nil
+}
 
-	log.Printf("instance started: %q", instance.NetworkInterfaces[0].AccessConfigs[0].NatIP)
-	return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP, err
+// Return the reference to a snapshot given by name or URL, empty for none.
+func snapshotLink(snapshot string) string {
+	if snapshot == "" || strings.Contains(snapshot, "/") {
+		return snapshot
+	}
+	return "global/snapshots/" + snapshot
+}
+
+// Print the resources CreateInstance would create, with the labels
+// TagManagedResource would add, and the startup script in the clear.
+func (cloud GCECloud) printDryRun(spec InstanceSpec, instance *compute.Instance, script string) error {
+	disk := &compute.Disk{
+		Name:           spec.DiskName,
+		SizeGb:         spec.DiskSizeGb,
+		SourceSnapshot: snapshotLink(spec.Snapshot),
+	}
+	if spec.Snapshot == "" {
+		disk.SourceImage = spec.Image
+	}
+	if !cloud.options.NoManagedTags {
+		disk.Labels = managedLabels()
+		instance.Labels = managedLabels()
+	}
+	for _, resource := range []struct {
+		kind  string
+		value interface{}
+	}{{"disk, unless it exists", disk}, {"instance", instance}} {
+		b, err := json.MarshalIndent(resource.value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("would create %s:\n%s\n", resource.kind, b)
+	}
+	fmt.Printf("startup script:\n%s", script)
+	return nil
 }
 
 // Implementation of the Cloud interface
-func (cloud GCECloud) DeleteInstance(name string, zone string) error {
+func (cloud GCECloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	if cloud.dryRun {
+		fmt.Printf("would delete instance: projects/%s/zones/%s/instances/%s\n", cloud.projectId, zone, name)
+		return nil
+	}
 	log.Print("deleting instance")
-	op, err := cloud.service.Instances.Delete(cloud.projectId, zone, name).Do()
+	op, err := cloud.service.Instances.Delete(cloud.projectId, zone, name).Context(ctx).Do()
 	if err != nil {
 		log.Printf("Got compute.Operation, err: %#v, %v", op, err)
-		return err
+		return gceError(err)
 	}
-	err = cloud.waitForOp(op, zone)
+	err = cloud.waitForOp(ctx, op, zone)
 	log.Print("instance deleted")
 	return err
 }
 
-func (cloud GCECloud) OpenSecureTunnel(name, zone string, localPort, remotePort int) (*os.Process, error) {
-	return cloud.openSecureTunnel(name, zone, "localhost", localPort, remotePort)
+// Delete a disk, such as the root disk of a deleted instance. A missing disk
+// is not an error.
+func (cloud GCECloud) DeleteDisk(ctx context.Context, name string, zone string) error {
+	if cloud.dryRun {
+		fmt.Printf("would delete disk: projects/%s/zones/%s/disks/%s\n", cloud.projectId, zone, name)
+		return nil
+	}
+	log.Printf("deleting disk: %q", name)
+	op, err := cloud.service.Disks.Delete(cloud.projectId, zone, name).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		log.Printf("no disk %q to delete", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := cloud.waitForOp(ctx, op, zone); err != nil {
+		return err
+	}
+	log.Print("disk deleted")
+	return nil
+}
+
+// Issue the deletion of a virtual machine instance without waiting for it to
+// complete. Returns the name of the delete operation.
+func (cloud GCECloud) DeleteInstanceAsync(ctx context.Context, name string, zone string) (string, error) {
+	if cloud.dryRun {
+		return "", cloud.DeleteInstance(ctx, name, zone)
+	}
+	log.Print("deleting instance")
+	op, err := cloud.service.Instances.Delete(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		log.Printf("Got compute.Operation, err: %#v, %v", op, err)
+		return "", gceError(err)
+	}
+	return op.Name, nil
+}
+
+func (cloud GCECloud) OpenSecureTunnel(ctx context.Context, name, zone string, localPort, remotePort int) (*os.Process, error) {
+	return cloud.OpenMultiTunnel(ctx, name, zone, []PortMapping{{LocalPort: localPort, RemotePort: remotePort}})
+}
+
+// Open a single secure tunnel forwarding all the given ports.
+func (cloud GCECloud) OpenMultiTunnel(ctx context.Context, name, zone string, mappings []PortMapping) (*os.Process, error) {
+	target, err := cloud.sshTarget(ctx, name, zone)
+	if err != nil {
+		return nil, err
+	}
+	return target.OpenTunnel(ctx, "localhost", mappings)
+}
+
+// Implementation of the Cloud interface
+func (cloud GCECloud) RunCommand(ctx context.Context, name, zone, command string) (string, error) {
+	target, err := cloud.sshTarget(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Running %q on %s", command, name)
+	return target.Run(ctx, command)
+}
+
+// Run a command on the instance attached to the local standard streams,
+// allocating a pseudo-terminal when tty is set.
+func (cloud GCECloud) RunInteractiveCommand(ctx context.Context, name, zone, command string, tty bool) error {
+	target, err := cloud.sshTarget(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	return target.RunInteractive(ctx, command, tty)
+}
+
+// Copy a local file or directory to an instance.
+func (cloud GCECloud) CopyToInstance(ctx context.Context, name, zone, localPath, remotePath string) error {
+	target, err := cloud.sshTarget(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	return target.Copy(ctx, target.Path(remotePath), localPath)
+}
+
+// Copy a file or directory from an instance to the local machine.
+func (cloud GCECloud) CopyFromInstance(ctx context.Context, name, zone, remotePath, localPath string) error {
+	target, err := cloud.sshTarget(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	return target.Copy(ctx, localPath, target.Path(remotePath))
+}
+
+// Copy a file or directory directly from an instance to another one, see
+// SSHTarget.CopyTo.
+func (cloud GCECloud) CopyBetweenInstances(ctx context.Context, srcName, srcZone, remoteSrcPath, dstName, dstZone, remoteDstPath string) error {
+	src, err := cloud.sshTarget(ctx, srcName, srcZone)
+	if err != nil {
+		return err
+	}
+	dst, err := cloud.sshTarget(ctx, dstName, dstZone)
+	if err != nil {
+		return err
+	}
+	return src.CopyTo(ctx, remoteSrcPath, dst, remoteDstPath)
+}
+
+// Return the ssh login on an instance, refreshing its host keys first with
+// -ssh-strict-host-key-checking=yes.
+func (cloud GCECloud) sshTarget(ctx context.Context, name, zone string) (SSHTarget, error) {
+	ip, err := cloud.GetPublicIPAddress(ctx, name, zone)
+	if err != nil {
+		return SSHTarget{}, err
+	}
+	if cloud.options.SSH.StrictHostKeyChecking == "yes" {
+		if err := cloud.UpdateKnownHosts(ctx, name, zone); err != nil {
+			return SSHTarget{}, err
+		}
+	}
+	return SSHTarget{
+		Config:  cloud.options.SSH,
+		User:    os.Getenv("USER"),
+		Host:    ip,
+		KeyPath: GCESSHKeyPath(),
+	}, nil
+}
+
+// Record the SSH host keys the instance published in its guest attributes in
+// the -ssh-known-hosts-file.
+func (cloud GCECloud) UpdateKnownHosts(ctx context.Context, name, zone string) error {
+	ip, err := cloud.GetPublicIPAddress(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	attrs, err := cloud.service.Instances.GetGuestAttributes(cloud.projectId, zone, name).QueryPath("hostkeys/").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get the instance host keys: %v", err)
+	}
+	if attrs.QueryValue == nil || len(attrs.QueryValue.Items) == 0 {
+		return fmt.Errorf("instance %q published no host keys", name)
+	}
+	// Keep the entries of the other hosts.
+	lines := []string{}
+	if data, err := ioutil.ReadFile(cloud.options.SSH.KnownHostsFile); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" && !strings.HasPrefix(line, ip+" ") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	for _, key := range attrs.QueryValue.Items {
+		lines = append(lines, fmt.Sprintf("%s %s %s", ip, key.Key, key.Value))
+	}
+	if err := os.MkdirAll(path.Dir(cloud.options.SSH.KnownHostsFile), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cloud.options.SSH.KnownHostsFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// Return the email of the service account an instance runs as.
+func (cloud GCECloud) GetServiceAccountEmail(ctx context.Context, name, zone string) (string, error) {
+	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return "", gceError(err)
+	}
+	if len(instance.ServiceAccounts) == 0 {
+		return "", fmt.Errorf("instance %q has no service account", name)
+	}
+	return instance.ServiceAccounts[0].Email, nil
+}
+
+// Set a metadata value on an instance, replacing any previous value of key.
+func (cloud GCECloud) setInstanceMetadata(ctx context.Context, name, zone, key, value string) error {
+	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	metadata := instance.Metadata
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	found := false
+	for _, item := range metadata.Items {
+		if item.Key == key {
+			item.Value = googleapi.String(value)
+			found = true
+		}
+	}
+	if !found {
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{
+			Key:   key,
+			Value: googleapi.String(value),
+		})
+	}
+	op, err := cloud.service.Instances.SetMetadata(cloud.projectId, zone, name, metadata).Context(ctx).Do()
+	if err != nil {
+		log.Printf("set metadata api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, zone)
 }
 
-func (cloud GCECloud) openSecureTunnel(name, zone, hostname string, localPort, remotePort int) (*os.Process, error) {
-	ip, err := cloud.GetPublicIPAddress(name, zone)
+// Replace the startup script of an instance with the one of the spec, run
+// from the next boot on.
+func (cloud GCECloud) UpdateStartupScript(ctx context.Context, name, zone string, spec InstanceSpec) error {
+	script, err := startupScript(spec)
+	if err != nil {
+		return err
+	}
+	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return gceError(err)
+	}
+	metadata := &compute.Metadata{Fingerprint: instance.Metadata.Fingerprint}
+	for _, item := range instance.Metadata.Items {
+		if item.Key != "startup-script" && !strings.HasPrefix(item.Key, startupScriptChunkKey) {
+			metadata.Items = append(metadata.Items, item)
+		}
+	}
+	if err := addStartupScript(script, spec, metadata); err != nil {
+		return err
+	}
+	log.Printf("updating startup script of %q", name)
+	op, err := cloud.service.Instances.SetMetadata(cloud.projectId, zone, name, metadata).Context(ctx).Do()
+	if err != nil {
+		log.Printf("set metadata api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, zone)
+}
+
+// Enable interactive access to the serial ports of an instance.
+//
+// GCE has no per-port setting, serial-port-enable opens all four ports.
+// Anyone with access to the project can then reach them through the serial
+// console gateway (ssh-serialport.googleapis.com, port 9600).
+func (cloud GCECloud) EnableSerialConsolePort(ctx context.Context, name, zone string) error {
+	log.Printf("enabling serial ports on %q", name)
+	if err := cloud.setInstanceMetadata(ctx, name, zone, "serial-port-enable", "1"); err != nil {
+		if strings.Contains(err.Error(), "disableSerialPortAccess") {
+			return fmt.Errorf("serial port access is blocked by the compute.disableSerialPortAccess organization policy: %v", err)
+		}
+		return err
+	}
+	log.Printf("connect to port 1 with: ssh -p 9600 %s.%s.%s.%s.port=1@ssh-serialport.googleapis.com",
+		cloud.projectId, zone, name, os.Getenv("USER"))
+	return nil
+}
+
+// Disable interactive access to the serial ports of an instance.
+func (cloud GCECloud) DisableSerialConsolePort(ctx context.Context, name, zone string) error {
+	log.Printf("disabling serial ports on %q", name)
+	return cloud.setInstanceMetadata(ctx, name, zone, "serial-port-enable", "0")
+}
+
+// List the CPU platforms available in a zone.
+func (cloud GCECloud) ListCPUPlatforms(ctx context.Context, zone string) ([]string, error) {
+	z, err := cloud.service.Zones.Get(cloud.projectId, zone).Context(ctx).Do()
 	if err != nil {
 		return nil, err
 	}
-	username := os.Getenv("USER")
-	homedir := os.Getenv("HOME")
+	return z.AvailableCpuPlatforms, nil
+}
+
+// Set the minimum CPU platform of a stopped instance, e.g. "Intel Skylake".
+// The instance may be moved to another host when it starts again.
+func (cloud GCECloud) SetMinCPUPlatform(ctx context.Context, name, zone, platform string) error {
+	platforms, err := cloud.ListCPUPlatforms(ctx, zone)
+	if err != nil {
+		return err
+	}
+	valid := false
+	for _, p := range platforms {
+		valid = valid || p == platform
+	}
+	if !valid {
+		return fmt.Errorf("CPU platform %q not available in %s, want one of %q", platform, zone, platforms)
+	}
+	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if instance.Status != "TERMINATED" {
+		return ErrInstanceMustBeStopped
+	}
+	log.Printf("setting minimum CPU platform of %q to %q", name, platform)
+	op, err := cloud.service.Instances.SetMinCpuPlatform(cloud.projectId, zone, name, &compute.InstancesSetMinCpuPlatformRequest{
+		MinCpuPlatform: platform,
+	}).Context(ctx).Do()
+	if err != nil {
+		log.Printf("set min cpu platform api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, zone)
+}
+
+// Return the Cloud Console URL of the serial console for an instance.
+func (cloud GCECloud) GetInstanceConsoleURL(ctx context.Context, name, zone string) (string, error) {
+	_, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://console.cloud.google.com/compute/instances/serial-console?project=%s&zone=%s&instance=%s",
+		url.QueryEscape(cloud.projectId), url.QueryEscape(zone), url.QueryEscape(name)), nil
+}
+
+// Pin external IPs on a Cloud NAT gateway of a router, along with those it
+// already uses. The other gateways of the router are left alone.
+//   routerName The Cloud Router hosting the NAT configuration
+//   natName The NAT gateway to pin the IPs on, the first one when empty
+//   region The region of the router
+//   ips The reserved external IP addresses (or address resource URLs) to use
+// Returns an error if one occurs, or nil
+func (cloud GCECloud) SetNATExternalIPs(ctx context.Context, routerName, natName, region string, ips []string) error {
+	router, err := cloud.service.Routers.Get(cloud.projectId, region, routerName).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	if len(router.Nats) == 0 {
+		return fmt.Errorf("router %q has no NAT configuration", routerName)
+	}
+	nat := router.Nats[0]
+	if natName != "" {
+		nat = nil
+		for _, n := range router.Nats {
+			if n.Name == natName {
+				nat = n
+			}
+		}
+		if nat == nil {
+			return fmt.Errorf("router %q has no NAT %q", routerName, natName)
+		}
+	}
+	// Addresses are regional, their name is enough to tell them apart.
+	pinned := map[string]bool{}
+	for _, link := range nat.NatIps {
+		pinned[path.Base(link)] = true
+	}
+	for _, ip := range ips {
+		link, err := cloud.addressLink(ctx, ip, region)
+		if err != nil {
+			return err
+		}
+		if !pinned[path.Base(link)] {
+			pinned[path.Base(link)] = true
+			nat.NatIps = append(nat.NatIps, link)
+		}
+	}
+	nat.NatIpAllocateOption = "MANUAL_ONLY"
+	log.Printf("setting NAT %q external IPs on router %q: %v", nat.Name, routerName, nat.NatIps)
+	op, err := cloud.service.Routers.Patch(cloud.projectId, region, routerName, &compute.Router{
+		Nats: router.Nats,
+	}).Context(ctx).Do()
+	if err != nil {
+		log.Printf("router patch api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForRegionOp(ctx, op, region)
+}
+
+// Resolve a reserved external IP address to its address resource URL.
+func (cloud GCECloud) addressLink(ctx context.Context, ip, region string) (string, error) {
+	if strings.HasPrefix(ip, "https://") {
+		return ip, nil
+	}
+	addresses, err := cloud.service.Addresses.List(cloud.projectId, region).Filter(fmt.Sprintf("address=%q", ip)).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	if len(addresses.Items) == 0 {
+		return "", fmt.Errorf("no reserved address %q in region %q", ip, region)
+	}
+	return addresses.Items[0].SelfLink, nil
+}
+
+// Return the default zone configured for the project, or an empty string.
+func (cloud GCECloud) GetProjectDefaultZone(ctx context.Context) (string, error) {
+	project, err := cloud.service.Projects.Get(cloud.projectId).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	if project.CommonInstanceMetadata == nil {
+		return "", nil
+	}
+	for _, item := range project.CommonInstanceMetadata.Items {
+		if item.Key == "google-compute-default-zone" && item.Value != nil {
+			return *item.Value, nil
+		}
+	}
+	return "", nil
+}
 
-	sshCommand := fmt.Sprintf("-o LogLevel=quiet -o UserKnownHostsFile=/dev/null -o CheckHostIP=no -o StrictHostKeyChecking=no -i %s/.ssh/google_compute_engine -A -p 22 %s@%s -f -N -L %d:%s:%d", homedir, username, ip, localPort, hostname, remotePort)
-	log.Printf("Running %s", sshCommand)
-	cmd := exec.Command("ssh", strings.Split(sshCommand, " ")...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// Return the first non-empty zone out of the explicit one, the project default
+// and the hard-coded default.
+func ResolveZone(explicit, projectDefault, hardDefault string) string {
+	switch {
+	case explicit != "":
+		log.Printf("using zone %q from -zone", explicit)
+		return explicit
+	case projectDefault != "":
+		log.Printf("using project default zone %q", projectDefault)
+		return projectDefault
+	default:
+		log.Printf("using default zone %q", hardDefault)
+		return hardDefault
+	}
+}
+
+var (
+	invalidNameChars = regexp.MustCompile("[^a-z0-9-]+")
+	repeatedDashes   = regexp.MustCompile("-+")
+)
 
-	cmd.Run()
-	return cmd.Process, nil
+// Reduce a string to lowercase letters, digits and single dashes.
+func SanitizeNameSegment(s string) string {
+	s = invalidNameChars.ReplaceAllString(strings.ToLower(s), "-")
+	return strings.Trim(repeatedDashes.ReplaceAllString(s, "-"), "-")
+}
+
+// Turn a string into a valid GCE resource name: lowercase letters, digits
+// and dashes, starting with a letter and at most 63 characters long.
+func SanitizeInstanceName(name string) string {
+	name = SanitizeNameSegment(name)
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "docker-" + name
+	}
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// List the names of the instances of a zone ending with -suffix.
+func (cloud GCECloud) ListInstancesBySuffix(ctx context.Context, zone, suffix string) ([]string, error) {
+	names := []string{}
+	call := cloud.service.Instances.List(cloud.projectId, zone).Filter(fmt.Sprintf("name eq '.*-%s'", regexp.QuoteMeta(suffix)))
+	for {
+		list, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, instance := range list.Items {
+			names = append(names, instance.Name)
+		}
+		if list.NextPageToken == "" {
+			return names, nil
+		}
+		call.PageToken(list.NextPageToken)
+	}
+}
+
+// Return the region a zone belongs to, e.g. "us-central1" for "us-central1-a".
+func RegionForZone(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// Return the error of waiting for the named operation, ErrOperationTimeout
+// once the deadline of the context passed.
+func opTimeoutError(name string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: operation %s: %v", ErrOperationTimeout, name, err)
+	}
+	return err
 }
 
 // Wait for a compute operation to finish.
 //   op The operation
 //   zone The zone for the operation
 // Returns an error if one occurs, or nil
-func (cloud GCECloud) waitForOp(op *compute.Operation, zone string) error {
-	op, err := cloud.service.ZoneOperations.Get(cloud.projectId, zone, op.Name).Do()
-	for op.Status != "DONE" {
+func (cloud GCECloud) waitForOp(ctx context.Context, op *compute.Operation, zone string) error {
+	name := op.Name
+	op, err := cloud.service.ZoneOperations.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	for err == nil && op.Status != "DONE" {
 		fmt.Print(".")
-		time.Sleep(5 * time.Second)
-		op, err = cloud.service.ZoneOperations.Get(cloud.projectId, zone, op.Name).Do()
+		if err = sleep(ctx, 5*time.Second); err != nil {
+			break
+		}
+		op, err = cloud.service.ZoneOperations.Get(cloud.projectId, zone, name).Context(ctx).Do()
 		if err != nil {
 			log.Printf("Got compute.Operation, err: %#v, %v", op, err)
+			break
 		}
 		if op.Status != "PENDING" && op.Status != "RUNNING" && op.Status != "DONE" {
-			log.Printf("Error waiting for operation: %s\n", op)
-			return errors.New(fmt.Sprintf("Bad operation: %s", op))
+			log.Printf("Error waiting for operation: %v\n", op)
+			return errors.New(fmt.Sprintf("Bad operation: %v", op))
 		}
 	}
 	fmt.Print("\n")
-	return err
+	if err == nil {
+		return gceOpError(op)
+	}
+	return opTimeoutError(name, err)
+}
+
+// Wait for a regional compute operation to finish.
+func (cloud GCECloud) waitForRegionOp(ctx context.Context, op *compute.Operation, region string) error {
+	name := op.Name
+	op, err := cloud.service.RegionOperations.Get(cloud.projectId, region, name).Context(ctx).Do()
+	for err == nil && op.Status != "DONE" {
+		fmt.Print(".")
+		if err = sleep(ctx, 5*time.Second); err != nil {
+			break
+		}
+		op, err = cloud.service.RegionOperations.Get(cloud.projectId, region, name).Context(ctx).Do()
+		if err != nil {
+			log.Printf("Got compute.Operation, err: %#v, %v", op, err)
+		}
+	}
+	fmt.Print("\n")
+	if err == nil {
+		return gceOpError(op)
+	}
+	return opTimeoutError(name, err)
+}
+
+// Wait for a global compute operation to finish.
+func (cloud GCECloud) waitForGlobalOp(ctx context.Context, op *compute.Operation) error {
+	name := op.Name
+	op, err := cloud.service.GlobalOperations.Get(cloud.projectId, name).Context(ctx).Do()
+	for err == nil && op.Status != "DONE" {
+		fmt.Print(".")
+		if err = sleep(ctx, 5*time.Second); err != nil {
+			break
+		}
+		op, err = cloud.service.GlobalOperations.Get(cloud.projectId, name).Context(ctx).Do()
+		if err != nil {
+			log.Printf("Got compute.Operation, err: %#v, %v", op, err)
+		}
+	}
+	fmt.Print("\n")
+	if err == nil {
+		return gceOpError(op)
+	}
+	return opTimeoutError(name, err)
 }
@@ -0,0 +1,84 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	cloudbuild "google.golang.org/api/cloudbuild/v1"
+)
+
+// Substitutions populated by RunBuildTrigger, which callers may not override.
+var reservedSubstitutions = []string{"_INSTANCE_NAME", "_ZONE", "_PROJECT"}
+
+// Run a Cloud Build trigger against the Docker daemon of an instance and wait
+// for the build to finish. The daemon only listens on the instance loopback,
+// so the build has to reach it itself, e.g. with gcloud compute ssh -L.
+//   triggerId The Cloud Build trigger to run
+//   name The instance running the Docker daemon
+//   zone The zone of the instance
+//   substitutions Extra user substitutions for the build
+//   timeout How long to wait for the build before failing
+// Returns an error if one occurs, or nil
+func (cloud GCECloud) RunBuildTrigger(ctx context.Context, triggerId, name, zone string, substitutions map[string]string, timeout time.Duration) error {
+	for _, key := range reservedSubstitutions {
+		if _, ok := substitutions[key]; ok {
+			return fmt.Errorf("substitution %s is reserved", key)
+		}
+	}
+	subs := map[string]string{
+		"_INSTANCE_NAME": name,
+		"_ZONE":          zone,
+		"_PROJECT":       cloud.projectId,
+	}
+	for key, value := range substitutions {
+		subs[key] = value
+	}
+	log.Printf("running build trigger %q", triggerId)
+	op, err := cloud.cloudbuild.Projects.Locations.Triggers.Run(
+		fmt.Sprintf("projects/%s/locations/global/triggers/%s", cloud.projectId, triggerId),
+		&cloudbuild.RunBuildTriggerRequest{
+			ProjectId: cloud.projectId,
+			TriggerId: triggerId,
+			Source:    &cloudbuild.RepoSource{Substitutions: subs},
+		}).Context(ctx).Do()
+	if err != nil {
+		log.Printf("build trigger api call failed: %v", err)
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for !op.Done {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: build %s did not finish within %v", ErrOperationTimeout, op.Name, timeout)
+		}
+		fmt.Print(".")
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
+		op, err = cloud.cloudbuild.Operations.Get(op.Name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Print("\n")
+	if op.Error != nil {
+		return fmt.Errorf("build %s failed: %s", op.Name, op.Error.Message)
+	}
+	log.Printf("build trigger %q finished", triggerId)
+	return nil
+}
@@ -0,0 +1,117 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// The private key logging into the GCE instances.
+func GCESSHKeyPath() string {
+	return path.Join(os.Getenv("HOME"), ".ssh/google_compute_engine")
+}
+
+// The usage of a GCE quota.
+type Quota struct {
+	Metric string
+	Usage  float64
+	Limit  float64
+}
+
+// Check that the project can be read with the credentials.
+func (cloud GCECloud) CheckProjectAccess(ctx context.Context) error {
+	_, err := cloud.service.Projects.Get(cloud.projectId).Context(ctx).Do()
+	return err
+}
+
+// Return the quotas of a region.
+func (cloud GCECloud) GetRegionQuotas(ctx context.Context, region string) ([]Quota, error) {
+	r, err := cloud.service.Regions.Get(cloud.projectId, region).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	quotas := []Quota{}
+	for _, q := range r.Quotas {
+		quotas = append(quotas, Quota{Metric: q.Metric, Usage: q.Usage, Limit: q.Limit})
+	}
+	return quotas, nil
+}
+
+// Return the names of the firewall rules of the default network letting a
+// TCP port in from anywhere.
+func (cloud GCECloud) ListOpenFirewallRules(ctx context.Context, port int) ([]string, error) {
+	list, err := cloud.service.Firewalls.List(cloud.projectId).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, rule := range list.Items {
+		if path.Base(rule.Network) != "default" || !fromAnywhere(rule.SourceRanges) {
+			continue
+		}
+		for _, allowed := range rule.Allowed {
+			if (allowed.IPProtocol == "tcp" || allowed.IPProtocol == "all") && portsInclude(allowed.Ports, port) {
+				names = append(names, rule.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// Tell whether the source ranges of a firewall rule cover the internet.
+func fromAnywhere(ranges []string) bool {
+	for _, r := range ranges {
+		if r == "0.0.0.0/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell whether the ports of a firewall rule, such as "22" or "8000-9000",
+// include port. No ports means all of them.
+func portsInclude(ports []string, port int) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		if low <= port && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// Return a short description of a quota usage, such as "CPUS: 20/24".
+func (q Quota) String() string {
+	return fmt.Sprintf("%s: %g/%g", q.Metric, q.Usage, q.Limit)
+}
@@ -0,0 +1,82 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"log"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// Create a global TCP health check. Returns the URL of the health check.
+//   name The name of the health check
+//   port The TCP port to probe
+//   checkIntervalSec How often to probe
+//   timeoutSec How long to wait for a probe to succeed
+//   healthyThreshold The consecutive successes to consider a backend healthy
+//   unhealthyThreshold The consecutive failures to consider a backend unhealthy
+func (cloud GCECloud) CreateTCPHealthCheck(ctx context.Context, name string, port int, checkIntervalSec, timeoutSec, healthyThreshold, unhealthyThreshold int64) (string, error) {
+	log.Printf("creating health check: %q", name)
+	op, err := cloud.service.HealthChecks.Insert(cloud.projectId, &compute.HealthCheck{
+		Name:               name,
+		Description:        "Docker on GCE",
+		Type:               "TCP",
+		TcpHealthCheck:     &compute.TCPHealthCheck{Port: int64(port)},
+		CheckIntervalSec:   checkIntervalSec,
+		TimeoutSec:         timeoutSec,
+		HealthyThreshold:   healthyThreshold,
+		UnhealthyThreshold: unhealthyThreshold,
+	}).Context(ctx).Do()
+	if err != nil {
+		log.Printf("health check insert api call failed: %v", err)
+		return "", err
+	}
+	err = cloud.waitForGlobalOp(ctx, op)
+	if err != nil {
+		log.Printf("health check insert operation failed: %v", err)
+		return "", err
+	}
+	log.Printf("health check created: %q", op.TargetLink)
+	return op.TargetLink, nil
+}
+
+// Delete a global health check.
+func (cloud GCECloud) DeleteHealthCheck(ctx context.Context, name string) error {
+	log.Printf("deleting health check: %q", name)
+	op, err := cloud.service.HealthChecks.Delete(cloud.projectId, name).Context(ctx).Do()
+	if err != nil {
+		log.Printf("health check delete api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForGlobalOp(ctx, op)
+}
+
+// List the global health checks of the project.
+func (cloud GCECloud) ListHealthChecks(ctx context.Context) ([]*compute.HealthCheck, error) {
+	checks := []*compute.HealthCheck{}
+	call := cloud.service.HealthChecks.List(cloud.projectId)
+	for {
+		list, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, list.Items...)
+		if list.NextPageToken == "" {
+			return checks, nil
+		}
+		call.PageToken(list.NextPageToken)
+	}
+}
@@ -0,0 +1,342 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Implementation of the Cloud interface. Only the instances labeled as
+// managed by docker-cloud are listed, so none with -no-managed-tags.
+func (cloud GCECloud) ListInstances(ctx context.Context, zone string) ([]Instance, error) {
+	instances := []Instance{}
+	if zone != "" {
+		call := cloud.service.Instances.List(cloud.projectId, zone).Filter(ManagedFilter)
+		for {
+			list, err := call.Context(ctx).Do()
+			if err != nil {
+				return nil, err
+			}
+			for _, instance := range list.Items {
+				instances = append(instances, gceInstance(instance))
+			}
+			if list.NextPageToken == "" {
+				return instances, nil
+			}
+			call.PageToken(list.NextPageToken)
+		}
+	}
+	call := cloud.service.Instances.AggregatedList(cloud.projectId).Filter(ManagedFilter)
+	for {
+		list, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, scoped := range list.Items {
+			for _, instance := range scoped.Instances {
+				instances = append(instances, gceInstance(instance))
+			}
+		}
+		if list.NextPageToken == "" {
+			return instances, nil
+		}
+		call.PageToken(list.NextPageToken)
+	}
+}
+
+// Return the zone of an instance, managed or not, searching all the zones.
+// Returns ErrInstanceNotFound when no zone has it.
+func (cloud GCECloud) FindInstanceZone(ctx context.Context, name string) (string, error) {
+	list, err := cloud.service.Instances.AggregatedList(cloud.projectId).Filter(fmt.Sprintf("name eq '%s'", regexp.QuoteMeta(name))).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	for _, scoped := range list.Items {
+		for _, instance := range scoped.Instances {
+			if instance.Name == name {
+				return path.Base(instance.Zone), nil
+			}
+		}
+	}
+	return "", ErrInstanceNotFound
+}
+
+// Return the zones of a region, sorted.
+func (cloud GCECloud) ZonesInRegion(ctx context.Context, region string) ([]string, error) {
+	r, err := cloud.service.Regions.Get(cloud.projectId, region).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	zones := []string{}
+	for _, zone := range r.Zones {
+		zones = append(zones, path.Base(zone))
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// How long StartInstance and ResetInstance wait for docker once the instance is running.
+const gceDockerTimeout = 10 * time.Minute
+
+// Implementation of the Cloud interface. Stopped instances are only billed
+// for their disks and reserved IPs.
+func (cloud GCECloud) StopInstance(ctx context.Context, name string, zone string) error {
+	log.Printf("stopping instance: %q", name)
+	op, err := cloud.service.Instances.Stop(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return gceError(err)
+	}
+	if err := cloud.waitForOp(ctx, op, zone); err != nil {
+		return err
+	}
+	log.Print("instance stopped")
+	return nil
+}
+
+// Implementation of the Cloud interface. The startup script runs again on
+// boot, so docker comes back as configured.
+func (cloud GCECloud) StartInstance(ctx context.Context, name string, zone string) (string, error) {
+	log.Printf("starting instance: %q", name)
+	op, err := cloud.service.Instances.Start(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return "", gceError(err)
+	}
+	if err := cloud.waitForOp(ctx, op, zone); err != nil {
+		return "", err
+	}
+	ip, err := cloud.waitForDocker(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("instance started: %q", ip)
+	return ip, nil
+}
+
+// Hard reset a running instance, as with the reset button of a machine, for
+// when it stops answering. Returns its IP address, unchanged, once Docker is
+// up again. Unlike a reboot, the running processes get no chance to shut
+// down cleanly.
+func (cloud GCECloud) ResetInstance(ctx context.Context, name string, zone string) (string, error) {
+	log.Printf("resetting instance: %q", name)
+	op, err := cloud.service.Instances.Reset(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return "", gceError(err)
+	}
+	if err := cloud.waitForOp(ctx, op, zone); err != nil {
+		return "", err
+	}
+	ip, err := cloud.waitForDocker(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("instance reset: %q", ip)
+	return ip, nil
+}
+
+// Wait for docker to listen on a booting instance. Returns the instance IP.
+func (cloud GCECloud) waitForDocker(ctx context.Context, name, zone string) (string, error) {
+	target, err := cloud.sshTarget(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	if err := target.WaitForPort(ctx, startupDockerPort, gceDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	return target.Host, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud GCECloud) DescribeInstance(ctx context.Context, name string, zone string) (*Instance, error) {
+	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return nil, gceError(err)
+	}
+	result := gceInstance(instance)
+	return &result, nil
+}
+
+// The GCE specifics of an instance, beyond what DescribeInstance returns.
+type GCEInstanceDetails struct {
+	Disks []GCEAttachedDisk
+	// The startup script values are replaced by their size.
+	Metadata        map[string]string
+	Tags            []string
+	ServiceAccounts []string
+}
+
+// A disk attached to a GCE instance.
+type GCEAttachedDisk struct {
+	Name       string
+	Boot       bool
+	Mode       string
+	AutoDelete bool
+}
+
+// Return the disks, metadata, network tags and service accounts of an
+// instance.
+func (cloud GCECloud) DescribeInstanceDetails(ctx context.Context, name string, zone string) (*GCEInstanceDetails, error) {
+	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	if err != nil {
+		return nil, gceError(err)
+	}
+	details := &GCEInstanceDetails{Metadata: map[string]string{}}
+	for _, disk := range instance.Disks {
+		details.Disks = append(details.Disks, GCEAttachedDisk{
+			Name:       path.Base(disk.Source),
+			Boot:       disk.Boot,
+			Mode:       disk.Mode,
+			AutoDelete: disk.AutoDelete,
+		})
+	}
+	if instance.Metadata != nil {
+		for _, item := range instance.Metadata.Items {
+			value := ""
+			if item.Value != nil {
+				value = *item.Value
+			}
+			if item.Key == "startup-script" || strings.HasPrefix(item.Key, startupScriptChunkKey) {
+				value = fmt.Sprintf("<%d bytes>", len(value))
+			}
+			details.Metadata[item.Key] = value
+		}
+	}
+	if instance.Tags != nil {
+		details.Tags = instance.Tags.Items
+	}
+	for _, account := range instance.ServiceAccounts {
+		details.ServiceAccounts = append(details.ServiceAccounts, account.Email)
+	}
+	return details, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud GCECloud) Capabilities() Capabilities {
+	return Capabilities{ListInstances: true, StopStart: true, Resize: true, Snapshots: true}
+}
+
+// Return the name of a machine type given by name, such as "n1-standard-2",
+// or by reference, such as "/zones/us-central1-a/machineTypes/n1-standard-2".
+// The zone of a reference is dropped for zone, with a warning when they
+// differ.
+func machineTypeName(machineType, zone string) string {
+	parts := strings.Split(strings.Trim(machineType, "/"), "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "zones" && parts[i+1] != zone {
+			log.Printf("warning: using the machine type %q in zone %q, not in %q", path.Base(machineType), zone, parts[i+1])
+		}
+	}
+	return path.Base(machineType)
+}
+
+// Check that the machine type exists in the zone, and return its name.
+func (cloud GCECloud) resolveMachineType(ctx context.Context, machineType, zone string) (string, error) {
+	name := machineTypeName(machineType, zone)
+	_, err := cloud.service.MachineTypes.Get(cloud.projectId, zone, name).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return "", fmt.Errorf("unknown machine type %q in zone %q, list them with gcloud compute machine-types list --zones %s", name, zone, zone)
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Implementation of the Cloud interface. machineType is a machine type name
+// such as "n2-standard-8", or a reference to one.
+func (cloud GCECloud) ResizeInstance(ctx context.Context, name string, zone string, machineType string) error {
+	machineType, err := cloud.resolveMachineType(ctx, machineType, zone)
+	if err != nil {
+		return err
+	}
+	instance, err := cloud.DescribeInstance(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	if instance.MachineType == machineType {
+		return nil
+	}
+	running := instance.Status != StatusStopped
+	if running {
+		if err := cloud.StopInstance(ctx, name, zone); err != nil {
+			return err
+		}
+	}
+	log.Printf("setting machine type of %q to %q", name, machineType)
+	op, err := cloud.service.Instances.SetMachineType(cloud.projectId, zone, name, &compute.InstancesSetMachineTypeRequest{
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", zone, machineType),
+	}).Context(ctx).Do()
+	if err == nil {
+		err = cloud.waitForOp(ctx, op, zone)
+	}
+	if err != nil {
+		log.Printf("set machine type failed: %v", err)
+	}
+	if running {
+		// Bring the instance back even when the machine type didn't change.
+		if _, startErr := cloud.StartInstance(ctx, name, zone); err == nil {
+			err = startErr
+		}
+	}
+	return err
+}
+
+// The InstanceStatus of the GCE instance states. GCE calls stopped
+// instances TERMINATED.
+var gceStatuses = map[string]InstanceStatus{
+	"PROVISIONING": StatusProvisioning,
+	"STAGING":      StatusProvisioning,
+	"RUNNING":      StatusRunning,
+	"REPAIRING":    StatusRunning,
+	"STOPPING":     StatusStopped,
+	"STOPPED":      StatusStopped,
+	"SUSPENDING":   StatusStopped,
+	"SUSPENDED":    StatusStopped,
+	"TERMINATED":   StatusStopped,
+}
+
+// Convert a GCE instance, whose zone and machine type are URLs.
+func gceInstance(instance *compute.Instance) Instance {
+	result := Instance{
+		Name:        instance.Name,
+		Zone:        path.Base(instance.Zone),
+		Status:      gceStatuses[instance.Status],
+		MachineType: path.Base(instance.MachineType),
+		Labels:      instance.Labels,
+	}
+	result.CreationTime, _ = time.Parse(time.RFC3339, instance.CreationTimestamp)
+	result.LastStartTime, _ = time.Parse(time.RFC3339, instance.LastStartTimestamp)
+	if len(instance.NetworkInterfaces) > 0 {
+		nic := instance.NetworkInterfaces[0]
+		result.PrivateIP = nic.NetworkIP
+		if len(nic.AccessConfigs) > 0 {
+			result.PublicIP = nic.AccessConfigs[0].NatIP
+		}
+	}
+	return result
+}
@@ -0,0 +1,107 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// The label identifying the resources created by docker-cloud.
+const managedByLabel = "managed-by"
+
+// Filter matching the resources created by docker-cloud.
+const ManagedFilter = "labels." + managedByLabel + "=docker-cloud"
+
+var invalidLabelChars = regexp.MustCompile("[^a-z0-9_-]")
+
+// Turn a string into a valid GCE label value.
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// Return the labels applied to every resource created by docker-cloud.
+func managedLabels() map[string]string {
+	return map[string]string{
+		managedByLabel:         "docker-cloud",
+		"docker-cloud-version": labelValue(Version),
+		"created-at":           strconv.FormatInt(time.Now().Unix(), 10),
+		"created-by-user":      labelValue(os.Getenv("USER")),
+	}
+}
+
+// Apply the docker-cloud management labels to a resource, keeping its existing labels.
+//   resourceType The type of resource, "instance" or "disk"
+//   name The name of the resource
+//   zone The zone of the resource
+// Returns an error if one occurs, or nil
+func (cloud GCECloud) TagManagedResource(ctx context.Context, resourceType, name, zone string) error {
+	if cloud.options.NoManagedTags {
+		return nil
+	}
+	var op *compute.Operation
+	switch resourceType {
+	case "instance":
+		instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		op, err = cloud.service.Instances.SetLabels(cloud.projectId, zone, name, &compute.InstancesSetLabelsRequest{
+			Labels:           mergeLabels(instance.Labels, managedLabels()),
+			LabelFingerprint: instance.LabelFingerprint,
+		}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+	case "disk":
+		disk, err := cloud.service.Disks.Get(cloud.projectId, zone, name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		op, err = cloud.service.Disks.SetLabels(cloud.projectId, zone, name, &compute.ZoneSetLabelsRequest{
+			Labels:           mergeLabels(disk.Labels, managedLabels()),
+			LabelFingerprint: disk.LabelFingerprint,
+		}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("can't tag resources of type %q", resourceType)
+	}
+	return cloud.waitForOp(ctx, op, zone)
+}
+
+// Return the union of two label sets, the second one taking precedence.
+func mergeLabels(labels, extra map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,52 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const sentBytesMetric = "compute.googleapis.com/instance/network/sent_bytes_count"
+
+// Return the number of bytes an instance has sent since the given time, as
+// reported by Cloud Monitoring.
+func (cloud GCECloud) GetInternetEgress(ctx context.Context, name, zone string, since time.Time) (float64, error) {
+	filter := fmt.Sprintf("metric.type=%q AND resource.labels.zone=%q AND metric.labels.instance_name=%q",
+		sentBytesMetric, zone, name)
+	call := cloud.monitoring.Projects.TimeSeries.List("projects/" + cloud.projectId).
+		Filter(filter).
+		IntervalStartTime(since.UTC().Format(time.RFC3339)).
+		IntervalEndTime(time.Now().UTC().Format(time.RFC3339))
+	total := 0.0
+	for {
+		resp, err := call.Context(ctx).Do()
+		if err != nil {
+			return 0, err
+		}
+		for _, series := range resp.TimeSeries {
+			for _, point := range series.Points {
+				if point.Value != nil && point.Value.Int64Value != nil {
+					total += float64(*point.Value.Int64Value)
+				}
+			}
+		}
+		if resp.NextPageToken == "" {
+			return total, nil
+		}
+		call.PageToken(resp.NextPageToken)
+	}
+}
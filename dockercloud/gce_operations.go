@@ -0,0 +1,112 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// A GCE operation on an instance, as streamed by WatchInstanceOperations.
+type InstanceOperation struct {
+	Id string `json:"id"`
+	// The operation type, such as "insert", "attachDisk" or
+	// "compute.instances.preempted" for the system events.
+	Type       string    `json:"type"`
+	Status     string    `json:"status"`
+	Instance   string    `json:"instance"`
+	User       string    `json:"user,omitempty"`
+	InsertTime time.Time `json:"insertTime"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Stream the operations on an instance inserted after since, polling every
+// interval. An operation is sent again each time its status changes. The
+// system events, such as preemptions or live migrations, are operations
+// too. Both channels are closed when ctx is done or polling fails.
+func (cloud GCECloud) WatchInstanceOperations(ctx context.Context, name, zone string, since time.Time, interval time.Duration) (<-chan InstanceOperation, <-chan error) {
+	ops := make(chan InstanceOperation)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(ops)
+		seen := map[string]string{}
+		for {
+			list, err := cloud.listInstanceOperations(ctx, name, zone)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for _, op := range list {
+				if op.InsertTime.Before(since) || seen[op.Id] == op.Status {
+					continue
+				}
+				seen[op.Id] = op.Status
+				select {
+				case ops <- op:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
+			}
+			if err := sleep(ctx, interval); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return ops, errs
+}
+
+// List the operations on an instance, oldest first.
+func (cloud GCECloud) listInstanceOperations(ctx context.Context, name, zone string) ([]InstanceOperation, error) {
+	ops := []InstanceOperation{}
+	call := cloud.service.ZoneOperations.List(cloud.projectId, zone).Filter(fmt.Sprintf("targetLink eq '.*/zones/%s/instances/%s'", zone, name))
+	for {
+		list, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range list.Items {
+			ops = append(ops, gceInstanceOperation(op, name))
+		}
+		if list.NextPageToken == "" {
+			break
+		}
+		call.PageToken(list.NextPageToken)
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].InsertTime.Before(ops[j].InsertTime) })
+	return ops, nil
+}
+
+func gceInstanceOperation(op *compute.Operation, name string) InstanceOperation {
+	inserted, _ := time.Parse(time.RFC3339, op.InsertTime)
+	result := InstanceOperation{
+		Id:         op.Name,
+		Type:       op.OperationType,
+		Status:     op.Status,
+		Instance:   name,
+		User:       op.User,
+		InsertTime: inserted,
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		result.Error = op.Error.Errors[0].Message
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// A GCE resource created by docker-cloud that nothing uses anymore.
+type OrphanedResource struct {
+	// "disk" or "snapshot".
+	Kind string
+	Name string
+	// Empty for the global resources.
+	Zone         string
+	CreationTime time.Time
+}
+
+func (r OrphanedResource) String() string {
+	if r.Zone == "" {
+		return fmt.Sprintf("%s %q", r.Kind, r.Name)
+	}
+	return fmt.Sprintf("%s %q in %q", r.Kind, r.Name, r.Zone)
+}
+
+// Return the disks created by docker-cloud which are attached to no
+// instance, such as the root disks of deleted instances, in all the zones.
+func (cloud GCECloud) ListOrphanedDisks(ctx context.Context) ([]OrphanedResource, error) {
+	orphans := []OrphanedResource{}
+	call := cloud.service.Disks.AggregatedList(cloud.projectId).Filter(ManagedFilter)
+	for {
+		list, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, scoped := range list.Items {
+			for _, disk := range scoped.Disks {
+				if len(disk.Users) > 0 {
+					continue
+				}
+				created, _ := time.Parse(time.RFC3339, disk.CreationTimestamp)
+				orphans = append(orphans, OrphanedResource{"disk", disk.Name, path.Base(disk.Zone), created})
+			}
+		}
+		if list.NextPageToken == "" {
+			return orphans, nil
+		}
+		call.PageToken(list.NextPageToken)
+	}
+}
+
+// Return the snapshots created by docker-cloud whose source disk is gone.
+func (cloud GCECloud) ListDanglingSnapshots(ctx context.Context) ([]OrphanedResource, error) {
+	orphans := []OrphanedResource{}
+	call := cloud.service.Snapshots.List(cloud.projectId).Filter(ManagedFilter)
+	for {
+		list, err := call.Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, snapshot := range list.Items {
+			zone := path.Base(path.Dir(path.Dir(snapshot.SourceDisk)))
+			_, err := cloud.service.Disks.Get(cloud.projectId, zone, path.Base(snapshot.SourceDisk)).Context(ctx).Do()
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) || apiErr.Code != http.StatusNotFound {
+				continue
+			}
+			created, _ := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+			orphans = append(orphans, OrphanedResource{"snapshot", snapshot.Name, "", created})
+		}
+		if list.NextPageToken == "" {
+			return orphans, nil
+		}
+		call.PageToken(list.NextPageToken)
+	}
+}
+
+// Delete a snapshot.
+func (cloud GCECloud) DeleteSnapshot(ctx context.Context, name string) error {
+	if cloud.dryRun {
+		fmt.Printf("would delete snapshot: projects/%s/global/snapshots/%s\n", cloud.projectId, name)
+		return nil
+	}
+	log.Printf("deleting snapshot: %q", name)
+	op, err := cloud.service.Snapshots.Delete(cloud.projectId, name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	return cloud.waitForGlobalOp(ctx, op)
+}
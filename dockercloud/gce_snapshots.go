@@ -0,0 +1,47 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"log"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// Snapshot a disk, such as the instance root disk, with the given labels
+// added to the management ones. The disk of a running instance is snapshotted
+// as after a crash, so stop it first for a consistent docker state. Returns
+// the snapshot URL.
+func (cloud GCECloud) CreateSnapshot(ctx context.Context, diskName, zone, name string, labels map[string]string) (string, error) {
+	if !cloud.options.NoManagedTags {
+		labels = mergeLabels(managedLabels(), labels)
+	}
+	log.Printf("snapshotting disk %q to %q", diskName, name)
+	op, err := cloud.service.Disks.CreateSnapshot(cloud.projectId, zone, diskName, &compute.Snapshot{
+		Name:   name,
+		Labels: labels,
+	}).Context(ctx).Do()
+	if err != nil {
+		log.Printf("create snapshot api call failed: %v", err)
+		return "", err
+	}
+	if err := cloud.waitForOp(ctx, op, zone); err != nil {
+		log.Printf("create snapshot operation failed: %v", err)
+		return "", err
+	}
+	log.Printf("snapshot created: %q", op.TargetLink)
+	return op.TargetLink, nil
+}
@@ -0,0 +1,71 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"log"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Grant the service account of an instance the given role on a GCS bucket.
+func (cloud GCECloud) GrantGCSAccess(ctx context.Context, bucketName, instanceName, zone string, role string) error {
+	return cloud.updateBucketBinding(ctx, bucketName, instanceName, zone, role, true)
+}
+
+// Revoke a role on a GCS bucket from the service account of an instance.
+func (cloud GCECloud) RevokeGCSAccess(ctx context.Context, bucketName, instanceName, zone string, role string) error {
+	return cloud.updateBucketBinding(ctx, bucketName, instanceName, zone, role, false)
+}
+
+// Add or remove the instance service account from the bucket IAM binding for role.
+func (cloud GCECloud) updateBucketBinding(ctx context.Context, bucketName, instanceName, zone, role string, grant bool) error {
+	email, err := cloud.GetServiceAccountEmail(ctx, instanceName, zone)
+	if err != nil {
+		return err
+	}
+	member := "serviceAccount:" + email
+	policy, err := cloud.storage.Buckets.GetIamPolicy(bucketName).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	var binding *storage.PolicyBindings
+	for _, b := range policy.Bindings {
+		if b.Role == role {
+			binding = b
+			break
+		}
+	}
+	if binding == nil {
+		binding = &storage.PolicyBindings{Role: role}
+		policy.Bindings = append(policy.Bindings, binding)
+	}
+	members := []string{}
+	for _, m := range binding.Members {
+		if m != member {
+			members = append(members, m)
+		}
+	}
+	if grant {
+		members = append(members, member)
+		log.Printf("granting %s on gs://%s to %s", role, bucketName, email)
+	} else {
+		log.Printf("revoking %s on gs://%s from %s", role, bucketName, email)
+	}
+	binding.Members = members
+	_, err = cloud.storage.Buckets.SetIamPolicy(bucketName, policy).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,73 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// Return a GCECloud whose compute operations never finish.
+func pendingOpCloud(t *testing.T) GCECloud {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&compute.Operation{Name: "op-1", Status: "RUNNING"})
+	}))
+	t.Cleanup(server.Close)
+	service, err := compute.NewService(context.Background(), option.WithEndpoint(server.URL), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return GCECloud{service: service, projectId: "project"}
+}
+
+func TestWaitForOpTimeout(t *testing.T) {
+	cloud := pendingOpCloud(t)
+	op := &compute.Operation{Name: "op-1"}
+	waits := map[string]func(context.Context) error{
+		"zone":   func(ctx context.Context) error { return cloud.waitForOp(ctx, op, "us-central1-a") },
+		"region": func(ctx context.Context) error { return cloud.waitForRegionOp(ctx, op, "us-central1") },
+		"global": func(ctx context.Context) error { return cloud.waitForGlobalOp(ctx, op) },
+	}
+	for kind, wait := range waits {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := wait(ctx)
+		cancel()
+		if !errors.Is(err, ErrOperationTimeout) {
+			t.Errorf("%s: got %v, want ErrOperationTimeout", kind, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "op-1") {
+			t.Errorf("%s: %q doesn't name the operation", kind, err)
+		}
+	}
+}
+
+func TestWaitForOpCanceled(t *testing.T) {
+	cloud := pendingOpCloud(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err := cloud.waitForOp(ctx, &compute.Operation{Name: "op-1"}, "us-central1-a")
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrOperationTimeout) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,83 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// The directory of the gcloud SDK configuration.
+func gcloudConfigDir() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return dir
+	}
+	return path.Join(os.Getenv("HOME"), ".config/gcloud")
+}
+
+// Return the active project of the gcloud SDK configuration, empty when
+// there is none. Reads the properties files, falling back to gcloud itself.
+func GcloudProject() string {
+	if project := os.Getenv("CLOUDSDK_CORE_PROJECT"); project != "" {
+		return project
+	}
+	dir := gcloudConfigDir()
+	name := os.Getenv("CLOUDSDK_ACTIVE_CONFIG_NAME")
+	if name == "" {
+		data, _ := os.ReadFile(path.Join(dir, "active_config"))
+		name = strings.TrimSpace(string(data))
+	}
+	if name == "" {
+		name = "default"
+	}
+	// The properties file predates the named configurations.
+	for _, file := range []string{path.Join(dir, "configurations", "config_"+name), path.Join(dir, "properties")} {
+		if project := iniValue(file, "core", "project"); project != "" {
+			return project
+		}
+	}
+	out, err := exec.Command("gcloud", "config", "get-value", "project").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Return the value of a key in a section of an INI file, empty when the
+// file or the key is missing.
+func iniValue(file, section, key string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if ok && current == section && strings.TrimSpace(k) == key {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// The settings of a generic Cloud.
+type GenericConfig struct {
+	Options
+	// The hostname or IP of the existing host to run docker on.
+	Host string
+	// The user to log into the host, a sudoer.
+	User string
+	// The ssh port of the host.
+	Port int
+	// The private key to log into the host.
+	SSHKeyPath string
+	// Also uninstall docker and remove its data when deleting the host instance.
+	Purge bool
+}
+
+// The file marking a host as provisioned by docker-cloud.
+const genericProvisionedMarker = "/var/lib/docker-cloud/provisioned"
+
+// Where the docker settings of the host that the startup script overwrites
+// are kept until the host is uninstalled.
+const genericBackupDir = "/var/lib/docker-cloud/backup"
+
+// The docker settings written by the startup script on systemd hosts.
+const genericDockerSettings = "/etc/docker/daemon.json /etc/systemd/system/docker.service.d/docker-cloud.conf"
+
+// Back up the docker settings of the host before the first provisioning.
+const genericBackupScript = `if ! test -f %[1]s; then
+  for f in %[3]s; do
+    if test -e $f; then mkdir -p %[2]s$(dirname $f) && cp -p $f %[2]s$f; fi
+  done
+fi
+`
+
+// Undo the startup script, restoring the docker settings of the host, and
+// with -generic-purge remove docker altogether, only with apt.
+const genericUninstallScript = `#!/bin/bash
+if %[3]t && ! command -v apt-get >/dev/null; then
+  echo "-generic-purge only knows how to uninstall docker with apt-get" >&2
+  exit 1
+fi
+rm -f %[1]s
+iptables -D INPUT -p tcp --dport %[2]d ! -i lo -j DROP 2>/dev/null
+sed -i '/-H :%[2]d/d' /etc/default/docker 2>/dev/null
+for f in %[5]s; do
+  if test -e %[4]s$f; then cp -p %[4]s$f $f; else rm -f $f; fi
+done
+rm -rf %[4]s
+systemctl daemon-reload 2>/dev/null
+if %[3]t; then
+  service docker stop
+  apt-get purge -y docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin
+  rm -rf /var/lib/docker /var/lib/containerd /etc/docker
+else
+  service docker restart
+fi
+`
+
+// A Cloud implementation for a Linux host that already exists, reached with
+// ssh. Creating the instance installs docker on the host with the startup
+// script and deleting it uninstalls it: the instance name and zone are
+// ignored.
+type GenericCloud struct {
+	unsupported
+	sshInstances
+
+	host   string
+	config GenericConfig
+}
+
+// Create a generic Cloud instance.
+func NewGenericCloud(config GenericConfig) (Cloud, error) {
+	if config.Host == "" {
+		return nil, errors.New("-generic-host must be set")
+	}
+	cloud := &GenericCloud{host: config.Host, config: config}
+	// The host is the only instance, whatever its name.
+	cloud.sshInstances = sshInstances{target: func(ctx context.Context, name, zone string) (SSHTarget, error) {
+		return cloud.target(), nil
+	}}
+	return cloud, nil
+}
+
+// Implementation of the Cloud interface. Empty until the host is
+// provisioned.
+func (cloud GenericCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	_, err := cloud.target().Run(ctx, "test -f "+genericProvisionedMarker)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return "", fmt.Errorf("%w: %s is not provisioned", ErrInstanceNotFound, cloud.host)
+	}
+	if err != nil {
+		return "", err
+	}
+	return cloud.host, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud GenericCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The host may well be on the internet without a firewall.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	backup := fmt.Sprintf(genericBackupScript, genericProvisionedMarker, genericBackupDir, genericDockerSettings)
+	shebang := strings.Index(script, "\n") + 1
+	script = script[:shebang] + backup + script[shebang:]
+	script += fmt.Sprintf("mkdir -p %s && touch %s\n", path.Dir(genericProvisionedMarker), genericProvisionedMarker)
+	log.Printf("provisioning host: %q", cloud.host)
+	if err := cloud.target().RunScript(ctx, script); err != nil {
+		log.Printf("failed to provision host: %v", err)
+		return "", err
+	}
+	log.Printf("host provisioned: %q", cloud.host)
+	return cloud.host, nil
+}
+
+// Implementation of the Cloud interface. The host itself is left running.
+func (cloud GenericCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	log.Printf("uninstalling docker-cloud from %q", cloud.host)
+	script := fmt.Sprintf(genericUninstallScript, genericProvisionedMarker, startupDockerPort, cloud.config.Purge, genericBackupDir, genericDockerSettings)
+	if err := cloud.target().RunScript(ctx, script); err != nil {
+		return err
+	}
+	log.Print("docker-cloud uninstalled")
+	return nil
+}
+
+// Return the ssh login on the host, whose host keys are trusted on first use.
+func (cloud GenericCloud) target() SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.User, Host: cloud.host, Port: cloud.config.Port, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,285 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The settings of a Hetzner Cloud.
+type HetznerConfig struct {
+	Options
+	// The Hetzner Cloud API token, $HCLOUD_TOKEN when empty.
+	Token string
+	// The Hetzner Cloud server type.
+	ServerType string
+	// The Hetzner Cloud image.
+	Image string
+	// The private key to log into the servers, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	hcloudAPI = "https://api.hetzner.cloud/v1"
+
+	// The names of the ssh key and firewall created by docker-cloud.
+	hcloudSSHKeyName = "docker-cloud"
+	hcloudFirewall   = "docker-cloud"
+
+	hcloudTimeout       = 5 * time.Minute
+	hcloudDockerTimeout = 10 * time.Minute
+)
+
+// A Hetzner Cloud implementation of the Cloud interface. Zones are Hetzner
+// locations such as "fsn1".
+type HetznerCloud struct {
+	unsupported
+	sshInstances
+
+	token  string
+	client *http.Client
+	config HetznerConfig
+}
+
+// Create a Hetzner Cloud instance.
+func NewHetznerCloud(config HetznerConfig) (Cloud, error) {
+	token := config.Token
+	if token == "" {
+		token = os.Getenv("HCLOUD_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.New("-hcloud-token or HCLOUD_TOKEN must be set")
+	}
+	cloud := &HetznerCloud{token: token, client: &http.Client{Timeout: 30 * time.Second}, config: config}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call the Hetzner Cloud API.
+func (cloud HetznerCloud) call(ctx context.Context, method, path string, body, result interface{}) error {
+	header := http.Header{"Authorization": {"Bearer " + cloud.token}}
+	return callJSON(ctx, cloud.client, "hcloud", method, hcloudAPI+path, header, body, result)
+}
+
+type hcloudServer struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Datacenter struct {
+		Location struct {
+			Name string `json:"name"`
+		} `json:"location"`
+	} `json:"datacenter"`
+	PublicNet struct {
+		IPv4 struct {
+			IP string `json:"ip"`
+		} `json:"ipv4"`
+	} `json:"public_net"`
+}
+
+// Find the server with the given name in a location.
+func (cloud HetznerCloud) findServer(ctx context.Context, name, zone string) (*hcloudServer, error) {
+	var resp struct {
+		Servers []hcloudServer `json:"servers"`
+	}
+	if err := cloud.call(ctx, "GET", "/servers?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, s := range resp.Servers {
+		if s.Datacenter.Location.Name == zone {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: server %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud HetznerCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	server, err := cloud.findServer(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return server.PublicNet.IPv4.IP, nil
+}
+
+// Register the -hcloud-ssh-key-path public key, generating the key pair
+// first if needed. Returns the key id.
+func (cloud HetznerCloud) ensureSSHKey(ctx context.Context) (int, error) {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return 0, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		SSHKeys []struct {
+			Id int `json:"id"`
+		} `json:"ssh_keys"`
+	}
+	fingerprint := ssh.FingerprintLegacyMD5(key)
+	if err := cloud.call(ctx, "GET", "/ssh_keys?fingerprint="+url.QueryEscape(fingerprint), nil, &resp); err != nil {
+		return 0, err
+	}
+	if len(resp.SSHKeys) > 0 {
+		return resp.SSHKeys[0].Id, nil
+	}
+	log.Printf("registering ssh key: %q", hcloudSSHKeyName)
+	var created struct {
+		SSHKey struct {
+			Id int `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err = cloud.call(ctx, "POST", "/ssh_keys", map[string]string{
+		"name":       hcloudSSHKeyName,
+		"public_key": strings.TrimSpace(string(publicKey)),
+	}, &created)
+	return created.SSHKey.Id, err
+}
+
+// Get or create the firewall of the servers, only letting ssh in so that
+// docker is only reached through the tunnel. Returns the firewall id.
+func (cloud HetznerCloud) ensureFirewall(ctx context.Context) (int, error) {
+	var resp struct {
+		Firewalls []struct {
+			Id int `json:"id"`
+		} `json:"firewalls"`
+	}
+	if err := cloud.call(ctx, "GET", "/firewalls?name="+hcloudFirewall, nil, &resp); err != nil {
+		return 0, err
+	}
+	if len(resp.Firewalls) > 0 {
+		return resp.Firewalls[0].Id, nil
+	}
+	log.Printf("creating firewall: %q", hcloudFirewall)
+	var created struct {
+		Firewall struct {
+			Id int `json:"id"`
+		} `json:"firewall"`
+	}
+	err := cloud.call(ctx, "POST", "/firewalls", map[string]interface{}{
+		"name": hcloudFirewall,
+		"rules": []map[string]interface{}{{
+			"direction":  "in",
+			"protocol":   "tcp",
+			"port":       "22",
+			"source_ips": []string{"0.0.0.0/0", "::/0"},
+		}},
+	}, &created)
+	return created.Firewall.Id, err
+}
+
+// Implementation of the Cloud interface
+func (cloud HetznerCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	keyId, err := cloud.ensureSSHKey(ctx)
+	if err != nil {
+		log.Printf("failed to register ssh key: %v", err)
+		return "", err
+	}
+	firewallId, err := cloud.ensureFirewall(ctx)
+	if err != nil {
+		log.Printf("failed to create firewall: %v", err)
+		return "", err
+	}
+	server := map[string]interface{}{
+		"name":        name,
+		"location":    zone,
+		"server_type": cloud.config.ServerType,
+		"image":       cloud.config.Image,
+		"ssh_keys":    []int{keyId},
+		"firewalls":   []map[string]int{{"firewall": firewallId}},
+		// Passed to cloud-init, which runs scripts as is.
+		"user_data": script,
+	}
+	if !cloud.config.NoManagedTags {
+		server["labels"] = map[string]string{managedByLabel: "docker-cloud"}
+	}
+	log.Printf("starting server: %q", name)
+	var created struct {
+		Server hcloudServer `json:"server"`
+	}
+	if err := cloud.call(ctx, "POST", "/servers", server, &created); err != nil {
+		log.Printf("server create api call failed: %v", err)
+		return "", err
+	}
+	if err := cloud.waitForServer(ctx, created.Server.Id); err != nil {
+		log.Printf("server failed to start: %v", err)
+		return "", err
+	}
+	ip := created.Server.PublicNet.IPv4.IP
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, hcloudDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("server started: %q", ip)
+	return ip, nil
+}
+
+// Wait until a server is running.
+func (cloud HetznerCloud) waitForServer(ctx context.Context, id int) error {
+	deadline := time.Now().Add(hcloudTimeout)
+	for {
+		var resp struct {
+			Server hcloudServer `json:"server"`
+		}
+		if err := cloud.call(ctx, "GET", fmt.Sprintf("/servers/%d", id), nil, &resp); err != nil {
+			return err
+		}
+		if resp.Server.Status == "running" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w waiting for server %d to run", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud HetznerCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	server, err := cloud.findServer(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting server")
+	err = cloud.call(ctx, "DELETE", fmt.Sprintf("/servers/%d", server.Id), nil, nil)
+	if err == nil {
+		log.Print("server deleted")
+	}
+	return err
+}
+
+// Return the ssh login on a server, whose host keys are trusted on first use.
+func (cloud HetznerCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
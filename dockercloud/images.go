@@ -0,0 +1,111 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The GCE image family of an OS, always resolving to its current image.
+func gceFamily(project, family string) string {
+	return "https://www.googleapis.com/compute/v1/projects/" + project + "/global/images/family/" + family
+}
+
+// The images of each OS alias on a provider, and the provider flag they go
+// to.
+var osImages = map[string]struct {
+	flag   string
+	images map[string]string
+}{
+	"gce": {"image", map[string]string{
+		"debian-11":    gceFamily("debian-cloud", "debian-11"),
+		"debian-12":    gceFamily("debian-cloud", "debian-12"),
+		"ubuntu-22.04": gceFamily("ubuntu-os-cloud", "ubuntu-2204-lts"),
+		"ubuntu-24.04": gceFamily("ubuntu-os-cloud", "ubuntu-2404-lts-amd64"),
+	}},
+	"azure": {"azure-image", map[string]string{
+		"debian-11":    "Debian:debian-11:11-gen2:latest",
+		"debian-12":    "Debian:debian-12:12-gen2:latest",
+		"ubuntu-22.04": "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest",
+		"ubuntu-24.04": "Canonical:ubuntu-24_04-lts:server:latest",
+	}},
+	"digitalocean": {"do-image", map[string]string{
+		"debian-11":    "debian-11-x64",
+		"debian-12":    "debian-12-x64",
+		"ubuntu-22.04": "ubuntu-22-04-x64",
+		"ubuntu-24.04": "ubuntu-24-04-x64",
+	}},
+	"hetzner": {"hcloud-image", map[string]string{
+		"debian-11":    "debian-11",
+		"debian-12":    "debian-12",
+		"ubuntu-22.04": "ubuntu-22.04",
+		"ubuntu-24.04": "ubuntu-24.04",
+	}},
+	"linode": {"linode-image", map[string]string{
+		"debian-11":    "linode/debian11",
+		"debian-12":    "linode/debian12",
+		"ubuntu-22.04": "linode/ubuntu22.04",
+		"ubuntu-24.04": "linode/ubuntu24.04",
+	}},
+	"packet": {"packet-os", map[string]string{
+		"debian-11":    "debian_11",
+		"debian-12":    "debian_12",
+		"ubuntu-22.04": "ubuntu_22_04",
+		"ubuntu-24.04": "ubuntu_24_04",
+	}},
+	"scaleway": {"scw-image", map[string]string{
+		"debian-11":    "debian_bullseye",
+		"debian-12":    "debian_bookworm",
+		"ubuntu-22.04": "ubuntu_jammy",
+		"ubuntu-24.04": "ubuntu_noble",
+	}},
+}
+
+// The OS aliases docker-cloud can't start an instance with, and why.
+var unavailableOS = map[string]string{
+	"debian-7":     "its images were deleted",
+	"ubuntu-14.04": "its images were deleted",
+	"coreos":       "CoreOS Container Linux reached its end of life",
+	"cos":          "Container-Optimized OS has no package manager to install docker with",
+}
+
+// Return the image flag of the provider and its value for an OS alias such
+// as debian-12 or ubuntu-22.04.
+func ResolveOS(provider, name string) (flagName, image string, err error) {
+	p, ok := osImages[provider]
+	if !ok {
+		return "", "", fmt.Errorf("-os is not supported by the %s provider, pick the image with its flags", provider)
+	}
+	image, ok = p.images[name]
+	if reason, unavailable := unavailableOS[name]; !ok && unavailable {
+		return "", "", fmt.Errorf("OS %q is no longer available: %s", name, reason)
+	}
+	if !ok {
+		return "", "", fmt.Errorf("unknown OS %q on %s, want one of %s", name, provider, strings.Join(OSAliases(provider), ", "))
+	}
+	return p.flag, image, nil
+}
+
+// Return the OS aliases of a provider, sorted.
+func OSAliases(provider string) []string {
+	aliases := []string{}
+	for alias := range osImages[provider].images {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
@@ -0,0 +1,259 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The settings of a libvirt Cloud.
+type LibvirtConfig struct {
+	Options
+	// The libvirt connection URI.
+	URI string
+	// The base qcow2 image path or URL, with cloud-init.
+	BaseImage string
+	// The libvirt network of the domains.
+	Network string
+	// The number of vCPUs of the domain.
+	CPUs int
+	// The memory of the domain in MB.
+	Memory int
+	// The size of the domain disk.
+	DiskSize string
+	// Where the base image and the domain disks are stored, readable by qemu.
+	StorageDir string
+	// The default user of the base image.
+	SSHUser string
+	// The private key to log into the domains, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	libvirtLeaseTimeout  = 5 * time.Minute
+	libvirtDockerTimeout = 10 * time.Minute
+)
+
+var libvirtDomain = template.Must(template.New("domain").Parse(`<domain type='kvm'>
+  <name>{{.Name}}</name>
+  <memory unit='MiB'>{{.Memory}}</memory>
+  <vcpu>{{.CPUs}}</vcpu>
+  <os><type arch='x86_64'>hvm</type></os>
+  <features><acpi/><apic/></features>
+  <cpu mode='host-passthrough'/>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source file='{{.Disk}}'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+    <disk type='file' device='cdrom'>
+      <driver name='qemu' type='raw'/>
+      <source file='{{.Seed}}'/>
+      <target dev='sda' bus='sata'/>
+      <readonly/>
+    </disk>
+    <interface type='network'>
+      <source network='{{.Network}}'/>
+      <model type='virtio'/>
+    </interface>
+    <serial type='pty'><target port='0'/></serial>
+    <console type='pty'><target type='serial' port='0'/></console>
+  </devices>
+</domain>
+`))
+
+// A libvirt/KVM implementation of the Cloud interface, driving virsh and
+// qemu-img. The domains boot a copy-on-write overlay of -libvirt-base-image
+// and the zone is ignored.
+type LibvirtCloud struct {
+	unsupported
+	sshInstances
+
+	config LibvirtConfig
+}
+
+// Create a libvirt Cloud instance.
+func NewLibvirtCloud(config LibvirtConfig) (Cloud, error) {
+	for _, command := range []string{"virsh", "qemu-img"} {
+		if !lookPath(command) {
+			return nil, fmt.Errorf("%s not found, is libvirt installed?", command)
+		}
+	}
+	cloud := &LibvirtCloud{config: config}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Run virsh on -libvirt-uri and return its standard output.
+func (cloud LibvirtCloud) virsh(args ...string) (string, error) {
+	cmd := exec.Command("virsh", append([]string{"-c", cloud.config.URI}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("virsh %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// Implementation of the Cloud interface. The address is the DHCP lease of
+// the domain on -libvirt-network.
+func (cloud LibvirtCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	out, err := cloud.virsh("domifaddr", name, "--source", "lease")
+	if err != nil && strings.Contains(err.Error(), "failed to get domain") {
+		return "", fmt.Errorf("%w: domain %q", ErrInstanceNotFound, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	// e.g. " vnet0      52:54:00:12:34:56    ipv4         192.168.122.10/24"
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 4 && fields[2] == "ipv4" {
+			return strings.SplitN(fields[3], "/", 2)[0], nil
+		}
+	}
+	return "", nil
+}
+
+// Return the path of the base image, downloading it first when it is a URL.
+func (cloud LibvirtCloud) ensureBaseImage(ctx context.Context) (string, error) {
+	if !strings.HasPrefix(cloud.config.BaseImage, "http://") && !strings.HasPrefix(cloud.config.BaseImage, "https://") {
+		return cloud.config.BaseImage, nil
+	}
+	return downloadImage(ctx, cloud.config.BaseImage, cloud.config.StorageDir)
+}
+
+// Implementation of the Cloud interface
+func (cloud LibvirtCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		log.Printf("failed to get ssh key: %v", err)
+		return "", err
+	}
+	base, err := cloud.ensureBaseImage(ctx)
+	if err != nil {
+		log.Printf("failed to get base image: %v", err)
+		return "", err
+	}
+	dir := filepath.Join(cloud.config.StorageDir, name)
+	seed, err := writeCloudInitSeed(dir, name, string(publicKey), script)
+	if err != nil {
+		log.Printf("failed to write cloud-init seed: %v", err)
+		return "", err
+	}
+	disk := filepath.Join(dir, "disk.qcow2")
+	cmd := exec.Command("qemu-img", "create", "-q", "-f", "qcow2", "-F", "qcow2", "-b", base, disk, cloud.config.DiskSize)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("failed to create disk: %v", err)
+		return "", err
+	}
+	xml := filepath.Join(dir, "domain.xml")
+	f, err := os.Create(xml)
+	if err != nil {
+		return "", err
+	}
+	err = libvirtDomain.Execute(f, map[string]interface{}{
+		"Name":    name,
+		"Memory":  cloud.config.Memory,
+		"CPUs":    cloud.config.CPUs,
+		"Disk":    disk,
+		"Seed":    seed,
+		"Network": cloud.config.Network,
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	log.Printf("starting domain: %q", name)
+	if _, err := cloud.virsh("define", xml); err != nil {
+		log.Printf("failed to define domain: %v", err)
+		return "", err
+	}
+	if _, err := cloud.virsh("start", name); err != nil {
+		log.Printf("failed to start domain: %v", err)
+		return "", err
+	}
+	ip, err := cloud.waitForLease(ctx, name)
+	if err != nil {
+		log.Printf("domain got no address: %v", err)
+		return "", err
+	}
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, libvirtDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("domain started: %q", ip)
+	return ip, nil
+}
+
+// Wait until the domain gets a DHCP lease.
+func (cloud LibvirtCloud) waitForLease(ctx context.Context, name string) (string, error) {
+	deadline := time.Now().Add(libvirtLeaseTimeout)
+	for {
+		ip, err := cloud.GetPublicIPAddress(ctx, name, "")
+		if err != nil || ip != "" {
+			return ip, err
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("%w waiting for a lease for %q", ErrOperationTimeout, name)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud LibvirtCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	state, err := cloud.virsh("domstate", name)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting domain")
+	if strings.TrimSpace(state) == "running" {
+		if _, err := cloud.virsh("destroy", name); err != nil {
+			return err
+		}
+	}
+	if _, err := cloud.virsh("undefine", name); err != nil {
+		return err
+	}
+	log.Print("domain deleted")
+	return os.RemoveAll(filepath.Join(cloud.config.StorageDir, name))
+}
+
+// Return the ssh login on a domain, whose host keys are trusted on first use.
+func (cloud LibvirtCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
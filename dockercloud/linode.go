@@ -0,0 +1,265 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The settings of a Linode Cloud.
+type LinodeConfig struct {
+	Options
+	// The Linode API token, $LINODE_TOKEN when empty.
+	Token string
+	// The Linode plan.
+	Type string
+	// The Linode image.
+	Image string
+	// The private key to log into the Linodes, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	linodeAPI = "https://api.linode.com/v4"
+
+	// The private StackScript installing docker, kept in sync with the startup script.
+	linodeStackScript = "docker-cloud"
+
+	linodeTimeout       = 5 * time.Minute
+	linodeDockerTimeout = 10 * time.Minute
+)
+
+// A Linode implementation of the Cloud interface. Zones are Linode regions
+// such as "us-east".
+type LinodeCloud struct {
+	unsupported
+	sshInstances
+
+	token  string
+	client *http.Client
+	config LinodeConfig
+}
+
+// Create a Linode Cloud instance.
+func NewLinodeCloud(config LinodeConfig) (Cloud, error) {
+	token := config.Token
+	if token == "" {
+		token = os.Getenv("LINODE_TOKEN")
+	}
+	if token == "" {
+		return nil, errors.New("-linode-token or LINODE_TOKEN must be set")
+	}
+	cloud := &LinodeCloud{token: token, client: &http.Client{Timeout: 30 * time.Second}, config: config}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call the Linode API. filter, when not nil, restricts the listed objects.
+func (cloud LinodeCloud) call(ctx context.Context, method, path string, filter map[string]interface{}, body, result interface{}) error {
+	header := http.Header{"Authorization": {"Bearer " + cloud.token}}
+	if filter != nil {
+		b, err := json.Marshal(filter)
+		if err != nil {
+			return err
+		}
+		header.Set("X-Filter", string(b))
+	}
+	return callJSON(ctx, cloud.client, "linode", method, linodeAPI+path, header, body, result)
+}
+
+type linode struct {
+	Id     int      `json:"id"`
+	Label  string   `json:"label"`
+	Status string   `json:"status"`
+	Region string   `json:"region"`
+	IPv4   []string `json:"ipv4"`
+}
+
+// Return the public IPv4 address of the Linode.
+func (l linode) publicIP() string {
+	for _, ip := range l.IPv4 {
+		if parsed := net.ParseIP(ip); parsed != nil && !parsed.IsPrivate() {
+			return ip
+		}
+	}
+	return ""
+}
+
+// Find the Linode with the given label in a region.
+func (cloud LinodeCloud) findLinode(ctx context.Context, name, zone string) (*linode, error) {
+	var resp struct {
+		Data []linode `json:"data"`
+	}
+	err := cloud.call(ctx, "GET", "/linode/instances", map[string]interface{}{"label": name, "region": zone}, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("%w: linode %q in %q", ErrInstanceNotFound, name, zone)
+	}
+	return &resp.Data[0], nil
+}
+
+// Implementation of the Cloud interface
+func (cloud LinodeCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	l, err := cloud.findLinode(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return l.publicIP(), nil
+}
+
+// Create or update the StackScript running the startup script. Returns its id.
+func (cloud LinodeCloud) ensureStackScript(ctx context.Context, script string) (int, error) {
+	var resp struct {
+		Data []struct {
+			Id int `json:"id"`
+		} `json:"data"`
+	}
+	err := cloud.call(ctx, "GET", "/linode/stackscripts", map[string]interface{}{"label": linodeStackScript, "mine": true}, nil, &resp)
+	if err != nil {
+		return 0, err
+	}
+	stackScript := map[string]interface{}{
+		"label":       linodeStackScript,
+		"description": "Docker on Linode",
+		"images":      []string{cloud.config.Image},
+		"script":      script,
+		"is_public":   false,
+	}
+	var saved struct {
+		Id int `json:"id"`
+	}
+	if len(resp.Data) > 0 {
+		err = cloud.call(ctx, "PUT", fmt.Sprintf("/linode/stackscripts/%d", resp.Data[0].Id), nil, stackScript, &saved)
+	} else {
+		log.Printf("creating stackscript: %q", linodeStackScript)
+		err = cloud.call(ctx, "POST", "/linode/stackscripts", nil, stackScript, &saved)
+	}
+	return saved.Id, err
+}
+
+// Return a random root password, required by the API although the Linodes
+// are only logged into with the ssh key.
+func randomPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Implementation of the Cloud interface
+func (cloud LinodeCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The Linodes have no firewall by default.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	stackScriptId, err := cloud.ensureStackScript(ctx, script)
+	if err != nil {
+		log.Printf("failed to save stackscript: %v", err)
+		return "", err
+	}
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		log.Printf("failed to get ssh key: %v", err)
+		return "", err
+	}
+	rootPass, err := randomPassword()
+	if err != nil {
+		return "", err
+	}
+	instance := map[string]interface{}{
+		"label":           name,
+		"region":          zone,
+		"type":            cloud.config.Type,
+		"image":           cloud.config.Image,
+		"root_pass":       rootPass,
+		"authorized_keys": []string{strings.TrimSpace(string(publicKey))},
+		"stackscript_id":  stackScriptId,
+	}
+	if !cloud.config.NoManagedTags {
+		instance["tags"] = []string{"docker-cloud"}
+	}
+	log.Printf("starting linode: %q", name)
+	var created linode
+	if err := cloud.call(ctx, "POST", "/linode/instances", nil, instance, &created); err != nil {
+		log.Printf("linode create api call failed: %v", err)
+		return "", err
+	}
+	if err := cloud.waitForLinode(ctx, created.Id); err != nil {
+		log.Printf("linode failed to start: %v", err)
+		return "", err
+	}
+	ip := created.publicIP()
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, linodeDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("linode started: %q", ip)
+	return ip, nil
+}
+
+// Wait until a Linode is running.
+func (cloud LinodeCloud) waitForLinode(ctx context.Context, id int) error {
+	deadline := time.Now().Add(linodeTimeout)
+	for {
+		var l linode
+		if err := cloud.call(ctx, "GET", fmt.Sprintf("/linode/instances/%d", id), nil, nil, &l); err != nil {
+			return err
+		}
+		if l.Status == "running" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w waiting for linode %d to run", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud LinodeCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	l, err := cloud.findLinode(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting linode")
+	err = cloud.call(ctx, "DELETE", fmt.Sprintf("/linode/instances/%d", l.Id), nil, nil, nil)
+	if err == nil {
+		log.Print("linode deleted")
+	}
+	return err
+}
+
+// Return the ssh login on a Linode, whose host keys are trusted on first use.
+func (cloud LinodeCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
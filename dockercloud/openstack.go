@@ -0,0 +1,589 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The settings of an OpenStack Cloud.
+type OpenStackConfig struct {
+	Options
+	// The OpenStack flavor name or id.
+	Flavor string
+	// The OpenStack image name or id.
+	Image string
+	// The network of the instances, the only project network when empty.
+	Network string
+	// The external network to allocate floating IPs from.
+	FloatingNetwork string
+	// The Nova key pair to log into the instances.
+	KeyName string
+	// The user to log into the instances.
+	SSHUser string
+	// The private key of -openstack-key-name, generated if missing.
+	SSHKeyPath string
+	// The security group of the instances, created if missing.
+	SecurityGroup string
+}
+
+const (
+	osServerTimeout = 10 * time.Minute
+	osDockerTimeout = 10 * time.Minute
+)
+
+// An OpenStack Nova/Neutron implementation of the Cloud interface.
+// Zones are Nova availability zones such as "nova".
+type OpenStackCloud struct {
+	unsupported
+	sshInstances
+
+	authURL       string
+	username      string
+	password      string
+	userDomain    string
+	projectName   string
+	projectId     string
+	projectDomain string
+	region        string
+	client        *http.Client
+	token         *openStackToken
+	config        OpenStackConfig
+}
+
+// The cached keystone token and the endpoints of its catalog.
+type openStackToken struct {
+	sync.Mutex
+	id        string
+	expiry    time.Time
+	endpoints map[string]string
+}
+
+// Create an OpenStack Cloud instance, authenticated with the standard OS_AUTH_URL,
+// OS_USERNAME, OS_PASSWORD, OS_PROJECT_NAME or OS_PROJECT_ID, OS_USER_DOMAIN_NAME,
+// OS_PROJECT_DOMAIN_NAME and OS_REGION_NAME variables.
+func NewOpenStackCloud(config OpenStackConfig) (Cloud, error) {
+	cloud := &OpenStackCloud{
+		config:        config,
+		authURL:       strings.TrimSuffix(os.Getenv("OS_AUTH_URL"), "/"),
+		username:      os.Getenv("OS_USERNAME"),
+		password:      os.Getenv("OS_PASSWORD"),
+		userDomain:    envOr("OS_USER_DOMAIN_NAME", "Default"),
+		projectName:   os.Getenv("OS_PROJECT_NAME"),
+		projectId:     os.Getenv("OS_PROJECT_ID"),
+		projectDomain: envOr("OS_PROJECT_DOMAIN_NAME", "Default"),
+		region:        os.Getenv("OS_REGION_NAME"),
+		client:        &http.Client{Timeout: 60 * time.Second},
+		token:         &openStackToken{},
+	}
+	if cloud.authURL == "" || cloud.username == "" || cloud.password == "" || (cloud.projectName == "" && cloud.projectId == "") {
+		return nil, errors.New("OS_AUTH_URL, OS_USERNAME, OS_PASSWORD and OS_PROJECT_NAME or OS_PROJECT_ID must be set")
+	}
+	if !strings.HasSuffix(cloud.authURL, "/v3") {
+		cloud.authURL += "/v3"
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Return the value of an environment variable, or def if it is unset.
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// An error returned by an OpenStack API.
+type openStackError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *openStackError) Error() string {
+	return fmt.Sprintf("openstack: %d: %s", e.StatusCode, e.Message)
+}
+
+// Report whether err is an OpenStack error with the given status code.
+func isOpenStackStatus(err error, status int) bool {
+	var e *openStackError
+	return errors.As(err, &e) && e.StatusCode == status
+}
+
+// Authenticate with keystone if the cached token expired. Returns the token id
+// and the public endpoints of the region by service type.
+func (cloud OpenStackCloud) authenticate(ctx context.Context) (string, map[string]string, error) {
+	cloud.token.Lock()
+	defer cloud.token.Unlock()
+	if time.Now().Before(cloud.token.expiry) {
+		return cloud.token.id, cloud.token.endpoints, nil
+	}
+	project := map[string]interface{}{"id": cloud.projectId}
+	if cloud.projectId == "" {
+		project = map[string]interface{}{
+			"name":   cloud.projectName,
+			"domain": map[string]string{"name": cloud.projectDomain},
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"password"},
+				"password": map[string]interface{}{
+					"user": map[string]interface{}{
+						"name":     cloud.username,
+						"password": cloud.password,
+						"domain":   map[string]string{"name": cloud.userDomain},
+					},
+				},
+			},
+			"scope": map[string]interface{}{"project": project},
+		},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", cloud.authURL+"/auth/tokens", bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", nil, fmt.Errorf("keystone authentication failed: %s", resp.Status)
+	}
+	var token struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Catalog   []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					Region    string `json:"region"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", nil, err
+	}
+	endpoints := map[string]string{}
+	for _, service := range token.Token.Catalog {
+		for _, e := range service.Endpoints {
+			if e.Interface == "public" && (cloud.region == "" || e.Region == cloud.region) {
+				endpoints[service.Type] = strings.TrimSuffix(e.URL, "/")
+			}
+		}
+	}
+	cloud.token.id = resp.Header.Get("X-Subject-Token")
+	// Renew a minute early to not race the expiry.
+	cloud.token.expiry = token.Token.ExpiresAt.Add(-time.Minute)
+	cloud.token.endpoints = endpoints
+	return cloud.token.id, endpoints, nil
+}
+
+// Call the API of a service type ("compute", "network" or "image"), encoding
+// body and decoding the response into result when not nil.
+func (cloud OpenStackCloud) call(ctx context.Context, service, method, path string, body, result interface{}) error {
+	token, endpoints, err := cloud.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	endpoint, ok := endpoints[service]
+	if !ok {
+		return fmt.Errorf("no public %s endpoint in the keystone catalog", service)
+	}
+	if service == "network" && !strings.HasSuffix(endpoint, "/v2.0") {
+		endpoint += "/v2.0"
+	}
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		// Errors are wrapped in a type specific key, e.g. {"itemNotFound": {"message": ...}}.
+		var errResp map[string]struct {
+			Message string `json:"message"`
+		}
+		message := resp.Status
+		if json.Unmarshal(data, &errResp) == nil {
+			for _, e := range errResp {
+				if e.Message != "" {
+					message = e.Message
+				}
+			}
+		}
+		return &openStackError{StatusCode: resp.StatusCode, Message: message}
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+type osServer struct {
+	Id               string `json:"id"`
+	Status           string `json:"status"`
+	AvailabilityZone string `json:"OS-EXT-AZ:availability_zone"`
+}
+
+// Find the server with the given name in an availability zone.
+func (cloud OpenStackCloud) findServer(ctx context.Context, name, zone string) (*osServer, error) {
+	var resp struct {
+		Servers []osServer `json:"servers"`
+	}
+	// The name filter is a regular expression.
+	filter := url.QueryEscape("^" + regexp.QuoteMeta(name) + "$")
+	if err := cloud.call(ctx, "compute", "GET", "/servers/detail?name="+filter, nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, s := range resp.Servers {
+		if s.AvailabilityZone == zone {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: server %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Return the id of a named Neutron resource such as "networks" or
+// "security-groups".
+func (cloud OpenStackCloud) findNetworkResource(ctx context.Context, collection, name string) (string, error) {
+	var resp map[string][]struct {
+		Id string `json:"id"`
+	}
+	if err := cloud.call(ctx, "network", "GET", "/"+collection+"?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return "", err
+	}
+	for _, items := range resp {
+		if len(items) > 0 {
+			return items[0].Id, nil
+		}
+	}
+	return "", nil
+}
+
+// Return the floating IP of a server, allocating one from
+// -openstack-floating-network if it has none.
+func (cloud OpenStackCloud) floatingIP(ctx context.Context, serverId string) (string, error) {
+	var ports struct {
+		Ports []struct {
+			Id string `json:"id"`
+		} `json:"ports"`
+	}
+	if err := cloud.call(ctx, "network", "GET", "/ports?device_id="+serverId, nil, &ports); err != nil {
+		return "", err
+	}
+	if len(ports.Ports) == 0 {
+		return "", fmt.Errorf("server %q has no network port", serverId)
+	}
+	portId := ports.Ports[0].Id
+	var ips struct {
+		FloatingIPs []struct {
+			Address string `json:"floating_ip_address"`
+		} `json:"floatingips"`
+	}
+	if err := cloud.call(ctx, "network", "GET", "/floatingips?port_id="+portId, nil, &ips); err != nil {
+		return "", err
+	}
+	if len(ips.FloatingIPs) > 0 {
+		return ips.FloatingIPs[0].Address, nil
+	}
+	networkId, err := cloud.findNetworkResource(ctx, "networks", cloud.config.FloatingNetwork)
+	if err != nil {
+		return "", err
+	}
+	if networkId == "" {
+		return "", fmt.Errorf("floating network %q not found", cloud.config.FloatingNetwork)
+	}
+	log.Printf("allocating floating IP from %q", cloud.config.FloatingNetwork)
+	var created struct {
+		FloatingIP struct {
+			Address string `json:"floating_ip_address"`
+		} `json:"floatingip"`
+	}
+	err = cloud.call(ctx, "network", "POST", "/floatingips", map[string]interface{}{
+		"floatingip": map[string]string{"floating_network_id": networkId, "port_id": portId},
+	}, &created)
+	return created.FloatingIP.Address, err
+}
+
+// Implementation of the Cloud interface. Allocates a floating IP to the
+// instance if it has none.
+func (cloud OpenStackCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	server, err := cloud.findServer(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return cloud.floatingIP(ctx, server.Id)
+}
+
+// Get or create the -openstack-security-group security group, allowing ssh
+// from anywhere and the docker port only between its members.
+func (cloud OpenStackCloud) ensureSecurityGroup(ctx context.Context) error {
+	groupId, err := cloud.findNetworkResource(ctx, "security-groups", cloud.config.SecurityGroup)
+	if err != nil || groupId != "" {
+		return err
+	}
+	log.Printf("creating security group: %q", cloud.config.SecurityGroup)
+	var created struct {
+		SecurityGroup struct {
+			Id string `json:"id"`
+		} `json:"security_group"`
+	}
+	err = cloud.call(ctx, "network", "POST", "/security-groups", map[string]interface{}{
+		"security_group": map[string]string{"name": cloud.config.SecurityGroup, "description": "Docker on OpenStack"},
+	}, &created)
+	if err != nil {
+		return err
+	}
+	groupId = created.SecurityGroup.Id
+	rules := []map[string]interface{}{
+		{"port_range_min": 22, "port_range_max": 22, "remote_ip_prefix": "0.0.0.0/0"},
+		{"port_range_min": startupDockerPort, "port_range_max": startupDockerPort, "remote_group_id": groupId},
+	}
+	for _, rule := range rules {
+		rule["security_group_id"] = groupId
+		rule["direction"] = "ingress"
+		rule["ethertype"] = "IPv4"
+		rule["protocol"] = "tcp"
+		err := cloud.call(ctx, "network", "POST", "/security-group-rules", map[string]interface{}{"security_group_rule": rule}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve a flavor name or id to its id.
+func (cloud OpenStackCloud) resolveFlavor(ctx context.Context, nameOrId string) (string, error) {
+	var resp struct {
+		Flavors []struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"flavors"`
+	}
+	if err := cloud.call(ctx, "compute", "GET", "/flavors", nil, &resp); err != nil {
+		return "", err
+	}
+	for _, flavor := range resp.Flavors {
+		if flavor.Id == nameOrId || flavor.Name == nameOrId {
+			return flavor.Id, nil
+		}
+	}
+	return "", fmt.Errorf("flavor %q not found", nameOrId)
+}
+
+// Resolve an image name to its id, assuming an id when no image has that name.
+func (cloud OpenStackCloud) resolveImage(ctx context.Context, nameOrId string) (string, error) {
+	var resp struct {
+		Images []struct {
+			Id string `json:"id"`
+		} `json:"images"`
+	}
+	if err := cloud.call(ctx, "image", "GET", "/v2/images?name="+url.QueryEscape(nameOrId), nil, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Images) == 0 {
+		return nameOrId, nil
+	}
+	return resp.Images[0].Id, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud OpenStackCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		log.Printf("failed to get ssh key: %v", err)
+		return "", err
+	}
+	err = cloud.call(ctx, "compute", "POST", "/os-keypairs", map[string]interface{}{
+		"keypair": map[string]string{"name": cloud.config.KeyName, "public_key": strings.TrimSpace(string(publicKey))},
+	}, nil)
+	if err != nil && !isOpenStackStatus(err, http.StatusConflict) {
+		log.Printf("failed to import key pair: %v", err)
+		return "", err
+	}
+	if err := cloud.ensureSecurityGroup(ctx); err != nil {
+		log.Printf("failed to create security group: %v", err)
+		return "", err
+	}
+	flavorId, err := cloud.resolveFlavor(ctx, cloud.config.Flavor)
+	if err != nil {
+		return "", err
+	}
+	imageId, err := cloud.resolveImage(ctx, cloud.config.Image)
+	if err != nil {
+		return "", err
+	}
+	server := map[string]interface{}{
+		"name":              name,
+		"imageRef":          imageId,
+		"flavorRef":         flavorId,
+		"key_name":          cloud.config.KeyName,
+		"availability_zone": zone,
+		"security_groups":   []map[string]string{{"name": cloud.config.SecurityGroup}},
+		"user_data":         base64.StdEncoding.EncodeToString([]byte(script)),
+	}
+	if !cloud.config.NoManagedTags {
+		server["metadata"] = map[string]string{managedByLabel: "docker-cloud"}
+	}
+	if cloud.config.Network != "" {
+		networkId, err := cloud.findNetworkResource(ctx, "networks", cloud.config.Network)
+		if err != nil {
+			return "", err
+		}
+		if networkId == "" {
+			return "", fmt.Errorf("network %q not found", cloud.config.Network)
+		}
+		server["networks"] = []map[string]string{{"uuid": networkId}}
+	}
+	log.Printf("starting server: %q", name)
+	var created struct {
+		Server osServer `json:"server"`
+	}
+	if err := cloud.call(ctx, "compute", "POST", "/servers", map[string]interface{}{"server": server}, &created); err != nil {
+		log.Printf("server create api call failed: %v", err)
+		return "", err
+	}
+	if err := cloud.waitForServer(ctx, created.Server.Id, "ACTIVE"); err != nil {
+		log.Printf("server failed to start: %v", err)
+		return "", err
+	}
+	ip, err := cloud.floatingIP(ctx, created.Server.Id)
+	if err != nil {
+		log.Printf("failed to allocate floating IP: %v", err)
+		return "", err
+	}
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, osDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("server started: %q", ip)
+	return ip, nil
+}
+
+// Wait until a server reaches the given status, or is gone for "DELETED".
+func (cloud OpenStackCloud) waitForServer(ctx context.Context, id, status string) error {
+	deadline := time.Now().Add(osServerTimeout)
+	for {
+		var resp struct {
+			Server osServer `json:"server"`
+		}
+		err := cloud.call(ctx, "compute", "GET", "/servers/"+id, nil, &resp)
+		if status == "DELETED" && isOpenStackStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Server.Status == status {
+			return nil
+		}
+		if resp.Server.Status == "ERROR" {
+			return fmt.Errorf("server %q is in error", id)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w waiting for server %q to be %s", ErrOperationTimeout, id, status)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Implementation of the Cloud interface. The floating IPs of the instance are
+// released along.
+func (cloud OpenStackCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	server, err := cloud.findServer(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting server")
+	var ports struct {
+		Ports []struct {
+			Id string `json:"id"`
+		} `json:"ports"`
+	}
+	if err := cloud.call(ctx, "network", "GET", "/ports?device_id="+server.Id, nil, &ports); err != nil {
+		return err
+	}
+	for _, port := range ports.Ports {
+		var ips struct {
+			FloatingIPs []struct {
+				Id string `json:"id"`
+			} `json:"floatingips"`
+		}
+		if err := cloud.call(ctx, "network", "GET", "/floatingips?port_id="+port.Id, nil, &ips); err != nil {
+			return err
+		}
+		for _, ip := range ips.FloatingIPs {
+			if err := cloud.call(ctx, "network", "DELETE", "/floatingips/"+ip.Id, nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cloud.call(ctx, "compute", "DELETE", "/servers/"+server.Id, nil, nil); err != nil {
+		return err
+	}
+	err = cloud.waitForServer(ctx, server.Id, "DELETED")
+	log.Print("server deleted")
+	return err
+}
+
+// Return the ssh login on a server, whose host keys are trusted on first use.
+func (cloud OpenStackCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,255 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The settings of a Packet Cloud.
+type PacketConfig struct {
+	Options
+	// The Equinix Metal API token, $METAL_AUTH_TOKEN when empty.
+	Token string
+	// The Equinix Metal project id, $METAL_PROJECT_ID when empty.
+	Project string
+	// The Equinix Metal plan.
+	Plan string
+	// The Equinix Metal operating system slug.
+	OS string
+	// The private key to log into the devices, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	packetAPI = "https://api.equinix.com/metal/v1"
+
+	// The label of the ssh key registered by docker-cloud.
+	packetSSHKeyLabel = "docker-cloud"
+
+	// Bare metal takes a while to provision.
+	packetTimeout       = 30 * time.Minute
+	packetDockerTimeout = 10 * time.Minute
+)
+
+// A Packet (Equinix Metal) implementation of the Cloud interface, running
+// docker on bare-metal devices. Zones are metros such as "da".
+type PacketCloud struct {
+	unsupported
+	sshInstances
+
+	token     string
+	projectId string
+	client    *http.Client
+	config    PacketConfig
+}
+
+// Create a Packet Cloud instance.
+func NewPacketCloud(config PacketConfig) (Cloud, error) {
+	cloud := &PacketCloud{
+		config:    config,
+		token:     config.Token,
+		projectId: config.Project,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}
+	if cloud.token == "" {
+		cloud.token = os.Getenv("METAL_AUTH_TOKEN")
+	}
+	if cloud.projectId == "" {
+		cloud.projectId = os.Getenv("METAL_PROJECT_ID")
+	}
+	if cloud.token == "" || cloud.projectId == "" {
+		return nil, errors.New("-packet-token and -packet-project must be set")
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call the Equinix Metal API.
+func (cloud PacketCloud) call(ctx context.Context, method, path string, body, result interface{}) error {
+	header := http.Header{"X-Auth-Token": {cloud.token}}
+	return callJSON(ctx, cloud.client, "packet", method, packetAPI+path, header, body, result)
+}
+
+type packetDevice struct {
+	Id       string `json:"id"`
+	Hostname string `json:"hostname"`
+	State    string `json:"state"`
+	Metro    struct {
+		Code string `json:"code"`
+	} `json:"metro"`
+	IPAddresses []struct {
+		Address       string `json:"address"`
+		AddressFamily int    `json:"address_family"`
+		Public        bool   `json:"public"`
+	} `json:"ip_addresses"`
+}
+
+// Return the public IPv4 address of the device.
+func (d packetDevice) publicIP() string {
+	for _, ip := range d.IPAddresses {
+		if ip.Public && ip.AddressFamily == 4 {
+			return ip.Address
+		}
+	}
+	return ""
+}
+
+// Find the device with the given hostname in a metro.
+func (cloud PacketCloud) findDevice(ctx context.Context, name, zone string) (*packetDevice, error) {
+	var resp struct {
+		Devices []packetDevice `json:"devices"`
+	}
+	path := "/projects/" + cloud.projectId + "/devices?per_page=1000&hostname=" + url.QueryEscape(name)
+	if err := cloud.call(ctx, "GET", path, nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, d := range resp.Devices {
+		if d.Hostname == name && d.Metro.Code == zone {
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: device %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud PacketCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	device, err := cloud.findDevice(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return device.publicIP(), nil
+}
+
+// Register the -packet-ssh-key-path public key with the project, generating
+// the key pair first if needed. The project keys are installed on the devices.
+func (cloud PacketCloud) ensureSSHKey(ctx context.Context) error {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimSpace(string(publicKey))
+	var resp struct {
+		SSHKeys []struct {
+			Key string `json:"key"`
+		} `json:"ssh_keys"`
+	}
+	if err := cloud.call(ctx, "GET", "/projects/"+cloud.projectId+"/ssh-keys", nil, &resp); err != nil {
+		return err
+	}
+	for _, k := range resp.SSHKeys {
+		if strings.TrimSpace(k.Key) == key {
+			return nil
+		}
+	}
+	log.Printf("registering ssh key: %q", packetSSHKeyLabel)
+	return cloud.call(ctx, "POST", "/projects/"+cloud.projectId+"/ssh-keys", map[string]string{
+		"label": packetSSHKeyLabel,
+		"key":   key,
+	}, nil)
+}
+
+// Implementation of the Cloud interface
+func (cloud PacketCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The devices are directly on the internet.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	if err := cloud.ensureSSHKey(ctx); err != nil {
+		log.Printf("failed to register ssh key: %v", err)
+		return "", err
+	}
+	device := map[string]interface{}{
+		"hostname":         name,
+		"metro":            zone,
+		"plan":             cloud.config.Plan,
+		"operating_system": cloud.config.OS,
+		"userdata":         script,
+	}
+	if !cloud.config.NoManagedTags {
+		device["tags"] = []string{managedByLabel + "=docker-cloud"}
+	}
+	log.Printf("provisioning device: %q", name)
+	var created packetDevice
+	if err := cloud.call(ctx, "POST", "/projects/"+cloud.projectId+"/devices", device, &created); err != nil {
+		log.Printf("device create api call failed: %v", err)
+		return "", err
+	}
+	active, err := cloud.waitForDevice(ctx, created.Id)
+	if err != nil {
+		log.Printf("device failed to provision: %v", err)
+		return "", err
+	}
+	ip := active.publicIP()
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, packetDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("device provisioned: %q", ip)
+	return ip, nil
+}
+
+// Wait until a device is active.
+func (cloud PacketCloud) waitForDevice(ctx context.Context, id string) (*packetDevice, error) {
+	deadline := time.Now().Add(packetTimeout)
+	for {
+		var device packetDevice
+		if err := cloud.call(ctx, "GET", "/devices/"+id, nil, &device); err != nil {
+			return nil, err
+		}
+		switch device.State {
+		case "active":
+			return &device, nil
+		case "failed":
+			return nil, fmt.Errorf("device %q failed to provision", id)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for device %q to be active", ErrOperationTimeout, id)
+		}
+		log.Printf("device %q is %s", id, device.State)
+		if err := sleep(ctx, 30*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud PacketCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	device, err := cloud.findDevice(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting device")
+	err = cloud.call(ctx, "DELETE", "/devices/"+device.Id, nil, nil)
+	if err == nil {
+		log.Print("device deleted")
+	}
+	return err
+}
+
+// Return the ssh login on a device, whose host keys are trusted on first use.
+func (cloud PacketCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,386 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// The prefix of the external provider plugin binaries in $PATH, as in
+	// docker-cloud-provider-<name>.
+	pluginPrefix = "docker-cloud-provider-"
+
+	// The version of the protocol spoken with the plugins, bumped on
+	// incompatible changes.
+	pluginProtocolVersion = 1
+)
+
+// The provider implemented by an external plugin. ssh tunnels are opened by
+// docker-cloud itself, to the login the plugin returns.
+type PluginProvider interface {
+	GetPublicIPAddress(ctx context.Context, name, zone string) (string, error)
+	CreateInstance(ctx context.Context, name, zone string, spec InstanceSpec) (string, error)
+	DeleteInstance(ctx context.Context, name, zone string) error
+	RunCommand(ctx context.Context, name, zone, command string) (string, error)
+	// Return the ssh login on an instance.
+	SSHTarget(ctx context.Context, name, zone string) (SSHTarget, error)
+}
+
+// The arguments of the plugin calls.
+type PluginArgs struct {
+	Name        string
+	Zone        string
+	Command     string `json:",omitempty"`
+	MachineType string `json:",omitempty"`
+	Spec        InstanceSpec
+}
+
+// Serve a provider as a plugin: JSON-RPC requests are read on stdin and
+// answered on stdout, so the plugin must log to stderr only. Returns when
+// docker-cloud closes stdin.
+func ServePlugin(provider PluginProvider) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Cloud", &pluginServer{context.Background(), provider}); err != nil {
+		log.Fatalf("failed to register plugin: %v", err)
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(stdio{os.Stdin, os.Stdout}))
+}
+
+// The RPC receiver of a plugin, wrapping its provider. The calls get ctx
+// as net/rpc can't cancel them.
+type pluginServer struct {
+	ctx      context.Context
+	provider PluginProvider
+}
+
+func (s *pluginServer) Version(_ struct{}, version *int) error {
+	*version = pluginProtocolVersion
+	return nil
+}
+
+func (s *pluginServer) GetPublicIPAddress(args PluginArgs, ip *string) (err error) {
+	*ip, err = s.provider.GetPublicIPAddress(s.ctx, args.Name, args.Zone)
+	return err
+}
+
+func (s *pluginServer) CreateInstance(args PluginArgs, ip *string) (err error) {
+	*ip, err = s.provider.CreateInstance(s.ctx, args.Name, args.Zone, args.Spec)
+	return err
+}
+
+func (s *pluginServer) DeleteInstance(args PluginArgs, _ *struct{}) error {
+	return s.provider.DeleteInstance(s.ctx, args.Name, args.Zone)
+}
+
+func (s *pluginServer) RunCommand(args PluginArgs, output *string) (err error) {
+	*output, err = s.provider.RunCommand(s.ctx, args.Name, args.Zone, args.Command)
+	return err
+}
+
+func (s *pluginServer) SSHTarget(args PluginArgs, target *SSHTarget) (err error) {
+	*target, err = s.provider.SSHTarget(s.ctx, args.Name, args.Zone)
+	return err
+}
+
+// The optional methods of the providers are only served when implemented.
+func (s *pluginServer) ListInstances(args PluginArgs, instances *[]Instance) (err error) {
+	lister, ok := s.provider.(interface {
+		ListInstances(ctx context.Context, zone string) ([]Instance, error)
+	})
+	if !ok {
+		_, err := unsupported{}.ListInstances(s.ctx, args.Zone)
+		return err
+	}
+	*instances, err = lister.ListInstances(s.ctx, args.Zone)
+	return err
+}
+
+func (s *pluginServer) StopInstance(args PluginArgs, _ *struct{}) error {
+	stopper, ok := s.provider.(interface {
+		StopInstance(ctx context.Context, name, zone string) error
+	})
+	if !ok {
+		return unsupported{}.StopInstance(s.ctx, args.Name, args.Zone)
+	}
+	return stopper.StopInstance(s.ctx, args.Name, args.Zone)
+}
+
+func (s *pluginServer) DescribeInstance(args PluginArgs, instance *Instance) error {
+	describer, ok := s.provider.(interface {
+		DescribeInstance(ctx context.Context, name, zone string) (*Instance, error)
+	})
+	if !ok {
+		_, err := unsupported{}.DescribeInstance(s.ctx, args.Name, args.Zone)
+		return err
+	}
+	described, err := describer.DescribeInstance(s.ctx, args.Name, args.Zone)
+	if err != nil {
+		return err
+	}
+	*instance = *described
+	return nil
+}
+
+func (s *pluginServer) ResizeInstance(args PluginArgs, _ *struct{}) error {
+	resizer, ok := s.provider.(interface {
+		ResizeInstance(ctx context.Context, name, zone, machineType string) error
+	})
+	if !ok {
+		return unsupported{}.ResizeInstance(s.ctx, args.Name, args.Zone, args.MachineType)
+	}
+	return resizer.ResizeInstance(s.ctx, args.Name, args.Zone, args.MachineType)
+}
+
+func (s *pluginServer) StartInstance(args PluginArgs, ip *string) (err error) {
+	starter, ok := s.provider.(interface {
+		StartInstance(ctx context.Context, name, zone string) (string, error)
+	})
+	if !ok {
+		_, err := unsupported{}.StartInstance(s.ctx, args.Name, args.Zone)
+		return err
+	}
+	*ip, err = starter.StartInstance(s.ctx, args.Name, args.Zone)
+	return err
+}
+
+// Providers without a Capabilities method support the optional methods they
+// implement.
+func (s *pluginServer) Capabilities(_ struct{}, caps *Capabilities) error {
+	if provider, ok := s.provider.(interface{ Capabilities() Capabilities }); ok {
+		*caps = provider.Capabilities()
+		return nil
+	}
+	_, lister := s.provider.(interface {
+		ListInstances(ctx context.Context, zone string) ([]Instance, error)
+	})
+	_, describer := s.provider.(interface {
+		DescribeInstance(ctx context.Context, name, zone string) (*Instance, error)
+	})
+	_, stopper := s.provider.(interface {
+		StopInstance(ctx context.Context, name, zone string) error
+	})
+	_, starter := s.provider.(interface {
+		StartInstance(ctx context.Context, name, zone string) (string, error)
+	})
+	_, resizer := s.provider.(interface {
+		ResizeInstance(ctx context.Context, name, zone, machineType string) error
+	})
+	*caps = Capabilities{
+		ListInstances: lister && describer,
+		StopStart:     stopper && starter,
+		Resize:        resizer,
+	}
+	return nil
+}
+
+// A pair of pipes, closed together.
+type stdio struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (s stdio) Close() error {
+	err := s.WriteCloser.Close()
+	if rerr := s.ReadCloser.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// The errors restored out of the messages of the plugin errors.
+var pluginErrors = []error{ErrNotSupported, ErrInstanceNotFound, ErrQuotaExceeded, ErrOperationTimeout}
+
+// An error returned by a plugin, wrapping one of pluginErrors.
+type pluginSentinelError struct {
+	message  string
+	sentinel error
+}
+
+func (e pluginSentinelError) Error() string { return e.message }
+
+func (e pluginSentinelError) Unwrap() error { return e.sentinel }
+
+// Restore the Cloud errors out of the error returned by a plugin, which only
+// keeps the messages.
+func pluginError(err error) error {
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	for _, sentinel := range pluginErrors {
+		if strings.Contains(string(serverErr), sentinel.Error()) {
+			return pluginSentinelError{string(serverErr), sentinel}
+		}
+	}
+	return err
+}
+
+// A Cloud implementation calling an external provider plugin.
+type PluginCloud struct {
+	sshInstances
+
+	path         string
+	client       *rpc.Client
+	capabilities Capabilities
+	config       PluginConfig
+}
+
+// Return the path of the plugin binary of a provider, empty when there is
+// none in $PATH.
+func lookupPlugin(name string) string {
+	path, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// The settings of a plugin Cloud.
+type PluginConfig struct {
+	Options
+	// The arguments passed to the plugin binary.
+	Args []string
+}
+
+// Start the plugin binary at path, with the config arguments, and check that
+// it speaks the same protocol.
+func NewPluginCloud(path string, config PluginConfig) (Cloud, error) {
+	cmd := exec.Command(path, config.Args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	cloud := &PluginCloud{path: path, client: jsonrpc.NewClient(stdio{stdout, stdin}), config: config}
+	var version int
+	if err := cloud.client.Call("Cloud.Version", struct{}{}, &version); err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	if version != pluginProtocolVersion {
+		return nil, fmt.Errorf("plugin %s speaks protocol %d, expected %d", path, version, pluginProtocolVersion)
+	}
+	if err := cloud.client.Call("Cloud.Capabilities", struct{}{}, &cloud.capabilities); err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", path, err)
+	}
+	log.Printf("using provider plugin %s", path)
+	cloud.sshInstances = sshInstances{target: cloud.target}
+	return cloud, nil
+}
+
+// Call a plugin method, giving up when ctx is done. The plugin itself keeps
+// going, as the protocol has no cancellation.
+func (cloud PluginCloud) call(ctx context.Context, method string, args PluginArgs, reply interface{}) error {
+	call := cloud.client.Go("Cloud."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+		return pluginError(call.Error)
+	}
+}
+
+// Return the ssh login the plugin gives for an instance, with the local ssh
+// settings.
+func (cloud PluginCloud) target(ctx context.Context, name, zone string) (SSHTarget, error) {
+	var target SSHTarget
+	if err := cloud.call(ctx, "SSHTarget", PluginArgs{Name: name, Zone: zone}, &target); err != nil {
+		return SSHTarget{}, err
+	}
+	target.Config = cloud.config.SSH
+	return target, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	var ip string
+	err := cloud.call(ctx, "GetPublicIPAddress", PluginArgs{Name: name, Zone: zone}, &ip)
+	return ip, err
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	var ip string
+	err := cloud.call(ctx, "CreateInstance", PluginArgs{Name: name, Zone: zone, Spec: spec}, &ip)
+	return ip, err
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	return cloud.call(ctx, "DeleteInstance", PluginArgs{Name: name, Zone: zone}, &struct{}{})
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) ListInstances(ctx context.Context, zone string) ([]Instance, error) {
+	var instances []Instance
+	err := cloud.call(ctx, "ListInstances", PluginArgs{Zone: zone}, &instances)
+	return instances, err
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) StopInstance(ctx context.Context, name string, zone string) error {
+	return cloud.call(ctx, "StopInstance", PluginArgs{Name: name, Zone: zone}, &struct{}{})
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) StartInstance(ctx context.Context, name string, zone string) (string, error) {
+	var ip string
+	err := cloud.call(ctx, "StartInstance", PluginArgs{Name: name, Zone: zone}, &ip)
+	return ip, err
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) DescribeInstance(ctx context.Context, name string, zone string) (*Instance, error) {
+	var instance Instance
+	if err := cloud.call(ctx, "DescribeInstance", PluginArgs{Name: name, Zone: zone}, &instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) ResizeInstance(ctx context.Context, name string, zone string, machineType string) error {
+	return cloud.call(ctx, "ResizeInstance", PluginArgs{Name: name, Zone: zone, MachineType: machineType}, &struct{}{})
+}
+
+// Implementation of the Cloud interface. The capabilities are asked to the
+// plugin once when it starts.
+func (cloud PluginCloud) Capabilities() Capabilities {
+	return cloud.capabilities
+}
+
+// Implementation of the Cloud interface
+func (cloud PluginCloud) RunCommand(ctx context.Context, name, zone, command string) (string, error) {
+	log.Printf("Running %q on %s", command, name)
+	var output string
+	err := cloud.call(ctx, "RunCommand", PluginArgs{Name: name, Zone: zone, Command: command}, &output)
+	return output, err
+}
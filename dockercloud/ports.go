@@ -0,0 +1,102 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A local port, or unix socket when LocalSocket is set, forwarded to a port on
+// the instance, or to a unix socket on the instance when RemoteSocket is set.
+type PortMapping struct {
+	LocalPort    int
+	LocalSocket  string
+	RemotePort   int
+	RemoteSocket string
+}
+
+func (m PortMapping) String() string {
+	local := fmt.Sprintf("localhost:%d", m.LocalPort)
+	if m.LocalSocket != "" {
+		local = m.LocalSocket
+	}
+	if m.RemoteSocket != "" {
+		return fmt.Sprintf("%s -> %s", local, m.RemoteSocket)
+	}
+	return fmt.Sprintf("%s -> %d", local, m.RemotePort)
+}
+
+// Return the local side of the mapping in ssh -L syntax.
+func (m PortMapping) local() string {
+	if m.LocalSocket != "" {
+		return m.LocalSocket
+	}
+	return strconv.Itoa(m.LocalPort)
+}
+
+// Return the remote side of the mapping in ssh -L syntax, hostname being the
+// host the port is forwarded to as seen from the instance.
+func (m PortMapping) remote(hostname string) string {
+	if m.RemoteSocket != "" {
+		return m.RemoteSocket
+	}
+	return fmt.Sprintf("%s:%d", hostname, m.RemotePort)
+}
+
+// Parse a comma separated list of localPort:remotePort pairs, e.g.
+// "8080:80,5432:5432". Fails if two mappings share a local port.
+func ParsePortMappings(spec string) ([]PortMapping, error) {
+	mappings := []PortMapping{}
+	if spec == "" {
+		return mappings, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		ports := strings.Split(strings.TrimSpace(pair), ":")
+		if len(ports) != 2 {
+			return nil, fmt.Errorf("invalid port mapping %q, want localPort:remotePort", pair)
+		}
+		local, err := strconv.Atoi(ports[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid local port in %q: %v", pair, err)
+		}
+		remote, err := strconv.Atoi(ports[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote port in %q: %v", pair, err)
+		}
+		mappings = append(mappings, PortMapping{LocalPort: local, RemotePort: remote})
+	}
+	return mappings, ValidatePortMappings(mappings)
+}
+
+// Check that every port is in range and that no two mappings forward the
+// same local port or socket.
+func ValidatePortMappings(mappings []PortMapping) error {
+	seen := map[string]bool{}
+	for _, m := range mappings {
+		if m.LocalSocket == "" && (m.LocalPort <= 0 || m.LocalPort > 65535) {
+			return fmt.Errorf("port out of range in mapping %s", m)
+		}
+		if m.RemoteSocket == "" && (m.RemotePort <= 0 || m.RemotePort > 65535) {
+			return fmt.Errorf("port out of range in mapping %s", m)
+		}
+		if seen[m.local()] {
+			return fmt.Errorf("local port %s is mapped more than once", m.local())
+		}
+		seen[m.local()] = true
+	}
+	return nil
+}
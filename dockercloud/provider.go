@@ -0,0 +1,90 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Create the Cloud of a provider from its flags and resolve the zone given
+// with -zone, possibly empty. Returns an error when the flags are invalid.
+type ProviderFactory func(ctx context.Context, zone string) (Cloud, string, error)
+
+// The settings shared by the providers, embedded in their configs.
+type Options struct {
+	// The settings of the ssh logins on the instances.
+	SSH SSHConfig
+	// Don't label the created resources as managed by docker-cloud.
+	NoManagedTags bool
+}
+
+type provider struct {
+	flagPrefix string
+	factory    ProviderFactory
+}
+
+var providers = map[string]provider{}
+
+// Register a cloud provider under the given name, its flags being namespaced
+// by flagPrefix as in -<flagPrefix>-token. Providers usually register in
+// their init function.
+func RegisterProvider(name, flagPrefix string, factory ProviderFactory) {
+	if _, ok := providers[name]; ok {
+		panic("dockercloud: provider registered twice: " + name)
+	}
+	providers[name] = provider{flagPrefix: flagPrefix, factory: factory}
+}
+
+// Return the names of the registered providers, sorted.
+func Providers() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Create the Cloud of the named provider, falling back to its external
+// plugin started with the plugin config. Returns the resolved zone along.
+func NewCloud(ctx context.Context, name, zone string, plugin PluginConfig) (Cloud, string, error) {
+	p, ok := providers[name]
+	if !ok {
+		if path := lookupPlugin(name); path != "" {
+			cloud, err := NewPluginCloud(path, plugin)
+			return cloud, zone, err
+		}
+		return nil, "", fmt.Errorf("unknown provider %q, expected one of %s or a %s%s plugin", name, strings.Join(Providers(), "|"), pluginPrefix, name)
+	}
+	return p.factory(ctx, zone)
+}
+
+// Check that none of the flags set in fs belongs to the namespace of another
+// provider than the named one, as these would be silently ignored.
+func CheckProviderFlags(name string, fs *flag.FlagSet) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for other, p := range providers {
+			if other != name && p.flagPrefix != "" && strings.HasPrefix(f.Name, p.flagPrefix+"-") && err == nil {
+				err = fmt.Errorf("-%s is a %s flag, but -provider is %q", f.Name, other, name)
+			}
+		}
+	})
+	return err
+}
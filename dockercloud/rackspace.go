@@ -0,0 +1,386 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The settings of a Rackspace Cloud.
+type RackspaceConfig struct {
+	Options
+	// The Rackspace username, $RACKSPACE_USERNAME when empty.
+	Username string
+	// The Rackspace API key, $RACKSPACE_API_KEY when empty.
+	APIKey string
+	// The Rackspace region, used when -zone is not set.
+	Region string
+	// The Cloud Servers flavor.
+	Flavor string
+	// The Cloud Servers image name or id.
+	Image string
+	// The key pair to log into the servers.
+	KeyName string
+	// The private key of -rackspace-key-name, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	rackspaceIdentity = "https://identity.api.rackspacecloud.com/v2.0/tokens"
+
+	rackspaceServerTimeout = 10 * time.Minute
+	rackspaceDockerTimeout = 10 * time.Minute
+)
+
+// A Rackspace Cloud Servers implementation of the Cloud interface. Zones are
+// Rackspace regions such as "DFW", and -rackspace-region when empty.
+type RackspaceCloud struct {
+	unsupported
+	sshInstances
+
+	username string
+	apiKey   string
+	client   *http.Client
+	token    *rackspaceToken
+	config   RackspaceConfig
+}
+
+// The cached identity token and the Cloud Servers endpoints by region.
+type rackspaceToken struct {
+	sync.Mutex
+	id        string
+	expiry    time.Time
+	endpoints map[string]string
+}
+
+// Create a Rackspace Cloud instance.
+func NewRackspaceCloud(config RackspaceConfig) (Cloud, error) {
+	cloud := &RackspaceCloud{
+		config:   config,
+		username: config.Username,
+		apiKey:   config.APIKey,
+		client:   &http.Client{Timeout: 60 * time.Second},
+		token:    &rackspaceToken{},
+	}
+	if cloud.username == "" {
+		cloud.username = os.Getenv("RACKSPACE_USERNAME")
+	}
+	if cloud.apiKey == "" {
+		cloud.apiKey = os.Getenv("RACKSPACE_API_KEY")
+	}
+	if cloud.username == "" || cloud.apiKey == "" {
+		return nil, errors.New("-rackspace-username and -rackspace-api-key must be set")
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Return the region of a zone.
+func (cloud RackspaceCloud) regionForZone(zone string) string {
+	if zone == "" {
+		return cloud.config.Region
+	}
+	return strings.ToUpper(zone)
+}
+
+// Authenticate with the API key if the cached token expired. Returns the
+// token id and the Cloud Servers endpoints by region.
+func (cloud RackspaceCloud) authenticate(ctx context.Context) (string, map[string]string, error) {
+	cloud.token.Lock()
+	defer cloud.token.Unlock()
+	if time.Now().Before(cloud.token.expiry) {
+		return cloud.token.id, cloud.token.endpoints, nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"auth": map[string]interface{}{
+			"RAX-KSKEY:apiKeyCredentials": map[string]string{"username": cloud.username, "apiKey": cloud.apiKey},
+		},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", rackspaceIdentity, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("rackspace authentication failed: %s", resp.Status)
+	}
+	var access struct {
+		Access struct {
+			Token struct {
+				Id      string    `json:"id"`
+				Expires time.Time `json:"expires"`
+			} `json:"token"`
+			ServiceCatalog []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Region    string `json:"region"`
+					PublicURL string `json:"publicURL"`
+				} `json:"endpoints"`
+			} `json:"serviceCatalog"`
+		} `json:"access"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&access); err != nil {
+		return "", nil, err
+	}
+	endpoints := map[string]string{}
+	for _, service := range access.Access.ServiceCatalog {
+		if service.Type != "compute" {
+			continue
+		}
+		for _, e := range service.Endpoints {
+			// Skip the first generation servers endpoint, which has no region.
+			if e.Region != "" {
+				endpoints[e.Region] = strings.TrimSuffix(e.PublicURL, "/")
+			}
+		}
+	}
+	cloud.token.id = access.Access.Token.Id
+	// Renew a minute early to not race the expiry.
+	cloud.token.expiry = access.Access.Token.Expires.Add(-time.Minute)
+	cloud.token.endpoints = endpoints
+	return cloud.token.id, endpoints, nil
+}
+
+// Call the Cloud Servers API of a region, encoding body and decoding the
+// response into result when not nil.
+func (cloud RackspaceCloud) call(ctx context.Context, region, method, path string, body, result interface{}) error {
+	token, endpoints, err := cloud.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	endpoint, ok := endpoints[region]
+	if !ok {
+		return fmt.Errorf("no Cloud Servers endpoint in region %q", region)
+	}
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		// The errors have the same shape as OpenStack Nova ones.
+		var errResp map[string]struct {
+			Message string `json:"message"`
+		}
+		message := resp.Status
+		if json.Unmarshal(data, &errResp) == nil {
+			for _, e := range errResp {
+				if e.Message != "" {
+					message = e.Message
+				}
+			}
+		}
+		return &openStackError{StatusCode: resp.StatusCode, Message: message}
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+type rackspaceServer struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	AccessIPv4 string `json:"accessIPv4"`
+}
+
+// Find the server with the given name in a region.
+func (cloud RackspaceCloud) findServer(ctx context.Context, name, region string) (*rackspaceServer, error) {
+	var resp struct {
+		Servers []rackspaceServer `json:"servers"`
+	}
+	if err := cloud.call(ctx, region, "GET", "/servers/detail?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	// The name filter also matches substrings.
+	for _, s := range resp.Servers {
+		if s.Name == name {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: server %q in %q", ErrInstanceNotFound, name, region)
+}
+
+// Implementation of the Cloud interface
+func (cloud RackspaceCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	server, err := cloud.findServer(ctx, name, cloud.regionForZone(zone))
+	if err != nil {
+		return "", err
+	}
+	return server.AccessIPv4, nil
+}
+
+// Resolve an image name to its id, assuming an id when no image has that name.
+func (cloud RackspaceCloud) resolveImage(ctx context.Context, region, nameOrId string) (string, error) {
+	var resp struct {
+		Images []struct {
+			Id string `json:"id"`
+		} `json:"images"`
+	}
+	if err := cloud.call(ctx, region, "GET", "/images?name="+url.QueryEscape(nameOrId), nil, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Images) == 0 {
+		return nameOrId, nil
+	}
+	return resp.Images[0].Id, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud RackspaceCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The public interface of the servers isn't firewalled.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	region := cloud.regionForZone(zone)
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		log.Printf("failed to get ssh key: %v", err)
+		return "", err
+	}
+	err = cloud.call(ctx, region, "POST", "/os-keypairs", map[string]interface{}{
+		"keypair": map[string]string{"name": cloud.config.KeyName, "public_key": strings.TrimSpace(string(publicKey))},
+	}, nil)
+	if err != nil && !isOpenStackStatus(err, http.StatusConflict) {
+		log.Printf("failed to import key pair: %v", err)
+		return "", err
+	}
+	imageId, err := cloud.resolveImage(ctx, region, cloud.config.Image)
+	if err != nil {
+		return "", err
+	}
+	server := map[string]interface{}{
+		"name":      name,
+		"imageRef":  imageId,
+		"flavorRef": cloud.config.Flavor,
+		"key_name":  cloud.config.KeyName,
+		// Cloud Servers only pass the user data through a config drive.
+		"config_drive": true,
+		"user_data":    base64.StdEncoding.EncodeToString([]byte(script)),
+	}
+	if !cloud.config.NoManagedTags {
+		server["metadata"] = map[string]string{managedByLabel: "docker-cloud"}
+	}
+	log.Printf("starting server: %q", name)
+	var created struct {
+		Server rackspaceServer `json:"server"`
+	}
+	if err := cloud.call(ctx, region, "POST", "/servers", map[string]interface{}{"server": server}, &created); err != nil {
+		log.Printf("server create api call failed: %v", err)
+		return "", err
+	}
+	active, err := cloud.waitForServer(ctx, region, created.Server.Id, "ACTIVE")
+	if err != nil {
+		log.Printf("server failed to start: %v", err)
+		return "", err
+	}
+	ip := active.AccessIPv4
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, rackspaceDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("server started: %q", ip)
+	return ip, nil
+}
+
+// Wait until a server reaches the given status, or is gone for "DELETED".
+func (cloud RackspaceCloud) waitForServer(ctx context.Context, region, id, status string) (*rackspaceServer, error) {
+	deadline := time.Now().Add(rackspaceServerTimeout)
+	for {
+		var resp struct {
+			Server rackspaceServer `json:"server"`
+		}
+		err := cloud.call(ctx, region, "GET", "/servers/"+id, nil, &resp)
+		if status == "DELETED" && isOpenStackStatus(err, http.StatusNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.Server.Status == status {
+			return &resp.Server, nil
+		}
+		if resp.Server.Status == "ERROR" {
+			return nil, fmt.Errorf("server %q is in error", id)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for server %q to be %s", ErrOperationTimeout, id, status)
+		}
+		if err := sleep(ctx, 10*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud RackspaceCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	region := cloud.regionForZone(zone)
+	server, err := cloud.findServer(ctx, name, region)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting server")
+	if err := cloud.call(ctx, region, "DELETE", "/servers/"+server.Id, nil, nil); err != nil {
+		return err
+	}
+	_, err = cloud.waitForServer(ctx, region, server.Id, "DELETED")
+	log.Print("server deleted")
+	return err
+}
+
+// Return the ssh login on a server, whose host keys are trusted on first use.
+func (cloud RackspaceCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
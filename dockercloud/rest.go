@@ -0,0 +1,121 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// An error returned by a provider JSON API.
+type apiError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %d: %s", e.Provider, e.StatusCode, e.Message)
+}
+
+// Report whether err is an API error with the given status code.
+func isAPIStatus(err error, status int) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.StatusCode == status
+}
+
+// Send a JSON request with the given headers, encoding body and decoding the
+// response into result when not nil. Other than 2xx responses are returned as
+// an *apiError.
+func callJSON(ctx context.Context, client *http.Client, provider, method, url string, header http.Header, body, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, &reqBody)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doJSON(client, provider, req, result)
+}
+
+// Send a prepared request, bounded by its context, decoding the response into
+// result when not nil. Other than 2xx responses are returned as an *apiError.
+func doJSON(client *http.Client, provider string, req *http.Request, result interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		message := apiErrorMessage(data)
+		if message == "" {
+			message = resp.Status
+		}
+		return &apiError{Provider: provider, StatusCode: resp.StatusCode, Message: message}
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Find the message of a JSON error response, whose shape differs between
+// providers, e.g. {"message": ...} or {"errors": [{"reason": ...}]}.
+func apiErrorMessage(data []byte) string {
+	var v interface{}
+	if json.Unmarshal(data, &v) != nil {
+		return ""
+	}
+	return findMessage(v)
+}
+
+func findMessage(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, key := range []string{"message", "reason", "error_message", "errortext", "error"} {
+			if s, ok := v[key].(string); ok && s != "" {
+				return s
+			}
+		}
+		for _, value := range v {
+			if s := findMessage(value); s != "" {
+				return s
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if s := findMessage(value); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,323 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The settings of a Scaleway Cloud.
+type ScalewayConfig struct {
+	Options
+	// The Scaleway API secret key, $SCW_SECRET_KEY when empty.
+	SecretKey string
+	// The Scaleway project id, $SCW_DEFAULT_PROJECT_ID when empty.
+	Project string
+	// The Scaleway commercial type, e.g. AMP2-C2 for ARM.
+	CommercialType string
+	// The marketplace image label, or an image id.
+	Image string
+	// The private key to log into the servers, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	scwAPI = "https://api.scaleway.com"
+
+	// The name of the ssh key registered by docker-cloud.
+	scwSSHKeyName = "docker-cloud"
+
+	scwTimeout       = 10 * time.Minute
+	scwDockerTimeout = 10 * time.Minute
+)
+
+// A Scaleway Instances implementation of the Cloud interface. Zones are
+// Scaleway zones such as "fr-par-1".
+type ScalewayCloud struct {
+	unsupported
+	sshInstances
+
+	secretKey string
+	projectId string
+	client    *http.Client
+	config    ScalewayConfig
+}
+
+// Create a Scaleway Cloud instance.
+func NewScalewayCloud(config ScalewayConfig) (Cloud, error) {
+	cloud := &ScalewayCloud{
+		config:    config,
+		secretKey: config.SecretKey,
+		projectId: config.Project,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	if cloud.secretKey == "" {
+		cloud.secretKey = os.Getenv("SCW_SECRET_KEY")
+	}
+	if cloud.projectId == "" {
+		cloud.projectId = os.Getenv("SCW_DEFAULT_PROJECT_ID")
+	}
+	if cloud.secretKey == "" || cloud.projectId == "" {
+		return nil, errors.New("-scw-secret-key and -scw-project must be set")
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call the Scaleway API.
+func (cloud ScalewayCloud) call(ctx context.Context, method, path string, body, result interface{}) error {
+	header := http.Header{"X-Auth-Token": {cloud.secretKey}}
+	return callJSON(ctx, cloud.client, "scaleway", method, scwAPI+path, header, body, result)
+}
+
+// Return the path of the Instances API of a zone.
+func scwInstancePath(zone, path string) string {
+	return "/instance/v1/zones/" + zone + path
+}
+
+type scwServer struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	PublicIP *struct {
+		Address string `json:"address"`
+	} `json:"public_ip"`
+}
+
+// Return the public address of the server, empty until it is assigned.
+func (s scwServer) address() string {
+	if s.PublicIP == nil {
+		return ""
+	}
+	return s.PublicIP.Address
+}
+
+// Find the server with the given name in a zone.
+func (cloud ScalewayCloud) findServer(ctx context.Context, name, zone string) (*scwServer, error) {
+	var resp struct {
+		Servers []scwServer `json:"servers"`
+	}
+	query := "/servers?project=" + cloud.projectId + "&name=" + url.QueryEscape(name)
+	if err := cloud.call(ctx, "GET", scwInstancePath(zone, query), nil, &resp); err != nil {
+		return nil, err
+	}
+	// The name filter also matches substrings.
+	for _, s := range resp.Servers {
+		if s.Name == name {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: server %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud ScalewayCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	server, err := cloud.findServer(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return server.address(), nil
+}
+
+// Register the -scw-ssh-key-path public key with the project, generating the
+// key pair first if needed. The servers read the project keys at boot.
+func (cloud ScalewayCloud) ensureSSHKey(ctx context.Context) error {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimSpace(string(publicKey))
+	var resp struct {
+		SSHKeys []struct {
+			PublicKey string `json:"public_key"`
+		} `json:"ssh_keys"`
+	}
+	if err := cloud.call(ctx, "GET", "/iam/v1alpha1/ssh-keys?page_size=100&project_id="+cloud.projectId, nil, &resp); err != nil {
+		return err
+	}
+	for _, k := range resp.SSHKeys {
+		if strings.TrimSpace(k.PublicKey) == key {
+			return nil
+		}
+	}
+	log.Printf("registering ssh key: %q", scwSSHKeyName)
+	return cloud.call(ctx, "POST", "/iam/v1alpha1/ssh-keys", map[string]string{
+		"name":       scwSSHKeyName,
+		"public_key": key,
+		"project_id": cloud.projectId,
+	}, nil)
+}
+
+// Resolve -scw-image to the id of the marketplace image built for the
+// commercial type architecture. Ids are returned unchanged.
+func (cloud ScalewayCloud) resolveImage(ctx context.Context, zone string) (string, error) {
+	if !strings.Contains(cloud.config.Image, "_") {
+		return cloud.config.Image, nil
+	}
+	var resp struct {
+		LocalImages []struct {
+			Id                        string   `json:"id"`
+			CompatibleCommercialTypes []string `json:"compatible_commercial_types"`
+		} `json:"local_images"`
+	}
+	query := "/marketplace/v2/local-images?image_label=" + url.QueryEscape(cloud.config.Image) + "&zone=" + zone
+	if err := cloud.call(ctx, "GET", query, nil, &resp); err != nil {
+		return "", err
+	}
+	for _, image := range resp.LocalImages {
+		for _, t := range image.CompatibleCommercialTypes {
+			if t == cloud.config.CommercialType {
+				return image.Id, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no %q image for %q in %q", cloud.config.Image, cloud.config.CommercialType, zone)
+}
+
+// Set the cloud-init user data of a server, which the API takes as plain text.
+func (cloud ScalewayCloud) setUserData(ctx context.Context, zone, serverId, script string) error {
+	path := scwAPI + scwInstancePath(zone, "/servers/"+serverId+"/user_data/cloud-init")
+	req, err := http.NewRequestWithContext(ctx, "PATCH", path, strings.NewReader(script))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", cloud.secretKey)
+	req.Header.Set("Content-Type", "text/plain")
+	resp, err := cloud.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return &apiError{Provider: "scaleway", StatusCode: resp.StatusCode, Message: apiErrorMessage(data)}
+	}
+	return nil
+}
+
+// Implementation of the Cloud interface
+func (cloud ScalewayCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The default security group lets everything in.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	if err := cloud.ensureSSHKey(ctx); err != nil {
+		log.Printf("failed to register ssh key: %v", err)
+		return "", err
+	}
+	imageId, err := cloud.resolveImage(ctx, zone)
+	if err != nil {
+		log.Printf("failed to find image: %v", err)
+		return "", err
+	}
+	server := map[string]interface{}{
+		"name":                name,
+		"project":             cloud.projectId,
+		"commercial_type":     cloud.config.CommercialType,
+		"image":               imageId,
+		"dynamic_ip_required": true,
+	}
+	if !cloud.config.NoManagedTags {
+		server["tags"] = []string{managedByLabel + "=docker-cloud"}
+	}
+	log.Printf("creating server: %q", name)
+	var created struct {
+		Server scwServer `json:"server"`
+	}
+	if err := cloud.call(ctx, "POST", scwInstancePath(zone, "/servers"), server, &created); err != nil {
+		log.Printf("server create api call failed: %v", err)
+		return "", err
+	}
+	id := created.Server.Id
+	if err := cloud.setUserData(ctx, zone, id, script); err != nil {
+		log.Printf("failed to set user data: %v", err)
+		return "", err
+	}
+	log.Printf("starting server: %q", name)
+	if err := cloud.action(ctx, zone, id, "poweron"); err != nil {
+		log.Printf("server poweron api call failed: %v", err)
+		return "", err
+	}
+	running, err := cloud.waitForServer(ctx, zone, id)
+	if err != nil {
+		log.Printf("server failed to start: %v", err)
+		return "", err
+	}
+	ip := running.address()
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, scwDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("server started: %q", ip)
+	return ip, nil
+}
+
+// Run a server action such as "poweron" or "terminate".
+func (cloud ScalewayCloud) action(ctx context.Context, zone, id, action string) error {
+	return cloud.call(ctx, "POST", scwInstancePath(zone, "/servers/"+id+"/action"), map[string]string{"action": action}, nil)
+}
+
+// Wait until a server is running with its public address.
+func (cloud ScalewayCloud) waitForServer(ctx context.Context, zone, id string) (*scwServer, error) {
+	deadline := time.Now().Add(scwTimeout)
+	for {
+		var resp struct {
+			Server scwServer `json:"server"`
+		}
+		if err := cloud.call(ctx, "GET", scwInstancePath(zone, "/servers/"+id), nil, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Server.State == "running" && resp.Server.address() != "" {
+			return &resp.Server, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for server %q to run", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Implementation of the Cloud interface. Terminating the server also deletes
+// its volumes and IP.
+func (cloud ScalewayCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	server, err := cloud.findServer(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting server")
+	err = cloud.action(ctx, zone, server.Id, "terminate")
+	if err == nil {
+		log.Print("server deleted")
+	}
+	return err
+}
+
+// Return the ssh login on a server, whose host keys are trusted on first use.
+func (cloud ScalewayCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
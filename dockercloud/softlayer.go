@@ -0,0 +1,276 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The settings of a SoftLayer Cloud.
+type SoftLayerConfig struct {
+	Options
+	// The IBM Cloud classic infrastructure username, $SL_USERNAME when empty.
+	Username string
+	// The IBM Cloud classic infrastructure API key, $SL_API_KEY when empty.
+	APIKey string
+	// The SoftLayer datacenter, used when -zone is not set.
+	Datacenter string
+	// The virtual guest flavor key name.
+	Flavor string
+	// The operating system reference code.
+	OS string
+	// The domain of the virtual guests.
+	Domain string
+	// The private key to log into the virtual guests, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	slAPI = "https://api.softlayer.com/rest/v3.1"
+
+	// The label of the ssh key registered by docker-cloud.
+	slSSHKeyLabel = "docker-cloud"
+
+	slGuestTimeout  = 20 * time.Minute
+	slDockerTimeout = 10 * time.Minute
+)
+
+// An IBM SoftLayer implementation of the Cloud interface, running hourly
+// virtual guests. Zones are datacenters such as "dal13", and
+// -softlayer-datacenter when empty.
+type SoftLayerCloud struct {
+	unsupported
+	sshInstances
+
+	username string
+	apiKey   string
+	client   *http.Client
+	config   SoftLayerConfig
+}
+
+// Create a SoftLayer Cloud instance.
+func NewSoftLayerCloud(config SoftLayerConfig) (Cloud, error) {
+	cloud := &SoftLayerCloud{
+		config:   config,
+		username: config.Username,
+		apiKey:   config.APIKey,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}
+	if cloud.username == "" {
+		cloud.username = os.Getenv("SL_USERNAME")
+	}
+	if cloud.apiKey == "" {
+		cloud.apiKey = os.Getenv("SL_API_KEY")
+	}
+	if cloud.username == "" || cloud.apiKey == "" {
+		return nil, errors.New("-softlayer-username and -softlayer-api-key or SL_USERNAME and SL_API_KEY must be set")
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Return the datacenter of a zone.
+func (cloud SoftLayerCloud) datacenterForZone(zone string) string {
+	if zone == "" {
+		return cloud.config.Datacenter
+	}
+	return zone
+}
+
+// Call the SoftLayer REST API with basic authentication by API key. Method
+// parameters are sent as {"parameters": [...]}.
+func (cloud SoftLayerCloud) call(ctx context.Context, method, path string, parameters []interface{}, result interface{}) error {
+	var body interface{}
+	if parameters != nil {
+		body = map[string]interface{}{"parameters": parameters}
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(cloud.username + ":" + cloud.apiKey))
+	header := http.Header{"Authorization": {"Basic " + credentials}}
+	return callJSON(ctx, cloud.client, "softlayer", method, slAPI+path, header, body, result)
+}
+
+type slGuest struct {
+	Id               int    `json:"id"`
+	Hostname         string `json:"hostname"`
+	PrimaryIPAddress string `json:"primaryIpAddress"`
+	ProvisionDate    string `json:"provisionDate"`
+	Datacenter       struct {
+		Name string `json:"name"`
+	} `json:"datacenter"`
+}
+
+const slGuestMask = "mask[id,hostname,primaryIpAddress,provisionDate,datacenter.name]"
+
+// Find the virtual guest with the given hostname in a datacenter.
+func (cloud SoftLayerCloud) findGuest(ctx context.Context, name, zone string) (*slGuest, error) {
+	filter := fmt.Sprintf(`{"virtualGuests":{"hostname":{"operation":%q}}}`, name)
+	query := url.Values{"objectMask": {slGuestMask}, "objectFilter": {filter}}
+	var guests []slGuest
+	if err := cloud.call(ctx, "GET", "/SoftLayer_Account/getVirtualGuests.json?"+query.Encode(), nil, &guests); err != nil {
+		return nil, err
+	}
+	datacenter := cloud.datacenterForZone(zone)
+	for _, guest := range guests {
+		if guest.Hostname == name && guest.Datacenter.Name == datacenter {
+			return &guest, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: virtual guest %q in %q", ErrInstanceNotFound, name, datacenter)
+}
+
+// Implementation of the Cloud interface
+func (cloud SoftLayerCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	guest, err := cloud.findGuest(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return guest.PrimaryIPAddress, nil
+}
+
+// Register the -softlayer-ssh-key-path public key, generating the key pair
+// first if needed. Returns the key id.
+func (cloud SoftLayerCloud) ensureSSHKey(ctx context.Context) (int, error) {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return 0, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	var keys []struct {
+		Id          int    `json:"id"`
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := cloud.call(ctx, "GET", "/SoftLayer_Account/getSshKeys.json", nil, &keys); err != nil {
+		return 0, err
+	}
+	fingerprint := ssh.FingerprintLegacyMD5(key)
+	for _, k := range keys {
+		if k.Fingerprint == fingerprint {
+			return k.Id, nil
+		}
+	}
+	log.Printf("registering ssh key: %q", slSSHKeyLabel)
+	var created struct {
+		Id int `json:"id"`
+	}
+	err = cloud.call(ctx, "POST", "/SoftLayer_Security_Ssh_Key.json", []interface{}{map[string]string{
+		"label": slSSHKeyLabel,
+		"key":   strings.TrimSpace(string(publicKey)),
+	}}, &created)
+	return created.Id, err
+}
+
+// Implementation of the Cloud interface
+func (cloud SoftLayerCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// Virtual guests have no firewall by default.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	keyId, err := cloud.ensureSSHKey(ctx)
+	if err != nil {
+		log.Printf("failed to register ssh key: %v", err)
+		return "", err
+	}
+	guest := map[string]interface{}{
+		"hostname":                        name,
+		"domain":                          cloud.config.Domain,
+		"datacenter":                      map[string]string{"name": cloud.datacenterForZone(zone)},
+		"supplementalCreateObjectOptions": map[string]string{"flavorKeyName": cloud.config.Flavor},
+		"operatingSystemReferenceCode":    cloud.config.OS,
+		"hourlyBillingFlag":               true,
+		"localDiskFlag":                   false,
+		"sshKeys":                         []map[string]int{{"id": keyId}},
+		"userData":                        []map[string]string{{"value": script}},
+	}
+	log.Printf("ordering virtual guest: %q", name)
+	var created slGuest
+	if err := cloud.call(ctx, "POST", "/SoftLayer_Virtual_Guest.json", []interface{}{guest}, &created); err != nil {
+		log.Printf("virtual guest create api call failed: %v", err)
+		return "", err
+	}
+	if !cloud.config.NoManagedTags {
+		tags := []interface{}{managedByLabel + ":docker-cloud"}
+		if err := cloud.call(ctx, "POST", fmt.Sprintf("/SoftLayer_Virtual_Guest/%d/setTags.json", created.Id), tags, nil); err != nil {
+			log.Printf("failed to tag virtual guest: %v", err)
+		}
+	}
+	ip, err := cloud.waitForGuest(ctx, created.Id)
+	if err != nil {
+		log.Printf("virtual guest failed to provision: %v", err)
+		return "", err
+	}
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, slDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("virtual guest provisioned: %q", ip)
+	return ip, nil
+}
+
+// Wait until a virtual guest is provisioned, and return its public IP.
+func (cloud SoftLayerCloud) waitForGuest(ctx context.Context, id int) (string, error) {
+	deadline := time.Now().Add(slGuestTimeout)
+	path := fmt.Sprintf("/SoftLayer_Virtual_Guest/%d.json?objectMask=%s", id, url.QueryEscape(slGuestMask))
+	for {
+		var guest slGuest
+		if err := cloud.call(ctx, "GET", path, nil, &guest); err != nil {
+			return "", err
+		}
+		if guest.ProvisionDate != "" && guest.PrimaryIPAddress != "" {
+			return guest.PrimaryIPAddress, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("%w waiting for virtual guest %d to provision", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 15*time.Second); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud SoftLayerCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	guest, err := cloud.findGuest(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("canceling virtual guest")
+	err = cloud.call(ctx, "DELETE", fmt.Sprintf("/SoftLayer_Virtual_Guest/%d.json", guest.Id), nil, nil)
+	if err == nil {
+		log.Print("virtual guest canceled")
+	}
+	return err
+}
+
+// Return the ssh login on a virtual guest, whose host keys are trusted on
+// first use.
+func (cloud SoftLayerCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,429 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Errors returned by ValidateSSHKey.
+var (
+	ErrSSHKeyNotFound    = errors.New("ssh key not found")
+	ErrSSHKeyPermissions = errors.New("ssh key permissions too open")
+	ErrSSHKeyFormat      = errors.New("unsupported ssh key format")
+)
+
+// The settings of the ssh and scp commands.
+type SSHConfig struct {
+	// Check the instance SSH host key (yes|no), yes is recommended in production.
+	StrictHostKeyChecking string
+	// The known hosts file managed by docker-cloud for StrictHostKeyChecking.
+	KnownHostsFile string
+	// Space separated flags appended to the tunnel ssh command, they may
+	// override the safety settings.
+	ExtraFlags string
+	// Print verbose ssh output to troubleshoot tunnel failures.
+	Debug bool
+}
+
+// The time given to ssh to log in and listen on the local side of a tunnel.
+const tunnelTimeout = 2 * time.Minute
+
+var (
+	openSSHVersion         = regexp.MustCompile(`OpenSSH_(\d+)\.(\d+)`)
+	shellMetaChars         = "$;|&`<>(){}\\\n"
+	extraFlagsWarning      sync.Once
+	debugSSHWarning        sync.Once
+	insecureHostKeyWarning sync.Once
+)
+
+// An SSH login on an instance.
+type SSHTarget struct {
+	User    string
+	Host    string
+	KeyPath string
+	// The ssh port, 22 when zero.
+	Port int
+	// Accept the host key on first connection with -ssh-strict-host-key-checking=yes,
+	// for providers that can't publish the host keys before.
+	TrustOnFirstUse bool
+	// The local ssh settings, not sent by the plugins.
+	Config SSHConfig `json:"-"`
+}
+
+// Return the ssh options shared by ssh and scp.
+func (t SSHTarget) options() []string {
+	hostKeyOptions := "-o UserKnownHostsFile=/dev/null -o CheckHostIP=no -o StrictHostKeyChecking=no"
+	if t.Config.StrictHostKeyChecking == "yes" {
+		checking := "yes"
+		if t.TrustOnFirstUse {
+			checking = "accept-new"
+		}
+		hostKeyOptions = "-o UserKnownHostsFile=" + t.Config.KnownHostsFile + " -o StrictHostKeyChecking=" + checking
+	} else {
+		insecureHostKeyWarning.Do(func() {
+			log.Print("warning: not checking the instance SSH host key, use -ssh-strict-host-key-checking=yes in production")
+		})
+	}
+	sshCommand := fmt.Sprintf("%s %s -i %s", t.Config.logOptions(), hostKeyOptions, t.KeyPath)
+	return strings.Split(sshCommand, " ")
+}
+
+// Return the ssh arguments to log into the instance.
+func (t SSHTarget) args() []string {
+	return append(t.options(), "-A", "-p", t.port(), t.User+"@"+t.Host)
+}
+
+func (t SSHTarget) port() string {
+	if t.Port == 0 {
+		return "22"
+	}
+	return strconv.Itoa(t.Port)
+}
+
+// Return the scp path of a file on the instance.
+func (t SSHTarget) Path(remotePath string) string {
+	return t.User + "@" + t.Host + ":" + remotePath
+}
+
+// Open a tunnel forwarding the given ports to hostname as seen from the
+// instance. Returns the ssh process once the local side of every mapping
+// accepts connections, running in its own session until it is killed.
+func (t SSHTarget) OpenTunnel(ctx context.Context, hostname string, mappings []PortMapping) (*os.Process, error) {
+	if err := ValidatePortMappings(mappings); err != nil {
+		return nil, err
+	}
+	if err := ValidateSSHKey(t.KeyPath); err != nil {
+		return nil, err
+	}
+	args := append(t.args(), "-N", "-o", "ExitOnForwardFailure=yes")
+	for _, m := range mappings {
+		if m.LocalSocket != "" {
+			// Replace the socket file left behind by a previous tunnel.
+			args = append(args, "-o", "StreamLocalBindUnlink=yes")
+		}
+		args = append(args, "-L", fmt.Sprintf("%s:%s", m.local(), m.remote(hostname)))
+	}
+	extra, err := t.Config.extraFlags()
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, extra...)
+	log.Printf("Running %s", strings.Join(args, " "))
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	deadline := time.After(tunnelTimeout)
+	for !tunnelListening(mappings) {
+		select {
+		case err := <-exited:
+			return nil, fmt.Errorf("ssh tunnel to %s exited: %v", t.Host, err)
+		case <-ctx.Done():
+			cmd.Process.Kill()
+			return nil, ctx.Err()
+		case <-deadline:
+			cmd.Process.Kill()
+			return nil, fmt.Errorf("%w waiting for the ssh tunnel to %s", ErrOperationTimeout, t.Host)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	return cmd.Process, nil
+}
+
+// Report whether the local side of every mapping accepts connections.
+func tunnelListening(mappings []PortMapping) bool {
+	for _, m := range mappings {
+		network, addr := "tcp", net.JoinHostPort("localhost", strconv.Itoa(m.LocalPort))
+		if m.LocalSocket != "" {
+			network, addr = "unix", m.LocalSocket
+		}
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+	}
+	return true
+}
+
+// Run a command on the instance and return its standard output.
+func (t SSHTarget) Run(ctx context.Context, command string) (string, error) {
+	cmd := exec.CommandContext(ctx, "ssh", append(t.args(), command)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// Run a command on the instance attached to the local standard streams,
+// allocating a pseudo-terminal when tty is set.
+func (t SSHTarget) RunInteractive(ctx context.Context, command string, tty bool) error {
+	args := t.args()
+	if tty {
+		args = append(args, "-t")
+	}
+	// Without a command, ssh opens a login shell.
+	if command != "" {
+		args = append(args, command)
+	}
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Run a script as root on the instance, for providers that can't pass it as
+// user data.
+func (t SSHTarget) RunScript(ctx context.Context, script string) error {
+	cmd := exec.CommandContext(ctx, "ssh", append(t.args(), "sudo bash -s")...)
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Copy srcs to dst with scp, any of which may be a remote path from Path.
+func (t SSHTarget) Copy(ctx context.Context, dst string, srcs ...string) error {
+	args := append(t.options(), "-P", t.port(), "-r")
+	args = append(append(args, srcs...), dst)
+	log.Printf("Running scp %s", strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, "scp", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Copy a file or directory from the instance straight to another one, running
+// scp on the instance: scp from here between two remote hosts goes through
+// the local machine since OpenSSH 8.7. The instance logs into dst with the
+// agent forwarded by ssh -A, so the dst key must be loaded in the local agent.
+// dst has no entry in the known hosts of the instance, it is trusted on first
+// use with -ssh-strict-host-key-checking=yes and not checked otherwise.
+func (t SSHTarget) CopyTo(ctx context.Context, remotePath string, dst SSHTarget, dstPath string) error {
+	hostKeyOptions := []string{"-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no"}
+	if t.Config.StrictHostKeyChecking == "yes" {
+		hostKeyOptions = []string{"-o", "StrictHostKeyChecking=accept-new"}
+	}
+	args := append([]string{"scp", "-r", "-P", dst.port()}, hostKeyOptions...)
+	args = append(args, remotePath, dst.Path(dstPath))
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	log.Printf("Running %s on %s", strings.Join(args, " "), t.Host)
+	_, err := t.Run(ctx, strings.Join(quoted, " "))
+	return err
+}
+
+// Wait until a port answers on the instance localhost, retrying while sshd
+// comes up.
+func (t SSHTarget) WaitForPort(ctx context.Context, port int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := t.Run(ctx, fmt.Sprintf("echo 'GET /' >/dev/tcp/localhost/%d", port))
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w waiting for port %d on %s: %v", ErrOperationTimeout, port, t.Host, err)
+		}
+		log.Printf("waiting for port %d on %s", port, t.Host)
+		if err := sleep(ctx, 10*time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Embedded by the providers reaching their instances with ssh to implement
+// the tunnel, command and copy methods of the Cloud interface, given the ssh
+// login of an instance.
+type sshInstances struct {
+	target func(ctx context.Context, name, zone string) (SSHTarget, error)
+}
+
+// Return the sshInstances of a provider whose instances are reached on their
+// public IP address, with the ssh login returned by login for that address.
+func sshOnPublicIP(address func(ctx context.Context, name, zone string) (string, error), login func(ip string) SSHTarget) sshInstances {
+	return sshInstances{target: func(ctx context.Context, name, zone string) (SSHTarget, error) {
+		ip, err := address(ctx, name, zone)
+		if err != nil {
+			return SSHTarget{}, err
+		}
+		return login(ip), nil
+	}}
+}
+
+// Implementation of the Cloud interface
+func (s sshInstances) OpenSecureTunnel(ctx context.Context, name, zone string, localPort, remotePort int) (*os.Process, error) {
+	return s.OpenMultiTunnel(ctx, name, zone, []PortMapping{{LocalPort: localPort, RemotePort: remotePort}})
+}
+
+// Open a single secure tunnel forwarding all the given ports.
+func (s sshInstances) OpenMultiTunnel(ctx context.Context, name, zone string, mappings []PortMapping) (*os.Process, error) {
+	target, err := s.target(ctx, name, zone)
+	if err != nil {
+		return nil, err
+	}
+	return target.OpenTunnel(ctx, "localhost", mappings)
+}
+
+// Run a command on the instance attached to the local standard streams.
+func (s sshInstances) RunInteractiveCommand(ctx context.Context, name, zone, command string, tty bool) error {
+	target, err := s.target(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	return target.RunInteractive(ctx, command, tty)
+}
+
+// Copy a local file or directory to an instance.
+func (s sshInstances) CopyToInstance(ctx context.Context, name, zone, localPath, remotePath string) error {
+	target, err := s.target(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	return target.Copy(ctx, target.Path(remotePath), localPath)
+}
+
+// Copy a file or directory from an instance to the local machine.
+func (s sshInstances) CopyFromInstance(ctx context.Context, name, zone, remotePath, localPath string) error {
+	target, err := s.target(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	return target.Copy(ctx, localPath, target.Path(remotePath))
+}
+
+// Implementation of the Cloud interface
+func (s sshInstances) RunCommand(ctx context.Context, name, zone, command string) (string, error) {
+	target, err := s.target(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Running %q on %s", command, name)
+	return target.Run(ctx, command)
+}
+
+// Return the public key of the private key at keyPath, generating the key
+// pair first if it doesn't exist.
+func EnsureSSHKey(keyPath string) ([]byte, error) {
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		log.Printf("generating ssh key: %q", keyPath)
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			return nil, err
+		}
+		cmd := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "docker-cloud", "-f", keyPath)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("failed to generate ssh key: %v", err)
+		}
+	}
+	return ioutil.ReadFile(keyPath + ".pub")
+}
+
+// Return the ssh options setting its verbosity from Debug.
+func (c SSHConfig) logOptions() string {
+	if !c.Debug {
+		return "-o LogLevel=quiet"
+	}
+	debugSSHWarning.Do(func() {
+		log.Print("warning: -debug-ssh may print sensitive credential information to the terminal")
+	})
+	return "-vvv -o LogLevel=DEBUG3"
+}
+
+// Return the ExtraFlags, refusing shell metacharacters.
+func (c SSHConfig) extraFlags() ([]string, error) {
+	if c.ExtraFlags == "" {
+		return nil, nil
+	}
+	if i := strings.IndexAny(c.ExtraFlags, shellMetaChars); i >= 0 {
+		return nil, fmt.Errorf("-extra-ssh-flags contains the forbidden character %q", c.ExtraFlags[i])
+	}
+	extraFlagsWarning.Do(func() {
+		log.Printf("warning: -extra-ssh-flags %q may override the docker-cloud ssh settings", c.ExtraFlags)
+	})
+	return strings.Fields(c.ExtraFlags), nil
+}
+
+// Report whether the local ssh client can forward unix sockets, which
+// OpenSSH supports since 6.7.
+func SupportsUnixSocketForwarding() bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+	// ssh -V prints its version on stderr.
+	out, err := exec.Command("ssh", "-V").CombinedOutput()
+	if err != nil {
+		log.Printf("failed to get the ssh version: %v", err)
+		return false
+	}
+	m := openSSHVersion.FindStringSubmatch(string(out))
+	if m == nil {
+		return false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > 6 || (major == 6 && minor >= 7)
+}
+
+// Check that the private key at keyPath exists, is only readable by its owner
+// and can be parsed, so that ssh doesn't fail with a cryptic exit code.
+func ValidateSSHKey(keyPath string) error {
+	info, err := os.Stat(keyPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s, create it with ssh-keygen -f %s", ErrSSHKeyNotFound, keyPath, keyPath)
+	} else if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm != 0600 && perm != 0400 {
+		return fmt.Errorf("%w: %s has mode %04o, run chmod 600 %s", ErrSSHKeyPermissions, keyPath, perm, keyPath)
+	}
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	if _, err := ssh.ParsePrivateKey(data); err != nil {
+		// Encrypted keys are fine, the agent or ssh will ask for the passphrase.
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s: %v", ErrSSHKeyFormat, keyPath, err)
+	}
+	return nil
+}
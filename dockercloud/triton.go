@@ -0,0 +1,283 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The settings of a Triton Cloud.
+type TritonConfig struct {
+	Options
+	// The Triton CloudAPI URL, $TRITON_URL or else https://<zone>.api.joyent.com
+	// when empty.
+	URL string
+	// The Triton account, $TRITON_ACCOUNT when empty.
+	Account string
+	// The unencrypted RSA or ECDSA private key of the account, also used for ssh.
+	KeyPath string
+	// The Triton package name or id.
+	Package string
+	// The Triton image name or id.
+	Image string
+	// The user to log into the machines.
+	SSHUser string
+}
+
+const (
+	tritonTimeout       = 10 * time.Minute
+	tritonDockerTimeout = 10 * time.Minute
+)
+
+// A Joyent Triton (SmartDataCenter) implementation of the Cloud interface.
+// Zones are datacenters such as "us-east-1".
+type TritonCloud struct {
+	unsupported
+	sshInstances
+
+	account   string
+	keyId     string
+	algorithm string
+	key       crypto.Signer
+	client    *http.Client
+	config    TritonConfig
+}
+
+// Create a Triton Cloud instance, signing the requests with -triton-key-path.
+func NewTritonCloud(config TritonConfig) (Cloud, error) {
+	account := config.Account
+	if account == "" {
+		account = os.Getenv("TRITON_ACCOUNT")
+	}
+	if account == "" {
+		return nil, errors.New("-triton-account or TRITON_ACCOUNT must be set")
+	}
+	pem, err := ioutil.ReadFile(config.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read triton key: %v", err)
+	}
+	raw, err := ssh.ParseRawPrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse triton key: %v", err)
+	}
+	cloud := &TritonCloud{account: account, client: &http.Client{Timeout: 60 * time.Second}, config: config}
+	switch key := raw.(type) {
+	case *rsa.PrivateKey:
+		cloud.key, cloud.algorithm = key, "rsa-sha256"
+	case *ecdsa.PrivateKey:
+		cloud.key, cloud.algorithm = key, "ecdsa-sha256"
+	default:
+		return nil, fmt.Errorf("unsupported triton key type %T, use RSA or ECDSA", raw)
+	}
+	publicKey, err := ssh.NewPublicKey(cloud.key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get triton public key: %v", err)
+	}
+	// Triton identifies the keys by their MD5 fingerprint.
+	cloud.keyId = "/" + account + "/keys/" + ssh.FingerprintLegacyMD5(publicKey)
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Return the CloudAPI URL of a datacenter.
+func (cloud TritonCloud) endpoint(zone string) string {
+	if cloud.config.URL != "" {
+		return cloud.config.URL
+	}
+	if env := os.Getenv("TRITON_URL"); env != "" {
+		return env
+	}
+	return "https://" + zone + ".api.joyent.com"
+}
+
+// Call the CloudAPI of a datacenter, with the request signed per the HTTP
+// signature scheme.
+func (cloud TritonCloud) call(ctx context.Context, zone, method, path string, body, result interface{}) error {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	digest := sha256.Sum256([]byte("date: " + date))
+	var signature []byte
+	var err error
+	switch key := cloud.key.(type) {
+	case *ecdsa.PrivateKey:
+		signature, err = ecdsa.SignASN1(rand.Reader, key, digest[:])
+	default:
+		signature, err = cloud.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return err
+	}
+	header := http.Header{
+		"Date":           {date},
+		"Accept-Version": {"~9"},
+		"Authorization": {fmt.Sprintf(`Signature keyId="%s",algorithm="%s",headers="date",signature="%s"`,
+			cloud.keyId, cloud.algorithm, base64.StdEncoding.EncodeToString(signature))},
+	}
+	return callJSON(ctx, cloud.client, "triton", method, cloud.endpoint(zone)+"/"+cloud.account+path, header, body, result)
+}
+
+type tritonMachine struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	State     string `json:"state"`
+	PrimaryIP string `json:"primaryIp"`
+}
+
+// Find the machine with the given name in a datacenter.
+func (cloud TritonCloud) findMachine(ctx context.Context, name, zone string) (*tritonMachine, error) {
+	var machines []tritonMachine
+	if err := cloud.call(ctx, zone, "GET", "/machines?name="+url.QueryEscape(name), nil, &machines); err != nil {
+		return nil, err
+	}
+	for _, m := range machines {
+		if m.Name == name && m.State != "deleted" {
+			return &m, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: machine %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud TritonCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	machine, err := cloud.findMachine(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return machine.PrimaryIP, nil
+}
+
+// Resolve -triton-image to the id of the latest image with that name. Ids
+// are returned unchanged.
+func (cloud TritonCloud) resolveImage(ctx context.Context, zone string) (string, error) {
+	var images []struct {
+		Id          string `json:"id"`
+		PublishedAt string `json:"published_at"`
+	}
+	if err := cloud.call(ctx, zone, "GET", "/images?name="+url.QueryEscape(cloud.config.Image), nil, &images); err != nil {
+		return "", err
+	}
+	if len(images) == 0 {
+		return cloud.config.Image, nil
+	}
+	latest := images[0]
+	for _, image := range images[1:] {
+		// The publication dates are ISO 8601 and sort as strings.
+		if image.PublishedAt > latest.PublishedAt {
+			latest = image
+		}
+	}
+	return latest.Id, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud TritonCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The machine firewall is disabled by default.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	imageId, err := cloud.resolveImage(ctx, zone)
+	if err != nil {
+		log.Printf("failed to find image: %v", err)
+		return "", err
+	}
+	machine := map[string]interface{}{
+		"name":    name,
+		"package": cloud.config.Package,
+		"image":   imageId,
+		// Run as root at boot by the guest tools.
+		"metadata.user-script": script,
+	}
+	if !cloud.config.NoManagedTags {
+		machine["tag."+managedByLabel] = "docker-cloud"
+	}
+	log.Printf("starting machine: %q", name)
+	var created tritonMachine
+	if err := cloud.call(ctx, zone, "POST", "/machines", machine, &created); err != nil {
+		log.Printf("machine create api call failed: %v", err)
+		return "", err
+	}
+	running, err := cloud.waitForMachine(ctx, zone, created.Id)
+	if err != nil {
+		log.Printf("machine failed to start: %v", err)
+		return "", err
+	}
+	ip := running.PrimaryIP
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, tritonDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("machine started: %q", ip)
+	return ip, nil
+}
+
+// Wait until a machine is running.
+func (cloud TritonCloud) waitForMachine(ctx context.Context, zone, id string) (*tritonMachine, error) {
+	deadline := time.Now().Add(tritonTimeout)
+	for {
+		var machine tritonMachine
+		if err := cloud.call(ctx, zone, "GET", "/machines/"+id, nil, &machine); err != nil {
+			return nil, err
+		}
+		switch machine.State {
+		case "running":
+			return &machine, nil
+		case "failed":
+			return nil, fmt.Errorf("machine %q failed to provision", id)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for machine %q to run", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud TritonCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	machine, err := cloud.findMachine(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting machine")
+	err = cloud.call(ctx, zone, "DELETE", "/machines/"+machine.Id, nil, nil)
+	if err == nil {
+		log.Print("machine deleted")
+	}
+	return err
+}
+
+// Return the ssh login on a machine, with the account key Triton installs.
+// The host keys are trusted on first use.
+func (cloud TritonCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: ip, KeyPath: cloud.config.KeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,235 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The settings of a VirtualBox Cloud.
+type VirtualBoxConfig struct {
+	Options
+	// The OVA appliance to boot, with cloud-init.
+	ImageURL string
+	// The number of CPUs of the VM.
+	CPUs int
+	// The memory of the VM in MB.
+	Memory int
+	// The default user of the appliance.
+	SSHUser string
+	// The private key to log into the VMs, generated if missing.
+	SSHKeyPath string
+	// Where the appliance and the VM seeds are stored.
+	StorageDir string
+}
+
+const (
+	// The NAT port forwarding rule of the VM ssh port.
+	vboxSSHRule = "docker-cloud-ssh"
+	// The storage controller holding the cloud-init seed.
+	vboxSeedController = "docker-cloud-seed"
+
+	vboxDockerTimeout = 10 * time.Minute
+)
+
+// A local VirtualBox implementation of the Cloud interface, driving
+// VBoxManage. The VMs only have a NAT interface, with their ssh port
+// forwarded to localhost, and the zone is ignored.
+type VirtualBoxCloud struct {
+	unsupported
+	sshInstances
+
+	config VirtualBoxConfig
+}
+
+// Create a VirtualBox Cloud instance.
+func NewVirtualBoxCloud(config VirtualBoxConfig) (Cloud, error) {
+	if !lookPath("VBoxManage") {
+		return nil, errors.New("VBoxManage not found, is VirtualBox installed?")
+	}
+	cloud := &VirtualBoxCloud{config: config}
+	cloud.sshInstances = sshInstances{target: func(ctx context.Context, name, zone string) (SSHTarget, error) {
+		port, err := cloud.sshPort(name)
+		if err != nil {
+			return SSHTarget{}, err
+		}
+		return cloud.target(port), nil
+	}}
+	return cloud, nil
+}
+
+// Run VBoxManage and return its standard output.
+func vboxManage(args ...string) (string, error) {
+	cmd := exec.Command("VBoxManage", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("VBoxManage %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// Return the machine readable properties of a VM.
+func vboxInfo(name string) (map[string]string, error) {
+	out, err := vboxManage("showvminfo", name, "--machinereadable")
+	if err != nil && strings.Contains(err.Error(), "Could not find a registered machine") {
+		return nil, fmt.Errorf("%w: vm %q", ErrInstanceNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 {
+			info[strings.Trim(kv[0], `"`)] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return info, scanner.Err()
+}
+
+// Return the localhost port forwarded to the ssh port of a running VM.
+func (cloud VirtualBoxCloud) sshPort(name string) (int, error) {
+	info, err := vboxInfo(name)
+	if err != nil {
+		return 0, err
+	}
+	if info["VMState"] != "running" {
+		return 0, fmt.Errorf("vm %q is %s", name, info["VMState"])
+	}
+	for key, rule := range info {
+		// e.g. Forwarding(0)="docker-cloud-ssh,tcp,127.0.0.1,52022,,22"
+		fields := strings.Split(rule, ",")
+		if strings.HasPrefix(key, "Forwarding(") && len(fields) == 6 && fields[0] == vboxSSHRule {
+			return strconv.Atoi(fields[3])
+		}
+	}
+	return 0, fmt.Errorf("vm %q has no %s port forwarding", name, vboxSSHRule)
+}
+
+// Implementation of the Cloud interface. The VMs are reached on localhost.
+func (cloud VirtualBoxCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	if _, err := cloud.sshPort(name); err != nil {
+		return "", err
+	}
+	return "127.0.0.1", nil
+}
+
+// Download -virtualbox-image-url into the storage dir if missing. Returns its path.
+func (cloud VirtualBoxCloud) ensureImage(ctx context.Context) (string, error) {
+	return downloadImage(ctx, cloud.config.ImageURL, cloud.config.StorageDir)
+}
+
+// Return a free localhost port.
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud VirtualBoxCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	script, err := startupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		log.Printf("failed to get ssh key: %v", err)
+		return "", err
+	}
+	image, err := cloud.ensureImage(ctx)
+	if err != nil {
+		log.Printf("failed to get image: %v", err)
+		return "", err
+	}
+	dir := filepath.Join(cloud.config.StorageDir, name)
+	seed, err := writeCloudInitSeed(dir, name, string(publicKey), script)
+	if err != nil {
+		log.Printf("failed to write cloud-init seed: %v", err)
+		return "", err
+	}
+	port, err := freeLocalPort()
+	if err != nil {
+		return "", err
+	}
+	log.Printf("importing vm: %q", name)
+	steps := [][]string{
+		{"import", image, "--vsys", "0", "--vmname", name, "--cpus", strconv.Itoa(cloud.config.CPUs), "--memory", strconv.Itoa(cloud.config.Memory)},
+		{"storagectl", name, "--name", vboxSeedController, "--add", "sata"},
+		{"storageattach", name, "--storagectl", vboxSeedController, "--port", "0", "--device", "0", "--type", "dvddrive", "--medium", seed},
+		// The cloud images hang at boot without a serial port.
+		{"modifyvm", name, "--uart1", "0x3F8", "4", "--uartmode1", "file", filepath.Join(dir, "console.log")},
+		{"modifyvm", name, "--natpf1", fmt.Sprintf("%s,tcp,127.0.0.1,%d,,22", vboxSSHRule, port)},
+		{"startvm", name, "--type", "headless"},
+	}
+	for _, args := range steps {
+		if _, err := vboxManage(args...); err != nil {
+			log.Printf("failed to create vm: %v", err)
+			return "", err
+		}
+	}
+	target := cloud.target(port)
+	if err := target.WaitForPort(ctx, startupDockerPort, vboxDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("vm started on port %d", port)
+	return "127.0.0.1", nil
+}
+
+// Implementation of the Cloud interface
+func (cloud VirtualBoxCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	info, err := vboxInfo(name)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting vm")
+	if info["VMState"] == "running" {
+		if _, err := vboxManage("controlvm", name, "poweroff"); err != nil {
+			return err
+		}
+	}
+	// The seed is detached first to not delete it along with the disks.
+	vboxManage("storageattach", name, "--storagectl", vboxSeedController, "--port", "0", "--device", "0", "--medium", "none")
+	if _, err := vboxManage("unregistervm", name, "--delete"); err != nil {
+		return err
+	}
+	log.Print("vm deleted")
+	return os.RemoveAll(filepath.Join(cloud.config.StorageDir, name))
+}
+
+// Return the ssh login on the VM forwarded to the given localhost port.
+func (cloud VirtualBoxCloud) target(port int) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: "127.0.0.1", Port: port, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
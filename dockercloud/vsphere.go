@@ -0,0 +1,297 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The settings of a vSphere Cloud.
+type VSphereConfig struct {
+	Options
+	// The vCenter or ESXi server, $VSPHERE_SERVER when empty.
+	Server string
+	// The vSphere user, $VSPHERE_USER when empty.
+	User string
+	// The vSphere password, $VSPHERE_PASSWORD when empty.
+	Password string
+	// Don't verify the server TLS certificate.
+	Insecure bool
+	// The VM template to clone, with VMware tools and -vsphere-ssh-key-path authorized.
+	Template string
+	// The VM folder of the instances, the template one when empty.
+	Folder string
+	// The resource pool of the instances, the template one when empty.
+	ResourcePool string
+	// The datastore of the instances, the template one when empty.
+	Datastore string
+	// The user to log into the instances.
+	SSHUser string
+	// The private key authorized in the template.
+	SSHKeyPath string
+}
+
+const (
+	vsphereGuestTimeout  = 10 * time.Minute
+	vsphereDockerTimeout = 10 * time.Minute
+)
+
+// A VMware vSphere implementation of the Cloud interface on top of the
+// vSphere Automation REST API. Zones are datacenter names, and the instances
+// are clones of -vsphere-template.
+type VSphereCloud struct {
+	unsupported
+	sshInstances
+
+	server   string
+	user     string
+	password string
+	client   *http.Client
+	session  *vsphereSession
+	config   VSphereConfig
+}
+
+// The API session, created on first use.
+type vsphereSession struct {
+	sync.Mutex
+	id string
+}
+
+// Create a vSphere Cloud instance.
+func NewVSphereCloud(config VSphereConfig) (Cloud, error) {
+	cloud := &VSphereCloud{
+		config:   config,
+		server:   config.Server,
+		user:     config.User,
+		password: config.Password,
+		client:   &http.Client{Timeout: 60 * time.Second},
+		session:  &vsphereSession{},
+	}
+	if cloud.server == "" {
+		cloud.server = os.Getenv("VSPHERE_SERVER")
+	}
+	if cloud.user == "" {
+		cloud.user = os.Getenv("VSPHERE_USER")
+	}
+	if cloud.password == "" {
+		cloud.password = os.Getenv("VSPHERE_PASSWORD")
+	}
+	if cloud.server == "" || cloud.user == "" || cloud.password == "" {
+		return nil, errors.New("-vsphere-server, -vsphere-user and -vsphere-password must be set")
+	}
+	if config.Template == "" {
+		return nil, errors.New("-vsphere-template must be set")
+	}
+	if config.Insecure {
+		cloud.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call the vSphere Automation API, creating the session first if needed.
+func (cloud VSphereCloud) call(ctx context.Context, method, path string, body, result interface{}) error {
+	sessionId, err := cloud.sessionId(ctx)
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Vmware-Api-Session-Id": {sessionId}}
+	return callJSON(ctx, cloud.client, "vsphere", method, "https://"+cloud.server+"/api"+path, header, body, result)
+}
+
+// Return the API session id, logging in on first use.
+func (cloud VSphereCloud) sessionId(ctx context.Context) (string, error) {
+	cloud.session.Lock()
+	defer cloud.session.Unlock()
+	if cloud.session.id != "" {
+		return cloud.session.id, nil
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(cloud.user + ":" + cloud.password))
+	header := http.Header{"Authorization": {"Basic " + credentials}}
+	// The session id is returned as a JSON string.
+	err := callJSON(ctx, cloud.client, "vsphere", "POST", "https://"+cloud.server+"/api/session", header, nil, &cloud.session.id)
+	return cloud.session.id, err
+}
+
+// Return the id of the named object of a datacenter, such as a "vm" or
+// "folder". filter adds query parameters.
+func (cloud VSphereCloud) lookup(ctx context.Context, kind, name, datacenter, filter string) (string, error) {
+	var objects []map[string]interface{}
+	query := "/vcenter/" + kind + "?names=" + url.QueryEscape(name) + filter
+	if datacenter != "" {
+		query += "&datacenters=" + datacenter
+	}
+	if err := cloud.call(ctx, "GET", query, nil, &objects); err != nil {
+		return "", err
+	}
+	if len(objects) == 0 && kind == "vm" {
+		return "", fmt.Errorf("%w: vm %q", ErrInstanceNotFound, name)
+	}
+	if len(objects) == 0 {
+		return "", fmt.Errorf("%s %q not found", strings.Replace(kind, "-", " ", -1), name)
+	}
+	id, _ := objects[0][kind].(string)
+	return id, nil
+}
+
+// Return the id of the VM with the given name in a datacenter.
+func (cloud VSphereCloud) findVM(ctx context.Context, name, zone string) (string, error) {
+	datacenter, err := cloud.lookup(ctx, "datacenter", zone, "", "")
+	if err != nil {
+		return "", err
+	}
+	return cloud.lookup(ctx, "vm", name, datacenter, "")
+}
+
+// Implementation of the Cloud interface. The address is reported by the
+// VMware tools of the guest.
+func (cloud VSphereCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	vm, err := cloud.findVM(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	var identity struct {
+		IPAddress string `json:"ip_address"`
+	}
+	if err := cloud.call(ctx, "GET", "/vcenter/vm/"+vm+"/guest/identity", nil, &identity); err != nil {
+		return "", err
+	}
+	return identity.IPAddress, nil
+}
+
+// Implementation of the Cloud interface
+func (cloud VSphereCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The instances are on the datacenter network, keep docker to the tunnel.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	datacenter, err := cloud.lookup(ctx, "datacenter", zone, "", "")
+	if err != nil {
+		return "", err
+	}
+	template, err := cloud.lookup(ctx, "vm", cloud.config.Template, datacenter, "")
+	if err != nil {
+		return "", err
+	}
+	placement := map[string]string{}
+	for _, p := range []struct{ kind, key, name, filter string }{
+		{"folder", "folder", cloud.config.Folder, "&type=VIRTUAL_MACHINE"},
+		{"resource-pool", "resource_pool", cloud.config.ResourcePool, ""},
+		{"datastore", "datastore", cloud.config.Datastore, ""},
+	} {
+		if p.name == "" {
+			continue
+		}
+		id, err := cloud.lookup(ctx, p.kind, p.name, datacenter, p.filter)
+		if err != nil {
+			return "", err
+		}
+		placement[p.key] = id
+	}
+	clone := map[string]interface{}{
+		"source":   template,
+		"name":     name,
+		"power_on": true,
+	}
+	if len(placement) > 0 {
+		clone["placement"] = placement
+	}
+	log.Printf("cloning %q into %q", cloud.config.Template, name)
+	var vm string
+	if err := cloud.call(ctx, "POST", "/vcenter/vm?action=clone", clone, &vm); err != nil {
+		log.Printf("vm clone api call failed: %v", err)
+		return "", err
+	}
+	ip, err := cloud.waitForGuestIP(ctx, vm)
+	if err != nil {
+		log.Printf("vm failed to start: %v", err)
+		return "", err
+	}
+	target := cloud.target(ip)
+	if err := target.WaitForPort(ctx, 22, vsphereGuestTimeout); err != nil {
+		log.Printf("ssh failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("installing docker on %q", name)
+	if err := target.RunScript(ctx, script); err != nil {
+		log.Printf("startup script failed: %v", err)
+		return "", err
+	}
+	if err := target.WaitForPort(ctx, startupDockerPort, vsphereDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("vm started: %q", ip)
+	return ip, nil
+}
+
+// Wait until the VMware tools of a VM report its IP address.
+func (cloud VSphereCloud) waitForGuestIP(ctx context.Context, vm string) (string, error) {
+	deadline := time.Now().Add(vsphereGuestTimeout)
+	for {
+		var identity struct {
+			IPAddress string `json:"ip_address"`
+		}
+		// Fails until the tools are running in the guest.
+		err := cloud.call(ctx, "GET", "/vcenter/vm/"+vm+"/guest/identity", nil, &identity)
+		if err == nil && identity.IPAddress != "" {
+			return identity.IPAddress, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("%w waiting for the guest IP of %q: %v", ErrOperationTimeout, vm, err)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud VSphereCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	vm, err := cloud.findVM(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting vm")
+	err = cloud.call(ctx, "POST", "/vcenter/vm/"+vm+"/power?action=stop", nil, nil)
+	// Stopping an already stopped VM is a bad request.
+	if err != nil && !isAPIStatus(err, http.StatusBadRequest) {
+		return err
+	}
+	if err := cloud.call(ctx, "DELETE", "/vcenter/vm/"+vm, nil, nil); err != nil {
+		return err
+	}
+	log.Print("vm deleted")
+	return nil
+}
+
+// Return the ssh login on a VM. The clones share the host keys of the
+// template, trusted on first use.
+func (cloud VSphereCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: cloud.config.SSHUser, Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
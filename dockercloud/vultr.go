@@ -0,0 +1,239 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The settings of a Vultr Cloud.
+type VultrConfig struct {
+	Options
+	// The Vultr API key, $VULTR_API_KEY when empty.
+	APIKey string
+	// The Vultr plan.
+	Plan string
+	// The Vultr operating system id.
+	OS int
+	// The private key to log into the instances, generated if missing.
+	SSHKeyPath string
+}
+
+const (
+	vultrAPI = "https://api.vultr.com/v2"
+
+	// The name of the ssh key registered by docker-cloud.
+	vultrSSHKeyName = "docker-cloud"
+
+	vultrTimeout       = 10 * time.Minute
+	vultrDockerTimeout = 10 * time.Minute
+)
+
+// A Vultr implementation of the Cloud interface. Zones are Vultr regions
+// such as "ewr".
+type VultrCloud struct {
+	unsupported
+	sshInstances
+
+	apiKey string
+	client *http.Client
+	config VultrConfig
+}
+
+// Create a Vultr Cloud instance.
+func NewVultrCloud(config VultrConfig) (Cloud, error) {
+	apiKey := config.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("VULTR_API_KEY")
+	}
+	if apiKey == "" {
+		return nil, errors.New("-vultr-api-key or VULTR_API_KEY must be set")
+	}
+	cloud := &VultrCloud{apiKey: apiKey, client: &http.Client{Timeout: 30 * time.Second}, config: config}
+	cloud.sshInstances = sshOnPublicIP(cloud.GetPublicIPAddress, cloud.target)
+	return cloud, nil
+}
+
+// Call the Vultr API.
+func (cloud VultrCloud) call(ctx context.Context, method, path string, body, result interface{}) error {
+	header := http.Header{"Authorization": {"Bearer " + cloud.apiKey}}
+	return callJSON(ctx, cloud.client, "vultr", method, vultrAPI+path, header, body, result)
+}
+
+type vultrInstance struct {
+	Id          string `json:"id"`
+	Label       string `json:"label"`
+	Region      string `json:"region"`
+	MainIP      string `json:"main_ip"`
+	Status      string `json:"status"`
+	PowerStatus string `json:"power_status"`
+}
+
+// Find the instance with the given label in a region.
+func (cloud VultrCloud) findInstance(ctx context.Context, name, zone string) (*vultrInstance, error) {
+	var resp struct {
+		Instances []vultrInstance `json:"instances"`
+	}
+	if err := cloud.call(ctx, "GET", "/instances?label="+url.QueryEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, i := range resp.Instances {
+		if i.Label == name && i.Region == zone {
+			return &i, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: instance %q in %q", ErrInstanceNotFound, name, zone)
+}
+
+// Implementation of the Cloud interface
+func (cloud VultrCloud) GetPublicIPAddress(ctx context.Context, name string, zone string) (string, error) {
+	instance, err := cloud.findInstance(ctx, name, zone)
+	if err != nil {
+		return "", err
+	}
+	return instance.MainIP, nil
+}
+
+// Register the -vultr-ssh-key-path public key, generating the key pair first
+// if needed. Returns the key id.
+func (cloud VultrCloud) ensureSSHKey(ctx context.Context) (string, error) {
+	publicKey, err := EnsureSSHKey(cloud.config.SSHKeyPath)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(publicKey))
+	var resp struct {
+		SSHKeys []struct {
+			Id     string `json:"id"`
+			Name   string `json:"name"`
+			SSHKey string `json:"ssh_key"`
+		} `json:"ssh_keys"`
+	}
+	if err := cloud.call(ctx, "GET", "/ssh-keys?per_page=500", nil, &resp); err != nil {
+		return "", err
+	}
+	for _, k := range resp.SSHKeys {
+		if k.SSHKey == key {
+			return k.Id, nil
+		}
+	}
+	log.Printf("registering ssh key: %q", vultrSSHKeyName)
+	var created struct {
+		SSHKey struct {
+			Id string `json:"id"`
+		} `json:"ssh_key"`
+	}
+	err = cloud.call(ctx, "POST", "/ssh-keys", map[string]string{"name": vultrSSHKeyName, "ssh_key": key}, &created)
+	return created.SSHKey.Id, err
+}
+
+// Implementation of the Cloud interface
+func (cloud VultrCloud) CreateInstance(ctx context.Context, name string, zone string, spec InstanceSpec) (string, error) {
+	// The instances have no firewall by default.
+	script, err := localDockerStartupScript(spec)
+	if err != nil {
+		log.Printf("failed to render startup script: %v", err)
+		return "", err
+	}
+	keyId, err := cloud.ensureSSHKey(ctx)
+	if err != nil {
+		log.Printf("failed to register ssh key: %v", err)
+		return "", err
+	}
+	instance := map[string]interface{}{
+		"label":     name,
+		"hostname":  name,
+		"region":    zone,
+		"plan":      cloud.config.Plan,
+		"os_id":     cloud.config.OS,
+		"sshkey_id": []string{keyId},
+		"user_data": base64.StdEncoding.EncodeToString([]byte(script)),
+	}
+	if !cloud.config.NoManagedTags {
+		instance["tags"] = []string{"docker-cloud"}
+	}
+	log.Printf("starting instance: %q", name)
+	var created struct {
+		Instance vultrInstance `json:"instance"`
+	}
+	if err := cloud.call(ctx, "POST", "/instances", instance, &created); err != nil {
+		log.Printf("instance create api call failed: %v", err)
+		return "", err
+	}
+	running, err := cloud.waitForInstance(ctx, created.Instance.Id)
+	if err != nil {
+		log.Printf("instance failed to start: %v", err)
+		return "", err
+	}
+	ip := running.MainIP
+	if err := cloud.target(ip).WaitForPort(ctx, startupDockerPort, vultrDockerTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return "", err
+	}
+	log.Printf("instance started: %q", ip)
+	return ip, nil
+}
+
+// Wait until an instance is active, running and has its IP address.
+func (cloud VultrCloud) waitForInstance(ctx context.Context, id string) (*vultrInstance, error) {
+	deadline := time.Now().Add(vultrTimeout)
+	for {
+		var resp struct {
+			Instance vultrInstance `json:"instance"`
+		}
+		if err := cloud.call(ctx, "GET", "/instances/"+id, nil, &resp); err != nil {
+			return nil, err
+		}
+		i := resp.Instance
+		// The main IP is 0.0.0.0 until assigned.
+		if i.Status == "active" && i.PowerStatus == "running" && i.MainIP != "0.0.0.0" {
+			return &i, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w waiting for instance %q to run", ErrOperationTimeout, id)
+		}
+		if err := sleep(ctx, 5*time.Second); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Implementation of the Cloud interface
+func (cloud VultrCloud) DeleteInstance(ctx context.Context, name string, zone string) error {
+	instance, err := cloud.findInstance(ctx, name, zone)
+	if err != nil {
+		return err
+	}
+	log.Print("deleting instance")
+	err = cloud.call(ctx, "DELETE", "/instances/"+instance.Id, nil, nil)
+	if err == nil {
+		log.Print("instance deleted")
+	}
+	return err
+}
+
+// Return the ssh login on an instance, whose host keys are trusted on first use.
+func (cloud VultrCloud) target(ip string) SSHTarget {
+	return SSHTarget{Config: cloud.config.SSH, User: "root", Host: ip, KeyPath: cloud.config.SSHKeyPath, TrustOnFirstUse: true}
+}
@@ -0,0 +1,197 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+	"google.golang.org/api/googleapi"
+)
+
+// The outcome of a doctor check.
+type checkResult struct {
+	Check string
+	// "ok", "warn" or "fail".
+	Status string
+	Detail string
+	// What to do about it, when it isn't ok.
+	Fix string `json:",omitempty"`
+}
+
+// The GCE quotas an instance draws from, warned about above 90% usage.
+var doctorQuotas = []string{"CPUS", "IN_USE_ADDRESSES", "DISKS_TOTAL_GB", "SSD_TOTAL_GB"}
+
+// Run the checks which don't need the cloud: the GCE project, credentials
+// and ssh key.
+func localChecks() []checkResult {
+	if *provider != "gce" {
+		return nil
+	}
+	results := []checkResult{}
+	resolveProject()
+	if *projectId == "" {
+		results = append(results, checkResult{"project", "fail", "no -project nor gcloud project",
+			"pass -project, save it with docker-cloud config set project <id>, or run gcloud config set project <id>"})
+	} else {
+		results = append(results, checkResult{"project", "ok", *projectId, ""})
+	}
+	if _, err := os.Stat(*gcloudCredentialsPath); err != nil {
+		results = append(results, checkResult{"credentials", "fail", err.Error(),
+			"run gcloud auth login, or point -gcloudcredentials to the credentials file"})
+	} else {
+		results = append(results, checkResult{"credentials", "ok", *gcloudCredentialsPath, ""})
+	}
+	keyPath := dockercloud.GCESSHKeyPath()
+	err := dockercloud.ValidateSSHKey(keyPath)
+	switch {
+	case errors.Is(err, dockercloud.ErrSSHKeyNotFound):
+		results = append(results, checkResult{"ssh key", "fail", err.Error(),
+			"run gcloud compute config-ssh, or ssh-keygen -t ed25519 -f " + keyPath})
+	case errors.Is(err, dockercloud.ErrSSHKeyPermissions):
+		results = append(results, checkResult{"ssh key", "fail", err.Error(), "run chmod 600 " + keyPath})
+	case err != nil:
+		results = append(results, checkResult{"ssh key", "fail", err.Error(), "use an ed25519 or RSA key in the OpenSSH format"})
+	default:
+		results = append(results, checkResult{"ssh key", "ok", keyPath, ""})
+	}
+	return results
+}
+
+// Run the checks against the cloud: API access, GCE quotas and firewall
+// rules, and the tunnel.
+func (cloud *DockerCloud) cloudChecks(ctx context.Context) []checkResult {
+	results := []checkResult{}
+	gce, isGCE := cloud.Cloud.(*dockercloud.GCECloud)
+	if isGCE {
+		err := gce.CheckProjectAccess(ctx)
+		var apiErr *googleapi.Error
+		switch {
+		case errors.As(err, &apiErr) && (apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden):
+			results = append(results, checkResult{"api", "fail", err.Error(),
+				"run gcloud auth login with an account allowed to manage Compute Engine in " + *projectId})
+			return results
+		case err != nil:
+			results = append(results, checkResult{"api", "fail", err.Error(),
+				"check the network, and that the Compute Engine API is enabled in " + *projectId})
+			return results
+		}
+		results = append(results, checkResult{"api", "ok", "project " + *projectId + " readable", ""})
+		results = append(results, gceQuotaCheck(ctx, gce))
+		results = append(results, gceFirewallChecks(ctx, gce)...)
+	} else {
+		_, err := cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+		if err != nil && !errors.Is(err, dockercloud.ErrInstanceNotFound) {
+			results = append(results, checkResult{"api", "fail", err.Error(), "check the credentials of the " + *provider + " provider"})
+			return results
+		}
+		results = append(results, checkResult{"api", "ok", *provider + " reachable", ""})
+	}
+	network, addr := dockerAddr()
+	conn, err := net.DialTimeout(network, addr, 3*time.Second)
+	if err != nil {
+		results = append(results, checkResult{"tunnel", "warn", "nothing listening on " + addr, "run docker-cloud start"})
+		return results
+	}
+	conn.Close()
+	if err := cloud.TestDockerConnectivity(ctx); err != nil {
+		results = append(results, checkResult{"tunnel", "fail", err.Error(),
+			"look at docker-cloud logs, then run docker-cloud restart"})
+	} else {
+		results = append(results, checkResult{"tunnel", "ok", "docker answers on " + addr, ""})
+	}
+	return results
+}
+
+func gceQuotaCheck(ctx context.Context, gce *dockercloud.GCECloud) checkResult {
+	region := dockercloud.RegionForZone(*zone)
+	quotas, err := gce.GetRegionQuotas(ctx, region)
+	if err != nil {
+		return checkResult{"quota", "fail", err.Error(), "check the access to the region " + region}
+	}
+	fix := fmt.Sprintf("request more quota at https://console.cloud.google.com/iam-admin/quotas?project=%s, or pick another -zone", *projectId)
+	status, details := "ok", []string{}
+	for _, q := range quotas {
+		for _, metric := range doctorQuotas {
+			if q.Metric != metric {
+				continue
+			}
+			details = append(details, q.String())
+			if q.Usage >= q.Limit {
+				status = "fail"
+			} else if q.Usage >= 0.9*q.Limit && status == "ok" {
+				status = "warn"
+			}
+		}
+	}
+	if status == "ok" {
+		fix = ""
+	}
+	return checkResult{"quota", status, region + " " + strings.Join(details, ", "), fix}
+}
+
+func gceFirewallChecks(ctx context.Context, gce *dockercloud.GCECloud) []checkResult {
+	ssh, err := gce.ListOpenFirewallRules(ctx, 22)
+	if err != nil {
+		return []checkResult{{"firewall", "fail", err.Error(), "check the access to the firewall rules of " + *projectId}}
+	}
+	results := []checkResult{}
+	if len(ssh) == 0 {
+		results = append(results, checkResult{"firewall ssh", "fail", "no rule of the default network lets ssh in",
+			"run gcloud compute firewall-rules create default-allow-ssh --network default --allow tcp:22"})
+	} else {
+		results = append(results, checkResult{"firewall ssh", "ok", "allowed by " + strings.Join(ssh, ", "), ""})
+	}
+	docker, err := gce.ListOpenFirewallRules(ctx, *dockerPort)
+	if err != nil {
+		return append(results, checkResult{"firewall docker", "fail", err.Error(), ""})
+	}
+	if len(docker) > 0 {
+		results = append(results, checkResult{"firewall docker", "fail",
+			fmt.Sprintf("%s let anyone drive docker on port %d", strings.Join(docker, ", "), *dockerPort),
+			"docker is reached through the tunnel, run gcloud compute firewall-rules delete " + strings.Join(docker, " ")})
+	} else {
+		results = append(results, checkResult{"firewall docker", "ok", fmt.Sprintf("port %d closed to the internet", *dockerPort), ""})
+	}
+	return results
+}
+
+// Tell whether any check failed.
+func checksFailed(results []checkResult) bool {
+	for _, r := range results {
+		if r.Status == "fail" {
+			return true
+		}
+	}
+	return false
+}
+
+// Print the results one per line, with the fix of those not ok.
+func printChecks(w io.Writer, results []checkResult) {
+	for _, r := range results {
+		fmt.Fprintf(w, "%-5s %s: %s\n", strings.ToUpper(r.Status), r.Check, r.Detail)
+		if r.Fix != "" {
+			fmt.Fprintf(w, "      fix: %s\n", r.Fix)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Return a Docker API client connected through the tunnel.
+func (cloud *DockerCloud) dockerClient() (*client.Client, error) {
+	return client.NewClientWithOpts(
+		client.WithHost(dockerHost()),
+		client.WithAPIVersionNegotiation())
+}
+
+// Return the version of the Docker daemon answering through the tunnel.
+func (cloud *DockerCloud) DockerVersion(ctx context.Context) (types.Version, error) {
+	cli, err := cloud.dockerClient()
+	if err != nil {
+		return types.Version{}, err
+	}
+	defer cli.Close()
+	return cli.ServerVersion(ctx)
+}
+
+// Stream the Docker daemon events matching filters, starting from since (a
+// timestamp or a duration such as "5m", empty for now). Neither channel is
+// closed, the stream ends with a single error, ctx.Err() once ctx is done.
+func (cloud *DockerCloud) Events(ctx context.Context, filterMap map[string][]string, since string) (<-chan events.Message, <-chan error) {
+	cli, err := cloud.dockerClient()
+	if err != nil {
+		errs := make(chan error, 1)
+		errs <- err
+		close(errs)
+		return nil, errs
+	}
+	args := filters.NewArgs()
+	for key, values := range filterMap {
+		for _, value := range values {
+			args.Add(key, value)
+		}
+	}
+	return cli.Events(ctx, types.EventsOptions{Since: since, Filters: args})
+}
@@ -0,0 +1,138 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// What gc collects: the GCE resources created by docker-cloud that nothing
+// uses anymore, and the saved instances which are gone.
+type garbage struct {
+	Resources []dockercloud.OrphanedResource
+	// Names of the saved instances.
+	Machines []string
+}
+
+// Find the garbage older than olderThan. The saved instances of other
+// providers, and those whose disks stop kept, are left alone.
+func (cloud *DockerCloud) findGarbage(ctx context.Context, olderThan time.Duration) (*garbage, error) {
+	found := &garbage{Resources: []dockercloud.OrphanedResource{}, Machines: []string{}}
+	if gce, ok := cloud.Cloud.(*dockercloud.GCECloud); ok {
+		disks, err := gce.ListOrphanedDisks(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list disks: %v", err)
+		}
+		snapshots, err := gce.ListDanglingSnapshots(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots: %v", err)
+		}
+		found.Resources = collectable(append(disks, snapshots...), savedDisks(), olderThan)
+	}
+	for _, name := range knownInstances() {
+		m, err := loadMachine(name)
+		// The instance of a kept disk is gone on purpose.
+		if err != nil || m == nil || m.Provider != *provider || m.DiskKept {
+			continue
+		}
+		_, err = cloud.GetPublicIPAddress(ctx, m.Name, m.Zone)
+		if errors.Is(err, dockercloud.ErrInstanceNotFound) {
+			found.Machines = append(found.Machines, m.Name)
+		}
+	}
+	return found, nil
+}
+
+// Return the resources older than olderThan, leaving out the disks of the
+// saved instances.
+func collectable(resources []dockercloud.OrphanedResource, saved map[string]bool, olderThan time.Duration) []dockercloud.OrphanedResource {
+	found := []dockercloud.OrphanedResource{}
+	for _, r := range resources {
+		if r.Kind == "disk" && saved[r.Name] {
+			continue
+		}
+		// Without a creation time, the resource may well be in use.
+		if !r.CreationTime.IsZero() && time.Since(r.CreationTime) > olderThan {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// Return the names of the disks of all the saved instances, such as the root
+// disks kept by stop.
+func savedDisks() map[string]bool {
+	disks := map[string]bool{}
+	for _, name := range knownInstances() {
+		m, err := loadMachine(name)
+		if err != nil || m == nil {
+			continue
+		}
+		if m.DiskName != "" {
+			disks[m.DiskName] = true
+		}
+		for _, disk := range m.Disks {
+			disks[disk] = true
+		}
+	}
+	return disks
+}
+
+// Describe the garbage for the confirmation.
+func (g *garbage) describe() []string {
+	doomed := []string{}
+	for _, r := range g.Resources {
+		doomed = append(doomed, r.String())
+	}
+	for _, name := range g.Machines {
+		doomed = append(doomed, fmt.Sprintf("saved instance %q, gone from the cloud", name))
+	}
+	return doomed
+}
+
+// Delete the garbage. Returns an error when anything couldn't be deleted.
+func (cloud *DockerCloud) collectGarbage(ctx context.Context, g *garbage) error {
+	failed := 0
+	for _, r := range g.Resources {
+		var err error
+		switch r.Kind {
+		case "disk":
+			err = cloud.gce().DeleteDisk(ctx, r.Name, r.Zone)
+		case "snapshot":
+			err = cloud.gce().DeleteSnapshot(ctx, r.Name)
+		}
+		if err != nil {
+			log.Printf("failed to delete %s: %v", r, err)
+			failed++
+		}
+	}
+	for _, name := range g.Machines {
+		if *dryRun {
+			fmt.Printf("would forget instance: %s\n", name)
+			continue
+		}
+		forgetInstance(name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d resources", failed)
+	}
+	return nil
+}
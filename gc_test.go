@@ -0,0 +1,54 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+func TestCollectableSkipsKeptDisks(t *testing.T) {
+	saved := machinesDir
+	machinesDir = t.TempDir()
+	defer func() { machinesDir = saved }()
+	kept := &machine{Name: "kept", Provider: "gce", Zone: "us-central1-a", DiskName: "kept-root", Disks: []string{"kept-root", "kept-data"}, DiskKept: true}
+	if err := kept.save(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	orphans := []dockercloud.OrphanedResource{
+		{Kind: "disk", Name: "kept-root", Zone: "us-central1-a", CreationTime: old},
+		{Kind: "disk", Name: "kept-data", Zone: "us-central1-a", CreationTime: old},
+		{Kind: "disk", Name: "gone-root", Zone: "us-central1-a", CreationTime: old},
+		{Kind: "disk", Name: "new-root", Zone: "us-central1-a", CreationTime: time.Now()},
+		{Kind: "snapshot", Name: "kept-root", CreationTime: old},
+	}
+	found := collectable(orphans, savedDisks(), 24*time.Hour)
+	names := []string{}
+	for _, r := range found {
+		names = append(names, r.String())
+	}
+	want := []string{`disk "gone-root" in "us-central1-a"`, `snapshot "kept-root"`}
+	if len(names) != len(want) {
+		t.Fatalf("collectable() = %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("collectable()[%d] = %s, want %s", i, names[i], want[i])
+		}
+	}
+}
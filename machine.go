@@ -0,0 +1,330 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// Where docker-cloud keeps what it knows about each named instance, one
+// directory per instance.
+var machinesDir = path.Join(os.Getenv("HOME"), ".docker-cloud/machines")
+
+// What docker-cloud remembers about an instance named on the command line,
+// so that each instance keeps its zone and tunnel port from one command to
+// the next.
+type machine struct {
+	Name       string
+	Provider   string
+	Zone       string
+	TunnelPort int
+	DiskName   string
+	// The public IP when last seen.
+	IP string
+	// The process of the tunnel kept open by start, resume, restart or
+	// tunnel, and what it forwards. 0 when there is none.
+	TunnelPID   int
+	TunnelPorts []dockercloud.PortMapping
+	// All the disks of the instance, on GCE.
+	Disks        []string
+	CreationTime time.Time
+	// The instance was deleted by stop, keeping its disks for the next
+	// start.
+	DiskKept bool
+}
+
+// The machine of the instance named on the command line, nil when the
+// instance comes from -instancename.
+var currentMachine *machine
+
+func machinePath(name string) string {
+	return path.Join(machinesDir, name, "machine.json")
+}
+
+// Read what was saved about an instance, nil when nothing was.
+func loadMachine(name string) (*machine, error) {
+	data, err := os.ReadFile(machinePath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &machine{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid machine %q: %v", machinePath(name), err)
+	}
+	return m, nil
+}
+
+func (m *machine) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(machinePath(m.Name)), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(machinePath(m.Name), append(data, '\n'), 0600)
+}
+
+// Return the first local port above base not used by the tunnel of another
+// instance.
+func freeTunnelPort(base int) (int, error) {
+	used := map[int]bool{}
+	for _, name := range knownInstances() {
+		m, err := loadMachine(name)
+		if err != nil {
+			return 0, err
+		}
+		if m != nil {
+			used[m.TunnelPort] = true
+		}
+	}
+	port := base + 1
+	for used[port] {
+		port++
+	}
+	return port, nil
+}
+
+// Work on the named instance: take its provider, zone, tunnel port and root
+// disk from what was saved about it, unless set on the command line. A new
+// instance gets its own tunnel port and root disk, saved by start.
+func useMachine(name string) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	m, err := loadMachine(name)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &machine{Name: name, Provider: *provider, Zone: *zone, TunnelPort: *tunnelPort, DiskName: name + "-root"}
+		if !set["tunnelport"] {
+			if m.TunnelPort, err = freeTunnelPort(*tunnelPort); err != nil {
+				return err
+			}
+		}
+	}
+	*instanceName = name
+	overrides := []struct {
+		flag  string
+		value *string
+		saved string
+	}{
+		{"provider", provider, m.Provider},
+		{"zone", zone, m.Zone},
+		{"diskname", diskName, m.DiskName},
+	}
+	for _, o := range overrides {
+		if !set[o.flag] && o.saved != "" {
+			*o.value = o.saved
+		}
+	}
+	if !set["tunnelport"] {
+		*tunnelPort = m.TunnelPort
+	}
+	currentMachine = m
+	return nil
+}
+
+// Save the named instance, with its resolved zone.
+func saveMachine() {
+	if currentMachine == nil {
+		return
+	}
+	currentMachine.Provider = *provider
+	currentMachine.Zone = *zone
+	currentMachine.TunnelPort = *tunnelPort
+	currentMachine.DiskName = *diskName
+	if err := currentMachine.save(); err != nil {
+		log.Printf("failed to save instance %q: %v", currentMachine.Name, err)
+	}
+}
+
+// Forget the named instance once deleted, unless its disks were kept.
+func stoppedMachine(diskKept bool) {
+	if diskKept {
+		var disks []string
+		if currentMachine != nil {
+			disks = currentMachine.Disks
+		}
+		keepDisks(*instanceName, *zone, *diskName, disks)
+		return
+	}
+	if currentMachine != nil {
+		forgetInstance(currentMachine.Name)
+	}
+}
+
+// Remember that an instance was deleted without its disks, closing its
+// tunnel, so that gc leaves the disks alone and start reuses the root disk.
+//   disks All the disks of the instance, when known
+func keepDisks(name, zone, rootDisk string, disks []string) {
+	m, err := loadMachine(name)
+	if err != nil {
+		log.Printf("failed to keep the disks of %q: %v", name, err)
+		return
+	}
+	if m == nil {
+		m = &machine{Name: name, Provider: *provider, Zone: zone, DiskName: rootDisk}
+		if m.TunnelPort, err = freeTunnelPort(*tunnelPort); err != nil {
+			log.Printf("failed to keep the disks of %q: %v", name, err)
+			return
+		}
+	}
+	if rootDisk != "" {
+		m.DiskName = rootDisk
+	}
+	m.closeTunnel()
+	m.IP = ""
+	m.CreationTime = time.Time{}
+	m.TunnelPID = 0
+	m.TunnelPorts = nil
+	if len(disks) > 0 {
+		m.Disks = disks
+	}
+	m.DiskKept = true
+	if err := m.save(); err != nil {
+		log.Printf("failed to keep the disks of %q: %v", name, err)
+	}
+}
+
+// Forget what was saved about an instance, if anything, closing its tunnel.
+func forgetInstance(name string) {
+	if m, err := loadMachine(name); err == nil && m != nil {
+		m.closeTunnel()
+	}
+	if err := os.RemoveAll(path.Dir(machinePath(name))); err != nil {
+		log.Printf("failed to forget instance %q: %v", name, err)
+	}
+}
+
+// Take over an instance created outside docker-cloud: find its zone unless
+// -zone is set, check that docker answers through a tunnel and save it, so
+// that the other commands work on it by name.
+func (cloud *DockerCloud) adopt(ctx context.Context, zoneSet bool) error {
+	gce, isGCE := cloud.Cloud.(*dockercloud.GCECloud)
+	ip, err := cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+	if errors.Is(err, dockercloud.ErrInstanceNotFound) && !zoneSet && isGCE {
+		// ListInstances only sees the managed instances.
+		found, ferr := gce.FindInstanceZone(ctx, *instanceName)
+		if ferr != nil {
+			return ferr
+		}
+		log.Printf("found %q in zone %q", *instanceName, found)
+		*zone = found
+		ip, err = cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+	}
+	if err != nil {
+		return err
+	}
+	if isGCE {
+		details, err := gce.DescribeInstanceDetails(ctx, *instanceName, *zone)
+		if err != nil {
+			return err
+		}
+		for _, disk := range details.Disks {
+			if disk.Boot {
+				*diskName = disk.Name
+			}
+		}
+	}
+	tunnel, err := cloud.ensureTunnel(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create SSH tunnel: %v", err)
+	}
+	if tunnel != nil {
+		defer tunnel.Kill()
+	}
+	if err := cloud.waitForDocker(ctx, 30*time.Second); err != nil {
+		return fmt.Errorf("docker unreachable through the tunnel, is it listening on port %d? %v", *dockerPort, err)
+	}
+	if isGCE {
+		// So that list, gc and stop -all see them.
+		if err := gce.TagManagedResource(ctx, "instance", *instanceName, *zone); err != nil {
+			return err
+		}
+		if err := gce.TagManagedResource(ctx, "disk", *diskName, *zone); err != nil {
+			return err
+		}
+	}
+	cloud.recordInstance(ctx, ip)
+	return nil
+}
+
+// Save what the cloud tells about the named instance: its IP, creation time
+// and, on GCE, disks.
+func (cloud *DockerCloud) recordInstance(ctx context.Context, ip string) {
+	if currentMachine == nil {
+		return
+	}
+	currentMachine.IP = ip
+	currentMachine.DiskKept = false
+	if currentMachine.CreationTime.IsZero() && cloud.Capabilities().ListInstances {
+		if instance, err := cloud.DescribeInstance(ctx, *instanceName, *zone); err == nil {
+			currentMachine.CreationTime = instance.CreationTime
+		}
+	}
+	if gce, ok := cloud.Cloud.(*dockercloud.GCECloud); ok {
+		if details, err := gce.DescribeInstanceDetails(ctx, *instanceName, *zone); err == nil {
+			currentMachine.Disks = nil
+			for _, disk := range details.Disks {
+				currentMachine.Disks = append(currentMachine.Disks, disk.Name)
+			}
+		}
+	}
+	saveMachine()
+}
+
+// Save the tunnel kept open to the named instance, so that stop closes it.
+func rememberTunnel(tunnel *os.Process) {
+	if currentMachine == nil || tunnel == nil {
+		return
+	}
+	currentMachine.TunnelPID = tunnel.Pid
+	currentMachine.TunnelPorts, _ = portMappings()
+	saveMachine()
+}
+
+// Kill the saved tunnel, unless its process is gone or was reused by
+// another program than ssh.
+func (m *machine) closeTunnel() {
+	if m.TunnelPID == 0 {
+		return
+	}
+	out, err := exec.Command("ps", "-p", strconv.Itoa(m.TunnelPID), "-o", "comm=").Output()
+	if err != nil || !strings.Contains(string(out), "ssh") {
+		return
+	}
+	log.Printf("closing the tunnel of %q", m.Name)
+	if p, err := os.FindProcess(m.TunnelPID); err == nil {
+		p.Kill()
+	}
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+const (
+	tunnelCheckInterval = 30 * time.Second
+	egressCheckInterval = 10 * time.Minute
+)
+
+// Supervise the tunnel to the instance: check that Docker answers through it,
+// recover when it doesn't, and watch the instance egress. Returns when ctx
+// is done.
+func (cloud *DockerCloud) TunnelMonitor(ctx context.Context, started time.Time) {
+	lastEgressCheck := started
+	ticker := time.NewTicker(tunnelCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := cloud.TestDockerConnectivity(ctx); err != nil {
+			log.Printf("docker unreachable through the tunnel: %v", err)
+			cloud.recoverTunnel(ctx)
+		}
+		if _, gce := cloud.Cloud.(*dockercloud.GCECloud); gce && *egressAlertGb > 0 && time.Since(lastEgressCheck) >= egressCheckInterval {
+			cloud.checkEgress(ctx, started)
+			lastEgressCheck = time.Now()
+		}
+	}
+}
+
+// Check that the Docker API answers through the tunnel.
+func (cloud *DockerCloud) TestDockerConnectivity(ctx context.Context) error {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				network, addr := dockerAddr()
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker/version", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker API returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Optionally restart the remote Docker daemon, then reopen the tunnel if it
+// is no longer listening.
+func (cloud *DockerCloud) recoverTunnel(ctx context.Context) {
+	if *restartDocker {
+		log.Printf("restarting docker on %q", *instanceName)
+		if _, err := cloud.RunCommand(ctx, *instanceName, *zone, "sudo service docker restart"); err != nil {
+			log.Printf("docker restart failed: %v", err)
+		} else if err := cloud.waitForDocker(ctx, *restartTimeout); err != nil {
+			log.Printf("docker did not come back after restart: %v", err)
+		} else {
+			log.Printf("docker restarted on %q", *instanceName)
+			return
+		}
+	}
+	network, addr := dockerAddr()
+	conn, err := net.Dial(network, addr)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	log.Printf("reopening tunnel to %q", *instanceName)
+	tunnel, err := cloud.openTunnel(ctx)
+	if err != nil {
+		log.Printf("failed to reopen tunnel: %v", err)
+		return
+	}
+	rememberTunnel(tunnel)
+}
+
+// Wait until Docker answers through the tunnel or the timeout expires.
+func (cloud *DockerCloud) waitForDocker(ctx context.Context, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cloud.TestDockerConnectivity(ctx)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Warn when the instance has sent more than -egress-alert-gb since the given time.
+func (cloud *DockerCloud) checkEgress(ctx context.Context, since time.Time) {
+	sent, err := cloud.gce().GetInternetEgress(ctx, *instanceName, *zone, since)
+	if err != nil {
+		log.Printf("failed to get instance egress: %v", err)
+		return
+	}
+	if gb := sent / 1e9; gb > *egressAlertGb {
+		log.Printf("warning: instance %q sent %.2f GB since %s, above the %.2f GB alert threshold",
+			*instanceName, gb, since.Format(time.RFC3339), *egressAlertGb)
+	}
+}
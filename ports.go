@@ -0,0 +1,140 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types"
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// A port forwarded through the tunnel.
+type ForwardedPort struct {
+	Local      string
+	RemotePort int
+	// The unix socket on the instance, instead of RemotePort.
+	RemoteSocket string
+	// Something accepts connections on Local.
+	Listening bool
+}
+
+// A port exposed by a container on the instance.
+type ContainerPort struct {
+	Container   string
+	PrivatePort int
+	// The port published on the instance, 0 when only exposed.
+	PublicPort int
+	Protocol   string
+	// The local address reaching PublicPort through the tunnel, empty when it
+	// is not forwarded.
+	Local string
+}
+
+// The path from localhost to the containers.
+type PortsReport struct {
+	Forwarded  []ForwardedPort
+	Containers []ContainerPort
+}
+
+// Address of a port mapping on the local machine.
+func localAddr(m dockercloud.PortMapping) (network, addr string) {
+	if m.LocalSocket != "" {
+		return "unix", m.LocalSocket
+	}
+	return "tcp", fmt.Sprintf("localhost:%d", m.LocalPort)
+}
+
+// List the ports forwarded through the tunnel and the ports of the running
+// containers, queried through the tunnel.
+func (cloud *DockerCloud) Ports(ctx context.Context) (*PortsReport, error) {
+	mappings, err := portMappings()
+	if err != nil {
+		return nil, err
+	}
+	report := &PortsReport{Forwarded: []ForwardedPort{}, Containers: []ContainerPort{}}
+	local := map[int]string{}
+	for _, m := range mappings {
+		network, addr := localAddr(m)
+		port := ForwardedPort{Local: addr, RemotePort: m.RemotePort, RemoteSocket: m.RemoteSocket}
+		if conn, err := net.Dial(network, addr); err == nil {
+			conn.Close()
+			port.Listening = true
+		}
+		report.Forwarded = append(report.Forwarded, port)
+		if m.RemoteSocket == "" {
+			local[m.RemotePort] = addr
+		}
+	}
+	cli, err := cloud.dockerClient()
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		for _, p := range c.Ports {
+			port := ContainerPort{
+				Container:   name,
+				PrivatePort: int(p.PrivatePort),
+				PublicPort:  int(p.PublicPort),
+				Protocol:    p.Type,
+			}
+			if p.PublicPort != 0 && p.Type == "tcp" {
+				port.Local = local[int(p.PublicPort)]
+			}
+			report.Containers = append(report.Containers, port)
+		}
+	}
+	return report, nil
+}
+
+// Print the report as two tables, the forwarded ports first.
+func (r *PortsReport) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "LOCAL\tREMOTE\tLISTENING")
+	for _, p := range r.Forwarded {
+		remote := fmt.Sprint(p.RemotePort)
+		if p.RemoteSocket != "" {
+			remote = p.RemoteSocket
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\n", p.Local, remote, p.Listening)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CONTAINER\tPORT\tPUBLISHED\tLOCAL")
+	for _, p := range r.Containers {
+		published, local := "-", "-"
+		if p.PublicPort != 0 {
+			published = fmt.Sprint(p.PublicPort)
+		}
+		if p.Local != "" {
+			local = p.Local
+		}
+		fmt.Fprintf(w, "%s\t%d/%s\t%s\t%s\n", p.Container, p.PrivatePort, p.Protocol, published, local)
+	}
+	w.Flush()
+}
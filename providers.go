@@ -0,0 +1,583 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// The flags shared by the providers.
+var (
+	strictHostKeyChecking = flag.String("ssh-strict-host-key-checking", "no",
+		"Check the instance SSH host key (yes|no), yes is recommended in production")
+	knownHostsFile = flag.String("ssh-known-hosts-file", path.Join(os.Getenv("HOME"), ".docker-cloud/known_hosts"),
+		"The known hosts file managed by docker-cloud for -ssh-strict-host-key-checking=yes")
+	extraSSHFlags = flag.String("extra-ssh-flags", "",
+		"Space separated flags appended to the tunnel ssh command, they may override the safety settings")
+	debugSSH      = flag.Bool("debug-ssh", false, "Print verbose ssh output to troubleshoot tunnel failures")
+	noManagedTags = flag.Bool("no-managed-tags", false, "Don't label the created GCE resources as managed by docker-cloud")
+	pluginArgs    = flag.String("plugin-args", "", "Space separated arguments passed to an external provider plugin")
+)
+
+// The flags of the AWS provider, turned into its dockercloud configuration.
+var (
+	awsRegion        = flag.String("aws-region", "", "The AWS region (default the -zone availability zone region)")
+	awsInstanceType  = flag.String("aws-instance-type", "t3.small", "The EC2 instance type")
+	awsAMI           = flag.String("aws-ami", "", "The AMI to boot (default the latest Ubuntu LTS from Canonical)")
+	awsKeyName       = flag.String("aws-key-name", "docker-cloud", "The EC2 key pair to log into the instances")
+	awsKeyPath       = flag.String("aws-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_aws"), "The private key of -aws-key-name, generated if missing")
+	awsSSHUser       = flag.String("aws-ssh-user", "ubuntu", "The user to log into the instances")
+	awsSecurityGroup = flag.String("aws-security-group", "docker-cloud", "The security group of the instances, created if missing")
+)
+
+// The flags of the Azure provider, turned into its dockercloud configuration.
+var (
+	azureSubscription  = flag.String("azure-subscription", "", "The Azure subscription id (default $AZURE_SUBSCRIPTION_ID)")
+	azureResourceGroup = flag.String("azure-resource-group", "docker-cloud", "The resource group holding the instances, created if missing")
+	azureVMSize        = flag.String("azure-vm-size", "Standard_B2s", "The Azure VM size")
+	azureImage         = flag.String("azure-image", "Canonical:0001-com-ubuntu-server-jammy:22_04-lts-gen2:latest", "The publisher:offer:sku:version image")
+	azureSSHUser       = flag.String("azure-ssh-user", "azureuser", "The admin user of the instances")
+	azureSSHKeyPath    = flag.String("azure-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_azure"), "The private key to log into the instances, generated if missing")
+)
+
+// The flags of the CloudStack provider, turned into its dockercloud configuration.
+var (
+	csURL             = flag.String("cloudstack-url", "", "The CloudStack API URL (default $CLOUDSTACK_API_URL)")
+	csAPIKey          = flag.String("cloudstack-api-key", "", "The CloudStack API key (default $CLOUDSTACK_API_KEY)")
+	csSecretKey       = flag.String("cloudstack-secret-key", "", "The CloudStack secret key (default $CLOUDSTACK_SECRET_KEY)")
+	csServiceOffering = flag.String("cloudstack-service-offering", "Medium Instance", "The service offering name")
+	csTemplate        = flag.String("cloudstack-template", "Ubuntu 22.04", "The template name, with cloud-init")
+	csNetwork         = flag.String("cloudstack-network", "", "The isolated network of the VMs, reached through a public IP port forwarding (default the zone network)")
+	csKeyPair         = flag.String("cloudstack-key-pair", "docker-cloud", "The SSH key pair to log into the VMs")
+	csSSHUser         = flag.String("cloudstack-ssh-user", "ubuntu", "The user to log into the VMs")
+	csSSHKeyPath      = flag.String("cloudstack-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_cloudstack"), "The private key of -cloudstack-key-pair, generated if missing")
+)
+
+// The flags of the DigitalOcean provider, turned into its dockercloud configuration.
+var (
+	doToken      = flag.String("do-token", "", "The DigitalOcean API token (default $DIGITALOCEAN_TOKEN)")
+	doSize       = flag.String("do-size", "s-2vcpu-2gb", "The droplet size")
+	doImage      = flag.String("do-image", "ubuntu-22-04-x64", "The droplet image")
+	doSSHKeyPath = flag.String("do-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_do"), "The private key to log into the droplets, generated if missing")
+)
+
+// The flags of the Exoscale provider, turned into its dockercloud configuration.
+var (
+	exoAPIKey       = flag.String("exoscale-api-key", "", "The Exoscale API key (default $EXOSCALE_API_KEY)")
+	exoAPISecret    = flag.String("exoscale-api-secret", "", "The Exoscale API secret (default $EXOSCALE_API_SECRET)")
+	exoInstanceType = flag.String("exoscale-instance-type", "standard.medium", "The Exoscale instance type, as family.size")
+	exoTemplate     = flag.String("exoscale-template", "Linux Ubuntu 22.04 LTS 64-bit", "The Exoscale template name")
+	exoDiskSize     = flag.Int("exoscale-disk-size", 50, "The disk size of the instances in GB")
+	exoSSHKeyPath   = flag.String("exoscale-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_exoscale"), "The private key to log into the instances, generated if missing")
+)
+
+// The flags of the generic host provider, turned into its dockercloud configuration.
+var (
+	genericHost       = flag.String("generic-host", "", "The hostname or IP of the existing host to run docker on")
+	genericUser       = flag.String("generic-user", os.Getenv("USER"), "The user to log into the host, a sudoer")
+	genericPort       = flag.Int("generic-port", 22, "The ssh port of the host")
+	genericSSHKeyPath = flag.String("generic-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/id_ed25519"), "The private key to log into the host")
+	genericPurge      = flag.Bool("generic-purge", false, "Also uninstall docker and remove its data when deleting the host instance")
+)
+
+// The flags of the Hetzner provider, turned into its dockercloud configuration.
+var (
+	hcloudToken      = flag.String("hcloud-token", "", "The Hetzner Cloud API token (default $HCLOUD_TOKEN)")
+	hcloudServerType = flag.String("hcloud-server-type", "cx22", "The Hetzner Cloud server type")
+	hcloudImage      = flag.String("hcloud-image", "ubuntu-22.04", "The Hetzner Cloud image")
+	hcloudSSHKeyPath = flag.String("hcloud-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_hcloud"), "The private key to log into the servers, generated if missing")
+)
+
+// The flags of the libvirt provider, turned into its dockercloud configuration.
+var (
+	libvirtURI        = flag.String("libvirt-uri", "qemu:///system", "The libvirt connection URI")
+	libvirtBaseImage  = flag.String("libvirt-base-image", "https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-amd64.img", "The base qcow2 image path or URL, with cloud-init")
+	libvirtNetwork    = flag.String("libvirt-network", "default", "The libvirt network of the domains")
+	libvirtCPUs       = flag.Int("libvirt-cpus", 2, "The number of vCPUs of the domain")
+	libvirtMemory     = flag.Int("libvirt-memory", 2048, "The memory of the domain in MB")
+	libvirtDiskSize   = flag.String("libvirt-disk-size", "20G", "The size of the domain disk")
+	libvirtStorageDir = flag.String("libvirt-storage-dir", path.Join(os.Getenv("HOME"), ".docker-cloud/libvirt"), "Where the base image and the domain disks are stored, readable by qemu")
+	libvirtSSHUser    = flag.String("libvirt-ssh-user", "ubuntu", "The default user of the base image")
+	libvirtSSHKeyPath = flag.String("libvirt-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_libvirt"), "The private key to log into the domains, generated if missing")
+)
+
+// The flags of the Linode provider, turned into its dockercloud configuration.
+var (
+	linodeToken      = flag.String("linode-token", "", "The Linode API token (default $LINODE_TOKEN)")
+	linodeType       = flag.String("linode-type", "g6-standard-1", "The Linode plan")
+	linodeImage      = flag.String("linode-image", "linode/ubuntu22.04", "The Linode image")
+	linodeSSHKeyPath = flag.String("linode-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_linode"), "The private key to log into the Linodes, generated if missing")
+)
+
+// The flags of the OpenStack provider, turned into its dockercloud configuration.
+var (
+	osFlavor          = flag.String("openstack-flavor", "m1.small", "The OpenStack flavor name or id")
+	osImage           = flag.String("openstack-image", "ubuntu-22.04", "The OpenStack image name or id")
+	osNetwork         = flag.String("openstack-network", "", "The network of the instances (default the only project network)")
+	osFloatingNetwork = flag.String("openstack-floating-network", "public", "The external network to allocate floating IPs from")
+	osKeyName         = flag.String("openstack-key-name", "docker-cloud", "The Nova key pair to log into the instances")
+	osSSHUser         = flag.String("openstack-ssh-user", "ubuntu", "The user to log into the instances")
+	osSSHKeyPath      = flag.String("openstack-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_openstack"), "The private key of -openstack-key-name, generated if missing")
+	osSecurityGroup   = flag.String("openstack-security-group", "docker-cloud", "The security group of the instances, created if missing")
+)
+
+// The flags of the Packet provider, turned into its dockercloud configuration.
+var (
+	packetToken      = flag.String("packet-token", "", "The Equinix Metal API token (default $METAL_AUTH_TOKEN)")
+	packetProject    = flag.String("packet-project", "", "The Equinix Metal project id (default $METAL_PROJECT_ID)")
+	packetPlan       = flag.String("packet-plan", "c3.small.x86", "The Equinix Metal plan")
+	packetOS         = flag.String("packet-os", "ubuntu_22_04", "The Equinix Metal operating system slug")
+	packetSSHKeyPath = flag.String("packet-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_packet"), "The private key to log into the devices, generated if missing")
+)
+
+// The flags of the Rackspace provider, turned into its dockercloud configuration.
+var (
+	rackspaceUsername   = flag.String("rackspace-username", "", "The Rackspace username (default $RACKSPACE_USERNAME)")
+	rackspaceAPIKey     = flag.String("rackspace-api-key", "", "The Rackspace API key (default $RACKSPACE_API_KEY)")
+	rackspaceRegion     = flag.String("rackspace-region", "DFW", "The Rackspace region, used when -zone is not set")
+	rackspaceFlavor     = flag.String("rackspace-flavor", "general1-2", "The Cloud Servers flavor")
+	rackspaceImage      = flag.String("rackspace-image", "Ubuntu 22.04 (Jammy Jellyfish) (PVHVM)", "The Cloud Servers image name or id")
+	rackspaceKeyName    = flag.String("rackspace-key-name", "docker-cloud", "The key pair to log into the servers")
+	rackspaceSSHKeyPath = flag.String("rackspace-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_rackspace"), "The private key of -rackspace-key-name, generated if missing")
+)
+
+// The flags of the Scaleway provider, turned into its dockercloud configuration.
+var (
+	scwSecretKey      = flag.String("scw-secret-key", "", "The Scaleway API secret key (default $SCW_SECRET_KEY)")
+	scwProject        = flag.String("scw-project", "", "The Scaleway project id (default $SCW_DEFAULT_PROJECT_ID)")
+	scwCommercialType = flag.String("scw-commercial-type", "DEV1-S", "The Scaleway commercial type, e.g. AMP2-C2 for ARM")
+	scwImage          = flag.String("scw-image", "ubuntu_jammy", "The marketplace image label, or an image id")
+	scwSSHKeyPath     = flag.String("scw-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_scw"), "The private key to log into the servers, generated if missing")
+)
+
+// The flags of the SoftLayer provider, turned into its dockercloud configuration.
+var (
+	slUsername   = flag.String("softlayer-username", "", "The IBM Cloud classic infrastructure username (default $SL_USERNAME)")
+	slAPIKey     = flag.String("softlayer-api-key", "", "The IBM Cloud classic infrastructure API key (default $SL_API_KEY)")
+	slDatacenter = flag.String("softlayer-datacenter", "dal13", "The SoftLayer datacenter, used when -zone is not set")
+	slFlavor     = flag.String("softlayer-flavor", "B1_2X4X25", "The virtual guest flavor key name")
+	slOS         = flag.String("softlayer-os", "UBUNTU_22_64", "The operating system reference code")
+	slDomain     = flag.String("softlayer-domain", "docker-cloud.local", "The domain of the virtual guests")
+	slSSHKeyPath = flag.String("softlayer-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_softlayer"), "The private key to log into the virtual guests, generated if missing")
+)
+
+// The flags of the Triton provider, turned into its dockercloud configuration.
+var (
+	tritonURL     = flag.String("triton-url", "", "The Triton CloudAPI URL (default $TRITON_URL, or https://<zone>.api.joyent.com)")
+	tritonAccount = flag.String("triton-account", "", "The Triton account (default $TRITON_ACCOUNT)")
+	tritonKeyPath = flag.String("triton-key-path", path.Join(os.Getenv("HOME"), ".ssh/id_rsa"), "The unencrypted RSA or ECDSA private key of the account, also used for ssh")
+	tritonPackage = flag.String("triton-package", "g4-general-4G", "The Triton package name or id")
+	tritonImage   = flag.String("triton-image", "ubuntu-certified-22.04", "The Triton image name or id")
+	tritonSSHUser = flag.String("triton-ssh-user", "ubuntu", "The user to log into the machines")
+)
+
+// The flags of the VirtualBox provider, turned into its dockercloud configuration.
+var (
+	vboxImageURL   = flag.String("virtualbox-image-url", "https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-amd64.ova", "The OVA appliance to boot, with cloud-init")
+	vboxCPUs       = flag.Int("virtualbox-cpus", 2, "The number of CPUs of the VM")
+	vboxMemory     = flag.Int("virtualbox-memory", 2048, "The memory of the VM in MB")
+	vboxSSHUser    = flag.String("virtualbox-ssh-user", "ubuntu", "The default user of the appliance")
+	vboxSSHKeyPath = flag.String("virtualbox-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_virtualbox"), "The private key to log into the VMs, generated if missing")
+	vboxStorageDir = flag.String("virtualbox-storage-dir", path.Join(os.Getenv("HOME"), ".docker-cloud/virtualbox"), "Where the appliance and the VM seeds are stored")
+)
+
+// The flags of the vSphere provider, turned into its dockercloud configuration.
+var (
+	vsphereServer       = flag.String("vsphere-server", "", "The vCenter or ESXi server (default $VSPHERE_SERVER)")
+	vsphereUser         = flag.String("vsphere-user", "", "The vSphere user (default $VSPHERE_USER)")
+	vspherePassword     = flag.String("vsphere-password", "", "The vSphere password (default $VSPHERE_PASSWORD)")
+	vsphereInsecure     = flag.Bool("vsphere-insecure", false, "Don't verify the server TLS certificate")
+	vsphereTemplate     = flag.String("vsphere-template", "", "The VM template to clone, with VMware tools and -vsphere-ssh-key-path authorized")
+	vsphereFolder       = flag.String("vsphere-folder", "", "The VM folder of the instances (default the template one)")
+	vsphereResourcePool = flag.String("vsphere-resource-pool", "", "The resource pool of the instances (default the template one)")
+	vsphereDatastore    = flag.String("vsphere-datastore", "", "The datastore of the instances (default the template one)")
+	vsphereSSHUser      = flag.String("vsphere-ssh-user", "ubuntu", "The user to log into the instances")
+	vsphereSSHKeyPath   = flag.String("vsphere-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/id_rsa"), "The private key authorized in the template")
+)
+
+// The flags of the Vultr provider, turned into its dockercloud configuration.
+var (
+	vultrAPIKey     = flag.String("vultr-api-key", "", "The Vultr API key (default $VULTR_API_KEY)")
+	vultrPlan       = flag.String("vultr-plan", "vc2-1c-2gb", "The Vultr plan")
+	vultrOS         = flag.Int("vultr-os", 1743, "The Vultr operating system id (default Ubuntu 22.04 x64)")
+	vultrSSHKeyPath = flag.String("vultr-ssh-key-path", path.Join(os.Getenv("HOME"), ".ssh/docker_cloud_vultr"), "The private key to log into the instances, generated if missing")
+)
+
+// Register the providers, the flags of each sharing its prefix.
+func registerProviders() {
+	// The GCE flags predate the providers and have no prefix.
+	dockercloud.RegisterProvider("gce", "", newGCECloud)
+	dockercloud.RegisterProvider("aws", "aws", newAWSCloud)
+	dockercloud.RegisterProvider("azure", "azure", newAzureCloud)
+	dockercloud.RegisterProvider("cloudstack", "cloudstack", newCloudStackCloud)
+	dockercloud.RegisterProvider("digitalocean", "do", newDOCloud)
+	dockercloud.RegisterProvider("exoscale", "exoscale", newExoscaleCloud)
+	dockercloud.RegisterProvider("generic", "generic", newGenericCloud)
+	dockercloud.RegisterProvider("hetzner", "hcloud", newHetznerCloud)
+	dockercloud.RegisterProvider("libvirt", "libvirt", newLibvirtCloud)
+	dockercloud.RegisterProvider("linode", "linode", newLinodeCloud)
+	dockercloud.RegisterProvider("openstack", "openstack", newOpenStackCloud)
+	dockercloud.RegisterProvider("packet", "packet", newPacketCloud)
+	dockercloud.RegisterProvider("rackspace", "rackspace", newRackspaceCloud)
+	dockercloud.RegisterProvider("scaleway", "scw", newScalewayCloud)
+	dockercloud.RegisterProvider("softlayer", "softlayer", newSoftLayerCloud)
+	dockercloud.RegisterProvider("triton", "triton", newTritonCloud)
+	dockercloud.RegisterProvider("virtualbox", "virtualbox", newVirtualBoxCloud)
+	dockercloud.RegisterProvider("vsphere", "vsphere", newVSphereCloud)
+	dockercloud.RegisterProvider("vultr", "vultr", newVultrCloud)
+}
+
+// Return the settings shared by the providers, from their flags.
+func providerOptions() dockercloud.Options {
+	return dockercloud.Options{
+		SSH: dockercloud.SSHConfig{
+			StrictHostKeyChecking: *strictHostKeyChecking,
+			KnownHostsFile:        *knownHostsFile,
+			ExtraFlags:            *extraSSHFlags,
+			Debug:                 *debugSSH,
+		},
+		NoManagedTags: *noManagedTags,
+	}
+}
+
+// Return the settings of the provider plugins, from their flags.
+func pluginConfig() dockercloud.PluginConfig {
+	return dockercloud.PluginConfig{Options: providerOptions(), Args: strings.Fields(*pluginArgs)}
+}
+
+// Create the AWS cloud from the flags.
+func newAWSCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewAWSCloud(dockercloud.AWSConfig{
+		Options:       providerOptions(),
+		Region:        *awsRegion,
+		InstanceType:  *awsInstanceType,
+		AMI:           *awsAMI,
+		KeyName:       *awsKeyName,
+		KeyPath:       *awsKeyPath,
+		SSHUser:       *awsSSHUser,
+		SecurityGroup: *awsSecurityGroup,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "us-east-1a"), nil
+}
+
+// Create the Azure cloud from the flags.
+func newAzureCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewAzureCloud(dockercloud.AzureConfig{
+		Options:       providerOptions(),
+		Subscription:  *azureSubscription,
+		ResourceGroup: *azureResourceGroup,
+		VMSize:        *azureVMSize,
+		Image:         *azureImage,
+		SSHUser:       *azureSSHUser,
+		SSHKeyPath:    *azureSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "eastus"), nil
+}
+
+// Create the CloudStack cloud from the flags.
+func newCloudStackCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	if zone == "" {
+		return nil, "", errors.New("-zone must be set to a CloudStack zone name")
+	}
+	cloud, err := dockercloud.NewCloudStackCloud(dockercloud.CloudStackConfig{
+		Options:         providerOptions(),
+		URL:             *csURL,
+		APIKey:          *csAPIKey,
+		SecretKey:       *csSecretKey,
+		ServiceOffering: *csServiceOffering,
+		Template:        *csTemplate,
+		Network:         *csNetwork,
+		KeyPair:         *csKeyPair,
+		SSHUser:         *csSSHUser,
+		SSHKeyPath:      *csSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, zone, nil
+}
+
+// Create the DigitalOcean cloud from the flags.
+func newDOCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewDOCloud(dockercloud.DOConfig{
+		Options:    providerOptions(),
+		Token:      *doToken,
+		Size:       *doSize,
+		Image:      *doImage,
+		SSHKeyPath: *doSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "nyc3"), nil
+}
+
+// Create the Exoscale cloud from the flags.
+func newExoscaleCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewExoscaleCloud(dockercloud.ExoscaleConfig{
+		Options:      providerOptions(),
+		APIKey:       *exoAPIKey,
+		APISecret:    *exoAPISecret,
+		InstanceType: *exoInstanceType,
+		Template:     *exoTemplate,
+		DiskSize:     *exoDiskSize,
+		SSHKeyPath:   *exoSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "ch-gva-2"), nil
+}
+
+// Create the generic host cloud from the flags.
+func newGenericCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewGenericCloud(dockercloud.GenericConfig{
+		Options:    providerOptions(),
+		Host:       *genericHost,
+		User:       *genericUser,
+		Port:       *genericPort,
+		SSHKeyPath: *genericSSHKeyPath,
+		Purge:      *genericPurge,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// The host is given by -generic-host.
+	return cloud, zone, nil
+}
+
+// Create the Hetzner cloud from the flags.
+func newHetznerCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewHetznerCloud(dockercloud.HetznerConfig{
+		Options:    providerOptions(),
+		Token:      *hcloudToken,
+		ServerType: *hcloudServerType,
+		Image:      *hcloudImage,
+		SSHKeyPath: *hcloudSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "fsn1"), nil
+}
+
+// Create the libvirt cloud from the flags.
+func newLibvirtCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewLibvirtCloud(dockercloud.LibvirtConfig{
+		Options:    providerOptions(),
+		URI:        *libvirtURI,
+		BaseImage:  *libvirtBaseImage,
+		Network:    *libvirtNetwork,
+		CPUs:       *libvirtCPUs,
+		Memory:     *libvirtMemory,
+		DiskSize:   *libvirtDiskSize,
+		StorageDir: *libvirtStorageDir,
+		SSHUser:    *libvirtSSHUser,
+		SSHKeyPath: *libvirtSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// Local VMs have no zone.
+	return cloud, zone, nil
+}
+
+// Create the Linode cloud from the flags.
+func newLinodeCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewLinodeCloud(dockercloud.LinodeConfig{
+		Options:    providerOptions(),
+		Token:      *linodeToken,
+		Type:       *linodeType,
+		Image:      *linodeImage,
+		SSHKeyPath: *linodeSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "us-east"), nil
+}
+
+// Create the OpenStack cloud from the flags.
+func newOpenStackCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewOpenStackCloud(dockercloud.OpenStackConfig{
+		Options:         providerOptions(),
+		Flavor:          *osFlavor,
+		Image:           *osImage,
+		Network:         *osNetwork,
+		FloatingNetwork: *osFloatingNetwork,
+		KeyName:         *osKeyName,
+		SSHUser:         *osSSHUser,
+		SSHKeyPath:      *osSSHKeyPath,
+		SecurityGroup:   *osSecurityGroup,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "nova"), nil
+}
+
+// Create the Packet cloud from the flags.
+func newPacketCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewPacketCloud(dockercloud.PacketConfig{
+		Options:    providerOptions(),
+		Token:      *packetToken,
+		Project:    *packetProject,
+		Plan:       *packetPlan,
+		OS:         *packetOS,
+		SSHKeyPath: *packetSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "da"), nil
+}
+
+// Create the Rackspace cloud from the flags.
+func newRackspaceCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewRackspaceCloud(dockercloud.RackspaceConfig{
+		Options:    providerOptions(),
+		Username:   *rackspaceUsername,
+		APIKey:     *rackspaceAPIKey,
+		Region:     *rackspaceRegion,
+		Flavor:     *rackspaceFlavor,
+		Image:      *rackspaceImage,
+		KeyName:    *rackspaceKeyName,
+		SSHKeyPath: *rackspaceSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// An empty zone is the -rackspace-region.
+	return cloud, zone, nil
+}
+
+// Create the Scaleway cloud from the flags.
+func newScalewayCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewScalewayCloud(dockercloud.ScalewayConfig{
+		Options:        providerOptions(),
+		SecretKey:      *scwSecretKey,
+		Project:        *scwProject,
+		CommercialType: *scwCommercialType,
+		Image:          *scwImage,
+		SSHKeyPath:     *scwSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "fr-par-1"), nil
+}
+
+// Create the SoftLayer cloud from the flags.
+func newSoftLayerCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewSoftLayerCloud(dockercloud.SoftLayerConfig{
+		Options:    providerOptions(),
+		Username:   *slUsername,
+		APIKey:     *slAPIKey,
+		Datacenter: *slDatacenter,
+		Flavor:     *slFlavor,
+		OS:         *slOS,
+		Domain:     *slDomain,
+		SSHKeyPath: *slSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// An empty zone is the -softlayer-datacenter.
+	return cloud, zone, nil
+}
+
+// Create the Triton cloud from the flags.
+func newTritonCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewTritonCloud(dockercloud.TritonConfig{
+		Options: providerOptions(),
+		URL:     *tritonURL,
+		Account: *tritonAccount,
+		KeyPath: *tritonKeyPath,
+		Package: *tritonPackage,
+		Image:   *tritonImage,
+		SSHUser: *tritonSSHUser,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "us-east-1"), nil
+}
+
+// Create the VirtualBox cloud from the flags.
+func newVirtualBoxCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewVirtualBoxCloud(dockercloud.VirtualBoxConfig{
+		Options:    providerOptions(),
+		ImageURL:   *vboxImageURL,
+		CPUs:       *vboxCPUs,
+		Memory:     *vboxMemory,
+		SSHUser:    *vboxSSHUser,
+		SSHKeyPath: *vboxSSHKeyPath,
+		StorageDir: *vboxStorageDir,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// Local VMs have no zone.
+	return cloud, zone, nil
+}
+
+// Create the vSphere cloud from the flags.
+func newVSphereCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewVSphereCloud(dockercloud.VSphereConfig{
+		Options:      providerOptions(),
+		Server:       *vsphereServer,
+		User:         *vsphereUser,
+		Password:     *vspherePassword,
+		Insecure:     *vsphereInsecure,
+		Template:     *vsphereTemplate,
+		Folder:       *vsphereFolder,
+		ResourcePool: *vsphereResourcePool,
+		Datastore:    *vsphereDatastore,
+		SSHUser:      *vsphereSSHUser,
+		SSHKeyPath:   *vsphereSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "Datacenter"), nil
+}
+
+// Create the Vultr cloud from the flags.
+func newVultrCloud(ctx context.Context, zone string) (dockercloud.Cloud, string, error) {
+	cloud, err := dockercloud.NewVultrCloud(dockercloud.VultrConfig{
+		Options:    providerOptions(),
+		APIKey:     *vultrAPIKey,
+		Plan:       *vultrPlan,
+		OS:         *vultrOS,
+		SSHKeyPath: *vultrSSHKeyPath,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return cloud, dockercloud.ResolveZone(zone, "", "ewr"), nil
+}
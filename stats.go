@@ -0,0 +1,168 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Print the CPUs, the load, the memory and the disk of docker, one value
+// per line.
+const instanceStatsCommand = `nproc && cut -d' ' -f1 /proc/loadavg &&
+awk '/^(MemTotal|MemAvailable):/ { print $2 * 1024 }' /proc/meminfo &&
+df -P -B1 /var/lib/docker | awk 'NR == 2 { print $2; print $3 }'`
+
+// Resource usage of the instance.
+type InstanceStats struct {
+	CPUs                 int
+	Load1                float64
+	MemoryTotalBytes     int64
+	MemoryAvailableBytes int64
+	DiskTotalBytes       int64
+	DiskUsedBytes        int64
+}
+
+// Resource usage of a running container.
+type ContainerStats struct {
+	Container        string
+	CPUPercent       float64
+	MemoryBytes      int64
+	MemoryLimitBytes int64
+}
+
+// Resource usage of the instance and its containers.
+type StatsReport struct {
+	Instance   InstanceStats
+	Containers []ContainerStats
+}
+
+// Return the resource usage of the instance, read over SSH.
+func (cloud *DockerCloud) InstanceStats(ctx context.Context) (InstanceStats, error) {
+	out, err := cloud.RunCommand(ctx, *instanceName, *zone, instanceStatsCommand)
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 6 {
+		return InstanceStats{}, fmt.Errorf("unexpected stats output %q", out)
+	}
+	stats := InstanceStats{}
+	stats.CPUs, _ = strconv.Atoi(fields[0])
+	stats.Load1, _ = strconv.ParseFloat(fields[1], 64)
+	for i, value := range []*int64{&stats.MemoryTotalBytes, &stats.MemoryAvailableBytes, &stats.DiskTotalBytes, &stats.DiskUsedBytes} {
+		*value, _ = strconv.ParseInt(fields[i+2], 10, 64)
+	}
+	return stats, nil
+}
+
+// Return the resource usage of the running containers, read through the
+// tunnel.
+func (cloud *DockerCloud) ContainerStats(ctx context.Context) ([]ContainerStats, error) {
+	cli, err := cloud.dockerClient()
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	result := []ContainerStats{}
+	for _, c := range containers {
+		resp, err := cli.ContainerStats(ctx, c.ID, false)
+		if err != nil {
+			return nil, err
+		}
+		var s types.StatsJSON
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the stats of %s: %v", c.ID, err)
+		}
+		name := c.ID
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		result = append(result, ContainerStats{
+			Container:        name,
+			CPUPercent:       cpuPercent(s),
+			MemoryBytes:      int64(s.MemoryStats.Usage - pageCache(s.MemoryStats)),
+			MemoryLimitBytes: int64(s.MemoryStats.Limit),
+		})
+	}
+	return result, nil
+}
+
+// Return the CPU usage between the two samples of the stats, in percent of
+// one CPU as docker stats does.
+func cpuPercent(s types.StatsJSON) float64 {
+	cpu := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	system := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if cpu <= 0 || system <= 0 {
+		return 0
+	}
+	return cpu / system * float64(s.CPUStats.OnlineCPUs) * 100
+}
+
+// Return the page cache counted in the memory usage, which docker stats
+// leaves out. cgroup v1 calls it cache, v2 inactive_file.
+func pageCache(m types.MemoryStats) uint64 {
+	cache, ok := m.Stats["cache"]
+	if !ok {
+		cache = m.Stats["inactive_file"]
+	}
+	if cache > m.Usage {
+		return 0
+	}
+	return cache
+}
+
+// Tell why the instance looks too small, empty when it doesn't.
+func (s InstanceStats) pressure() string {
+	reasons := []string{}
+	if s.CPUs > 0 && s.Load1 > float64(s.CPUs) {
+		reasons = append(reasons, fmt.Sprintf("load %.2f above %d CPUs", s.Load1, s.CPUs))
+	}
+	if s.MemoryTotalBytes > 0 && s.MemoryAvailableBytes*10 < s.MemoryTotalBytes {
+		reasons = append(reasons, "less than 10% memory available")
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// Print the instance usage, then a table of the containers.
+func (r *StatsReport) print(out io.Writer) {
+	i := r.Instance
+	fmt.Fprintf(out, "CPU     %d CPUs, load %.2f\n", i.CPUs, i.Load1)
+	fmt.Fprintf(out, "Memory  %.2f GB used of %.2f GB\n", float64(i.MemoryTotalBytes-i.MemoryAvailableBytes)/1e9, float64(i.MemoryTotalBytes)/1e9)
+	fmt.Fprintf(out, "Disk    %.2f GB used of %.2f GB\n", float64(i.DiskUsedBytes)/1e9, float64(i.DiskTotalBytes)/1e9)
+	if pressure := i.pressure(); pressure != "" {
+		fmt.Fprintf(out, "Consider docker-cloud resize: %s\n", pressure)
+	}
+	fmt.Fprintln(out)
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tCPU %\tMEM USAGE\tMEM LIMIT")
+	for _, c := range r.Containers {
+		fmt.Fprintf(w, "%s\t%.2f%%\t%.1f MB\t%.1f MB\n", c.Container, c.CPUPercent, float64(c.MemoryBytes)/1e6, float64(c.MemoryLimitBytes)/1e6)
+	}
+	w.Flush()
+}
@@ -0,0 +1,147 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/proppy/docker-cloud/dockercloud"
+)
+
+// What status reports about the instance and the tunnel to it.
+type Status struct {
+	Instance string
+	Zone     string
+	Exists   bool
+	// The power state, empty when the provider can't describe instances.
+	State dockercloud.InstanceStatus
+	IP    string
+	// The local end of the tunnel accepts connections.
+	TunnelUp bool
+	// How docker answered: "tunnel", "direct" or "" when it didn't.
+	DockerReachable string
+	Ports           []dockercloud.PortMapping
+}
+
+// Look up the instance, then check the tunnel and docker.
+func (cloud *DockerCloud) Status(ctx context.Context) (*Status, error) {
+	mappings, err := portMappings()
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{Instance: *instanceName, Zone: *zone, Ports: mappings}
+	status.IP, err = cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+	if errors.Is(err, dockercloud.ErrInstanceNotFound) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Exists = true
+	if cloud.Capabilities().ListInstances {
+		instance, err := cloud.DescribeInstance(ctx, *instanceName, *zone)
+		if err != nil {
+			return nil, err
+		}
+		status.State = instance.Status
+	}
+	network, addr := dockerAddr()
+	if conn, err := net.DialTimeout(network, addr, 3*time.Second); err == nil {
+		conn.Close()
+		status.TunnelUp = true
+	}
+	if status.TunnelUp && cloud.TestDockerConnectivity(ctx) == nil {
+		status.DockerReachable = "tunnel"
+	} else if status.IP != "" {
+		// Only answers when a firewall rule lets the docker port in.
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(status.IP, fmt.Sprint(*dockerPort)), 3*time.Second)
+		if err == nil {
+			conn.Close()
+			status.DockerReachable = "direct"
+		}
+	}
+	return status, nil
+}
+
+// What inspect prints about the instance, as JSON.
+type Inspection struct {
+	Provider string
+	Instance dockercloud.Instance
+	// On GCE only.
+	Details *dockercloud.GCEInstanceDetails `json:",omitempty"`
+	Ports   []dockercloud.PortMapping
+	// What is saved about a named instance.
+	Machine *machine `json:",omitempty"`
+}
+
+// Describe the instance in full, with the GCE details on GCE.
+func (cloud *DockerCloud) Inspect(ctx context.Context) (*Inspection, error) {
+	mappings, err := portMappings()
+	if err != nil {
+		return nil, err
+	}
+	inspection := &Inspection{Provider: *provider, Ports: mappings, Machine: currentMachine}
+	if cloud.Capabilities().ListInstances {
+		instance, err := cloud.DescribeInstance(ctx, *instanceName, *zone)
+		if err != nil {
+			return nil, err
+		}
+		inspection.Instance = *instance
+	} else {
+		ip, err := cloud.GetPublicIPAddress(ctx, *instanceName, *zone)
+		if err != nil {
+			return nil, err
+		}
+		inspection.Instance = dockercloud.Instance{Name: *instanceName, Zone: *zone, PublicIP: ip}
+	}
+	if gce, ok := cloud.Cloud.(*dockercloud.GCECloud); ok {
+		if inspection.Details, err = gce.DescribeInstanceDetails(ctx, *instanceName, *zone); err != nil {
+			return nil, err
+		}
+	}
+	return inspection, nil
+}
+
+// Print the status one "key: value" per line.
+func (status *Status) Print(w io.Writer) {
+	fmt.Fprintf(w, "instance: %s\nzone: %s\n", status.Instance, status.Zone)
+	if !status.Exists {
+		fmt.Fprintln(w, "exists: no")
+		return
+	}
+	fmt.Fprintln(w, "exists: yes")
+	if status.State != "" {
+		fmt.Fprintf(w, "state: %s\n", status.State)
+	}
+	fmt.Fprintf(w, "ip: %s\n", status.IP)
+	if status.TunnelUp {
+		fmt.Fprintln(w, "tunnel: up")
+	} else {
+		fmt.Fprintln(w, "tunnel: down")
+	}
+	if status.DockerReachable != "" {
+		fmt.Fprintf(w, "docker: reachable through the %s connection\n", status.DockerReachable)
+	} else {
+		fmt.Fprintln(w, "docker: unreachable")
+	}
+	for _, m := range status.Ports {
+		fmt.Fprintf(w, "port: %s\n", m)
+	}
+}